@@ -1,27 +1,71 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"example.com/starterkit/server"
 )
 
 func main() {
+	server.InitLogging()
+	if err := server.InitTracing(); err != nil {
+		slog.Error("Failed to initialize tracing", "error", err)
+		os.Exit(1)
+	}
+
+	// Background work and the listener stop on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Initialize database
-	if err := server.InitDB(); err != nil {
-		log.Fatal("Failed to initialize database:", err)
+	if err := server.InitDB(ctx); err != nil {
+		slog.Error("Failed to initialize database", "error", err)
+		os.Exit(1)
 	}
-	log.Println("Database initialized successfully")
+	slog.Info("Database initialized successfully")
 
 	addr := ":8080"
 	if a := os.Getenv("PORT"); a != "" {
 		addr = ":" + a
 	}
-	mux := server.NewRouter()
-	log.Printf("listening on %s", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		log.Fatal(err)
+	// Metrics and other operational endpoints live on a separate listener,
+	// bound to loopback unless ADMIN_ADDR says otherwise
+	adminAddr := "127.0.0.1:9090"
+	if a := os.Getenv("ADMIN_ADDR"); a != "" {
+		adminAddr = a
+	}
+	go func() {
+		slog.Info("Admin listening", "addr", adminAddr)
+		if err := http.ListenAndServe(adminAddr, server.NewAdminRouter()); err != nil {
+			slog.Error("Admin listener stopped", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	srv := &http.Server{Addr: addr, Handler: server.NewRouter()}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		slog.Info("Shutting down")
+		// Requests in flight get a while to finish
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Error shutting down", "error", err)
+		}
+	}()
+
+	slog.Info("Listening", "addr", addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		slog.Error("Listener stopped", "error", err)
+		os.Exit(1)
 	}
+	<-done
 }
@@ -0,0 +1,37 @@
+// Command mock-oidc runs a throwaway OpenID Connect provider for trying
+// social login locally. Point the app at it with
+//
+//	OIDC_PROVIDERS=mock
+//	OIDC_MOCK_ISSUER=http://127.0.0.1:9400
+//	OIDC_MOCK_CLIENT_ID=starterkit
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+
+	"example.com/starterkit/server"
+)
+
+func main() {
+	addr := "127.0.0.1:9400"
+	if a := os.Getenv("MOCK_OIDC_ADDR"); a != "" {
+		addr = a
+	}
+	issuer := "http://" + addr
+	if i := os.Getenv("MOCK_OIDC_ISSUER"); i != "" {
+		issuer = i
+	}
+
+	provider, err := server.NewMockOIDCProvider(issuer)
+	if err != nil {
+		slog.Error("Failed to create mock provider", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Mock OIDC provider listening", "addr", addr, "issuer", provider.Issuer)
+	if err := http.ListenAndServe(addr, provider); err != nil {
+		slog.Error("Listener stopped", "error", err)
+		os.Exit(1)
+	}
+}
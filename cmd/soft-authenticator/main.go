@@ -0,0 +1,91 @@
+// Command soft-authenticator stands in for a browser and passkey when trying
+// passkey login from the command line. It reads the response of a begin
+// endpoint on stdin and writes the body for the matching finish endpoint:
+//
+//	curl -X POST -H "Authorization: Bearer $TOKEN" localhost:8080/passkeys/register/begin |
+//		soft-authenticator create |
+//		curl -H "Authorization: Bearer $TOKEN" -d @- localhost:8080/passkeys/register/finish
+//	curl -X POST localhost:8080/login/passkey/begin |
+//		soft-authenticator get |
+//		curl -d @- localhost:8080/login/passkey/finish
+//
+// Passkeys, private keys included, are kept in the -state file.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"example.com/starterkit/server"
+)
+
+func main() {
+	state := flag.String("state", "passkeys.json", "file the passkeys are kept in")
+	origin := flag.String("origin", "", "origin of the page using the passkey (default PUBLIC_URL)")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: soft-authenticator [flags] create|get < options.json")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *origin == "" {
+		*origin = os.Getenv("PUBLIC_URL")
+	}
+	if *origin == "" {
+		*origin = "http://localhost:8080"
+	}
+
+	if err := run(flag.Arg(0), *state, *origin); err != nil {
+		fmt.Fprintln(os.Stderr, "soft-authenticator:", err)
+		os.Exit(1)
+	}
+}
+
+func run(command, state, origin string) error {
+	var authenticator server.SoftwareAuthenticator
+	data, err := os.ReadFile(state)
+	if err == nil {
+		err = json.Unmarshal(data, &authenticator)
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	options, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	var resp []byte
+	switch command {
+	case "create":
+		resp, err = authenticator.Create(options, origin)
+	case "get":
+		resp, err = authenticator.Get(options, origin)
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The counter moves on every use, so the state is saved either way
+	data, err = json.MarshalIndent(&authenticator, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(state, data, 0o600); err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(resp, '\n'))
+	return err
+}
@@ -0,0 +1,474 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"log/slog"
+	"math"
+	"math/bits"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Raw business and event views are rolled up in the background into hourly
+// and daily buckets (UTC) that the stats endpoints read instead of counting
+// raw rows. Each bucket keeps a HyperLogLog sketch of its visitor hashes, so
+// unique visitor estimates can be merged across buckets and ranges. Views
+// from known bots are counted separately and excluded, and opted-out views
+// (no visitor hash) count towards views but not visitors.
+
+const (
+	rollupInterval  = 5 * time.Minute
+	rollupBatchSize = 5000
+
+	// Views are only rolled up once this old. IDs are handed out before a
+	// view commits, so a view can land after a higher ID has been rolled up
+	// and would be skipped by the watermark for good.
+	rollupGraceSeconds = 60
+
+	// HyperLogLog precision: 2^10 one-byte registers per sketch, about 3%
+	// standard error
+	sketchPrecision = 10
+	sketchSize      = 1 << sketchPrecision
+
+	defaultStatsRange = 30 * 24 * time.Hour
+	maxHourlyRange    = 31 * 24 * time.Hour
+	maxDailyRange     = 366 * 24 * time.Hour
+)
+
+// User agent fragments of crawlers, previews and scripts
+var botSignatures = []string{
+	"bot", "crawler", "spider", "slurp", "crawl", "archiver", "facebookexternalhit",
+	"embedly", "preview", "monitor", "pingdom", "headless", "phantomjs", "lighthouse",
+	"curl/", "wget/", "python-requests", "python-urllib", "go-http-client", "java/",
+	"okhttp", "axios/", "node-fetch", "httpclient", "libwww-perl",
+}
+
+// isBot reports whether a user agent looks automated. Requests without a
+// user agent are treated as bots.
+func isBot(userAgent string) bool {
+	ua := strings.ToLower(strings.TrimSpace(userAgent))
+	if ua == "" {
+		return true
+	}
+	for _, sig := range botSignatures {
+		if strings.Contains(ua, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+// sketch is a HyperLogLog cardinality estimator
+type sketch []byte
+
+func newSketch() sketch {
+	return make(sketch, sketchSize)
+}
+
+// loadSketch reads a stored sketch, treating missing or malformed data as
+// empty
+func loadSketch(b []byte) sketch {
+	s := newSketch()
+	if len(b) == sketchSize {
+		copy(s, b)
+	}
+	return s
+}
+
+// add records a visitor
+func (s sketch) add(visitor string) {
+	sum := sha256.Sum256([]byte(visitor))
+	h := binary.BigEndian.Uint64(sum[:8])
+	idx := h >> (64 - sketchPrecision)
+	rank := byte(bits.LeadingZeros64(h<<sketchPrecision|1<<(sketchPrecision-1)) + 1)
+	if rank > s[idx] {
+		s[idx] = rank
+	}
+}
+
+// merge folds another sketch into s
+func (s sketch) merge(other sketch) {
+	for i, v := range other {
+		if v > s[i] {
+			s[i] = v
+		}
+	}
+}
+
+// estimate returns the approximate number of distinct visitors
+func (s sketch) estimate() int {
+	m := float64(sketchSize)
+	var sum float64
+	zeros := 0
+	for _, v := range s {
+		sum += math.Pow(2, -float64(v))
+		if v == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// Linear counting is more accurate for small cardinalities
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(e))
+}
+
+// viewSource is a raw view table and the bucket table it rolls up into.
+// Table doubles as the name of its row in analytics_state.
+type viewSource struct {
+	Table       string
+	BucketTable string
+	Column      string
+}
+
+var (
+	businessViews = viewSource{Table: "business_views", BucketTable: "business_view_buckets", Column: "business_id"}
+	eventViews    = viewSource{Table: "event_views", BucketTable: "event_view_buckets", Column: "event_id"}
+
+	viewSources = []viewSource{businessViews, eventViews}
+)
+
+// migrateAnalytics creates the rollup state rows
+func migrateAnalytics(ctx context.Context) error {
+	for _, src := range viewSources {
+		if _, err := db.ExecContext(ctx, "INSERT IGNORE INTO analytics_state (name, value) VALUES (?, 0)", src.Table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startAnalyticsRollup rolls up new views now and then periodically
+func startAnalyticsRollup(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(rollupInterval)
+		defer ticker.Stop()
+		for {
+			for _, src := range viewSources {
+				if err := rollupViews(ctx, src); err != nil {
+					slog.Error("Error rolling up views", "table", src.Table, "error", err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+type bucketKey struct {
+	EntityID    int
+	Granularity string
+	Start       time.Time
+}
+
+type bucket struct {
+	Views    int
+	BotViews int
+	Visitors sketch
+}
+
+// rollupViews folds views past the watermark into their buckets in batches.
+// The watermark row is locked so concurrent instances take turns.
+func rollupViews(ctx context.Context, src viewSource) error {
+	for {
+		n, err := rollupBatch(ctx, src)
+		if err != nil {
+			return err
+		}
+		if n < rollupBatchSize {
+			return nil
+		}
+	}
+}
+
+// rollupBatch processes one batch and returns how many views it read
+func rollupBatch(ctx context.Context, src viewSource) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var watermark int64
+	if err := tx.QueryRowContext(ctx, "SELECT value FROM analytics_state WHERE name = ? FOR UPDATE", src.Table).Scan(&watermark); err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, `+src.Column+`, IFNULL(visitor_hash, ''), is_bot, viewed_at,
+		       viewed_at < NOW() - INTERVAL ? SECOND
+		FROM `+src.Table+`
+		WHERE id > ?
+		ORDER BY id
+		LIMIT ?
+	`, rollupGraceSeconds, watermark, rollupBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	buckets := make(map[bucketKey]*bucket)
+	read := 0
+	for rows.Next() {
+		var id int64
+		var entityID int
+		var visitor string
+		var bot bool
+		var viewedAt time.Time
+		var settled bool
+		if err := rows.Scan(&id, &entityID, &visitor, &bot, &viewedAt, &settled); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		// Stop at the first recent view so the watermark can't pass it
+		if !settled {
+			break
+		}
+		read++
+		watermark = id
+
+		viewedAt = viewedAt.UTC()
+		for _, k := range []bucketKey{
+			{entityID, "hour", viewedAt.Truncate(time.Hour)},
+			{entityID, "day", time.Date(viewedAt.Year(), viewedAt.Month(), viewedAt.Day(), 0, 0, 0, 0, time.UTC)},
+		} {
+			b, ok := buckets[k]
+			if !ok {
+				b = &bucket{Visitors: newSketch()}
+				buckets[k] = b
+			}
+			if bot {
+				b.BotViews++
+				continue
+			}
+			b.Views++
+			if visitor != "" {
+				b.Visitors.add(visitor)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if read == 0 {
+		return 0, nil
+	}
+
+	for k, b := range buckets {
+		var views, botViews int
+		var stored []byte
+		err := tx.QueryRowContext(ctx, `
+			SELECT views, bot_views, visitor_sketch FROM `+src.BucketTable+`
+			WHERE `+src.Column+` = ? AND granularity = ? AND bucket_start = ?
+			FOR UPDATE
+		`, k.EntityID, k.Granularity, k.Start).Scan(&views, &botViews, &stored)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+		visitors := loadSketch(stored)
+		visitors.merge(b.Visitors)
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO `+src.BucketTable+` (`+src.Column+`, granularity, bucket_start, views, bot_views, unique_visitors, visitor_sketch)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE views = VALUES(views), bot_views = VALUES(bot_views),
+				unique_visitors = VALUES(unique_visitors), visitor_sketch = VALUES(visitor_sketch)
+		`, k.EntityID, k.Granularity, k.Start, views+b.Views, botViews+b.BotViews, visitors.estimate(), []byte(visitors))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE analytics_state SET value = ? WHERE name = ?", watermark, src.Table); err != nil {
+		return 0, err
+	}
+	return read, tx.Commit()
+}
+
+// StatsPoint is one bucket of a business's view series
+type StatsPoint struct {
+	Start          time.Time `json:"start"`
+	Views          int       `json:"views"`
+	UniqueVisitors int       `json:"unique_visitors"`
+}
+
+// BusinessStatsSeries is a business's views over the requested range
+type BusinessStatsSeries struct {
+	BusinessID     int          `json:"business_id"`
+	Name           string       `json:"name"`
+	Views          int          `json:"views"`
+	UniqueVisitors int          `json:"unique_visitors"`
+	Points         []StatsPoint `json:"points"`
+}
+
+// parseStatsTime accepts a date (YYYY-MM-DD) or an RFC 3339 time
+func parseStatsTime(v string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t.UTC(), err
+}
+
+// statsRange reads ?from=, ?to= and ?interval= (hour or day). Ranges are
+// half-open, aligned to the interval, and default to the last 30 days.
+func statsRange(r *http.Request) (from, to time.Time, interval string, err error) {
+	interval = r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	if interval != "hour" && interval != "day" {
+		return from, to, interval, errString("interval must be hour or day")
+	}
+	step := statsStep(interval)
+
+	to = time.Now().UTC().Truncate(step).Add(step)
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = parseStatsTime(v); err != nil {
+			return from, to, interval, errString("invalid to, use YYYY-MM-DD or RFC 3339")
+		}
+		// A bare date includes the whole day
+		if len(v) == len("2006-01-02") {
+			to = to.Add(24 * time.Hour)
+		}
+	}
+	from = to.Add(-defaultStatsRange)
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = parseStatsTime(v); err != nil {
+			return from, to, interval, errString("invalid from, use YYYY-MM-DD or RFC 3339")
+		}
+	}
+	from = from.Truncate(step)
+	to = to.Add(step - 1).Truncate(step)
+
+	if !from.Before(to) {
+		return from, to, interval, errString("from must be before to")
+	}
+	limit := maxDailyRange
+	if interval == "hour" {
+		limit = maxHourlyRange
+	}
+	if to.Sub(from) > limit {
+		return from, to, interval, errString("range is too long for interval " + interval)
+	}
+	return from, to, interval, nil
+}
+
+func statsStep(interval string) time.Duration {
+	if interval == "hour" {
+		return time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// viewSeries holds one entity's view buckets over a range
+type viewSeries struct {
+	Points         []StatsPoint
+	Views          int
+	UniqueVisitors int
+}
+
+// loadViewSeries reads zero-filled view series for the given entities. Range
+// totals merge the bucket sketches, so visitors seen in several buckets are
+// counted once.
+func loadViewSeries(ctx context.Context, src viewSource, ids []int, from, to time.Time, interval string) (map[int]*viewSeries, error) {
+	step := statsStep(interval)
+	n := int(to.Sub(from) / step)
+	series := make(map[int]*viewSeries, len(ids))
+	for _, id := range ids {
+		s := &viewSeries{Points: make([]StatsPoint, n)}
+		for j := range s.Points {
+			s.Points[j].Start = from.Add(time.Duration(j) * step)
+		}
+		series[id] = s
+	}
+	if len(ids) == 0 {
+		return series, nil
+	}
+
+	placeholders, idArgs := idPlaceholders(ids)
+	args := append([]interface{}{interval, from, to}, idArgs...)
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+src.Column+`, bucket_start, views, unique_visitors, visitor_sketch
+		FROM `+src.BucketTable+`
+		WHERE granularity = ? AND bucket_start >= ? AND bucket_start < ?
+			AND `+src.Column+` IN (`+placeholders+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	visitors := make(map[int]sketch)
+	for rows.Next() {
+		var id, views, unique int
+		var start time.Time
+		var stored []byte
+		if err := rows.Scan(&id, &start, &views, &unique, &stored); err != nil {
+			return nil, err
+		}
+		s, ok := series[id]
+		j := int(start.UTC().Sub(from) / step)
+		if !ok || j < 0 || j >= n {
+			continue
+		}
+		s.Points[j].Views = views
+		s.Points[j].UniqueVisitors = unique
+		s.Views += views
+
+		if visitors[id] == nil {
+			visitors[id] = newSketch()
+		}
+		visitors[id].merge(loadSketch(stored))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for id, v := range visitors {
+		series[id].UniqueVisitors = v.estimate()
+	}
+	return series, nil
+}
+
+// businessStatsSeries builds view series for the businesses in the
+// organisation scope
+func businessStatsSeries(ctx context.Context, scope string, scopeArgs []interface{}, from, to time.Time, interval string) ([]BusinessStatsSeries, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, name FROM businesses WHERE "+scope+" ORDER BY name", scopeArgs...)
+	if err != nil {
+		return nil, err
+	}
+	series := []BusinessStatsSeries{}
+	var ids []int
+	for rows.Next() {
+		var s BusinessStatsSeries
+		if err := rows.Scan(&s.BusinessID, &s.Name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		series = append(series, s)
+		ids = append(ids, s.BusinessID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	views, err := loadViewSeries(ctx, businessViews, ids, from, to, interval)
+	if err != nil {
+		return nil, err
+	}
+	for i := range series {
+		v := views[series[i].BusinessID]
+		series[i].Points, series[i].Views, series[i].UniqueVisitors = v.Points, v.Views, v.UniqueVisitors
+	}
+	return series, nil
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Categories form two trees, one for businesses and one for events. Listings
+// reference a category by ID; the old free-form category column is kept in
+// sync with the category's display name for existing readers.
+
+var (
+	errUnknownCategory = errors.New("unknown category")
+
+	slugInvalidChars = regexp.MustCompile(`[^a-z0-9]+`)
+
+	// Taxonomy created on first start: kind -> parent name -> child names
+	defaultCategories = map[string][]struct {
+		name     string
+		children []string
+	}{
+		"business": {
+			{"Restaurant", []string{"Cafe", "Pizza", "Bakery"}},
+			{"Retail", []string{"Books", "Grocery", "Clothing"}},
+			{"Services", []string{"Auto Repair", "Hair & Beauty", "Spa & Wellness"}},
+			{"Healthcare", []string{"Fitness", "Clinic"}},
+			{"Technology", []string{"Electronics", "Computer Repair"}},
+			{"Entertainment", []string{"Kids", "Nightlife"}},
+			{"Other", nil},
+		},
+		"event": {
+			{"Workshop", nil},
+			{"Concert", nil},
+			{"Sale", nil},
+			{"Class", nil},
+			{"Meetup", nil},
+			{"Other", nil},
+		},
+	}
+)
+
+// Category is a node of the category tree
+type Category struct {
+	ID            int         `json:"id"`
+	ParentID      *int        `json:"parent_id,omitempty"`
+	Kind          string      `json:"kind"`
+	Slug          string      `json:"slug"`
+	Name          string      `json:"name"`
+	BusinessCount int         `json:"business_count"`
+	EventCount    int         `json:"event_count"`
+	Children      []*Category `json:"children,omitempty"`
+}
+
+// slugify turns a display name into a URL-friendly slug
+func slugify(name string) string {
+	slug := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), "&", "and")
+	return strings.Trim(slugInvalidChars.ReplaceAllString(slug, "-"), "-")
+}
+
+// migrateCategories seeds the taxonomy, adds category_id to businesses and
+// events and maps their existing category strings onto categories
+func migrateCategories(ctx context.Context) error {
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM categories").Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		for _, kind := range []string{"business", "event"} {
+			for _, parent := range defaultCategories[kind] {
+				parentID, err := createCategory(ctx, kind, parent.name, nil)
+				if err != nil {
+					return err
+				}
+				for _, child := range parent.children {
+					if _, err := createCategory(ctx, kind, child, &parentID); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	tables := map[string]string{"businesses": "business", "events": "event"}
+	for table, kind := range tables {
+		if err := addColumnIfMissing(ctx, table, "category_id", "INT NULL"); err != nil {
+			return err
+		}
+		if err := addConstraintIfMissing(ctx, table, "fk_"+table+"_category",
+			"FOREIGN KEY (category_id) REFERENCES categories(id) ON DELETE SET NULL"); err != nil {
+			return err
+		}
+		if err := addIndexIfMissing(ctx, table, "idx_"+table+"_category_id", "(category_id)"); err != nil {
+			return err
+		}
+		if err := mapLegacyCategories(ctx, table, kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapLegacyCategories assigns category_id to rows that only have a category
+// string. Strings matching an existing category by name or slug use it, so
+// "restaurant" and "Restaurant " end up together; anything else becomes a
+// new top-level category so no listing loses its category.
+func mapLegacyCategories(ctx context.Context, table, kind string) error {
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT category FROM "+table+" WHERE category_id IS NULL AND category IS NOT NULL AND category != ''")
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	for _, name := range names {
+		category, err := resolveCategory(ctx, kind, nil, name)
+		if err == errUnknownCategory {
+			var id int
+			id, err = createCategory(ctx, kind, strings.TrimSpace(name), nil)
+			if err == nil {
+				category = &Category{ID: id, Name: strings.TrimSpace(name)}
+				slog.Info("Created category for existing listings", "kind", kind, "category", category.Name)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		_, err = db.ExecContext(ctx, "UPDATE "+table+" SET category_id = ?, category = ? WHERE category_id IS NULL AND category = ?",
+			category.ID, category.Name, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createCategory inserts a category and returns its ID
+func createCategory(ctx context.Context, kind, name string, parentID *int) (int, error) {
+	result, err := db.ExecContext(ctx, "INSERT INTO categories (parent_id, kind, slug, name) VALUES (?, ?, ?, ?)",
+		parentID, kind, slugify(name), name)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := result.LastInsertId()
+	return int(id), nil
+}
+
+// resolveCategory finds a category of the given kind by ID or, when id is
+// nil, by display name or slug
+func resolveCategory(ctx context.Context, kind string, id *int, name string) (*Category, error) {
+	var c Category
+	var parentID sql.NullInt64
+	var err error
+	if id != nil {
+		err = db.QueryRowContext(ctx, "SELECT id, parent_id, kind, slug, name FROM categories WHERE id = ? AND kind = ?", *id, kind).
+			Scan(&c.ID, &parentID, &c.Kind, &c.Slug, &c.Name)
+	} else {
+		err = db.QueryRowContext(ctx, "SELECT id, parent_id, kind, slug, name FROM categories WHERE kind = ? AND (slug = ? OR LOWER(name) = LOWER(?)) LIMIT 1",
+			kind, slugify(name), strings.TrimSpace(name)).
+			Scan(&c.ID, &parentID, &c.Kind, &c.Slug, &c.Name)
+	}
+	if err == sql.ErrNoRows {
+		return nil, errUnknownCategory
+	}
+	if err != nil {
+		return nil, err
+	}
+	if parentID.Valid {
+		pid := int(parentID.Int64)
+		c.ParentID = &pid
+	}
+	return &c, nil
+}
+
+// categorySubtreeIDs returns the IDs of the category with the given slug and
+// all of its descendants
+func categorySubtreeIDs(ctx context.Context, kind, slug string) ([]int, error) {
+	rows, err := db.QueryContext(ctx, `
+		WITH RECURSIVE subtree AS (
+			SELECT id FROM categories WHERE kind = ? AND slug = ?
+			UNION ALL
+			SELECT c.id FROM categories c INNER JOIN subtree s ON c.parent_id = s.id
+		)
+		SELECT id FROM subtree
+	`, kind, slug)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 && rows.Err() == nil {
+		return nil, errUnknownCategory
+	}
+	return ids, rows.Err()
+}
+
+// categoryFilter builds a "category_id IN (...)" condition for the ?category=
+// query parameter, covering subcategories. It returns an empty condition when
+// the parameter is absent.
+func categoryFilter(r *http.Request, kind, column string) (string, []interface{}, error) {
+	slug := r.URL.Query().Get("category")
+	if slug == "" {
+		return "", nil, nil
+	}
+	ids, err := categorySubtreeIDs(r.Context(), kind, slugify(slug))
+	if err != nil {
+		return "", nil, err
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return column + " IN (?" + strings.Repeat(", ?", len(ids)-1) + ")", args, nil
+}
+
+// Get the category trees with listing counts. Counts include listings in
+// subcategories. ?kind=business or ?kind=event limits the result to one tree.
+func getCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	kind := r.URL.Query().Get("kind")
+	if kind != "" && kind != "business" && kind != "event" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "kind must be business or event"})
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT c.id, c.parent_id, c.kind, c.slug, c.name,
+		  (SELECT COUNT(*) FROM businesses b WHERE b.category_id = c.id) AS business_count,
+		  (SELECT COUNT(*) FROM events e WHERE e.category_id = c.id AND e.event_date >= NOW()) AS event_count
+		FROM categories c
+		WHERE ? = '' OR c.kind = ?
+		ORDER BY c.name ASC
+	`, kind, kind)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying categories", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	var all []*Category
+	byID := make(map[int]*Category)
+	for rows.Next() {
+		c := &Category{}
+		var parentID sql.NullInt64
+		if err := rows.Scan(&c.ID, &parentID, &c.Kind, &c.Slug, &c.Name, &c.BusinessCount, &c.EventCount); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning category", "error", err)
+			continue
+		}
+		if parentID.Valid {
+			pid := int(parentID.Int64)
+			c.ParentID = &pid
+		}
+		all = append(all, c)
+		byID[c.ID] = c
+	}
+
+	roots := []*Category{}
+	for _, c := range all {
+		if c.ParentID == nil || byID[*c.ParentID] == nil {
+			roots = append(roots, c)
+			continue
+		}
+		parent := byID[*c.ParentID]
+		parent.Children = append(parent.Children, c)
+	}
+	for _, root := range roots {
+		rollUpCounts(root)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roots)
+}
+
+// rollUpCounts adds the listing counts of descendants to each category
+func rollUpCounts(c *Category) {
+	for _, child := range c.Children {
+		rollUpCounts(child)
+		c.BusinessCount += child.BusinessCount
+		c.EventCount += child.EventCount
+	}
+}
+
+// requestCategory resolves the category_id or category given in a create or
+// update request. It returns nil when neither is set.
+func requestCategory(ctx context.Context, kind string, id *int, name string) (*Category, error) {
+	if id == nil && strings.TrimSpace(name) == "" {
+		return nil, nil
+	}
+	return resolveCategory(ctx, kind, id, name)
+}
+
+// writeCategoryError reports a failed category lookup
+func writeCategoryError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errUnknownCategory {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown category"})
+		return
+	}
+	writeServerError(w, r, err, "Error resolving category", "internal server error")
+}
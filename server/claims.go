@@ -0,0 +1,616 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Business owners claim listings they run but don't own (seeded or created
+// by someone else). A claim is verified either by a link mailed to an
+// address at the listing's email domain (only the listing's own address when
+// that domain is a public mail service) or by an uploaded document, then a
+// platform operator approves it, ownership moves to the claimant and the
+// business is marked verified.
+
+const (
+	claimTokenLifetime = 48 * time.Hour
+	maxClaimDocSize    = 10 << 20 // 10 MB
+)
+
+// Claim documents are private, so they live outside the public uploads dir
+var claimDocumentDir = "./claim-documents"
+
+var claimDocumentTypes = map[string]string{
+	"application/pdf": ".pdf",
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+}
+
+// BusinessClaim is a request to take over a business listing
+type BusinessClaim struct {
+	ID                int        `json:"id"`
+	BusinessID        int        `json:"business_id"`
+	BusinessName      string     `json:"business_name,omitempty"`
+	ClaimantID        int        `json:"claimant_id"`
+	ClaimantEmail     string     `json:"claimant_email,omitempty"`
+	Method            string     `json:"method"`
+	Status            string     `json:"status"`
+	VerificationEmail string     `json:"verification_email,omitempty"`
+	HasDocument       bool       `json:"has_document"`
+	EmailVerifiedAt   *time.Time `json:"email_verified_at,omitempty"`
+	ReviewedBy        *int       `json:"reviewed_by,omitempty"`
+	ReviewedAt        *time.Time `json:"reviewed_at,omitempty"`
+	ReviewNote        string     `json:"review_note,omitempty"`
+	CreatedAt         time.Time  `json:"created_at"`
+}
+
+// ClaimEvent is what the public event stream says about a claim. The
+// claimant and their addresses stay out of it.
+type ClaimEvent struct {
+	ClaimID    int `json:"claim_id"`
+	BusinessID int `json:"business_id"`
+}
+
+// newToken returns a random hex token for links sent by email
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken is how emailed tokens are stored, so a database leak doesn't
+// expose usable links
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// operatorEmails reads the OPERATOR_EMAILS allow-list
+func operatorEmails() map[string]bool {
+	emails := make(map[string]bool)
+	for _, e := range strings.Split(os.Getenv("OPERATOR_EMAILS"), ",") {
+		if e = strings.ToLower(strings.TrimSpace(e)); e != "" {
+			emails[e] = true
+		}
+	}
+	return emails
+}
+
+// isOperator reports whether the user is on the operator allow-list
+func isOperator(ctx context.Context, userID int) (bool, error) {
+	var email string
+	err := db.QueryRowContext(ctx, "SELECT email FROM users WHERE id = ?", userID).Scan(&email)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return operatorEmails()[strings.ToLower(email)], nil
+}
+
+// operatorOnly middleware ensures only platform operators can access
+func operatorOnly(next http.HandlerFunc) http.HandlerFunc {
+	return authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+		ok, err := isOperator(r.Context(), userID)
+		if err != nil {
+			writeServerError(w, r, err, "Error checking operator", "internal server error")
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "operator access required"})
+			return
+		}
+		next(w, r)
+	})
+}
+
+// migrateClaims adds the verified badge to businesses
+func migrateClaims(ctx context.Context) error {
+	return addColumnIfMissing(ctx, "businesses", "verified", "BOOLEAN NOT NULL DEFAULT FALSE")
+}
+
+// sharedMailDomains are public mail services, where anyone can have an
+// address at the listing's domain
+var sharedMailDomains = map[string]bool{
+	"gmail.com": true, "googlemail.com": true, "outlook.com": true, "hotmail.com": true,
+	"live.com": true, "msn.com": true, "yahoo.com": true, "ymail.com": true,
+	"icloud.com": true, "me.com": true, "aol.com": true, "proton.me": true,
+	"protonmail.com": true, "gmx.com": true, "mail.com": true, "zoho.com": true,
+	"yandex.com": true,
+}
+
+// emailDomain returns the lower-cased domain part of an email address
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(email[at+1:]))
+}
+
+func claimsRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		businessOwnerOnly(getMyClaimsHandler)(w, r)
+	case http.MethodPost:
+		businessOwnerOnly(createClaimHandler)(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Create a claim on a business. JSON bodies request email verification
+// ({business_id, method: "email", email}); multipart forms with business_id
+// and a document file request document review.
+func createClaimHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	claimantID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid user ID"})
+		return
+	}
+
+	var req struct {
+		BusinessID int    `json:"business_id"`
+		Method     string `json:"method"`
+		Email      string `json:"email"`
+	}
+	isMultipart := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+	if isMultipart {
+		r.Body = http.MaxBytesReader(w, r.Body, maxClaimDocSize+1<<20)
+		if err := r.ParseMultipartForm(maxClaimDocSize); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "file too large or invalid form"})
+			return
+		}
+		req.BusinessID, _ = strconv.Atoi(r.FormValue("business_id"))
+		req.Method = "document"
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if req.BusinessID <= 0 || (req.Method != "email" && req.Method != "document") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "business_id and method (email or document) are required"})
+		return
+	}
+	if req.Method == "document" && !isMultipart {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "document claims must be uploaded as multipart/form-data"})
+		return
+	}
+
+	var businessName string
+	var listingEmail sql.NullString
+	var orgID sql.NullInt64
+	err = db.QueryRowContext(ctx, "SELECT name, email, organization_id FROM businesses WHERE id = ?", req.BusinessID).
+		Scan(&businessName, &listingEmail, &orgID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "business not found"})
+			return
+		}
+		writeServerError(w, r, err, "Error fetching business for claim", "internal server error")
+		return
+	}
+	if orgID.Valid {
+		role, err := organizationRole(ctx, db, int(orgID.Int64), claimantID)
+		if err != nil {
+			writeServerError(w, r, err, "Error checking membership", "internal server error")
+			return
+		}
+		if role == "owner" {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "you already own this business"})
+			return
+		}
+	}
+
+	var open int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM business_claims WHERE business_id = ? AND claimant_id = ? AND status IN ('pending_verification', 'pending_review')",
+		req.BusinessID, claimantID).Scan(&open)
+	if err != nil {
+		writeServerError(w, r, err, "Error checking open claims", "internal server error")
+		return
+	}
+	if open > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "you already have an open claim for this business"})
+		return
+	}
+
+	claim := BusinessClaim{
+		BusinessID:   req.BusinessID,
+		BusinessName: businessName,
+		ClaimantID:   claimantID,
+		Method:       req.Method,
+		CreatedAt:    time.Now(),
+	}
+
+	var token, tokenHash, documentPath, documentType string
+	var tokenExpires *time.Time
+	if req.Method == "email" {
+		// The address must be at the listing's own domain, or be the
+		// listing's address itself when anyone can sign up at that domain
+		domain := emailDomain(listingEmail.String)
+		if domain == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "this listing has no email address, claim it with a document instead"})
+			return
+		}
+		email := strings.TrimSpace(req.Email)
+		if email == "" {
+			email = listingEmail.String
+		}
+		if sharedMailDomains[domain] && !strings.EqualFold(email, strings.TrimSpace(listingEmail.String)) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "verification email must be the listing's own address"})
+			return
+		}
+		if emailDomain(email) != domain {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "verification email must be an address at " + domain})
+			return
+		}
+		if token, err = newToken(); err != nil {
+			writeServerError(w, r, err, "Error generating claim token", "internal server error")
+			return
+		}
+		tokenHash = hashToken(token)
+		expires := time.Now().Add(claimTokenLifetime)
+		tokenExpires = &expires
+		claim.Status = "pending_verification"
+		claim.VerificationEmail = email
+	} else {
+		documentPath, documentType, err = saveClaimDocument(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		claim.Status = "pending_review"
+		claim.HasDocument = true
+	}
+
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO business_claims (business_id, claimant_id, method, status, verification_email, token_hash, token_expires_at, document_path, document_type)
+		VALUES (?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, NULLIF(?, ''), NULLIF(?, ''))
+	`, claim.BusinessID, claimantID, claim.Method, claim.Status, claim.VerificationEmail, tokenHash, tokenExpires, documentPath, documentType)
+	if err != nil {
+		if documentPath != "" {
+			os.Remove(documentPath)
+		}
+		writeServerError(w, r, err, "Error creating claim", "failed to create claim")
+		return
+	}
+	id, _ := result.LastInsertId()
+	claim.ID = int(id)
+
+	if token != "" {
+		sendMailAsync(claim.VerificationEmail, "Confirm your claim on "+businessName,
+			"Someone asked to manage the listing for "+businessName+".\n\n"+
+				"If that was you or your colleague, confirm by opening this link within 48 hours:\n\n"+
+				publicURL("/claims/verify?token="+token)+"\n\n"+
+				"If not, you can ignore this email.\n")
+	}
+
+	logEvent("claim_created", "Claim on "+businessName+" requested", ClaimEvent{ClaimID: claim.ID, BusinessID: claim.BusinessID})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(claim)
+}
+
+// saveClaimDocument stores the "document" form file and returns its path and
+// content type
+func saveClaimDocument(r *http.Request) (string, string, error) {
+	file, _, err := r.FormFile("document")
+	if err != nil {
+		return "", "", errString("document file is required")
+	}
+	defer file.Close()
+
+	// Trust the content, not the client's Content-Type
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	contentType := http.DetectContentType(head[:n])
+	ext, ok := claimDocumentTypes[contentType]
+	if !ok {
+		return "", "", errString("document must be a PDF, JPEG or PNG")
+	}
+
+	if err := os.MkdirAll(claimDocumentDir, 0700); err != nil {
+		return "", "", err
+	}
+	name, err := newToken()
+	if err != nil {
+		return "", "", err
+	}
+	path := filepath.Join(claimDocumentDir, name+ext)
+	dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", "", err
+	}
+	_, err = io.Copy(dst, io.MultiReader(bytes.NewReader(head[:n]), file))
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", "", errString("failed to save document")
+	}
+	return path, contentType, nil
+}
+
+// errString is an error whose message is safe to show to clients
+type errString string
+
+func (e errString) Error() string { return string(e) }
+
+// Confirm an email claim from the emailed link
+func verifyClaimHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "token is required"})
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `
+		UPDATE business_claims
+		SET status = 'pending_review', email_verified_at = NOW(), token_hash = NULL
+		WHERE token_hash = ? AND status = 'pending_verification' AND token_expires_at > NOW()
+	`, hashToken(token))
+	if err != nil {
+		writeServerError(w, r, err, "Error verifying claim", "internal server error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired link"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "email confirmed, your claim is now waiting for review"})
+}
+
+const claimColumns = `
+	c.id, c.business_id, b.name, c.claimant_id, u.email, c.method, c.status,
+	c.verification_email, c.document_path IS NOT NULL, c.email_verified_at,
+	c.reviewed_by, c.reviewed_at, c.review_note, c.created_at
+`
+
+// queryClaims runs a claims query selecting claimColumns
+func queryClaims(ctx context.Context, where string, args ...interface{}) ([]BusinessClaim, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+claimColumns+`
+		FROM business_claims c
+		INNER JOIN businesses b ON b.id = c.business_id
+		INNER JOIN users u ON u.id = c.claimant_id
+		`+where+`
+		ORDER BY c.created_at DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	claims := []BusinessClaim{}
+	for rows.Next() {
+		var c BusinessClaim
+		var verificationEmail, note sql.NullString
+		var reviewedBy sql.NullInt64
+		var verifiedAt, reviewedAt sql.NullTime
+		if err := rows.Scan(&c.ID, &c.BusinessID, &c.BusinessName, &c.ClaimantID, &c.ClaimantEmail, &c.Method, &c.Status,
+			&verificationEmail, &c.HasDocument, &verifiedAt, &reviewedBy, &reviewedAt, &note, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		c.VerificationEmail = verificationEmail.String
+		c.ReviewNote = note.String
+		if verifiedAt.Valid {
+			c.EmailVerifiedAt = &verifiedAt.Time
+		}
+		if reviewedBy.Valid {
+			id := int(reviewedBy.Int64)
+			c.ReviewedBy = &id
+		}
+		if reviewedAt.Valid {
+			c.ReviewedAt = &reviewedAt.Time
+		}
+		claims = append(claims, c)
+	}
+	return claims, rows.Err()
+}
+
+// Get the claims made by the current user
+func getMyClaimsHandler(w http.ResponseWriter, r *http.Request) {
+	claimantID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	claims, err := queryClaims(r.Context(), "WHERE c.claimant_id = ?", claimantID)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying claims", "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(claims)
+}
+
+// Get claims for operators, by default those waiting for review
+func getClaimsForReviewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "pending_review"
+	}
+	claims, err := queryClaims(r.Context(), "WHERE c.status = ?", status)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying claims", "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(claims)
+}
+
+// Download the document attached to a claim (operators only)
+func getClaimDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid claim ID"})
+		return
+	}
+
+	var path, contentType sql.NullString
+	err = db.QueryRowContext(r.Context(), "SELECT document_path, document_type FROM business_claims WHERE id = ?", id).Scan(&path, &contentType)
+	if err == sql.ErrNoRows || (err == nil && !path.Valid) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "document not found"})
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching claim document", "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType.String)
+	w.Header().Set("Content-Disposition", "attachment; filename=claim-"+strconv.Itoa(id)+filepath.Ext(path.String))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, path.String)
+}
+
+// Approve or reject a claim. Approving moves the business into the
+// claimant's own organisation, marks it verified and rejects other open
+// claims on it.
+func reviewClaimHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	operatorID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		ID       int    `json:"id"`
+		Decision string `json:"decision"`
+		Note     string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if req.Decision != "approve" && req.Decision != "reject" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "decision must be approve or reject"})
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		writeServerError(w, r, err, "Error starting transaction", "internal server error")
+		return
+	}
+	defer tx.Rollback()
+
+	var businessID, claimantID int
+	var status string
+	err = tx.QueryRowContext(ctx, "SELECT business_id, claimant_id, status FROM business_claims WHERE id = ? FOR UPDATE", req.ID).
+		Scan(&businessID, &claimantID, &status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "claim not found"})
+			return
+		}
+		writeServerError(w, r, err, "Error fetching claim", "internal server error")
+		return
+	}
+	if status != "pending_review" {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "claim is not waiting for review"})
+		return
+	}
+
+	newStatus := "rejected"
+	if req.Decision == "approve" {
+		newStatus = "approved"
+		var orgID int
+		if err = lockEntity(ctx, tx, "business", businessID); err == nil {
+			orgID, err = personalOrganization(ctx, tx, claimantID)
+		}
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "UPDATE businesses SET owner_id = ?, organization_id = ?, verified = TRUE WHERE id = ?", claimantID, orgID, businessID)
+		}
+		if err == nil {
+			_, err = tx.ExecContext(ctx, `
+				UPDATE business_claims
+				SET status = 'rejected', reviewed_by = ?, reviewed_at = NOW(), review_note = 'another claim was approved'
+				WHERE business_id = ? AND id != ? AND status IN ('pending_verification', 'pending_review')
+			`, operatorID, businessID, req.ID)
+		}
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "UPDATE business_claims SET status = ?, reviewed_by = ?, reviewed_at = NOW(), review_note = NULLIF(?, '') WHERE id = ?",
+			newStatus, operatorID, req.Note, req.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error reviewing claim", "failed to review claim")
+		return
+	}
+
+	claims, err := queryClaims(ctx, "WHERE c.id = ?", req.ID)
+	if err != nil || len(claims) == 0 {
+		writeServerError(w, r, err, "Error fetching reviewed claim", "failed to fetch claim")
+		return
+	}
+	claim := claims[0]
+
+	// The claimant is told through the notification centre
+	logEvent("claim_"+newStatus, "Claim on "+claim.BusinessName+" "+newStatus, ClaimEvent{ClaimID: claim.ID, BusinessID: claim.BusinessID})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(claim)
+}
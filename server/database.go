@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Every statement runs with the context of the request or job that issued
+// it, so a client going away cancels its queries. On top of that each
+// statement gets its own deadline, DB_QUERY_TIMEOUT, and each request an
+// overall one, REQUEST_TIMEOUT, which also bounds the wait for a pooled
+// connection. Handlers report a timed-out statement as 504 and a database
+// that is out of connections or unreachable as 503. Background jobs use
+// DB_BACKGROUND_QUERY_TIMEOUT instead, and schema migrations run unbounded.
+//
+// The pool is sized through DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS,
+// DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME.
+
+const (
+	defaultMaxOpenConns           = 25
+	defaultMaxIdleConns           = 10
+	defaultConnMaxLifetime        = 5 * time.Minute
+	defaultConnMaxIdleTime        = time.Minute
+	defaultQueryTimeout           = 5 * time.Second
+	defaultBackgroundQueryTimeout = time.Minute
+	defaultRequestTimeout         = 30 * time.Second
+
+	// statusClientClosedRequest is logged for requests the client gave up on
+	statusClientClosedRequest = 499
+
+	// dbRetryAfter is sent with 503s caused by the database
+	dbRetryAfter = 5
+)
+
+// errQueryTimeout is the cause of a statement that ran past its deadline
+var errQueryTimeout = errors.New("query timed out")
+
+var (
+	queryTimeout           = defaultQueryTimeout
+	backgroundQueryTimeout = defaultBackgroundQueryTimeout
+	requestTimeout         = defaultRequestTimeout
+)
+
+type queryTimeoutKey struct{}
+
+// withQueryTimeout overrides the per-statement deadline for statements run
+// with ctx. Zero turns it off, for schema changes that may take a while.
+func withQueryTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, queryTimeoutKey{}, d)
+}
+
+// statementContext bounds one statement by the query timeout in effect
+func statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	d, ok := ctx.Value(queryTimeoutKey{}).(time.Duration)
+	if !ok {
+		d = queryTimeout
+	}
+	if d <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, d, errQueryTimeout)
+}
+
+// statementError marks an error caused by the statement's own deadline, as
+// opposed to the caller's, with errQueryTimeout
+func statementError(ctx context.Context, err error) error {
+	if err == nil || err == driver.ErrSkip || err == io.EOF {
+		return err
+	}
+	if context.Cause(ctx) == errQueryTimeout {
+		return fmt.Errorf("%w: %w", errQueryTimeout, err)
+	}
+	return err
+}
+
+// timedRows releases the statement's deadline once the rows are closed, as
+// the driver keeps watching the context while results are read
+type timedRows struct {
+	driver.Rows
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (r *timedRows) Next(dest []driver.Value) error {
+	return statementError(r.ctx, r.Rows.Next(dest))
+}
+
+func (r *timedRows) Close() error {
+	err := r.Rows.Close()
+	r.cancel()
+	return err
+}
+
+// configurePool applies the pool limits and timeouts from the environment
+func configurePool(db *sql.DB) {
+	db.SetMaxOpenConns(envInt("DB_MAX_OPEN_CONNS", defaultMaxOpenConns))
+	db.SetMaxIdleConns(envInt("DB_MAX_IDLE_CONNS", defaultMaxIdleConns))
+	db.SetConnMaxLifetime(envDuration("DB_CONN_MAX_LIFETIME", defaultConnMaxLifetime))
+	db.SetConnMaxIdleTime(envDuration("DB_CONN_MAX_IDLE_TIME", defaultConnMaxIdleTime))
+	queryTimeout = envDuration("DB_QUERY_TIMEOUT", defaultQueryTimeout)
+	backgroundQueryTimeout = envDuration("DB_BACKGROUND_QUERY_TIMEOUT", defaultBackgroundQueryTimeout)
+	requestTimeout = envDuration("REQUEST_TIMEOUT", defaultRequestTimeout)
+}
+
+// envInt reads a non-negative integer setting
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		slog.Warn("Invalid "+name+", using default", "value", v, "default", def)
+		return def
+	}
+	return n
+}
+
+// envDuration reads a duration setting such as "5s"; zero disables it
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		slog.Warn("Invalid "+name+", using default", "value", v, "default", def.String())
+		return def
+	}
+	return d
+}
+
+// poolExhausted reports whether every connection the pool may open is in use
+func poolExhausted() bool {
+	s := dbStats()
+	return s.MaxOpenConnections > 0 && s.InUse >= s.MaxOpenConnections
+}
+
+// dbErrorStatus maps an error from data access to a response status
+func dbErrorStatus(err error) int {
+	var mysqlErr *mysql.MySQLError
+	switch {
+	case errors.Is(err, errQueryTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.DeadlineExceeded):
+		// The request ran out of time, most likely waiting for a connection
+		// if the pool is full
+		if poolExhausted() {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &mysqlErr):
+		// Too many connections, for the server or for the user
+		if mysqlErr.Number == 1040 || mysqlErr.Number == 1203 {
+			return http.StatusServiceUnavailable
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// writeServerError logs an unexpected error and answers with the status it
+// maps to. message is sent for plain internal errors; timeouts and an
+// unavailable database get a message of their own.
+func writeServerError(w http.ResponseWriter, r *http.Request, err error, logMessage, message string) {
+	status := dbErrorStatus(err)
+	switch status {
+	case statusClientClosedRequest:
+		// Nobody is left to read the response
+		slog.InfoContext(r.Context(), "Request cancelled", "error", err)
+		w.WriteHeader(status)
+		return
+	case http.StatusServiceUnavailable:
+		w.Header().Set("Retry-After", strconv.Itoa(dbRetryAfter))
+		message = "service temporarily unavailable"
+	case http.StatusGatewayTimeout:
+		message = "request timed out"
+	}
+	slog.ErrorContext(r.Context(), logMessage, "error", err)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// withRequestTimeout puts a deadline on every request's context. Uploads are
+// left unbounded, as their length depends on the client's bandwidth.
+func withRequestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestTimeout <= 0 || strings.HasPrefix(r.URL.Path, tusBasePath) || r.URL.Path == "/images/upload" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
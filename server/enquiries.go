@@ -0,0 +1,1124 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Users and guests contact a business through enquiry threads. Neither side
+// sees the other's email address: messages are announced by notifications
+// sent from the site and, when ENQUIRY_RELAY_DOMAIN is set, those emails carry
+// a per-thread Reply-To address. The mail provider posts replies to that
+// address back to /enquiries/inbound. Guests prove their address by opening
+// the emailed link before the business sees the enquiry, and the same link
+// gives them access to the thread afterwards.
+
+const (
+	maxEnquiryAttachments   = 3
+	maxEnquiryMessageLength = 5000
+	enquiryVerifyWindow     = 48 * time.Hour
+
+	// Spam throttles
+	maxEnquiriesPerHour    = 5  // new threads per user or guest address
+	maxEnquiriesPerIPHour  = 10 // new threads per client address
+	maxEnquiryMessageBurst = 10 // messages per thread side per window
+	enquiryMessageWindow   = 10 * time.Minute
+)
+
+var (
+	errEnquiryThrottled = errors.New("too many messages, try again later")
+	errEnquiryClosed    = errors.New("enquiry is closed")
+)
+
+func init() {
+	registerPrivateEntityType("enquiry_message", "enquiry_messages", "Enquiry attachment")
+}
+
+type EnquiryThread struct {
+	ID            int              `json:"id"`
+	BusinessID    int              `json:"business_id"`
+	BusinessName  string           `json:"business_name"`
+	CustomerName  string           `json:"customer_name"`
+	Subject       string           `json:"subject"`
+	Status        string           `json:"status"`
+	Role          string           `json:"role"`
+	Unread        int              `json:"unread"`
+	LastMessageAt time.Time        `json:"last_message_at"`
+	CreatedAt     time.Time        `json:"created_at"`
+	Messages      []EnquiryMessage `json:"messages,omitempty"`
+
+	customerID     int
+	customerEmail  string
+	customerToken  string
+	businessToken  string
+	customerUnread int
+	businessUnread int
+}
+
+type EnquiryMessage struct {
+	ID          int       `json:"id"`
+	ThreadID    int       `json:"thread_id"`
+	Sender      string    `json:"sender"`
+	Via         string    `json:"via"`
+	Body        string    `json:"body"`
+	Attachments []Image   `json:"attachments"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// EnquiryEvent is what the public event stream says about an enquiry. The
+// customer and what they wrote stay out of it.
+type EnquiryEvent struct {
+	ThreadID   int `json:"thread_id"`
+	BusinessID int `json:"business_id"`
+}
+
+// viewAs sets the fields that depend on which side is looking at the thread
+func (t *EnquiryThread) viewAs(side string) {
+	t.Role = side
+	if side == "business" {
+		t.Unread = t.businessUnread
+	} else {
+		t.Unread = t.customerUnread
+	}
+}
+
+// newRelayToken returns a random token short enough for an email local part
+func newRelayToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// relayAddress is the Reply-To address routing email replies into a thread,
+// or "" when ENQUIRY_RELAY_DOMAIN is not set
+func relayAddress(token string) string {
+	domain := os.Getenv("ENQUIRY_RELAY_DOMAIN")
+	if domain == "" {
+		return ""
+	}
+	return "reply+" + token + "@" + domain
+}
+
+func queryEnquiryThreads(ctx context.Context, where string, args ...interface{}) ([]EnquiryThread, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.id, t.business_id, b.name, COALESCE(u.name, t.guest_name, ''), t.subject, t.status,
+			t.customer_unread, t.business_unread, t.last_message_at, t.created_at,
+			IFNULL(t.customer_id, 0), COALESCE(u.email, t.guest_email, ''), t.customer_token, t.business_token
+		FROM enquiry_threads t
+		INNER JOIN businesses b ON b.id = t.business_id
+		LEFT JOIN users u ON u.id = t.customer_id
+		`+where+`
+		ORDER BY t.last_message_at DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	threads := []EnquiryThread{}
+	for rows.Next() {
+		var t EnquiryThread
+		err := rows.Scan(&t.ID, &t.BusinessID, &t.BusinessName, &t.CustomerName, &t.Subject, &t.Status,
+			&t.customerUnread, &t.businessUnread, &t.LastMessageAt, &t.CreatedAt,
+			&t.customerID, &t.customerEmail, &t.customerToken, &t.businessToken)
+		if err != nil {
+			return nil, err
+		}
+		threads = append(threads, t)
+	}
+	return threads, rows.Err()
+}
+
+// loadEnquiryThread returns one thread, or errEntityNotFound
+func loadEnquiryThread(ctx context.Context, where string, args ...interface{}) (*EnquiryThread, error) {
+	threads, err := queryEnquiryThreads(ctx, where, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(threads) == 0 {
+		return nil, errEntityNotFound
+	}
+	return &threads[0], nil
+}
+
+// enquirySide works out which side of a thread the caller is on. Guests
+// authenticate with the thread link's ?token=. Callers who may not see the
+// thread get errEntityNotFound so its existence isn't revealed.
+func enquirySide(r *http.Request, t *EnquiryThread) (string, error) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		if t.Status != "pending_verification" && subtle.ConstantTimeCompare([]byte(token), []byte(t.customerToken)) == 1 {
+			return "customer", nil
+		}
+		return "", errEntityNotFound
+	}
+
+	userID := optionalUserID(r)
+	if userID == 0 {
+		return "", errEntityNotFound
+	}
+	if t.customerID == userID {
+		return "customer", nil
+	}
+	if t.Status == "pending_verification" {
+		return "", errEntityNotFound
+	}
+	err := authorizeEntity(r.Context(), "business", t.BusinessID, userID, permManageEnquiries)
+	if err == errForbidden {
+		return "", errEntityNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return "business", nil
+}
+
+// loadEnquiryMessages returns a thread's messages, oldest first, with their
+// attachments
+func loadEnquiryMessages(ctx context.Context, threadID int) ([]EnquiryMessage, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, thread_id, sender, via, body, created_at FROM enquiry_messages WHERE thread_id = ? ORDER BY id", threadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []EnquiryMessage
+	var ids []int
+	for rows.Next() {
+		var m EnquiryMessage
+		if err := rows.Scan(&m.ID, &m.ThreadID, &m.Sender, &m.Via, &m.Body, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		m.Attachments = []Image{}
+		messages = append(messages, m)
+		ids = append(ids, m.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return messages, nil
+	}
+
+	placeholders, args := idPlaceholders(ids)
+	imageRows, err := db.QueryContext(ctx, `
+		SELECT id, entity_id, image_url, created_at
+		FROM images
+		WHERE entity_type = 'enquiry_message' AND entity_id IN (`+placeholders+`)
+		ORDER BY display_order, id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer imageRows.Close()
+
+	attachments := make(map[int][]Image)
+	for imageRows.Next() {
+		img := Image{EntityType: "enquiry_message"}
+		if err := imageRows.Scan(&img.ID, &img.EntityID, &img.ImageURL, &img.CreatedAt); err != nil {
+			return nil, err
+		}
+		img.ImageURL = enquiryAttachmentURL(img.ID)
+		attachments[img.EntityID] = append(attachments[img.EntityID], img)
+	}
+	if err := imageRows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		if a, ok := attachments[messages[i].ID]; ok {
+			messages[i].Attachments = a
+		}
+	}
+	return messages, nil
+}
+
+// insertEnquiryMessage adds a message inside tx, enforcing the message
+// throttle and bumping the other side's unread count. It returns the
+// thread's status.
+func insertEnquiryMessage(ctx context.Context, tx *sql.Tx, threadID int, side string, senderID int, body, via string) (EnquiryMessage, string, error) {
+	msg := EnquiryMessage{ThreadID: threadID, Sender: side, Via: via, Body: body, Attachments: []Image{}, CreatedAt: time.Now()}
+
+	// Lock the thread so concurrent messages are counted consistently
+	var status string
+	if err := tx.QueryRowContext(ctx, "SELECT status FROM enquiry_threads WHERE id = ? FOR UPDATE", threadID).Scan(&status); err != nil {
+		return msg, "", err
+	}
+	if status == "closed" {
+		return msg, status, errEnquiryClosed
+	}
+
+	var recent int
+	err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM enquiry_messages WHERE thread_id = ? AND sender = ? AND created_at > ?",
+		threadID, side, time.Now().Add(-enquiryMessageWindow)).Scan(&recent)
+	if err != nil {
+		return msg, status, err
+	}
+	if recent >= maxEnquiryMessageBurst {
+		return msg, status, errEnquiryThrottled
+	}
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO enquiry_messages (thread_id, sender, sender_user_id, body, via) VALUES (?, ?, NULLIF(?, 0), ?, ?)",
+		threadID, side, senderID, body, via)
+	if err != nil {
+		return msg, status, err
+	}
+	id, _ := result.LastInsertId()
+	msg.ID = int(id)
+
+	unread := "business_unread"
+	if side == "business" {
+		unread = "customer_unread"
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE enquiry_threads SET "+unread+" = "+unread+" + 1, last_message_at = NOW() WHERE id = ?", threadID)
+	return msg, status, err
+}
+
+// storeEnquiryAttachments saves uploaded images against a message. Files
+// that fail to store are logged and skipped.
+func storeEnquiryAttachments(ctx context.Context, msg *EnquiryMessage, uploaderID int, files []*multipart.FileHeader) {
+	var uploadedBy *int
+	if uploaderID != 0 {
+		uploadedBy = &uploaderID
+	}
+	for _, fh := range files {
+		f, err := fh.Open()
+		if err != nil {
+			slog.Error("Error opening enquiry attachment", "error", err)
+			continue
+		}
+		image, err := storeImage(ctx, f, imageUpload{
+			EntityType:       "enquiry_message",
+			EntityID:         msg.ID,
+			UploadedBy:       uploadedBy,
+			OriginalFilename: fh.Filename,
+			ContentType:      fh.Header.Get("Content-Type"),
+		})
+		f.Close()
+		if err != nil {
+			slog.Error("Error storing enquiry attachment", "error", err)
+			continue
+		}
+		image.ImageURL, image.StoragePath = enquiryAttachmentURL(image.ID), ""
+		msg.Attachments = append(msg.Attachments, image)
+	}
+}
+
+// enquiryAttachmentURL is where the thread's participants fetch an
+// attachment. Guests add the ?token= from their thread link.
+func enquiryAttachmentURL(imageID int) string {
+	return fmt.Sprintf("/enquiries/attachments?id=%d", imageID)
+}
+
+// notifyEnquiry tells the other side of a thread about a new message
+func notifyEnquiry(ctx context.Context, t *EnquiryThread, msg EnquiryMessage) {
+	body := msg.Body
+	if len(msg.Attachments) > 0 {
+		body += fmt.Sprintf("\n\n(%d attachment(s))", len(msg.Attachments))
+	}
+
+	var n Notification
+	var recipients []recipient
+	if msg.Sender == "customer" {
+		var err error
+		if recipients, err = listingMembers(ctx, "business", t.BusinessID, permManageEnquiries); err != nil {
+			slog.Error("Error finding enquiry recipients", "error", err)
+			return
+		}
+		n = Notification{
+			Type:       "enquiry_received",
+			Title:      "Message from " + t.CustomerName + ": " + t.Subject,
+			Body:       body + "\n\n" + enquiryReplyHint(t.businessToken, fmt.Sprintf("/enquiries?id=%d", t.ID)),
+			EntityType: "business",
+			EntityID:   t.BusinessID,
+			ReplyTo:    relayAddress(t.businessToken),
+		}
+	} else {
+		link := fmt.Sprintf("/enquiries?id=%d", t.ID)
+		if t.customerID == 0 {
+			link += "&token=" + t.customerToken
+		}
+		recipients = []recipient{{UserID: t.customerID, Email: t.customerEmail}}
+		n = Notification{
+			Type:       "enquiry_reply",
+			Title:      t.BusinessName + " replied: " + t.Subject,
+			Body:       body + "\n\n" + enquiryReplyHint(t.customerToken, link),
+			EntityType: "business",
+			EntityID:   t.BusinessID,
+			ReplyTo:    relayAddress(t.customerToken),
+		}
+	}
+
+	if err := notify(ctx, n, recipients); err != nil {
+		slog.Error("Error sending enquiry notifications", "error", err)
+	}
+}
+
+// enquiryReplyHint tells the reader how to answer a message
+func enquiryReplyHint(token, path string) string {
+	if relayAddress(token) != "" {
+		return "Reply to this email or open the conversation: " + publicURL(path)
+	}
+	return "Open the conversation to reply: " + publicURL(path)
+}
+
+// checkEnquiryThrottle applies the limits on opening threads
+func checkEnquiryThrottle(ctx context.Context, customerID int, guestEmail, ip string) error {
+	since := time.Now().Add(-time.Hour)
+
+	var count int
+	var err error
+	if customerID != 0 {
+		err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM enquiry_threads WHERE customer_id = ? AND created_at > ?", customerID, since).Scan(&count)
+	} else {
+		err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM enquiry_threads WHERE guest_email = ? AND created_at > ?", guestEmail, since).Scan(&count)
+	}
+	if err != nil {
+		return err
+	}
+	if count >= maxEnquiriesPerHour {
+		return errEnquiryThrottled
+	}
+
+	if err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM enquiry_threads WHERE client_ip = ? AND created_at > ?", ip, since).Scan(&count); err != nil {
+		return err
+	}
+	if count >= maxEnquiriesPerIPHour {
+		return errEnquiryThrottled
+	}
+	return nil
+}
+
+// writeEnquiryError writes the response for errors from the enquiry helpers
+func writeEnquiryError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errEntityNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "enquiry not found"})
+	case errEnquiryClosed:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	case errEnquiryThrottled:
+		w.Header().Set("Retry-After", strconv.Itoa(int(enquiryMessageWindow.Seconds())))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	default:
+		writeServerError(w, r, err, "Error handling enquiry", "internal server error")
+	}
+}
+
+type enquiryRequest struct {
+	ThreadID   int    `json:"thread_id"`
+	BusinessID int    `json:"business_id"`
+	Subject    string `json:"subject"`
+	Message    string `json:"message"`
+	Name       string `json:"name"`
+	Email      string `json:"email"`
+}
+
+// parseEnquiryRequest reads a JSON body, or a multipart form carrying the
+// same fields plus up to three "attachments" image files
+func parseEnquiryRequest(w http.ResponseWriter, r *http.Request) (enquiryRequest, []*multipart.FileHeader, error) {
+	var req enquiryRequest
+	var files []*multipart.FileHeader
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+			return req, nil, errString("attachments too large or invalid form")
+		}
+		req.ThreadID, _ = strconv.Atoi(r.FormValue("thread_id"))
+		req.BusinessID, _ = strconv.Atoi(r.FormValue("business_id"))
+		req.Subject = r.FormValue("subject")
+		req.Message = r.FormValue("message")
+		req.Name = r.FormValue("name")
+		req.Email = r.FormValue("email")
+		files = r.MultipartForm.File["attachments"]
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, nil, errString("invalid request")
+	}
+
+	req.Message = strings.TrimSpace(req.Message)
+	if req.Message == "" {
+		return req, nil, errString("message is required")
+	}
+	if len(req.Message) > maxEnquiryMessageLength {
+		return req, nil, errString(fmt.Sprintf("message must be at most %d characters", maxEnquiryMessageLength))
+	}
+	if len(files) > maxEnquiryAttachments {
+		return req, nil, errString(fmt.Sprintf("at most %d attachments per message", maxEnquiryAttachments))
+	}
+	for _, fh := range files {
+		if !strings.HasPrefix(fh.Header.Get("Content-Type"), "image/") {
+			return req, nil, errString("attachments must be images")
+		}
+	}
+	return req, files, nil
+}
+
+func enquiriesRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("id") != "" {
+			getEnquiryHandler(w, r)
+			return
+		}
+		authMiddleware(listEnquiriesHandler)(w, r)
+	case http.MethodPost:
+		createEnquiryHandler(w, r)
+	case http.MethodPut:
+		updateEnquiryHandler(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// List the caller's enquiries. ?as=business lists threads for businesses the
+// caller manages (optionally one ?business_id=), otherwise threads the caller
+// opened. ?status=open|closed filters by status.
+func listEnquiriesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	side := "customer"
+	where := "WHERE t.customer_id = ?"
+	args := []interface{}{userID}
+	if r.URL.Query().Get("as") == "business" {
+		side = "business"
+		scope, scopeArgs := organizationScope("b.organization_id", userID, permManageEnquiries)
+		where = "WHERE t.status != 'pending_verification' AND " + scope
+		args = scopeArgs
+		if v := r.URL.Query().Get("business_id"); v != "" {
+			businessID, err := strconv.Atoi(v)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "invalid business_id"})
+				return
+			}
+			where += " AND t.business_id = ?"
+			args = append(args, businessID)
+		}
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		if status != "open" && status != "closed" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "status must be open or closed"})
+			return
+		}
+		where += " AND t.status = ?"
+		args = append(args, status)
+	}
+
+	threads, err := queryEnquiryThreads(r.Context(), where, args...)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying enquiries", "internal server error")
+		return
+	}
+	for i := range threads {
+		threads[i].viewAs(side)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(threads)
+}
+
+// Get one thread with its messages and mark it read for the caller's side.
+// Guests pass the ?token= from their emailed link.
+func getEnquiryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid id"})
+		return
+	}
+
+	thread, err := loadEnquiryThread(ctx, "WHERE t.id = ?", id)
+	if err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+	side, err := enquirySide(r, thread)
+	if err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+
+	if thread.Messages, err = loadEnquiryMessages(ctx, thread.ID); err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE enquiry_threads SET "+side+"_unread = 0 WHERE id = ?", thread.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error marking enquiry read", "error", err)
+	}
+	thread.customerUnread, thread.businessUnread = 0, 0
+	thread.viewAs(side)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(thread)
+}
+
+// Download an enquiry attachment. Only the two sides of its thread may see
+// it; guests pass the ?token= from their emailed link.
+func getEnquiryAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid id"})
+		return
+	}
+
+	var threadID int
+	var path, contentType sql.NullString
+	err = db.QueryRowContext(ctx, `
+		SELECT m.thread_id, i.storage_path, md.mime_type
+		FROM images i
+		INNER JOIN enquiry_messages m ON m.id = i.entity_id
+		LEFT JOIN image_metadata md ON md.image_id = i.id
+		WHERE i.id = ? AND i.entity_type = 'enquiry_message'
+	`, id).Scan(&threadID, &path, &contentType)
+	if err == sql.ErrNoRows || (err == nil && !path.Valid) {
+		writeEnquiryError(w, r, errEntityNotFound)
+		return
+	}
+	if err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+
+	thread, err := loadEnquiryThread(ctx, "WHERE t.id = ?", threadID)
+	if err == nil {
+		_, err = enquirySide(r, thread)
+	}
+	if err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+
+	// Attachments are checked to be images on upload, but the stored type
+	// came from the client
+	if !strings.HasPrefix(contentType.String, "image/") || strings.Contains(contentType.String, "svg") {
+		contentType.String = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType.String)
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	http.ServeFile(w, r, path.String)
+}
+
+// Open a thread with a business. Signed-in users' threads open immediately;
+// guests give a name and email address and must confirm the address from
+// the emailed link before the business is told.
+func createEnquiryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	req, files, err := parseEnquiryRequest(w, r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	req.Subject = strings.TrimSpace(req.Subject)
+	if req.BusinessID <= 0 || req.Subject == "" || len(req.Subject) > 255 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "business_id and a subject of at most 255 characters are required"})
+		return
+	}
+
+	userID := optionalUserID(r)
+	var guestName, guestEmail string
+	if userID == 0 {
+		addr, err := mail.ParseAddress(strings.TrimSpace(req.Email))
+		guestName = strings.TrimSpace(req.Name)
+		if err != nil || guestName == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "name and a valid email are required when not signed in"})
+			return
+		}
+		guestEmail = strings.ToLower(addr.Address)
+	}
+
+	var businessName string
+	err = db.QueryRowContext(ctx, "SELECT name FROM businesses WHERE id = ?", req.BusinessID).Scan(&businessName)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "business not found"})
+			return
+		}
+		writeServerError(w, r, err, "Error fetching business for enquiry", "internal server error")
+		return
+	}
+
+	ip := clientIP(r)
+	if err := checkEnquiryThrottle(ctx, userID, guestEmail, ip); err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+
+	customerToken, err := newRelayToken()
+	var businessToken string
+	if err == nil {
+		businessToken, err = newRelayToken()
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error generating enquiry tokens", "internal server error")
+		return
+	}
+
+	status := "open"
+	if userID == 0 {
+		status = "pending_verification"
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		writeServerError(w, r, err, "Error starting transaction", "failed to create enquiry")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO enquiry_threads (business_id, customer_id, guest_name, guest_email, subject, status, customer_token, business_token, client_ip)
+		VALUES (?, NULLIF(?, 0), NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?, ?, ?)
+	`, req.BusinessID, userID, guestName, guestEmail, req.Subject, status, customerToken, businessToken, ip)
+	var msg EnquiryMessage
+	if err == nil {
+		id, _ := result.LastInsertId()
+		msg, _, err = insertEnquiryMessage(ctx, tx, int(id), "customer", userID, req.Message, "web")
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error creating enquiry", "failed to create enquiry")
+		return
+	}
+
+	storeEnquiryAttachments(ctx, &msg, userID, files)
+
+	thread, err := loadEnquiryThread(ctx, "WHERE t.id = ?", msg.ThreadID)
+	if err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+	thread.Messages = []EnquiryMessage{msg}
+	thread.viewAs("customer")
+
+	logEvent("enquiry_created", "Enquiry to "+businessName+" opened", EnquiryEvent{ThreadID: thread.ID, BusinessID: thread.BusinessID})
+
+	w.Header().Set("Content-Type", "application/json")
+	if userID == 0 {
+		sendMailAsync(guestEmail, "Confirm your message to "+businessName,
+			"You asked to contact "+businessName+" about \""+req.Subject+"\".\n\n"+
+				"Confirm your email address within 48 hours to send it:\n\n"+
+				publicURL("/enquiries/verify?token="+customerToken)+"\n\n"+
+				"Keep this email: the link also lets you read replies and continue the conversation.\n"+
+				"If you didn't ask to contact them, you can ignore it.\n")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"message": "check your email to confirm your enquiry"})
+		return
+	}
+
+	go notifyEnquiry(context.WithoutCancel(r.Context()), thread, msg)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(thread)
+}
+
+// Confirm a guest's email address from the emailed link and pass the
+// enquiry on to the business
+func verifyEnquiryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "token is required"})
+		return
+	}
+
+	thread, err := loadEnquiryThread(ctx, "WHERE t.customer_token = ? AND t.customer_id IS NULL", token)
+	if err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+
+	if thread.Status == "pending_verification" {
+		if time.Since(thread.CreatedAt) > enquiryVerifyWindow {
+			w.WriteHeader(http.StatusGone)
+			json.NewEncoder(w).Encode(map[string]string{"error": "this link has expired, please send your enquiry again"})
+			return
+		}
+		result, err := db.ExecContext(ctx, "UPDATE enquiry_threads SET status = 'open' WHERE id = ? AND status = 'pending_verification'", thread.ID)
+		if err != nil {
+			writeEnquiryError(w, r, err)
+			return
+		}
+		thread.Status = "open"
+
+		// Only the request that opened the thread notifies the business
+		if n, _ := result.RowsAffected(); n > 0 {
+			messages, err := loadEnquiryMessages(ctx, thread.ID)
+			if err != nil {
+				writeEnquiryError(w, r, err)
+				return
+			}
+			for _, msg := range messages {
+				go notifyEnquiry(context.WithoutCancel(r.Context()), thread, msg)
+			}
+		}
+	}
+
+	if thread.Messages, err = loadEnquiryMessages(ctx, thread.ID); err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+	thread.viewAs("customer")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(thread)
+}
+
+// Close or reopen a thread. Either side may do this.
+func updateEnquiryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req struct {
+		ID     int    `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if req.Status != "open" && req.Status != "closed" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "status must be open or closed"})
+		return
+	}
+
+	thread, err := loadEnquiryThread(ctx, "WHERE t.id = ?", req.ID)
+	if err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+	side, err := enquirySide(r, thread)
+	if err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+
+	if _, err = db.ExecContext(ctx, "UPDATE enquiry_threads SET status = ? WHERE id = ?", req.Status, thread.ID); err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+	thread.Status = req.Status
+	thread.viewAs(side)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(thread)
+}
+
+// Reply in a thread. JSON {thread_id, message} or a multipart form with
+// attachments. Guests pass the ?token= from their emailed link.
+func postEnquiryMessageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, files, err := parseEnquiryRequest(w, r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	thread, err := loadEnquiryThread(ctx, "WHERE t.id = ?", req.ThreadID)
+	if err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+	side, err := enquirySide(r, thread)
+	if err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+	senderID := optionalUserID(r)
+
+	msg, err := addEnquiryMessage(ctx, thread, side, senderID, req.Message, "web")
+	if err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+	storeEnquiryAttachments(ctx, &msg, senderID, files)
+
+	go notifyEnquiry(context.WithoutCancel(r.Context()), thread, msg)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(msg)
+}
+
+// addEnquiryMessage adds a message in its own transaction
+func addEnquiryMessage(ctx context.Context, t *EnquiryThread, side string, senderID int, body, via string) (EnquiryMessage, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return EnquiryMessage{}, err
+	}
+	defer tx.Rollback()
+
+	msg, _, err := insertEnquiryMessage(ctx, tx, t.ID, side, senderID, body, via)
+	if err != nil {
+		return msg, err
+	}
+	return msg, tx.Commit()
+}
+
+// Unread message counts across the caller's threads, for badges
+func getEnquiryUnreadCountHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var customer, business int
+	err := db.QueryRowContext(ctx, "SELECT IFNULL(SUM(customer_unread), 0) FROM enquiry_threads WHERE customer_id = ?", userID).Scan(&customer)
+	if err == nil {
+		scope, args := organizationScope("b.organization_id", userID, permManageEnquiries)
+		err = db.QueryRowContext(ctx, `
+			SELECT IFNULL(SUM(t.business_unread), 0)
+			FROM enquiry_threads t
+			INNER JOIN businesses b ON b.id = t.business_id
+			WHERE t.status != 'pending_verification' AND `+scope, args...).Scan(&business)
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error counting unread enquiries", "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"customer": customer, "business": business})
+}
+
+// Receive a reply sent to a relay address. The mail provider posts
+// {to, from, text} with the ENQUIRY_RELAY_SECRET in X-Relay-Secret. Mail that
+// can't be delivered is acknowledged and dropped so the provider doesn't
+// retry it.
+func inboundEnquiryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	secret := os.Getenv("ENQUIRY_RELAY_SECRET")
+	if secret == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Relay-Secret")), []byte(secret)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid relay secret"})
+		return
+	}
+
+	var req struct {
+		To   string `json:"to"`
+		From string `json:"from"`
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	ignore := func(reason string) {
+		slog.InfoContext(r.Context(), "Ignoring relayed enquiry mail", "to", req.To, "reason", reason)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "ignored"})
+	}
+
+	token := relayToken(req.To)
+	if token == "" {
+		ignore("not a relay address")
+		return
+	}
+	thread, err := loadEnquiryThread(ctx, "WHERE t.customer_token = ? OR t.business_token = ?", token, token)
+	if err == errEntityNotFound {
+		ignore("unknown thread")
+		return
+	}
+	if err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+	if thread.Status == "pending_verification" {
+		ignore("thread not confirmed")
+		return
+	}
+
+	from, err := mail.ParseAddress(req.From)
+	if err != nil {
+		ignore("invalid sender")
+		return
+	}
+
+	// The sender must be the person the relay address was given to
+	side, senderID := "customer", 0
+	if token == thread.businessToken {
+		side = "business"
+		members, err := listingMembers(ctx, "business", thread.BusinessID, permManageEnquiries)
+		if err != nil {
+			writeEnquiryError(w, r, err)
+			return
+		}
+		for _, m := range members {
+			if strings.EqualFold(m.Email, from.Address) {
+				senderID = m.UserID
+			}
+		}
+		if senderID == 0 {
+			ignore("sender does not manage the business")
+			return
+		}
+	} else {
+		if !strings.EqualFold(thread.customerEmail, from.Address) {
+			ignore("sender is not the customer")
+			return
+		}
+		senderID = thread.customerID
+	}
+
+	body := stripQuotedReply(req.Text)
+	if body == "" {
+		ignore("empty message")
+		return
+	}
+	if len(body) > maxEnquiryMessageLength {
+		body = body[:maxEnquiryMessageLength]
+	}
+
+	msg, err := addEnquiryMessage(ctx, thread, side, senderID, body, "email")
+	if err == errEnquiryClosed || err == errEnquiryThrottled {
+		ignore(err.Error())
+		return
+	}
+	if err != nil {
+		writeEnquiryError(w, r, err)
+		return
+	}
+
+	go notifyEnquiry(context.WithoutCancel(r.Context()), thread, msg)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "delivered"})
+}
+
+// relayToken extracts the thread token from a reply+<token>@ address
+func relayToken(address string) string {
+	addr, err := mail.ParseAddress(address)
+	if err != nil {
+		return ""
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	if at < 0 || !strings.HasPrefix(addr.Address, "reply+") {
+		return ""
+	}
+	return addr.Address[len("reply+"):at]
+}
+
+// stripQuotedReply drops the quoted original that mail clients append below
+// a reply
+func stripQuotedReply(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, ">") || (strings.HasPrefix(trimmed, "On ") && strings.HasSuffix(trimmed, "wrote:")) {
+			lines = lines[:i]
+			break
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// deleteEnquiryAttachments removes the attachment rows of a business's
+// enquiries inside tx and returns their storage paths. The threads and
+// messages themselves go with the business through ON DELETE CASCADE.
+func deleteEnquiryAttachments(ctx context.Context, tx *sql.Tx, businessID int) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT i.id, i.storage_path
+		FROM images i
+		INNER JOIN enquiry_messages m ON i.entity_type = 'enquiry_message' AND i.entity_id = m.id
+		INNER JOIN enquiry_threads t ON t.id = m.thread_id
+		WHERE t.business_id = ?
+	`, businessID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	var paths []string
+	for rows.Next() {
+		var id int
+		var storagePath sql.NullString
+		if err := rows.Scan(&id, &storagePath); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		if storagePath.Valid && storagePath.String != "" {
+			paths = append(paths, storagePath.String)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	placeholders, args := idPlaceholders(ids)
+	_, err = tx.ExecContext(ctx, "DELETE FROM images WHERE id IN ("+placeholders+")", args...)
+	return paths, err
+}
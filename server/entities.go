@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EntityType describes a kind of record that polymorphic rows such as images
+// can be attached to. Name is the value stored in images.entity_type and
+// Table is the table holding the entity rows, keyed by an integer id. Images
+// of private types are only reachable through their owning feature, never
+// through the public image endpoints.
+type EntityType struct {
+	Name    string `json:"name"`
+	Table   string `json:"table"`
+	Label   string `json:"label"`
+	Private bool   `json:"-"`
+}
+
+var (
+	entityTypes     = make(map[string]EntityType)
+	entityTypeNames []string
+
+	errUnknownEntityType = errors.New("unknown entity_type")
+	errEntityNotFound    = errors.New("entity not found")
+)
+
+func init() {
+	registerEntityType("business", "businesses", "Business")
+	registerEntityType("event", "events", "Event")
+	registerEntityType("user", "users", "User avatar")
+}
+
+// registerEntityType adds an entity type to the registry. It must be called
+// before InitDB so the type is synced to the entity_types table.
+func registerEntityType(name, table, label string) {
+	if _, exists := entityTypes[name]; !exists {
+		entityTypeNames = append(entityTypeNames, name)
+	}
+	entityTypes[name] = EntityType{Name: name, Table: table, Label: label}
+}
+
+// registerPrivateEntityType adds an entity type hidden from the public image
+// endpoints
+func registerPrivateEntityType(name, table, label string) {
+	registerEntityType(name, table, label)
+	et := entityTypes[name]
+	et.Private = true
+	entityTypes[name] = et
+}
+
+// syncEntityTypes stores the registry in the entity_types table and enforces
+// it on images.entity_type with a foreign key
+func syncEntityTypes(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS entity_types (
+			name VARCHAR(50) PRIMARY KEY,
+			table_name VARCHAR(64) NOT NULL,
+			label VARCHAR(100) NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range entityTypeNames {
+		et := entityTypes[name]
+		_, err = db.ExecContext(ctx, `
+			INSERT INTO entity_types (name, table_name, label) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE table_name = VALUES(table_name), label = VALUES(label)
+		`, et.Name, et.Table, et.Label)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Existing rows must satisfy the constraint before it can be added
+	if err = purgeOrphanImages(ctx); err != nil {
+		return err
+	}
+
+	return addConstraintIfMissing(ctx, "images", "fk_images_entity_type",
+		"FOREIGN KEY (entity_type) REFERENCES entity_types(name)")
+}
+
+// checkEntity verifies that entityType is registered and that a row with
+// entityID exists for it
+func checkEntity(ctx context.Context, entityType string, entityID int) error {
+	et, ok := entityTypes[entityType]
+	if !ok || et.Private {
+		return errUnknownEntityType
+	}
+
+	var exists int
+	err := db.QueryRowContext(ctx, "SELECT 1 FROM "+et.Table+" WHERE id = ?", entityID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return errEntityNotFound
+	}
+	return err
+}
+
+// writeEntityError writes the response for an error returned by checkEntity
+func writeEntityError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errUnknownEntityType:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown entity_type"})
+	case errEntityNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "entity not found"})
+	default:
+		writeServerError(w, r, err, "Error checking entity", "internal server error")
+	}
+}
+
+// deleteEntityImages removes the image rows attached to an entity inside tx and
+// returns the storage paths of their files. The caller deletes the files with
+// removeImageFiles once the transaction has committed.
+func deleteEntityImages(ctx context.Context, tx *sql.Tx, entityType string, entityID int) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT storage_path FROM images WHERE entity_type = ? AND entity_id = ?", entityType, entityID)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for rows.Next() {
+		var storagePath sql.NullString
+		if err := rows.Scan(&storagePath); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if storagePath.Valid && storagePath.String != "" {
+			paths = append(paths, storagePath.String)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM images WHERE entity_type = ? AND entity_id = ?", entityType, entityID)
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// removeImageFiles deletes uploaded image files, logging any failure
+func removeImageFiles(paths []string) {
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Could not delete file", "path", p, "error", err)
+		}
+	}
+}
+
+// movePrivateImages moves files of private entity types uploaded before they
+// were kept out of uploadDir, and clears their public URLs
+func movePrivateImages(ctx context.Context) error {
+	var private []interface{}
+	for _, name := range entityTypeNames {
+		if entityTypes[name].Private {
+			private = append(private, name)
+		}
+	}
+	if len(private) == 0 {
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, IFNULL(storage_path, '') FROM images WHERE image_url != '' AND entity_type IN (?"+
+		strings.Repeat(", ?", len(private)-1)+")", private...)
+	if err != nil {
+		return err
+	}
+	type move struct {
+		id   int
+		path string
+	}
+	var moves []move
+	for rows.Next() {
+		var m move
+		if err := rows.Scan(&m.id, &m.path); err != nil {
+			rows.Close()
+			return err
+		}
+		moves = append(moves, m)
+	}
+	rows.Close()
+
+	for _, m := range moves {
+		path := m.path
+		if path != "" {
+			path = filepath.Join(privateUploadDir, filepath.Base(m.path))
+			if err := os.Rename(m.path, path); err != nil && !os.IsNotExist(err) {
+				slog.Warn("Could not move private image", "path", m.path, "error", err)
+				continue
+			}
+			os.Chmod(path, 0600)
+		}
+		if _, err := db.ExecContext(ctx, "UPDATE images SET image_url = '', storage_path = NULLIF(?, '') WHERE id = ?", path, m.id); err != nil {
+			return err
+		}
+	}
+	if len(moves) > 0 {
+		slog.Info("Moved private images out of the upload directory", "count", len(moves))
+	}
+	return nil
+}
+
+// purgeOrphanImages deletes images whose entity no longer exists or whose
+// entity_type is not registered. Rows removed through ON DELETE CASCADE
+// (e.g. events of a deleted user) never pass through a handler, so this runs
+// at startup to clean up after them.
+func purgeOrphanImages(ctx context.Context) error {
+	var conditions []string
+	var args []interface{}
+	placeholders := make([]string, len(entityTypeNames))
+	for i, name := range entityTypeNames {
+		et := entityTypes[name]
+		conditions = append(conditions, "(i.entity_type = ? AND NOT EXISTS (SELECT 1 FROM "+et.Table+" t WHERE t.id = i.entity_id))")
+		args = append(args, name)
+		placeholders[i] = "?"
+	}
+	conditions = append(conditions, "i.entity_type NOT IN ("+strings.Join(placeholders, ", ")+")")
+	for _, name := range entityTypeNames {
+		args = append(args, name)
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT i.id, i.storage_path FROM images i WHERE "+strings.Join(conditions, " OR "), args...)
+	if err != nil {
+		return err
+	}
+
+	var ids []interface{}
+	var paths []string
+	for rows.Next() {
+		var id int
+		var storagePath sql.NullString
+		if err := rows.Scan(&id, &storagePath); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		if storagePath.Valid && storagePath.String != "" {
+			paths = append(paths, storagePath.String)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	_, err = db.ExecContext(ctx, "DELETE FROM images WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", ids...)
+	if err != nil {
+		return err
+	}
+	removeImageFiles(paths)
+
+	slog.Info("Removed orphaned images", "count", len(ids))
+	return nil
+}
+
+// entityTypesHandler lists the registered entity types
+func entityTypesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	types := make([]EntityType, 0, len(entityTypeNames))
+	for _, name := range entityTypeNames {
+		if et := entityTypes[name]; !et.Private {
+			types = append(types, et)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types)
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Organiser stats follow each event from detail-page view to confirmed
+// booking. Views come from the event_views rollups; bookings are counted in
+// the bucket in which they were created, confirmed or cancelled. Tickets and
+// revenue are counted on confirmation, at the event's current price.
+
+// EventFunnel holds the booking funnel for an event or a bucket
+type EventFunnel struct {
+	Views             int     `json:"views"`
+	UniqueVisitors    int     `json:"unique_visitors"`
+	BookingsCreated   int     `json:"bookings_created"`
+	BookingsConfirmed int     `json:"bookings_confirmed"`
+	BookingsCancelled int     `json:"bookings_cancelled"`
+	TicketsSold       int     `json:"tickets_sold"`
+	Revenue           float64 `json:"revenue"`
+	ConversionRate    float64 `json:"conversion_rate"`
+}
+
+// EventStatsPoint is the funnel for one hourly or daily bucket
+type EventStatsPoint struct {
+	Start time.Time `json:"start"`
+	EventFunnel
+}
+
+// EventStats is the funnel of one event over the requested range
+type EventStats struct {
+	EventID   int       `json:"event_id"`
+	Title     string    `json:"title"`
+	EventDate time.Time `json:"event_date"`
+	Price     float64   `json:"price"`
+	EventFunnel
+	Points []EventStatsPoint `json:"points"`
+}
+
+// add counts another funnel in, leaving the conversion rate to finish
+func (f *EventFunnel) add(o EventFunnel) {
+	f.Views += o.Views
+	f.UniqueVisitors += o.UniqueVisitors
+	f.BookingsCreated += o.BookingsCreated
+	f.BookingsConfirmed += o.BookingsConfirmed
+	f.BookingsCancelled += o.BookingsCancelled
+	f.TicketsSold += o.TicketsSold
+	f.Revenue += o.Revenue
+}
+
+// finish sets the conversion rate from views to bookings
+func (f *EventFunnel) finish() {
+	f.ConversionRate = 0
+	if f.Views > 0 {
+		f.ConversionRate = float64(f.BookingsCreated) / float64(f.Views)
+	}
+}
+
+// migrateEventStats adds the status change times to bookings. Bookings
+// confirmed or cancelled before then fall back to their creation time.
+func migrateEventStats(ctx context.Context) error {
+	if err := addColumnIfMissing(ctx, "bookings", "confirmed_at", "TIMESTAMP NULL"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(ctx, "bookings", "cancelled_at", "TIMESTAMP NULL")
+}
+
+// eventStats builds the funnel for the events in the organisation scope,
+// optionally narrowed to one event
+func eventStats(ctx context.Context, scope string, scopeArgs []interface{}, eventID int, from, to time.Time, interval string) ([]EventStats, error) {
+	query := "SELECT id, title, event_date, price FROM events WHERE " + scope
+	args := append([]interface{}{}, scopeArgs...)
+	if eventID > 0 {
+		query += " AND id = ?"
+		args = append(args, eventID)
+	}
+	rows, err := db.QueryContext(ctx, query+" ORDER BY event_date DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	stats := []EventStats{}
+	index := make(map[int]int)
+	var ids []int
+	for rows.Next() {
+		var e EventStats
+		if err := rows.Scan(&e.EventID, &e.Title, &e.EventDate, &e.Price); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[e.EventID] = len(stats)
+		stats = append(stats, e)
+		ids = append(ids, e.EventID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	views, err := loadViewSeries(ctx, eventViews, ids, from, to, interval)
+	if err != nil {
+		return nil, err
+	}
+	for i := range stats {
+		v := views[stats[i].EventID]
+		stats[i].Views, stats[i].UniqueVisitors = v.Views, v.UniqueVisitors
+		stats[i].Points = make([]EventStatsPoint, len(v.Points))
+		for j, p := range v.Points {
+			stats[i].Points[j].Start = p.Start
+			stats[i].Points[j].Views = p.Views
+			stats[i].Points[j].UniqueVisitors = p.UniqueVisitors
+		}
+	}
+	if len(ids) == 0 {
+		return stats, nil
+	}
+
+	step := statsStep(interval)
+	bucket := func(t time.Time) int {
+		t = t.UTC()
+		if t.Before(from) || !t.Before(to) {
+			return -1
+		}
+		return int(t.Sub(from) / step)
+	}
+
+	placeholders, idArgs := idPlaceholders(ids)
+	args = append([]interface{}{to, from}, idArgs...)
+	rows, err = db.QueryContext(ctx, `
+		SELECT event_id, status, tickets, created_at,
+			COALESCE(confirmed_at, created_at), COALESCE(cancelled_at, created_at)
+		FROM bookings
+		WHERE created_at < ?
+			AND GREATEST(created_at, COALESCE(confirmed_at, created_at), COALESCE(cancelled_at, created_at)) >= ?
+			AND event_id IN (`+placeholders+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, tickets int
+		var status string
+		var createdAt, confirmedAt, cancelledAt time.Time
+		if err := rows.Scan(&id, &status, &tickets, &createdAt, &confirmedAt, &cancelledAt); err != nil {
+			return nil, err
+		}
+		e := &stats[index[id]]
+		if j := bucket(createdAt); j >= 0 {
+			e.Points[j].BookingsCreated++
+		}
+		switch status {
+		case "confirmed":
+			if j := bucket(confirmedAt); j >= 0 {
+				e.Points[j].BookingsConfirmed++
+				e.Points[j].TicketsSold += tickets
+				e.Points[j].Revenue += e.Price * float64(tickets)
+			}
+		case "cancelled":
+			if j := bucket(cancelledAt); j >= 0 {
+				e.Points[j].BookingsCancelled++
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range stats {
+		e := &stats[i]
+		for j := range e.Points {
+			p := &e.Points[j]
+			e.BookingsCreated += p.BookingsCreated
+			e.BookingsConfirmed += p.BookingsConfirmed
+			e.BookingsCancelled += p.BookingsCancelled
+			e.TicketsSold += p.TicketsSold
+			e.Revenue += p.Revenue
+			p.finish()
+		}
+		e.finish()
+	}
+	return stats, nil
+}
+
+func getMyEventStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.Header.Get("X-User-ID")
+	ownerID, err := strconv.Atoi(userID)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid user ID"})
+		return
+	}
+
+	from, to, interval, err := statsRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	eventID := 0
+	if v := r.URL.Query().Get("event_id"); v != "" {
+		eventID, err = strconv.Atoi(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid event ID"})
+			return
+		}
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "format must be json or csv"})
+		return
+	}
+
+	// Stats cover the events of every organisation whose bookings the user may see
+	scope, scopeArgs := organizationScope("organization_id", ownerID, permViewBookings)
+	stats, err := eventStats(r.Context(), scope, scopeArgs, eventID, from, to, interval)
+	if err != nil {
+		writeServerError(w, r, err, "Error building event stats", "internal server error")
+		return
+	}
+	if eventID > 0 && len(stats) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "event not found"})
+		return
+	}
+
+	if format == "csv" {
+		writeEventStatsCSV(w, r, stats, from, to)
+		return
+	}
+
+	// Visitors of several events are counted once per event
+	var totals EventFunnel
+	for _, e := range stats {
+		totals.add(e.EventFunnel)
+	}
+	totals.finish()
+
+	resp := map[string]interface{}{
+		"from":     from,
+		"to":       to,
+		"interval": interval,
+		"totals":   totals,
+		"events":   stats,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeEventStatsCSV writes one row per event and bucket
+func writeEventStatsCSV(w http.ResponseWriter, r *http.Request, stats []EventStats, from, to time.Time) {
+	filename := fmt.Sprintf("event-stats-%s-%s.csv", from.Format("20060102"), to.Format("20060102"))
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"event_id", "title", "bucket_start", "views", "unique_visitors", "bookings_created",
+		"bookings_confirmed", "bookings_cancelled", "tickets_sold", "revenue", "conversion_rate"})
+	for _, e := range stats {
+		for _, p := range e.Points {
+			cw.Write([]string{
+				strconv.Itoa(e.EventID),
+				csvText(e.Title),
+				p.Start.Format(time.RFC3339),
+				strconv.Itoa(p.Views),
+				strconv.Itoa(p.UniqueVisitors),
+				strconv.Itoa(p.BookingsCreated),
+				strconv.Itoa(p.BookingsConfirmed),
+				strconv.Itoa(p.BookingsCancelled),
+				strconv.Itoa(p.TicketsSold),
+				strconv.FormatFloat(p.Revenue, 'f', 2, 64),
+				strconv.FormatFloat(p.ConversionRate, 'f', 4, 64),
+			})
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		slog.ErrorContext(r.Context(), "Error writing event stats CSV", "error", err)
+	}
+}
+
+// csvText stops spreadsheets from reading user-entered text as a formula
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
@@ -0,0 +1,797 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Users favourite businesses and events and collect them in named saved
+// lists. Lists are private unless shared, in which case anyone with the
+// list's share link can read it.
+
+// SavedList is a named collection of businesses and events
+type SavedList struct {
+	ID          int             `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Visibility  string          `json:"visibility"`
+	ShareURL    string          `json:"share_url,omitempty"`
+	ItemCount   int             `json:"item_count"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	Items       []SavedListItem `json:"items,omitempty"`
+}
+
+// SavedListItem is a business or event in a list or the favourites
+type SavedListItem struct {
+	EntityType string         `json:"entity_type"`
+	EntityID   int            `json:"entity_id"`
+	Note       string         `json:"note,omitempty"`
+	AddedAt    time.Time      `json:"added_at"`
+	Business   *Business      `json:"business,omitempty"`
+	Event      *BusinessEvent `json:"event,omitempty"`
+}
+
+// favouriteTarget checks that entity_type is one users can save
+func favouriteTarget(ctx context.Context, entityType string, entityID int) error {
+	if entityType != "business" && entityType != "event" {
+		return errUnknownEntityType
+	}
+	return checkEntity(ctx, entityType, entityID)
+}
+
+// optionalUserID returns the caller's user ID on public endpoints, or 0 for
+// anonymous or invalid credentials
+func optionalUserID(r *http.Request) int {
+	if r.Header.Get("Authorization") == "" {
+		return 0
+	}
+	claims, err := authenticateToken(r)
+	if err != nil {
+		return 0
+	}
+	id, _ := claims["user_id"].(float64)
+	return int(id)
+}
+
+// idPlaceholders returns "?, ?, ?" and the matching args for an IN clause
+func idPlaceholders(ids []int) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return "?" + strings.Repeat(", ?", len(ids)-1), args
+}
+
+// favouriteStats loads favourite counts for many entities in one query, and
+// which of them userID has favourited in another
+func favouriteStats(ctx context.Context, entityType string, ids []int, userID int) (map[int]int, map[int]bool, error) {
+	counts := make(map[int]int)
+	mine := make(map[int]bool)
+	if len(ids) == 0 {
+		return counts, mine, nil
+	}
+	in, args := idPlaceholders(ids)
+
+	rows, err := db.QueryContext(ctx, "SELECT entity_id, COUNT(*) FROM favourites WHERE entity_type = ? AND entity_id IN ("+in+") GROUP BY entity_id",
+		append([]interface{}{entityType}, args...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var id, n int
+		if err := rows.Scan(&id, &n); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		counts[id] = n
+	}
+	rows.Close()
+
+	if userID == 0 {
+		return counts, mine, nil
+	}
+	rows, err = db.QueryContext(ctx, "SELECT entity_id FROM favourites WHERE user_id = ? AND entity_type = ? AND entity_id IN ("+in+")",
+		append([]interface{}{userID, entityType}, args...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, nil, err
+		}
+		mine[id] = true
+	}
+	return counts, mine, rows.Err()
+}
+
+// applyBusinessFavourites fills in favourite_count, and is_favourited when
+// the request is authenticated
+func applyBusinessFavourites(r *http.Request, businesses []Business) error {
+	ids := make([]int, len(businesses))
+	for i := range businesses {
+		ids[i] = businesses[i].ID
+	}
+	userID := optionalUserID(r)
+	counts, mine, err := favouriteStats(r.Context(), "business", ids, userID)
+	if err != nil {
+		return err
+	}
+	for i := range businesses {
+		businesses[i].FavouriteCount = counts[businesses[i].ID]
+		if userID != 0 {
+			favourited := mine[businesses[i].ID]
+			businesses[i].IsFavourited = &favourited
+		}
+	}
+	return nil
+}
+
+// applyEventFavourites is applyBusinessFavourites for events
+func applyEventFavourites(r *http.Request, events []BusinessEvent) error {
+	ids := make([]int, len(events))
+	for i := range events {
+		ids[i] = events[i].ID
+	}
+	userID := optionalUserID(r)
+	counts, mine, err := favouriteStats(r.Context(), "event", ids, userID)
+	if err != nil {
+		return err
+	}
+	for i := range events {
+		events[i].FavouriteCount = counts[events[i].ID]
+		if userID != 0 {
+			favourited := mine[events[i].ID]
+			events[i].IsFavourited = &favourited
+		}
+	}
+	return nil
+}
+
+// deleteEntityFavourites removes favourites and list items pointing at a
+// business or event that is being deleted
+func deleteEntityFavourites(ctx context.Context, tx *sql.Tx, entityType string, entityID int) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM favourites WHERE entity_type = ? AND entity_id = ?", entityType, entityID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "DELETE FROM saved_list_items WHERE entity_type = ? AND entity_id = ?", entityType, entityID)
+	return err
+}
+
+// expandItems loads the businesses and events referenced by items with one
+// query per entity type
+func expandItems(r *http.Request, items []SavedListItem) error {
+	ctx := r.Context()
+
+	var businessIDs, eventIDs []int
+	for _, item := range items {
+		if item.EntityType == "business" {
+			businessIDs = append(businessIDs, item.EntityID)
+		} else {
+			eventIDs = append(eventIDs, item.EntityID)
+		}
+	}
+
+	businesses := make(map[int]*Business)
+	if len(businessIDs) > 0 {
+		in, args := idPlaceholders(businessIDs)
+		rows, err := db.QueryContext(ctx, `
+			SELECT id, name, category, description, phone, email, address,
+			  (SELECT image_url FROM images WHERE entity_type = 'business' AND entity_id = businesses.id ORDER BY is_primary DESC, display_order ASC, created_at ASC LIMIT 1) as image_url,
+			  rating, created_at, IFNULL(owner_id, 0), organization_id, verified, category_id, latitude, longitude
+			FROM businesses
+			WHERE id IN (`+in+`)
+		`, args...)
+		if err != nil {
+			return err
+		}
+		var list []Business
+		for rows.Next() {
+			var b Business
+			var imageURL sql.NullString
+			if err := rows.Scan(&b.ID, &b.Name, &b.Category, &b.Description, &b.Phone, &b.Email, &b.Address, &imageURL, &b.Rating, &b.CreatedAt, &b.OwnerID, &b.OrganizationID, &b.Verified, &b.CategoryID, &b.Latitude, &b.Longitude); err != nil {
+				rows.Close()
+				return err
+			}
+			b.ImageURL = imageURL.String
+			list = append(list, b)
+		}
+		rows.Close()
+		if err := applyBusinessFavourites(r, list); err != nil {
+			return err
+		}
+		for i := range list {
+			businesses[list[i].ID] = &list[i]
+		}
+	}
+
+	events := make(map[int]*BusinessEvent)
+	if len(eventIDs) > 0 {
+		in, args := idPlaceholders(eventIDs)
+		rows, err := db.QueryContext(ctx, `
+			SELECT id, owner_id, organization_id, business_id, title, description, event_date, location, price, category,
+			  (SELECT image_url FROM images WHERE entity_type = 'event' AND entity_id = events.id ORDER BY is_primary DESC, display_order ASC, created_at ASC LIMIT 1) as image_url,
+			  created_at, category_id, latitude, longitude
+			FROM events
+			WHERE id IN (`+in+`)
+		`, args...)
+		if err != nil {
+			return err
+		}
+		var list []BusinessEvent
+		for rows.Next() {
+			var e BusinessEvent
+			var category, imageURL sql.NullString
+			if err := rows.Scan(&e.ID, &e.OwnerID, &e.OrganizationID, &e.BusinessID, &e.Title, &e.Description, &e.EventDate, &e.Location, &e.Price, &category, &imageURL, &e.CreatedAt, &e.CategoryID, &e.Latitude, &e.Longitude); err != nil {
+				rows.Close()
+				return err
+			}
+			e.Category = category.String
+			e.ImageURL = imageURL.String
+			list = append(list, e)
+		}
+		rows.Close()
+		if err := applyEventFavourites(r, list); err != nil {
+			return err
+		}
+		for i := range list {
+			events[list[i].ID] = &list[i]
+		}
+	}
+
+	for i := range items {
+		if items[i].EntityType == "business" {
+			items[i].Business = businesses[items[i].EntityID]
+		} else {
+			items[i].Event = events[items[i].EntityID]
+		}
+	}
+	return nil
+}
+
+func favouritesRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		authMiddleware(getFavouritesHandler)(w, r)
+	case http.MethodPost:
+		authMiddleware(addFavouriteHandler)(w, r)
+	case http.MethodDelete:
+		authMiddleware(removeFavouriteHandler)(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Get the current user's favourites, newest first
+func getFavouritesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	query := "SELECT entity_type, entity_id, created_at FROM favourites WHERE user_id = ?"
+	args := []interface{}{userID}
+	if entityType := r.URL.Query().Get("entity_type"); entityType != "" {
+		query += " AND entity_type = ?"
+		args = append(args, entityType)
+	}
+	rows, err := db.QueryContext(r.Context(), query+" ORDER BY created_at DESC", args...)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying favourites", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	items := []SavedListItem{}
+	for rows.Next() {
+		var item SavedListItem
+		if err := rows.Scan(&item.EntityType, &item.EntityID, &item.AddedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning favourite", "error", err)
+			continue
+		}
+		items = append(items, item)
+	}
+	rows.Close()
+
+	if err := expandItems(r, items); err != nil {
+		writeServerError(w, r, err, "Error loading favourites", "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// Favourite a business or event. Favouriting twice is not an error.
+func addFavouriteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		EntityType string `json:"entity_type"`
+		EntityID   int    `json:"entity_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if err := favouriteTarget(ctx, req.EntityType, req.EntityID); err != nil {
+		writeEntityError(w, r, err)
+		return
+	}
+
+	result, err := db.ExecContext(ctx, "INSERT IGNORE INTO favourites (user_id, entity_type, entity_id) VALUES (?, ?, ?)",
+		userID, req.EntityType, req.EntityID)
+	if err != nil {
+		writeServerError(w, r, err, "Error adding favourite", "failed to add favourite")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if n, _ := result.RowsAffected(); n > 0 {
+		logEvent("favourite_added", "Added "+req.EntityType+" to favourites", req)
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "added to favourites"})
+}
+
+// Remove a business or event from the favourites
+func removeFavouriteHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		EntityType string `json:"entity_type"`
+		EntityID   int    `json:"entity_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	_, err := db.ExecContext(r.Context(), "DELETE FROM favourites WHERE user_id = ? AND entity_type = ? AND entity_id = ?",
+		userID, req.EntityType, req.EntityID)
+	if err != nil {
+		writeServerError(w, r, err, "Error removing favourite", "failed to remove favourite")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "removed from favourites"})
+}
+
+func savedListsRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		authMiddleware(getSavedListsHandler)(w, r)
+	case http.MethodPost:
+		authMiddleware(createSavedListHandler)(w, r)
+	case http.MethodPut:
+		authMiddleware(updateSavedListHandler)(w, r)
+	case http.MethodDelete:
+		authMiddleware(deleteSavedListHandler)(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// listShareURL is the public link to a shared list
+func listShareURL(token sql.NullString) string {
+	if !token.Valid {
+		return ""
+	}
+	return publicURL("/lists/shared?token=" + token.String)
+}
+
+// loadSavedList fetches one list with its items; where selects the list
+func loadSavedList(r *http.Request, where string, arg ...interface{}) (*SavedList, error) {
+	ctx := r.Context()
+
+	var l SavedList
+	var description, shareToken sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT id, name, description, visibility, share_token, created_at, updated_at
+		FROM saved_lists WHERE `+where, arg...).
+		Scan(&l.ID, &l.Name, &description, &l.Visibility, &shareToken, &l.CreatedAt, &l.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	l.Description = description.String
+	l.ShareURL = listShareURL(shareToken)
+
+	rows, err := db.QueryContext(ctx, "SELECT entity_type, entity_id, note, added_at FROM saved_list_items WHERE list_id = ? ORDER BY added_at ASC", l.ID)
+	if err != nil {
+		return nil, err
+	}
+	l.Items = []SavedListItem{}
+	for rows.Next() {
+		var item SavedListItem
+		var note sql.NullString
+		if err := rows.Scan(&item.EntityType, &item.EntityID, &note, &item.AddedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		item.Note = note.String
+		l.Items = append(l.Items, item)
+	}
+	rows.Close()
+	l.ItemCount = len(l.Items)
+
+	if err := expandItems(r, l.Items); err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// Get the current user's lists, or one list with its items when ?id= is set
+func getSavedListsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	if idStr := r.URL.Query().Get("id"); idStr != "" {
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid list ID"})
+			return
+		}
+		list, err := loadSavedList(r, "id = ? AND user_id = ?", id, userID)
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "list not found"})
+			return
+		}
+		if err != nil {
+			writeServerError(w, r, err, "Error loading list", "internal server error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT l.id, l.name, l.description, l.visibility, l.share_token, l.created_at, l.updated_at,
+		  (SELECT COUNT(*) FROM saved_list_items i WHERE i.list_id = l.id) AS item_count
+		FROM saved_lists l
+		WHERE l.user_id = ?
+		ORDER BY l.updated_at DESC
+	`, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying lists", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	lists := []SavedList{}
+	for rows.Next() {
+		var l SavedList
+		var description, shareToken sql.NullString
+		if err := rows.Scan(&l.ID, &l.Name, &description, &l.Visibility, &shareToken, &l.CreatedAt, &l.UpdatedAt, &l.ItemCount); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning list", "error", err)
+			continue
+		}
+		l.Description = description.String
+		l.ShareURL = listShareURL(shareToken)
+		lists = append(lists, l)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lists)
+}
+
+// newShareToken returns a share token for a list, or nil for private lists
+func newShareToken(visibility string) (*string, error) {
+	if visibility != "shared" {
+		return nil, nil
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Create a list. Shared lists get a share link straight away.
+func createSavedListHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Visibility  string `json:"visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if req.Visibility == "" {
+		req.Visibility = "private"
+	}
+	if strings.TrimSpace(req.Name) == "" || (req.Visibility != "private" && req.Visibility != "shared") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "name is required and visibility must be private or shared"})
+		return
+	}
+
+	token, err := newShareToken(req.Visibility)
+	if err == nil {
+		var result sql.Result
+		result, err = db.ExecContext(r.Context(), "INSERT INTO saved_lists (user_id, name, description, visibility, share_token) VALUES (?, ?, NULLIF(?, ''), ?, ?)",
+			userID, strings.TrimSpace(req.Name), req.Description, req.Visibility, token)
+		if err == nil {
+			id, _ := result.LastInsertId()
+			var list *SavedList
+			list, err = loadSavedList(r, "id = ?", id)
+			if err == nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				json.NewEncoder(w).Encode(list)
+				return
+			}
+		}
+	}
+	writeServerError(w, r, err, "Error creating list", "failed to create list")
+}
+
+// Update a list. Switching to private revokes the share link and
+// regenerate_link issues a new one for a shared list.
+func updateSavedListHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		ID             int     `json:"id"`
+		Name           string  `json:"name"`
+		Description    *string `json:"description"`
+		Visibility     string  `json:"visibility"`
+		RegenerateLink bool    `json:"regenerate_link"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if req.Visibility != "" && req.Visibility != "private" && req.Visibility != "shared" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "visibility must be private or shared"})
+		return
+	}
+
+	var visibility string
+	var shareToken sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT visibility, share_token FROM saved_lists WHERE id = ? AND user_id = ?", req.ID, userID).
+		Scan(&visibility, &shareToken)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "list not found"})
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching list", "internal server error")
+		return
+	}
+
+	setParts := []string{}
+	args := []interface{}{}
+	if strings.TrimSpace(req.Name) != "" {
+		setParts = append(setParts, "name = ?")
+		args = append(args, strings.TrimSpace(req.Name))
+	}
+	if req.Description != nil {
+		setParts = append(setParts, "description = NULLIF(?, '')")
+		args = append(args, *req.Description)
+	}
+	if req.Visibility != "" {
+		visibility = req.Visibility
+		setParts = append(setParts, "visibility = ?")
+		args = append(args, visibility)
+	}
+	if visibility == "private" && shareToken.Valid {
+		setParts = append(setParts, "share_token = NULL")
+	} else if visibility == "shared" && (!shareToken.Valid || req.RegenerateLink) {
+		token, err := newShareToken(visibility)
+		if err != nil {
+			writeServerError(w, r, err, "Error generating share token", "internal server error")
+			return
+		}
+		setParts = append(setParts, "share_token = ?")
+		args = append(args, *token)
+	}
+
+	if len(setParts) > 0 {
+		args = append(args, req.ID)
+		if _, err := db.ExecContext(ctx, "UPDATE saved_lists SET "+strings.Join(setParts, ", ")+" WHERE id = ?", args...); err != nil {
+			writeServerError(w, r, err, "Error updating list", "failed to update list")
+			return
+		}
+	}
+
+	list, err := loadSavedList(r, "id = ?", req.ID)
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching updated list", "failed to fetch updated list")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Delete a list and its items
+func deleteSavedListHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM saved_lists WHERE id = ? AND user_id = ?", req.ID, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error deleting list", "failed to delete list")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "list not found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "list deleted successfully"})
+}
+
+func savedListItemsRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		authMiddleware(addSavedListItemHandler)(w, r)
+	case http.MethodDelete:
+		authMiddleware(removeSavedListItemHandler)(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// ownsSavedList reports whether the list exists and belongs to the user
+func ownsSavedList(ctx context.Context, listID, userID int) (bool, error) {
+	var owner int
+	err := db.QueryRowContext(ctx, "SELECT user_id FROM saved_lists WHERE id = ?", listID).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil && owner == userID, err
+}
+
+// Add a business or event to a list, or update its note if already there
+func addSavedListItemHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		ListID     int    `json:"list_id"`
+		EntityType string `json:"entity_type"`
+		EntityID   int    `json:"entity_id"`
+		Note       string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	owns, err := ownsSavedList(ctx, req.ListID, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error checking list owner", "internal server error")
+		return
+	}
+	if !owns {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "list not found"})
+		return
+	}
+	if err := favouriteTarget(ctx, req.EntityType, req.EntityID); err != nil {
+		writeEntityError(w, r, err)
+		return
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO saved_list_items (list_id, entity_type, entity_id, note) VALUES (?, ?, ?, NULLIF(?, ''))
+		ON DUPLICATE KEY UPDATE note = VALUES(note)
+	`, req.ListID, req.EntityType, req.EntityID, req.Note)
+	if err == nil {
+		_, err = db.ExecContext(ctx, "UPDATE saved_lists SET updated_at = NOW() WHERE id = ?", req.ListID)
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error adding list item", "failed to add to list")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": "added to list"})
+}
+
+// Remove a business or event from a list
+func removeSavedListItemHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		ListID     int    `json:"list_id"`
+		EntityType string `json:"entity_type"`
+		EntityID   int    `json:"entity_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	owns, err := ownsSavedList(ctx, req.ListID, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error checking list owner", "internal server error")
+		return
+	}
+	if !owns {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "list not found"})
+		return
+	}
+
+	_, err = db.ExecContext(ctx, "DELETE FROM saved_list_items WHERE list_id = ? AND entity_type = ? AND entity_id = ?",
+		req.ListID, req.EntityType, req.EntityID)
+	if err == nil {
+		_, err = db.ExecContext(ctx, "UPDATE saved_lists SET updated_at = NOW() WHERE id = ?", req.ListID)
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error removing list item", "failed to remove from list")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "removed from list"})
+}
+
+// Get a shared list by its share token (public)
+func getSharedListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "token is required"})
+		return
+	}
+
+	list, err := loadSavedList(r, "share_token = ? AND visibility = 'shared'", token)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "list not found"})
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error loading shared list", "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Users follow businesses and organisers (organisations). Activity from
+// followed accounts is fanned out into per-user feed rows when the matching
+// logEvent call fires, so reading a feed is a single indexed query.
+
+const (
+	feedQueueSize   = 1000
+	feedRetention   = 90 * 24 * time.Hour
+	feedPageSize    = 20
+	maxFeedPageSize = 100
+)
+
+// Logged events that appear in followers' feeds
+var feedActivities = map[string]bool{
+	"business_created": true,
+	"business_updated": true,
+	"event_created":    true,
+	"image_uploaded":   true,
+}
+
+var feedQueue = make(chan SystemEvent, feedQueueSize)
+
+// Follow is a business or organisation the user follows
+type Follow struct {
+	TargetType string    `json:"target_type"`
+	TargetID   int       `json:"target_id"`
+	Name       string    `json:"name"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// FeedItem is one activity in a user's feed. Data is a snapshot of the
+// business, event or image at the time of the activity.
+type FeedItem struct {
+	ID             int64           `json:"id"`
+	Activity       string          `json:"activity"`
+	Message        string          `json:"message"`
+	EntityType     string          `json:"entity_type"`
+	EntityID       int             `json:"entity_id"`
+	BusinessID     *int            `json:"business_id,omitempty"`
+	OrganizationID *int            `json:"organization_id,omitempty"`
+	Data           json.RawMessage `json:"data,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// startFeedWorker subscribes to logged events and fans feed activities out
+// in the background, and prunes old feed items
+func startFeedWorker(ctx context.Context) {
+	onEvent(func(e SystemEvent) {
+		if !feedActivities[e.Type] {
+			return
+		}
+		select {
+		case feedQueue <- e:
+		default:
+			slog.Info("Feed queue full, dropping activity", "activity", e.Type)
+		}
+	})
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-feedQueue:
+				if err := fanOut(ctx, e); err != nil {
+					slog.Error("Error fanning out activity", "activity", e.Type, "error", err)
+				}
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if _, err := db.ExecContext(ctx, "DELETE FROM feed_items WHERE created_at < ?", time.Now().Add(-feedRetention)); err != nil {
+				slog.Error("Error pruning feed items", "error", err)
+			}
+		}
+	}()
+}
+
+// fanOut writes one feed item for every follower of the business or
+// organisation behind an activity
+func fanOut(ctx context.Context, e SystemEvent) error {
+	var entityType string
+	var entityID int
+	var businessID, orgID *int
+
+	switch data := e.Data.(type) {
+	case Business:
+		entityType, entityID = "business", data.ID
+		businessID, orgID = &data.ID, data.OrganizationID
+	case BusinessEvent:
+		entityType, entityID = "event", data.ID
+		businessID, orgID = data.BusinessID, data.OrganizationID
+	case Image:
+		entityType, entityID = "image", data.ID
+		var err error
+		switch data.EntityType {
+		case "business":
+			businessID = &data.EntityID
+			err = db.QueryRowContext(ctx, "SELECT organization_id FROM businesses WHERE id = ?", data.EntityID).Scan(&orgID)
+		case "event":
+			err = db.QueryRowContext(ctx, "SELECT business_id, organization_id FROM events WHERE id = ?", data.EntityID).Scan(&businessID, &orgID)
+		default:
+			return nil
+		}
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	if businessID == nil && orgID == nil {
+		return nil
+	}
+
+	snapshot, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO feed_items (user_id, activity, message, entity_type, entity_id, business_id, organization_id, data, created_at)
+		SELECT DISTINCT user_id, ?, ?, ?, ?, ?, ?, ?, ?
+		FROM follows
+		WHERE (target_type = 'business' AND target_id = ?) OR (target_type = 'organization' AND target_id = ?)
+	`, e.Type, e.Message, entityType, entityID, businessID, orgID, snapshot, e.Timestamp, businessID, orgID)
+	return err
+}
+
+func followsRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		authMiddleware(getFollowsHandler)(w, r)
+	case http.MethodPost:
+		authMiddleware(followHandler)(w, r)
+	case http.MethodDelete:
+		authMiddleware(unfollowHandler)(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Get the businesses and organisers the current user follows
+func getFollowsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT f.target_type, f.target_id, COALESCE(b.name, o.name, ''), f.created_at
+		FROM follows f
+		LEFT JOIN businesses b ON f.target_type = 'business' AND b.id = f.target_id
+		LEFT JOIN organizations o ON f.target_type = 'organization' AND o.id = f.target_id
+		WHERE f.user_id = ?
+		ORDER BY f.created_at DESC
+	`, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying follows", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	follows := []Follow{}
+	for rows.Next() {
+		var f Follow
+		if err := rows.Scan(&f.TargetType, &f.TargetID, &f.Name, &f.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning follow", "error", err)
+			continue
+		}
+		follows = append(follows, f)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(follows)
+}
+
+// followTarget checks that a business or organisation exists
+func followTarget(ctx context.Context, targetType string, targetID int) error {
+	var query string
+	switch targetType {
+	case "business":
+		query = "SELECT id FROM businesses WHERE id = ?"
+	case "organization":
+		query = "SELECT id FROM organizations WHERE id = ?"
+	default:
+		return errUnknownEntityType
+	}
+	var id int
+	err := db.QueryRowContext(ctx, query, targetID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errEntityNotFound
+	}
+	return err
+}
+
+// Follow a business or organiser. Following twice is not an error.
+func followHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		TargetType string `json:"target_type"`
+		TargetID   int    `json:"target_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if err := followTarget(ctx, req.TargetType, req.TargetID); err != nil {
+		if err == errUnknownEntityType {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "target_type must be business or organization"})
+			return
+		}
+		writeEntityError(w, r, err)
+		return
+	}
+
+	result, err := db.ExecContext(ctx, "INSERT IGNORE INTO follows (user_id, target_type, target_id) VALUES (?, ?, ?)",
+		userID, req.TargetType, req.TargetID)
+	if err != nil {
+		writeServerError(w, r, err, "Error following", "failed to follow")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if n, _ := result.RowsAffected(); n > 0 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"message": "following"})
+}
+
+// Stop following a business or organiser
+func unfollowHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		TargetType string `json:"target_type"`
+		TargetID   int    `json:"target_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	_, err := db.ExecContext(r.Context(), "DELETE FROM follows WHERE user_id = ? AND target_type = ? AND target_id = ?",
+		userID, req.TargetType, req.TargetID)
+	if err != nil {
+		writeServerError(w, r, err, "Error unfollowing", "failed to unfollow")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "unfollowed"})
+}
+
+// Get the current user's feed, newest first. Pages are keyed by item ID:
+// pass the returned next_before as ?before= to get the next page.
+func getFeedHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	limit := feedPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxFeedPageSize {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "limit must be between 1 and 100"})
+			return
+		}
+		limit = n
+	}
+
+	query := `
+		SELECT id, activity, message, entity_type, entity_id, business_id, organization_id, data, created_at
+		FROM feed_items
+		WHERE user_id = ?`
+	args := []interface{}{userID}
+	if v := r.URL.Query().Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid before cursor"})
+			return
+		}
+		query += " AND id < ?"
+		args = append(args, before)
+	}
+	// Fetch one extra row to know whether there is another page
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying feed", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	items := []FeedItem{}
+	for rows.Next() {
+		var item FeedItem
+		var data []byte
+		if err := rows.Scan(&item.ID, &item.Activity, &item.Message, &item.EntityType, &item.EntityID, &item.BusinessID, &item.OrganizationID, &data, &item.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning feed item", "error", err)
+			continue
+		}
+		item.Data = data
+		items = append(items, item)
+	}
+
+	resp := map[string]interface{}{"items": items}
+	if len(items) > limit {
+		items = items[:limit]
+		resp["items"] = items
+		resp["next_before"] = items[len(items)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
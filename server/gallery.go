@@ -0,0 +1,520 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+)
+
+// An entity's images form a gallery. Every change to a gallery runs in a
+// transaction that first locks the entity row, so concurrent edits are
+// serialised, and leaves the gallery with display_order 0..n-1 and exactly
+// one primary image whenever it has any images. The primary_guard unique
+// index backs up the primary invariant at the database level.
+
+var errGalleryMismatch = errors.New("image_ids must list every image of the entity exactly once")
+
+// galleryKey identifies the gallery of one entity
+type galleryKey struct {
+	EntityType string
+	EntityID   int
+}
+
+// migrateGalleries repairs galleries written before changes were
+// transactional and adds the unique index that allows one primary per entity
+func migrateGalleries(ctx context.Context) error {
+	err := addColumnIfMissing(ctx, "images", "primary_guard",
+		"VARCHAR(80) AS (IF(is_primary, CONCAT(entity_type, ':', entity_id), NULL)) STORED")
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT entity_type, entity_id
+		FROM images
+		GROUP BY entity_type, entity_id
+		HAVING SUM(is_primary) != 1 OR COUNT(DISTINCT display_order) != COUNT(*) OR MAX(display_order) != COUNT(*) - 1
+	`)
+	if err != nil {
+		return err
+	}
+
+	var keys []galleryKey
+	for rows.Next() {
+		var k galleryKey
+		if err := rows.Scan(&k.EntityType, &k.EntityID); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		ids, primaryID, err := galleryImages(ctx, tx, k.EntityType, k.EntityID)
+		if err == nil {
+			err = applyGallery(ctx, tx, k.EntityType, k.EntityID, ids, primaryID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if len(keys) > 0 {
+		slog.Info("Repaired image galleries", "count", len(keys))
+	}
+
+	return addIndexIfMissing(ctx, "images", "uq_images_primary_guard", "(primary_guard)")
+}
+
+// lockEntity locks the entity row for the rest of tx. It also verifies the
+// entity exists, returning the same errors as checkEntity.
+func lockEntity(ctx context.Context, tx *sql.Tx, entityType string, entityID int) error {
+	et, ok := entityTypes[entityType]
+	if !ok {
+		return errUnknownEntityType
+	}
+
+	var id int
+	err := tx.QueryRowContext(ctx, "SELECT id FROM "+et.Table+" WHERE id = ? FOR UPDATE", entityID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return errEntityNotFound
+	}
+	return err
+}
+
+// lockGalleries locks several entities in a fixed order so that concurrent
+// bulk operations cannot deadlock
+func lockGalleries(ctx context.Context, tx *sql.Tx, keys []galleryKey) error {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].EntityType != keys[j].EntityType {
+			return keys[i].EntityType < keys[j].EntityType
+		}
+		return keys[i].EntityID < keys[j].EntityID
+	})
+	for _, k := range keys {
+		if err := lockEntity(ctx, tx, k.EntityType, k.EntityID); err != nil && err != errEntityNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// galleryImages returns an entity's image IDs in display order and the ID of
+// its primary image (0 if none is marked). It is a locking read so it sees the
+// latest committed gallery even if tx read images before taking its locks.
+func galleryImages(ctx context.Context, tx *sql.Tx, entityType string, entityID int) ([]int, int, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, is_primary FROM images
+		WHERE entity_type = ? AND entity_id = ?
+		ORDER BY display_order ASC, created_at ASC, id ASC
+		FOR UPDATE
+	`, entityType, entityID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	primaryID := 0
+	for rows.Next() {
+		var id int
+		var isPrimary bool
+		if err := rows.Scan(&id, &isPrimary); err != nil {
+			return nil, 0, err
+		}
+		ids = append(ids, id)
+		if isPrimary && primaryID == 0 {
+			primaryID = id
+		}
+	}
+	return ids, primaryID, rows.Err()
+}
+
+// applyGallery renumbers display_order to follow ids and makes primaryID the
+// only primary image, falling back to the first image when primaryID is not
+// part of the gallery
+func applyGallery(ctx context.Context, tx *sql.Tx, entityType string, entityID int, ids []int, primaryID int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if !containsID(ids, primaryID) {
+		primaryID = ids[0]
+	}
+
+	for i, id := range ids {
+		if _, err := tx.ExecContext(ctx, "UPDATE images SET display_order = ? WHERE id = ?", i, id); err != nil {
+			return err
+		}
+	}
+
+	// Clear the old primary before setting the new one so the unique
+	// primary_guard index is never violated mid-transaction
+	_, err := tx.ExecContext(ctx, "UPDATE images SET is_primary = FALSE WHERE entity_type = ? AND entity_id = ? AND id != ?", entityType, entityID, primaryID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE images SET is_primary = TRUE WHERE id = ?", primaryID)
+	return err
+}
+
+// normalizeGallery reapplies the gallery invariants after images were added
+// or removed, keeping the current order and primary where possible
+func normalizeGallery(ctx context.Context, tx *sql.Tx, entityType string, entityID int) error {
+	ids, primaryID, err := galleryImages(ctx, tx, entityType, entityID)
+	if err != nil {
+		return err
+	}
+	return applyGallery(ctx, tx, entityType, entityID, ids, primaryID)
+}
+
+// insertImage adds img to the end of its entity's gallery inside tx. The
+// first image of a gallery always becomes the primary image. img.ID,
+// img.DisplayOrder and img.IsPrimary are updated to match the stored row.
+func insertImage(ctx context.Context, tx *sql.Tx, img *Image) error {
+	if err := lockEntity(ctx, tx, img.EntityType, img.EntityID); err != nil {
+		return err
+	}
+
+	ids, primaryID, err := galleryImages(ctx, tx, img.EntityType, img.EntityID)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		img.IsPrimary = true
+	}
+	img.DisplayOrder = len(ids)
+
+	var storagePath interface{}
+	if img.StoragePath != "" {
+		storagePath = img.StoragePath
+	}
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO images (entity_type, entity_id, image_url, storage_path, caption, display_order, is_primary, uploaded_by)
+		VALUES (?, ?, ?, ?, ?, ?, FALSE, ?)
+	`, img.EntityType, img.EntityID, img.ImageURL, storagePath, img.Caption, img.DisplayOrder, img.UploadedBy)
+	if err != nil {
+		return err
+	}
+	id, _ := result.LastInsertId()
+	img.ID = int(id)
+
+	if img.IsPrimary {
+		primaryID = img.ID
+	} else if primaryID == 0 {
+		primaryID = ids[0]
+	}
+	_, err = tx.ExecContext(ctx, "UPDATE images SET is_primary = FALSE WHERE entity_type = ? AND entity_id = ? AND id != ?", img.EntityType, img.EntityID, primaryID)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "UPDATE images SET is_primary = TRUE WHERE id = ?", primaryID)
+	}
+	return err
+}
+
+// deleteImages deletes images by ID inside tx, keeping each affected gallery
+// consistent, and returns the storage paths of the deleted files along with
+// the number of rows removed
+func deleteImages(ctx context.Context, tx *sql.Tx, ids []int) ([]string, int, error) {
+	galleries, err := imageGalleries(ctx, tx, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	keys := make([]galleryKey, 0, len(galleries))
+	for k := range galleries {
+		keys = append(keys, k)
+	}
+	if err := lockGalleries(ctx, tx, keys); err != nil {
+		return nil, 0, err
+	}
+
+	var paths []string
+	deleted := 0
+	for _, id := range ids {
+		var storagePath sql.NullString
+		err := tx.QueryRowContext(ctx, "SELECT storage_path FROM images WHERE id = ?", id).Scan(&storagePath)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM images WHERE id = ?", id); err != nil {
+			return nil, 0, err
+		}
+		if storagePath.Valid && storagePath.String != "" {
+			paths = append(paths, storagePath.String)
+		}
+		deleted++
+	}
+
+	for _, k := range keys {
+		if err := normalizeGallery(ctx, tx, k.EntityType, k.EntityID); err != nil {
+			return nil, 0, err
+		}
+	}
+	return paths, deleted, nil
+}
+
+// imageGalleries maps image IDs to the galleries they belong to. Missing
+// images are left out. Images of private entity types are only managed
+// through their own handlers, so they fail with errUnknownEntityType.
+func imageGalleries(ctx context.Context, tx *sql.Tx, ids []int) (map[galleryKey][]int, error) {
+	galleries := make(map[galleryKey][]int)
+	for _, id := range ids {
+		var k galleryKey
+		err := tx.QueryRowContext(ctx, "SELECT entity_type, entity_id FROM images WHERE id = ?", id).Scan(&k.EntityType, &k.EntityID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entityTypes[k.EntityType].Private {
+			return nil, errUnknownEntityType
+		}
+		galleries[k] = append(galleries[k], id)
+	}
+	return galleries, nil
+}
+
+func containsID(ids []int, id int) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// writeGalleryError writes the response for an error from a gallery operation
+func writeGalleryError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	switch {
+	case errors.Is(err, errUnknownEntityType), errors.Is(err, errEntityNotFound):
+		writeEntityError(w, r, err)
+	case errors.Is(err, errGalleryMismatch):
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	default:
+		writeServerError(w, r, err, "Error updating gallery", "failed to "+action)
+	}
+}
+
+// Reorder an entity's images. image_ids must be the complete gallery in the
+// new order; primary_id optionally picks the new primary image.
+func reorderImagesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		EntityType string `json:"entity_type"`
+		EntityID   int    `json:"entity_id"`
+		ImageIDs   []int  `json:"image_ids"`
+		PrimaryID  int    `json:"primary_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if req.EntityType == "" || req.EntityID == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "entity_type and entity_id are required"})
+		return
+	}
+	if req.PrimaryID != 0 && !containsID(req.ImageIDs, req.PrimaryID) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "primary_id must be one of image_ids"})
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		writeGalleryError(w, r, err, "reorder images")
+		return
+	}
+	defer tx.Rollback()
+
+	err = func() error {
+		if entityTypes[req.EntityType].Private {
+			return errUnknownEntityType
+		}
+		if err := lockEntity(ctx, tx, req.EntityType, req.EntityID); err != nil {
+			return err
+		}
+		current, primaryID, err := galleryImages(ctx, tx, req.EntityType, req.EntityID)
+		if err != nil {
+			return err
+		}
+		if !sameIDs(current, req.ImageIDs) {
+			return errGalleryMismatch
+		}
+		if req.PrimaryID != 0 {
+			primaryID = req.PrimaryID
+		}
+		if err := applyGallery(ctx, tx, req.EntityType, req.EntityID, req.ImageIDs, primaryID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		writeGalleryError(w, r, err, "reorder images")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "images reordered successfully"})
+}
+
+// sameIDs reports whether b is a permutation of a
+func sameIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[int]bool, len(a))
+	for _, id := range a {
+		seen[id] = true
+	}
+	for _, id := range b {
+		if !seen[id] {
+			return false
+		}
+		delete(seen, id)
+	}
+	return true
+}
+
+func bulkImagesRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		bulkUpdateImagesHandler(w, r)
+	case http.MethodDelete:
+		bulkDeleteImagesHandler(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Update the captions of several images at once
+func bulkUpdateImagesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req struct {
+		Images []struct {
+			ID      int    `json:"id"`
+			Caption string `json:"caption"`
+		} `json:"images"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if len(req.Images) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "images are required"})
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		writeGalleryError(w, r, err, "update images")
+		return
+	}
+	defer tx.Rollback()
+
+	ids := make([]int, len(req.Images))
+	for i, img := range req.Images {
+		ids[i] = img.ID
+	}
+	if _, err := imageGalleries(ctx, tx, ids); err != nil {
+		writeGalleryError(w, r, err, "update images")
+		return
+	}
+
+	updated := 0
+	for _, img := range req.Images {
+		result, err := tx.ExecContext(ctx, "UPDATE images SET caption = ? WHERE id = ?", img.Caption, img.ID)
+		if err != nil {
+			writeGalleryError(w, r, err, "update images")
+			return
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			updated++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeGalleryError(w, r, err, "update images")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "images updated successfully",
+		"updated": updated,
+	})
+}
+
+// Delete several images at once. Galleries losing their primary image get
+// the next image in display order as their new primary.
+func bulkDeleteImagesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var req struct {
+		IDs []int `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if len(req.IDs) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "ids are required"})
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		writeGalleryError(w, r, err, "delete images")
+		return
+	}
+	defer tx.Rollback()
+
+	paths, deleted, err := deleteImages(ctx, tx, req.IDs)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeGalleryError(w, r, err, "delete images")
+		return
+	}
+	removeImageFiles(paths)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "images deleted successfully",
+		"deleted": deleted,
+	})
+}
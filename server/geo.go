@@ -0,0 +1,433 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Businesses and events store latitude/longitude next to their free-text
+// address/location, plus a geo_point column (x = longitude, y = latitude)
+// carrying a SPATIAL index. Nearby searches narrow candidates with a bounding
+// box on geo_point and then sort by great-circle distance.
+
+const (
+	defaultRadiusKM = 10.0
+	maxRadiusKM     = 500.0
+	earthRadiusKM   = 6371.0
+)
+
+var ErrNoGeocodeResult = errors.New("address could not be geocoded")
+
+// Geocoder turns a free-text address into coordinates
+type Geocoder interface {
+	Geocode(ctx context.Context, address string) (lat, lng float64, err error)
+}
+
+// geocoder is selected by the GEOCODER environment variable in InitDB.
+// When nil, coordinates are only set when supplied by the client.
+var geocoder Geocoder
+
+// StaticGeocoder resolves addresses from a fixed table. It makes no network
+// calls, which makes it suitable for tests and offline development.
+type StaticGeocoder struct {
+	mu        sync.RWMutex
+	locations map[string][2]float64
+}
+
+// NewStaticGeocoder creates a StaticGeocoder from address -> [lat, lng] pairs
+func NewStaticGeocoder(locations map[string][2]float64) *StaticGeocoder {
+	g := &StaticGeocoder{locations: make(map[string][2]float64)}
+	for address, coords := range locations {
+		g.Add(address, coords[0], coords[1])
+	}
+	return g
+}
+
+// Add registers the coordinates of an address
+func (g *StaticGeocoder) Add(address string, lat, lng float64) {
+	g.mu.Lock()
+	g.locations[normalizeAddress(address)] = [2]float64{lat, lng}
+	g.mu.Unlock()
+}
+
+func (g *StaticGeocoder) Geocode(_ context.Context, address string) (float64, float64, error) {
+	g.mu.RLock()
+	coords, ok := g.locations[normalizeAddress(address)]
+	g.mu.RUnlock()
+	if !ok {
+		return 0, 0, ErrNoGeocodeResult
+	}
+	return coords[0], coords[1], nil
+}
+
+func normalizeAddress(address string) string {
+	return strings.ToLower(strings.Join(strings.Fields(address), " "))
+}
+
+// NominatimGeocoder queries a Nominatim (OpenStreetMap) search endpoint.
+// Requests are spaced out to respect the public service's usage policy.
+type NominatimGeocoder struct {
+	BaseURL   string
+	UserAgent string
+	Client    *http.Client
+	Interval  time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// NewNominatimGeocoder creates a geocoder for the Nominatim instance at baseURL
+func NewNominatimGeocoder(baseURL, userAgent string) *NominatimGeocoder {
+	return &NominatimGeocoder{
+		BaseURL:   strings.TrimRight(baseURL, "/"),
+		UserAgent: userAgent,
+		Client:    &http.Client{Timeout: 10 * time.Second, Transport: newTracingTransport(nil)},
+		Interval:  time.Second,
+	}
+}
+
+func (g *NominatimGeocoder) Geocode(ctx context.Context, address string) (float64, float64, error) {
+	g.mu.Lock()
+	if wait := g.Interval - time.Since(g.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	g.last = time.Now()
+	g.mu.Unlock()
+
+	q := url.Values{"q": {address}, "format": {"json"}, "limit": {"1"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.BaseURL+"/search?"+q.Encode(), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("User-Agent", g.UserAgent)
+
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("geocoder returned %s", resp.Status)
+	}
+
+	var results []struct {
+		Lat string `json:"lat"`
+		Lon string `json:"lon"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return 0, 0, err
+	}
+	if len(results) == 0 {
+		return 0, 0, ErrNoGeocodeResult
+	}
+
+	lat, err := strconv.ParseFloat(results[0].Lat, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	lng, err := strconv.ParseFloat(results[0].Lon, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return lat, lng, nil
+}
+
+// initGeocoder configures the geocoder from the environment
+func initGeocoder() {
+	switch os.Getenv("GEOCODER") {
+	case "nominatim":
+		baseURL := os.Getenv("GEOCODER_URL")
+		if baseURL == "" {
+			baseURL = "https://nominatim.openstreetmap.org"
+		}
+		geocoder = NewNominatimGeocoder(baseURL, "business-directory/1.0")
+	case "static":
+		// Coordinates for the seeded sample businesses
+		geocoder = NewStaticGeocoder(map[string][2]float64{
+			"123 Main St, Downtown": {40.7128, -74.0060},
+			"456 Tech Ave":          {40.7306, -73.9866},
+			"789 Health Blvd":       {40.7484, -73.9857},
+			"321 Reading St":        {40.7580, -73.9855},
+			"654 Car Lane":          {40.6782, -73.9442},
+		})
+	}
+}
+
+// migrateGeo adds the coordinate columns and spatial indexes
+func migrateGeo(ctx context.Context) error {
+	for _, table := range []string{"businesses", "events"} {
+		if err := addColumnIfMissing(ctx, table, "latitude", "DECIMAL(9,6) NULL"); err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(ctx, table, "longitude", "DECIMAL(9,6) NULL"); err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(ctx, table, "geo_point", "POINT NOT NULL SRID 0 DEFAULT (POINT(0, 0))"); err != nil {
+			return err
+		}
+		exists, err := indexExists(ctx, table, "sidx_"+table+"_geo_point")
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if _, err := db.ExecContext(ctx, "ALTER TABLE "+table+" ADD SPATIAL INDEX sidx_"+table+"_geo_point (geo_point)"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validCoordinates reports whether lat/lng are both set and in range
+func validCoordinates(lat, lng *float64) bool {
+	return lat != nil && lng != nil && *lat >= -90 && *lat <= 90 && *lng >= -180 && *lng <= 180
+}
+
+// setCoordinates stores coordinates for a row of businesses or events
+func setCoordinates(ctx context.Context, table string, id int, lat, lng float64) error {
+	_, err := db.ExecContext(ctx, "UPDATE "+table+" SET latitude = ?, longitude = ?, geo_point = POINT(?, ?) WHERE id = ?",
+		lat, lng, lng, lat, id)
+	return err
+}
+
+// clearCoordinates removes the coordinates of a row, e.g. after its address
+// changed to something that can't be geocoded
+func clearCoordinates(ctx context.Context, table string, id int) error {
+	_, err := db.ExecContext(ctx, "UPDATE "+table+" SET latitude = NULL, longitude = NULL, geo_point = POINT(0, 0) WHERE id = ?", id)
+	return err
+}
+
+// geocodeAsync geocodes an address in the background and stores the result.
+// Requests don't wait on the (possibly slow, rate limited) geocoder.
+func geocodeAsync(ctx context.Context, table string, id int, address string) {
+	if geocoder == nil || strings.TrimSpace(address) == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+
+		lat, lng, err := geocoder.Geocode(ctx, address)
+		if err != nil {
+			if err != ErrNoGeocodeResult {
+				slog.Error("Error geocoding", "table", table, "id", id, "error", err)
+			}
+			if err := clearCoordinates(ctx, table, id); err != nil {
+				slog.Error("Error clearing coordinates", "table", table, "id", id, "error", err)
+			}
+			return
+		}
+		if err := setCoordinates(ctx, table, id, lat, lng); err != nil {
+			slog.Error("Error storing coordinates", "table", table, "id", id, "error", err)
+		}
+	}()
+}
+
+// startGeocodeBackfill geocodes existing rows that have an address but no
+// coordinates yet
+func startGeocodeBackfill(ctx context.Context) {
+	if geocoder == nil {
+		return
+	}
+	go func() {
+		for table, column := range map[string]string{"businesses": "address", "events": "location"} {
+			rows, err := db.QueryContext(ctx, "SELECT id, "+column+" FROM "+table+" WHERE latitude IS NULL AND "+column+" IS NOT NULL AND "+column+" != ''")
+			if err != nil {
+				slog.Error("Error querying rows to geocode", "table", table, "error", err)
+				continue
+			}
+			type pending struct {
+				id      int
+				address string
+			}
+			var todo []pending
+			for rows.Next() {
+				var p pending
+				if err := rows.Scan(&p.id, &p.address); err == nil {
+					todo = append(todo, p)
+				}
+			}
+			rows.Close()
+
+			for _, p := range todo {
+				geocodeCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				lat, lng, err := geocoder.Geocode(geocodeCtx, p.address)
+				cancel()
+				if err != nil {
+					continue
+				}
+				if err := setCoordinates(ctx, table, p.id, lat, lng); err != nil {
+					slog.Error("Error storing coordinates", "table", table, "id", p.id, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// nearQuery is a parsed ?near=lat,lng&radius_km= search
+type nearQuery struct {
+	Lat, Lng, RadiusKM float64
+}
+
+// parseNearQuery reads the near and radius_km query parameters. ok is false
+// when near is absent.
+func parseNearQuery(r *http.Request) (q nearQuery, ok bool, err error) {
+	near := r.URL.Query().Get("near")
+	if near == "" {
+		return q, false, nil
+	}
+
+	parts := strings.Split(near, ",")
+	if len(parts) != 2 {
+		return q, true, errors.New("near must be lat,lng")
+	}
+	lat, errLat := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lng, errLng := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if errLat != nil || errLng != nil || !validCoordinates(&lat, &lng) {
+		return q, true, errors.New("near must be lat,lng")
+	}
+
+	q = nearQuery{Lat: lat, Lng: lng, RadiusKM: defaultRadiusKM}
+	if radius := r.URL.Query().Get("radius_km"); radius != "" {
+		q.RadiusKM, err = strconv.ParseFloat(radius, 64)
+		if err != nil || q.RadiusKM <= 0 || q.RadiusKM > maxRadiusKM {
+			return q, true, fmt.Errorf("radius_km must be between 0 and %.0f", maxRadiusKM)
+		}
+	}
+	return q, true, nil
+}
+
+// boundingBox returns a WKT polygon around the search point that contains
+// every point within the radius, for filtering on the spatial index
+func (q nearQuery) boundingBox() string {
+	latDelta := q.RadiusKM / earthRadiusKM * 180 / math.Pi
+	minLat := math.Max(q.Lat-latDelta, -90)
+	maxLat := math.Min(q.Lat+latDelta, 90)
+
+	minLng, maxLng := -180.0, 180.0
+	// Near the poles or across the antimeridian fall back to all longitudes
+	if maxLat < 90 && minLat > -90 {
+		lngDelta := latDelta / math.Cos(q.Lat*math.Pi/180)
+		if q.Lng-lngDelta >= -180 && q.Lng+lngDelta <= 180 {
+			minLng, maxLng = q.Lng-lngDelta, q.Lng+lngDelta
+		}
+	}
+
+	return fmt.Sprintf("POLYGON((%[1]f %[2]f, %[3]f %[2]f, %[3]f %[4]f, %[1]f %[4]f, %[1]f %[2]f))",
+		minLng, minLat, maxLng, maxLat)
+}
+
+// getNearbyBusinessesHandler returns businesses within the radius, nearest first
+func getNearbyBusinessesHandler(w http.ResponseWriter, r *http.Request, q nearQuery) {
+	ctx := r.Context()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, name, category, description, phone, email, address,
+		  (SELECT image_url FROM images WHERE entity_type = 'business' AND entity_id = businesses.id ORDER BY is_primary DESC, display_order ASC, created_at ASC LIMIT 1) as image_url,
+		  rating, created_at, IFNULL(owner_id, 0), organization_id, verified, category_id, latitude, longitude,
+		  ST_Distance_Sphere(geo_point, POINT(?, ?)) / 1000 AS distance_km
+		FROM businesses
+		WHERE latitude IS NOT NULL AND MBRContains(ST_GeomFromText(?), geo_point)
+		HAVING distance_km <= ?
+		ORDER BY distance_km ASC
+	`, q.Lng, q.Lat, q.boundingBox(), q.RadiusKM)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying nearby businesses", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	businesses := []Business{}
+	for rows.Next() {
+		var b Business
+		var imageURL sql.NullString
+		var distance float64
+		err := rows.Scan(&b.ID, &b.Name, &b.Category, &b.Description, &b.Phone, &b.Email, &b.Address, &imageURL, &b.Rating, &b.CreatedAt, &b.OwnerID, &b.OrganizationID, &b.Verified, &b.CategoryID, &b.Latitude, &b.Longitude, &distance)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning business", "error", err)
+			continue
+		}
+		if imageURL.Valid {
+			b.ImageURL = imageURL.String
+		}
+		distance = math.Round(distance*100) / 100
+		b.DistanceKM = &distance
+		businesses = append(businesses, b)
+	}
+	rows.Close()
+
+	if err := applyOpeningHours(ctx, businesses, false); err != nil {
+		slog.ErrorContext(r.Context(), "Error loading opening hours", "error", err)
+	}
+	if r.URL.Query().Get("open_now") == "true" {
+		businesses = filterOpenNow(businesses)
+	}
+
+	if err := applyBusinessFavourites(r, businesses); err != nil {
+		slog.ErrorContext(r.Context(), "Error loading favourites", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(businesses)
+}
+
+// getNearbyEventsHandler returns upcoming events within the radius, nearest first
+func getNearbyEventsHandler(w http.ResponseWriter, r *http.Request, q nearQuery) {
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, owner_id, organization_id, business_id, title, description, event_date, location, price, category,
+		  (SELECT image_url FROM images WHERE entity_type = 'event' AND entity_id = events.id ORDER BY is_primary DESC, display_order ASC, created_at ASC LIMIT 1) as image_url,
+		  created_at, category_id, latitude, longitude,
+		  ST_Distance_Sphere(geo_point, POINT(?, ?)) / 1000 AS distance_km
+		FROM events
+		WHERE event_date >= NOW() AND latitude IS NOT NULL AND MBRContains(ST_GeomFromText(?), geo_point)
+		HAVING distance_km <= ?
+		ORDER BY distance_km ASC, event_date ASC
+	`, q.Lng, q.Lat, q.boundingBox(), q.RadiusKM)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying nearby events", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	events := []BusinessEvent{}
+	for rows.Next() {
+		var e BusinessEvent
+		var businessID sql.NullInt64
+		var imageURL sql.NullString
+		var distance float64
+		err := rows.Scan(&e.ID, &e.OwnerID, &e.OrganizationID, &businessID, &e.Title, &e.Description, &e.EventDate, &e.Location, &e.Price, &e.Category, &imageURL, &e.CreatedAt, &e.CategoryID, &e.Latitude, &e.Longitude, &distance)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning event", "error", err)
+			continue
+		}
+		if businessID.Valid {
+			bid := int(businessID.Int64)
+			e.BusinessID = &bid
+		}
+		if imageURL.Valid {
+			e.ImageURL = imageURL.String
+		}
+		distance = math.Round(distance*100) / 100
+		e.DistanceKM = &distance
+		events = append(events, e)
+	}
+
+	if err := applyEventFavourites(r, events); err != nil {
+		slog.ErrorContext(r.Context(), "Error loading favourites", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
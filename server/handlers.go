@@ -1,11 +1,12 @@
 package server
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
@@ -13,19 +14,18 @@ import (
 	"sync"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var (
-	db           *sql.DB
-	jwtSecret    = generateJWTSecret()
-	requestCount = 0
-	requestMutex sync.Mutex
-	startTime    = time.Now()
-	eventLog     = make([]SystemEvent, 0)
-	eventMutex   sync.Mutex
+	db             *sql.DB
+	jwtSecret      = generateJWTSecret()
+	startTime      = time.Now()
+	eventLog       = make([]SystemEvent, 0)
+	eventMutex     sync.Mutex
+	eventListeners []func(SystemEvent)
 )
 
 // generateJWTSecret generates a random JWT secret key
@@ -51,7 +51,7 @@ func checkPasswordHash(password, hash string) bool {
 }
 
 // generateToken generates a JWT token for a user and stores it in the database
-func generateToken(user User) (string, error) {
+func generateToken(ctx context.Context, user User) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"user_id": user.ID,
 		"email":   user.Email,
@@ -65,10 +65,10 @@ func generateToken(user User) (string, error) {
 
 	// Store token in database
 	expiresAt := time.Now().Add(time.Hour * 24)
-	_, err = db.Exec("INSERT INTO sessions (user_id, token, expires_at) VALUES (?, ?, ?)",
+	_, err = db.ExecContext(ctx, "INSERT INTO sessions (user_id, token, expires_at) VALUES (?, ?, ?)",
 		user.ID, tokenString, expiresAt)
 	if err != nil {
-		log.Printf("Error storing session: %v", err)
+		slog.Error("Error storing session", "error", err)
 		return "", err
 	}
 
@@ -87,7 +87,7 @@ func authenticateToken(r *http.Request) (jwt.MapClaims, error) {
 	// Check if token exists in database and is not expired
 	var userID int
 	var expiresAt time.Time
-	err := db.QueryRow("SELECT user_id, expires_at FROM sessions WHERE token = ? AND expires_at > NOW()",
+	err := db.QueryRowContext(r.Context(), "SELECT user_id, expires_at FROM sessions WHERE token = ? AND expires_at > NOW()",
 		tokenString).Scan(&userID, &expiresAt)
 
 	if err != nil {
@@ -129,6 +129,7 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// Store claims in request context for handlers to use
 		r.Header.Set("X-User-ID", fmt.Sprintf("%.0f", claims["user_id"]))
 		r.Header.Set("X-User-Type", claims["type"].(string))
+		setRequestUser(r, r.Header.Get("X-User-ID"))
 
 		next(w, r)
 	}
@@ -147,31 +148,30 @@ func businessOwnerOnly(next http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
-// eventOwnerOnly middleware ensures only event owners can access
-func eventOwnerOnly(next http.HandlerFunc) http.HandlerFunc {
-	return authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		userType := r.Header.Get("X-User-Type")
-		if userType != "event_owner" && userType != "business_owner" {
-			w.WriteHeader(http.StatusForbidden)
-			json.NewEncoder(w).Encode(map[string]string{"error": "event owner or business owner access required"})
-			return
-		}
-		next(w, r)
-	})
-}
-
 type Business struct {
-	ID          int       `json:"id"`
-	Name        string    `json:"name"`
-	Category    string    `json:"category"`
-	Description string    `json:"description"`
-	Phone       string    `json:"phone"`
-	Email       string    `json:"email"`
-	Address     string    `json:"address"`
-	ImageURL    string    `json:"image_url,omitempty"`
-	Rating      float64   `json:"rating"`
-	CreatedAt   time.Time `json:"created_at"`
-	OwnerID     int       `json:"owner_id,omitempty"`
+	ID             int           `json:"id"`
+	Name           string        `json:"name"`
+	Category       string        `json:"category"`
+	CategoryID     *int          `json:"category_id,omitempty"`
+	Description    string        `json:"description"`
+	Phone          string        `json:"phone"`
+	Email          string        `json:"email"`
+	Address        string        `json:"address"`
+	ImageURL       string        `json:"image_url,omitempty"`
+	Rating         float64       `json:"rating"`
+	CreatedAt      time.Time     `json:"created_at"`
+	OwnerID        int           `json:"owner_id,omitempty"`
+	OrganizationID *int          `json:"organization_id,omitempty"`
+	Verified       bool          `json:"verified"`
+	FavouriteCount int           `json:"favourite_count"`
+	IsFavourited   *bool         `json:"is_favourited,omitempty"`
+	Latitude       *float64      `json:"latitude,omitempty"`
+	Longitude      *float64      `json:"longitude,omitempty"`
+	DistanceKM     *float64      `json:"distance_km,omitempty"`
+	Hours          *OpeningHours `json:"hours,omitempty"`
+	OpenNow        *bool         `json:"open_now,omitempty"`
+	ClosesAt       *time.Time    `json:"closes_at,omitempty"`
+	NextOpenAt     *time.Time    `json:"next_open_at,omitempty"`
 }
 
 type BusinessOwner struct {
@@ -200,17 +200,24 @@ type SystemEvent struct {
 }
 
 type BusinessEvent struct {
-	ID          int       `json:"id"`
-	OwnerID     int       `json:"owner_id"`
-	BusinessID  *int      `json:"business_id,omitempty"`
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	EventDate   time.Time `json:"event_date"`
-	Location    string    `json:"location"`
-	ImageURL    string    `json:"image_url,omitempty"`
-	Price       float64   `json:"price"`
-	Category    string    `json:"category"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID             int       `json:"id"`
+	OwnerID        int       `json:"owner_id"`
+	OrganizationID *int      `json:"organization_id,omitempty"`
+	BusinessID     *int      `json:"business_id,omitempty"`
+	Title          string    `json:"title"`
+	Description    string    `json:"description"`
+	EventDate      time.Time `json:"event_date"`
+	Location       string    `json:"location"`
+	ImageURL       string    `json:"image_url,omitempty"`
+	Price          float64   `json:"price"`
+	Category       string    `json:"category"`
+	CategoryID     *int      `json:"category_id,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+	Latitude       *float64  `json:"latitude,omitempty"`
+	Longitude      *float64  `json:"longitude,omitempty"`
+	DistanceKM     *float64  `json:"distance_km,omitempty"`
+	FavouriteCount int       `json:"favourite_count"`
+	IsFavourited   *bool     `json:"is_favourited,omitempty"`
 }
 
 type Booking struct {
@@ -225,7 +232,17 @@ type Booking struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-func InitDB() error {
+// BookingEvent is what the public event stream says about a booking
+// changing status. The guest's details stay out of it.
+type BookingEvent struct {
+	BookingID int    `json:"booking_id"`
+	EventID   int    `json:"event_id"`
+	Status    string `json:"status"`
+}
+
+// InitDB connects to the database, migrates it and starts the background
+// work, which runs until ctx is done
+func InitDB(ctx context.Context) error {
 	var err error
 	host := os.Getenv("DB_HOST")
 	if host == "" {
@@ -249,36 +266,73 @@ func InitDB() error {
 	}
 
 	dsn := user + ":" + password + "@tcp(" + host + ":" + port + ")/" + dbname + "?parseTime=true"
-	db, err = sql.Open("mysql", dsn)
+	cfg, err := mysql.ParseDSN(dsn)
 	if err != nil {
 		return err
 	}
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return err
+	}
+	db = sql.OpenDB(tracedConnector{connector})
+	configurePool(db)
+	ctx = withQueryTimeout(ctx, backgroundQueryTimeout)
 
-	if err = db.Ping(); err != nil {
+	if err = db.PingContext(ctx); err != nil {
 		return err
 	}
 
-	// Create tables
-	if err = createTables(); err != nil {
+	// Create tables, without a statement deadline as migrations can be slow
+	if err = createTables(withQueryTimeout(ctx, 0)); err != nil {
 		return err
 	}
 
 	// Initialize image storage
 	if err = InitImageStorage(); err != nil {
-		log.Printf("Warning: Could not initialize image storage: %v", err)
+		slog.Warn("Could not initialize image storage", "error", err)
+	} else if err = movePrivateImages(ctx); err != nil {
+		slog.Warn("Could not move private images", "error", err)
 	}
 
+	// Outgoing mail for verification links and notices
+	initMailer()
+
+	// Where rate limit buckets are kept
+	initRateLimitStore(ctx)
+
+	// Identity providers for social login
+	initOIDC()
+
+	// Expire abandoned resumable uploads
+	startTusCleanup(ctx)
+
+	// Fan activity out to followers' feeds
+	startFeedWorker(ctx)
+
+	// Deliver notifications for bookings and listing changes
+	startNotifier(ctx)
+
+	// Roll raw business views up into time buckets
+	startAnalyticsRollup(ctx)
+
+	// Delete raw views and other personal data past retention
+	startRetentionPurge(ctx)
+
+	// Geocode addresses of existing listings
+	initGeocoder()
+	startGeocodeBackfill(ctx)
+
 	// Seed initial data
-	if err = seedData(); err != nil {
-		log.Printf("Warning: Could not seed initial data: %v", err)
+	if err = seedData(ctx); err != nil {
+		slog.Warn("Could not seed initial data", "error", err)
 	}
 
 	return nil
 }
 
-func createTables() error {
+func createTables(ctx context.Context) error {
 	// Users table
-	_, err := db.Exec(`
+	_, err := db.ExecContext(ctx, `
 		CREATE TABLE IF NOT EXISTS users (
 			id INT AUTO_INCREMENT PRIMARY KEY,
 			name VARCHAR(255) NOT NULL,
@@ -293,7 +347,7 @@ func createTables() error {
 	}
 
 	// Business owners additional info
-	_, err = db.Exec(`
+	_, err = db.ExecContext(ctx, `
 		CREATE TABLE IF NOT EXISTS business_owners (
 			id INT PRIMARY KEY,
 			company VARCHAR(255),
@@ -306,7 +360,7 @@ func createTables() error {
 	}
 
 	// Event owners additional info
-	_, err = db.Exec(`
+	_, err = db.ExecContext(ctx, `
 		CREATE TABLE IF NOT EXISTS event_owners (
 			id INT PRIMARY KEY,
 			organization VARCHAR(255),
@@ -318,8 +372,77 @@ func createTables() error {
 		return err
 	}
 
+	// Organisations owning businesses and events
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS organizations (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			created_by INT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Organisation members and their roles
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS organization_members (
+			organization_id INT NOT NULL,
+			user_id INT NOT NULL,
+			role ENUM('owner', 'manager', 'staff', 'viewer') NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (organization_id, user_id),
+			FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_organization_members_user (user_id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Pending email invitations to join an organisation
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS organization_invitations (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			organization_id INT NOT NULL,
+			email VARCHAR(255) NOT NULL,
+			role ENUM('owner', 'manager', 'staff', 'viewer') NOT NULL,
+			token_hash CHAR(64) NOT NULL,
+			invited_by INT,
+			expires_at DATETIME NOT NULL,
+			accepted_at DATETIME,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE CASCADE,
+			FOREIGN KEY (invited_by) REFERENCES users(id) ON DELETE SET NULL,
+			UNIQUE KEY uq_organization_invitations_token (token_hash)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Category taxonomy for businesses and events
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS categories (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			parent_id INT NULL,
+			kind ENUM('business', 'event') NOT NULL,
+			slug VARCHAR(100) NOT NULL,
+			name VARCHAR(100) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (parent_id) REFERENCES categories(id) ON DELETE CASCADE,
+			UNIQUE KEY uq_categories_kind_slug (kind, slug)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
 	// Businesses table
-	_, err = db.Exec(`
+	_, err = db.ExecContext(ctx, `
 		CREATE TABLE IF NOT EXISTS businesses (
 			id INT AUTO_INCREMENT PRIMARY KEY,
 			name VARCHAR(255) NOT NULL,
@@ -339,7 +462,7 @@ func createTables() error {
 	}
 
 	// Business views table for observability
-	_, err = db.Exec(`
+	_, err = db.ExecContext(ctx, `
 		CREATE TABLE IF NOT EXISTS business_views (
 			id INT AUTO_INCREMENT PRIMARY KEY,
 			business_id INT NOT NULL,
@@ -355,8 +478,84 @@ func createTables() error {
 		return err
 	}
 
+	// Hourly and daily rollups of business_views
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS business_view_buckets (
+			business_id INT NOT NULL,
+			granularity ENUM('hour', 'day') NOT NULL,
+			bucket_start DATETIME NOT NULL,
+			views INT NOT NULL DEFAULT 0,
+			bot_views INT NOT NULL DEFAULT 0,
+			unique_visitors INT NOT NULL DEFAULT 0,
+			visitor_sketch VARBINARY(1024),
+			PRIMARY KEY (business_id, granularity, bucket_start),
+			FOREIGN KEY (business_id) REFERENCES businesses(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Event detail page views, rolled up like business_views
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS event_views (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			event_id INT NOT NULL,
+			user_ip VARCHAR(45),
+			visitor_hash CHAR(64),
+			is_bot BOOLEAN NOT NULL DEFAULT FALSE,
+			viewed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE,
+			INDEX idx_event_views_event_id (event_id),
+			INDEX idx_event_views_viewed_at (viewed_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Hourly and daily rollups of event_views
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS event_view_buckets (
+			event_id INT NOT NULL,
+			granularity ENUM('hour', 'day') NOT NULL,
+			bucket_start DATETIME NOT NULL,
+			views INT NOT NULL DEFAULT 0,
+			bot_views INT NOT NULL DEFAULT 0,
+			unique_visitors INT NOT NULL DEFAULT 0,
+			visitor_sketch VARBINARY(1024),
+			PRIMARY KEY (event_id, granularity, bucket_start),
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Daily salts for visitor hashes, deleted once the day is over
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS view_salts (
+			day DATE PRIMARY KEY,
+			salt BINARY(32) NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Progress markers for background jobs
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS analytics_state (
+			name VARCHAR(50) PRIMARY KEY,
+			value BIGINT NOT NULL DEFAULT 0
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
 	// Sessions table for storing auth tokens
-	_, err = db.Exec(`
+	_, err = db.ExecContext(ctx, `
 		CREATE TABLE IF NOT EXISTS sessions (
 			id INT AUTO_INCREMENT PRIMARY KEY,
 			user_id INT NOT NULL,
@@ -373,7 +572,7 @@ func createTables() error {
 	}
 
 	// Events table
-	_, err = db.Exec(`
+	_, err = db.ExecContext(ctx, `
 		CREATE TABLE IF NOT EXISTS events (
 			id INT AUTO_INCREMENT PRIMARY KEY,
 			owner_id INT NOT NULL,
@@ -397,7 +596,7 @@ func createTables() error {
 	}
 
 	// Bookings table
-	_, err = db.Exec(`
+	_, err = db.ExecContext(ctx, `
 		CREATE TABLE IF NOT EXISTS bookings (
 			id INT AUTO_INCREMENT PRIMARY KEY,
 			event_id INT NOT NULL,
@@ -408,6 +607,8 @@ func createTables() error {
 			notes TEXT,
 			status ENUM('pending', 'confirmed', 'cancelled') DEFAULT 'pending',
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			confirmed_at TIMESTAMP NULL,
+			cancelled_at TIMESTAMP NULL,
 			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE,
 			INDEX idx_bookings_event_id (event_id),
 			INDEX idx_bookings_email (email),
@@ -418,41 +619,533 @@ func createTables() error {
 		return err
 	}
 
-	// Images table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS images (
+	// Images table
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS images (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			entity_type VARCHAR(50) NOT NULL,
+			entity_id INT NOT NULL,
+			image_url VARCHAR(500) NOT NULL,
+			storage_path VARCHAR(500),
+			caption VARCHAR(255),
+			display_order INT DEFAULT 0,
+			is_primary BOOLEAN DEFAULT FALSE,
+			uploaded_by INT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (uploaded_by) REFERENCES users(id) ON DELETE SET NULL,
+			INDEX idx_images_entity (entity_type, entity_id),
+			INDEX idx_images_created_at (created_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Image metadata table
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS image_metadata (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			image_id INT NOT NULL,
+			file_size INT,
+			width INT,
+			height INT,
+			mime_type VARCHAR(100),
+			original_filename VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE CASCADE,
+			INDEX idx_image_metadata_image_id (image_id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Resumable (tus) uploads in progress
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS tus_uploads (
+			id CHAR(32) PRIMARY KEY,
+			user_id INT NOT NULL,
+			entity_type VARCHAR(50) NOT NULL,
+			entity_id INT NOT NULL,
+			caption VARCHAR(255),
+			is_primary BOOLEAN DEFAULT FALSE,
+			filename VARCHAR(255),
+			upload_length BIGINT NOT NULL,
+			upload_offset BIGINT NOT NULL DEFAULT 0,
+			image_id INT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE SET NULL,
+			INDEX idx_tus_uploads_expires_at (expires_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Weekly opening hours per business
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS business_hours (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			business_id INT NOT NULL,
+			weekday TINYINT NOT NULL,
+			opens_at SMALLINT NOT NULL,
+			closes_at SMALLINT NOT NULL,
+			FOREIGN KEY (business_id) REFERENCES businesses(id) ON DELETE CASCADE,
+			INDEX idx_business_hours_business_id (business_id, weekday)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Dated exceptions to the weekly opening hours (holidays, special hours)
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS business_hour_exceptions (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			business_id INT NOT NULL,
+			exception_date DATE NOT NULL,
+			closed BOOLEAN NOT NULL DEFAULT FALSE,
+			opens_at SMALLINT,
+			closes_at SMALLINT,
+			note VARCHAR(255),
+			FOREIGN KEY (business_id) REFERENCES businesses(id) ON DELETE CASCADE,
+			INDEX idx_business_hour_exceptions_business_date (business_id, exception_date)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Ownership claims on business listings
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS business_claims (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			business_id INT NOT NULL,
+			claimant_id INT NOT NULL,
+			method ENUM('email', 'document') NOT NULL,
+			status ENUM('pending_verification', 'pending_review', 'approved', 'rejected') NOT NULL,
+			verification_email VARCHAR(255),
+			token_hash CHAR(64),
+			token_expires_at DATETIME,
+			document_path VARCHAR(255),
+			document_type VARCHAR(100),
+			email_verified_at DATETIME,
+			reviewed_by INT,
+			reviewed_at DATETIME,
+			review_note TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (business_id) REFERENCES businesses(id) ON DELETE CASCADE,
+			FOREIGN KEY (claimant_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (reviewed_by) REFERENCES users(id) ON DELETE SET NULL,
+			INDEX idx_business_claims_business (business_id, status),
+			INDEX idx_business_claims_claimant (claimant_id),
+			UNIQUE KEY uq_business_claims_token (token_hash)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Businesses and events favourited by users
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS favourites (
+			user_id INT NOT NULL,
+			entity_type VARCHAR(50) NOT NULL,
+			entity_id INT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, entity_type, entity_id),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_favourites_entity (entity_type, entity_id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Named lists of saved businesses and events
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS saved_lists (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			description TEXT,
+			visibility ENUM('private', 'shared') NOT NULL DEFAULT 'private',
+			share_token CHAR(64),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_saved_lists_user (user_id),
+			UNIQUE KEY uq_saved_lists_share_token (share_token)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Items in saved lists
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS saved_list_items (
+			list_id INT NOT NULL,
+			entity_type VARCHAR(50) NOT NULL,
+			entity_id INT NOT NULL,
+			note TEXT,
+			added_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (list_id, entity_type, entity_id),
+			FOREIGN KEY (list_id) REFERENCES saved_lists(id) ON DELETE CASCADE,
+			INDEX idx_saved_list_items_entity (entity_type, entity_id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Businesses and organisations followed by users
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS follows (
+			user_id INT NOT NULL,
+			target_type ENUM('business', 'organization') NOT NULL,
+			target_id INT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, target_type, target_id),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_follows_target (target_type, target_id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Activity fanned out to followers' feeds
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS feed_items (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			activity VARCHAR(50) NOT NULL,
+			message TEXT,
+			entity_type VARCHAR(50) NOT NULL,
+			entity_id INT NOT NULL,
+			business_id INT NULL,
+			organization_id INT NULL,
+			data JSON,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_feed_items_user (user_id, id),
+			INDEX idx_feed_items_created (created_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// In-app notifications
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS notifications (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			type VARCHAR(50) NOT NULL,
+			title VARCHAR(255) NOT NULL,
+			body TEXT,
+			entity_type VARCHAR(50) NULL,
+			entity_id INT NULL,
+			read_at TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_notifications_user (user_id, id),
+			INDEX idx_notifications_unread (user_id, read_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Per-user notification channels, one row per type the user has changed
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS notification_preferences (
+			user_id INT NOT NULL,
+			type VARCHAR(50) NOT NULL,
+			in_app BOOLEAN NOT NULL DEFAULT TRUE,
+			email BOOLEAN NOT NULL DEFAULT TRUE,
+			PRIMARY KEY (user_id, type),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Enquiry threads between customers (users or guests) and businesses
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS enquiry_threads (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			business_id INT NOT NULL,
+			customer_id INT NULL,
+			guest_name VARCHAR(255) NULL,
+			guest_email VARCHAR(255) NULL,
+			subject VARCHAR(255) NOT NULL,
+			status ENUM('pending_verification', 'open', 'closed') NOT NULL DEFAULT 'open',
+			customer_token CHAR(32) NOT NULL,
+			business_token CHAR(32) NOT NULL,
+			customer_unread INT NOT NULL DEFAULT 0,
+			business_unread INT NOT NULL DEFAULT 0,
+			client_ip VARCHAR(45),
+			last_message_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (business_id) REFERENCES businesses(id) ON DELETE CASCADE,
+			FOREIGN KEY (customer_id) REFERENCES users(id) ON DELETE CASCADE,
+			UNIQUE KEY uq_enquiry_threads_customer_token (customer_token),
+			UNIQUE KEY uq_enquiry_threads_business_token (business_token),
+			INDEX idx_enquiry_threads_business (business_id, last_message_at),
+			INDEX idx_enquiry_threads_customer (customer_id, last_message_at),
+			INDEX idx_enquiry_threads_guest (guest_email, created_at),
+			INDEX idx_enquiry_threads_ip (client_ip, created_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Messages in enquiry threads
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS enquiry_messages (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			thread_id INT NOT NULL,
+			sender ENUM('customer', 'business') NOT NULL,
+			sender_user_id INT NULL,
+			body TEXT NOT NULL,
+			via ENUM('web', 'email') NOT NULL DEFAULT 'web',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (thread_id) REFERENCES enquiry_threads(id) ON DELETE CASCADE,
+			FOREIGN KEY (sender_user_id) REFERENCES users(id) ON DELETE SET NULL,
+			INDEX idx_enquiry_messages_thread (thread_id, sender, created_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Entity type registry referenced by images.entity_type
+	if err = syncEntityTypes(ctx); err != nil {
+		return err
+	}
+
+	// One primary image and sequential display order per gallery
+	if err = migrateGalleries(ctx); err != nil {
+		return err
+	}
+
+	// Coordinates and spatial indexes for nearby search
+	if err = migrateGeo(ctx); err != nil {
+		return err
+	}
+
+	// Timezone that opening hours are expressed in
+	if err = migrateHours(ctx); err != nil {
+		return err
+	}
+
+	// Category references replacing free-form category strings
+	if err = migrateCategories(ctx); err != nil {
+		return err
+	}
+
+	// Verified badge granted by approved claims
+	if err = migrateClaims(ctx); err != nil {
+		return err
+	}
+
+	// Organisation ownership of businesses and events
+	if err = migrateOrganizations(ctx); err != nil {
+		return err
+	}
+
+	// Rollup progress for business and event views
+	if err = migrateAnalytics(ctx); err != nil {
+		return err
+	}
+
+	// Anonymised business views
+	if err = migrateViewPrivacy(ctx); err != nil {
+		return err
+	}
+
+	// Booking status change times for event stats
+	if err = migrateEventStats(ctx); err != nil {
+		return err
+	}
+
+	// Login history, also counted for lockouts
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS login_attempts (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NULL,
+			email VARCHAR(255) NOT NULL,
+			ip VARCHAR(45) NOT NULL,
+			user_agent VARCHAR(500),
+			device_hash CHAR(64) NOT NULL,
+			success BOOLEAN NOT NULL,
+			reason VARCHAR(50),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_login_attempts_user (user_id, created_at),
+			INDEX idx_login_attempts_ip (ip, created_at),
+			INDEX idx_login_attempts_created_at (created_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Failed login count and lock on accounts
+	if err = migrateLockout(ctx); err != nil {
+		return err
+	}
+
+	// Two-factor secrets on accounts
+	if err = migrateTwoFactor(ctx); err != nil {
+		return err
+	}
+
+	// Hashed single-use recovery codes for two-factor authentication
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS user_recovery_codes (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			code_hash CHAR(64) NOT NULL,
+			used_at TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			UNIQUE KEY uq_user_recovery_codes (user_id, code_hash)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Logins waiting for their second factor
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS login_challenges (
+			token_hash CHAR(64) PRIMARY KEY,
+			user_id INT NOT NULL,
+			purpose ENUM('verify', 'enroll') NOT NULL,
+			attempts INT NOT NULL DEFAULT 0,
+			expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_login_challenges_expires_at (expires_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Token buckets for rate limits shared between replicas
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+			bucket_key VARCHAR(255) PRIMARY KEY,
+			tokens DOUBLE NOT NULL,
+			updated_at DATETIME(6) NOT NULL,
+			full_at DATETIME(6) NOT NULL,
+			INDEX idx_rate_limit_buckets_full_at (full_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Accounts created through a provider have no password of their own
+	if err = migrateOIDC(ctx); err != nil {
+		return err
+	}
+
+	// Identity provider accounts linked to users
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS user_identities (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			provider VARCHAR(50) NOT NULL,
+			subject VARCHAR(255) NOT NULL,
+			email VARCHAR(255),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			last_login_at TIMESTAMP NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			UNIQUE KEY uq_user_identities_subject (provider, subject),
+			INDEX idx_user_identities_user (user_id)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// OIDC logins waiting for the provider to send the browser back
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS oidc_states (
+			state_hash CHAR(64) PRIMARY KEY,
+			provider VARCHAR(50) NOT NULL,
+			nonce VARCHAR(64) NOT NULL,
+			code_verifier VARCHAR(128) NOT NULL,
+			redirect VARCHAR(500) NOT NULL,
+			link_user_id INT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (link_user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_oidc_states_expires_at (expires_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Emailed sign-in links, bound to the device that asked for them
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS magic_links (
+			token_hash CHAR(64) PRIMARY KEY,
+			user_id INT NOT NULL,
+			device_hash CHAR(64) NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_magic_links_expires_at (expires_at)
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// Passkeys registered by users
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS webauthn_credentials (
 			id INT AUTO_INCREMENT PRIMARY KEY,
-			entity_type VARCHAR(50) NOT NULL,
-			entity_id INT NOT NULL,
-			image_url VARCHAR(500) NOT NULL,
-			storage_path VARCHAR(500),
-			caption VARCHAR(255),
-			display_order INT DEFAULT 0,
-			is_primary BOOLEAN DEFAULT FALSE,
-			uploaded_by INT,
+			user_id INT NOT NULL,
+			credential_id VARBINARY(1023) NOT NULL,
+			public_key BLOB NOT NULL,
+			sign_count BIGINT UNSIGNED NOT NULL DEFAULT 0,
+			name VARCHAR(100) NOT NULL,
+			transports VARCHAR(255) NOT NULL DEFAULT '',
+			backed_up BOOLEAN NOT NULL DEFAULT FALSE,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (uploaded_by) REFERENCES users(id) ON DELETE SET NULL,
-			INDEX idx_images_entity (entity_type, entity_id),
-			INDEX idx_images_created_at (created_at)
+			last_used_at TIMESTAMP NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			UNIQUE KEY uq_webauthn_credentials_id (credential_id),
+			INDEX idx_webauthn_credentials_user (user_id)
 		)
 	`)
 	if err != nil {
 		return err
 	}
 
-	// Image metadata table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS image_metadata (
-			id INT AUTO_INCREMENT PRIMARY KEY,
-			image_id INT NOT NULL,
-			file_size INT,
-			width INT,
-			height INT,
-			mime_type VARCHAR(100),
-			original_filename VARCHAR(255),
+	// Passkey registrations and logins waiting for the authenticator
+	_, err = db.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS webauthn_challenges (
+			challenge_hash CHAR(64) PRIMARY KEY,
+			purpose ENUM('register', 'login') NOT NULL,
+			user_id INT NULL,
+			expires_at TIMESTAMP NOT NULL,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE CASCADE,
-			INDEX idx_image_metadata_image_id (image_id)
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_webauthn_challenges_expires_at (expires_at)
 		)
 	`)
 	if err != nil {
@@ -462,12 +1155,12 @@ func createTables() error {
 	return nil
 }
 
-func seedData() error {
+func seedData(ctx context.Context) error {
 	// Check if data already exists
 	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM businesses").Scan(&count)
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM businesses").Scan(&count)
 	if err == nil && count > 0 {
-		log.Println("Data already exists, skipping seed")
+		slog.Info("Data already exists, skipping seed")
 		return nil
 	}
 
@@ -510,41 +1203,46 @@ func seedData() error {
 	for i, owner := range businessOwners {
 		hashedPassword, err := hashPassword("password123")
 		if err != nil {
-			log.Printf("Error hashing password for %s: %v", owner.name, err)
+			slog.Error("Error hashing seed password", "user", owner.name, "error", err)
 			continue
 		}
 
-		result, err := db.Exec("INSERT INTO users (name, email, password, type) VALUES (?, ?, ?, 'business_owner')",
+		result, err := db.ExecContext(ctx, "INSERT INTO users (name, email, password, type) VALUES (?, ?, ?, 'business_owner')",
 			owner.name, owner.email, hashedPassword)
 
 		if err != nil {
-			log.Printf("Error seeding user %s: %v", owner.name, err)
+			slog.Error("Error seeding user", "user", owner.name, "error", err)
 			continue
 		}
 
 		userID, _ := result.LastInsertId()
 
-		_, err = db.Exec("INSERT INTO business_owners (id, company, phone) VALUES (?, ?, ?)",
+		_, err = db.ExecContext(ctx, "INSERT INTO business_owners (id, company, phone) VALUES (?, ?, ?)",
 			userID, owner.company, owner.phone)
 
 		if err != nil {
-			log.Printf("Error seeding business owner %s: %v", owner.company, err)
+			slog.Error("Error seeding business owner", "company", owner.company, "error", err)
 			continue
 		}
 
 		// Insert corresponding business
 		if i < len(businesses) {
 			business := businesses[i]
-			_, err = db.Exec("INSERT INTO businesses (name, category, description, phone, email, address, rating, owner_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-				business.name, business.category, business.description, business.phone, business.email, business.address, business.rating, userID)
+			orgID, err := personalOrganization(ctx, db, int(userID))
+			if err != nil {
+				slog.Error("Error seeding organization", "company", owner.company, "error", err)
+				continue
+			}
+			_, err = db.ExecContext(ctx, "INSERT INTO businesses (name, category, category_id, description, phone, email, address, rating, owner_id, organization_id) VALUES (?, ?, (SELECT id FROM categories WHERE kind = 'business' AND name = ?), ?, ?, ?, ?, ?, ?, ?)",
+				business.name, business.category, business.category, business.description, business.phone, business.email, business.address, business.rating, userID, orgID)
 
 			if err != nil {
-				log.Printf("Error seeding business %s: %v", business.name, err)
+				slog.Error("Error seeding business", "business", business.name, "error", err)
 			}
 		}
 	}
 
-	log.Println("Sample data seeded successfully")
+	slog.Info("Sample data seeded successfully")
 	return nil
 }
 
@@ -552,17 +1250,14 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID, X-API-Key")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		requestMutex.Lock()
-		requestCount++
-		requestMutex.Unlock()
-
 		next(w, r)
 	}
 }
@@ -571,9 +1266,34 @@ func NewRouter() http.Handler {
 	mux := http.NewServeMux()
 
 	// Auth routes (no auth required)
-	mux.HandleFunc("/register", corsMiddleware(registerHandler))
-	mux.HandleFunc("/login", corsMiddleware(loginHandler))
+	mux.HandleFunc("/register", corsMiddleware(rateLimited(registerRateLimit, registerHandler)))
+	mux.HandleFunc("/login", corsMiddleware(rateLimited(loginRateLimit, loginHandler)))
+	mux.HandleFunc("/login/2fa", corsMiddleware(rateLimited(loginRateLimit, verifyLoginChallengeHandler)))
+	mux.HandleFunc("/login/magic", corsMiddleware(rateLimited(magicLinkRateLimit, requestMagicLinkHandler)))
+	mux.HandleFunc("/login/magic/verify", corsMiddleware(rateLimited(loginRateLimit, verifyMagicLinkHandler)))
+	mux.HandleFunc("/login/passkey/begin", corsMiddleware(rateLimited(loginRateLimit, beginPasskeyLoginHandler)))
+	mux.HandleFunc("/login/passkey/finish", corsMiddleware(rateLimited(loginRateLimit, finishPasskeyLoginHandler)))
 	mux.HandleFunc("/logout", corsMiddleware(authMiddleware(logoutHandler)))
+	mux.HandleFunc("/login-history", corsMiddleware(authMiddleware(getLoginHistoryHandler)))
+	mux.HandleFunc("/account/unlock", corsMiddleware(unlockAccountHandler))
+
+	// Two-factor authentication routes. Setup and enable also accept the
+	// challenge token of a login that requires enrolment.
+	mux.HandleFunc("/2fa", corsMiddleware(authMiddleware(getTwoFactorStatusHandler)))
+	mux.HandleFunc("/2fa/setup", corsMiddleware(setupTwoFactorHandler))
+	mux.HandleFunc("/2fa/enable", corsMiddleware(enableTwoFactorHandler))
+	mux.HandleFunc("/2fa/disable", corsMiddleware(authMiddleware(disableTwoFactorHandler)))
+	mux.HandleFunc("/2fa/recovery-codes", corsMiddleware(authMiddleware(regenerateRecoveryCodesHandler)))
+
+	// Social login through OpenID Connect providers, and the providers
+	// linked to the current account
+	mux.HandleFunc("/auth/oidc/", corsMiddleware(rateLimited(loginRateLimit, oidcRouter)))
+	mux.HandleFunc("/identities", corsMiddleware(authMiddleware(identitiesRouter)))
+
+	// Passkey management for the current account
+	mux.HandleFunc("/passkeys", corsMiddleware(authMiddleware(passkeysRouter)))
+	mux.HandleFunc("/passkeys/register/begin", corsMiddleware(authMiddleware(beginPasskeyRegistrationHandler)))
+	mux.HandleFunc("/passkeys/register/finish", corsMiddleware(authMiddleware(finishPasskeyRegistrationHandler)))
 
 	// API routes
 	mux.HandleFunc("/health", corsMiddleware(healthHandler))
@@ -581,13 +1301,55 @@ func NewRouter() http.Handler {
 	// Business routes
 	mux.HandleFunc("/businesses", corsMiddleware(businessesRouter))
 	mux.HandleFunc("/business/", corsMiddleware(getBusinessByIDHandler))
-	mux.HandleFunc("/my-businesses", corsMiddleware(businessOwnerOnly(getMyBusinessesHandler)))
-	mux.HandleFunc("/my-business-stats", corsMiddleware(businessOwnerOnly(getMyBusinessStatsHandler)))
+	mux.HandleFunc("/my-businesses", corsMiddleware(authMiddleware(getMyBusinessesHandler)))
+	mux.HandleFunc("/my-business-stats", corsMiddleware(authMiddleware(getMyBusinessStatsHandler)))
+	mux.HandleFunc("/business-hours", corsMiddleware(businessHoursRouter))
+	mux.HandleFunc("/categories", corsMiddleware(getCategoriesHandler))
+
+	// Organisation routes
+	mux.HandleFunc("/organizations", corsMiddleware(organizationsRouter))
+	mux.HandleFunc("/organizations/members", corsMiddleware(organizationMembersRouter))
+	mux.HandleFunc("/organizations/invitations", corsMiddleware(organizationInvitationsRouter))
+	mux.HandleFunc("/organizations/invitations/accept", corsMiddleware(authMiddleware(acceptOrganizationInvitationHandler)))
+
+	// Favourites and saved list routes
+	mux.HandleFunc("/favourites", corsMiddleware(favouritesRouter))
+	mux.HandleFunc("/lists", corsMiddleware(savedListsRouter))
+	mux.HandleFunc("/lists/items", corsMiddleware(savedListItemsRouter))
+	mux.HandleFunc("/lists/shared", corsMiddleware(getSharedListHandler))
+
+	// Follow and feed routes
+	mux.HandleFunc("/follows", corsMiddleware(followsRouter))
+	mux.HandleFunc("/feed", corsMiddleware(authMiddleware(getFeedHandler)))
+
+	// Notification routes
+	mux.HandleFunc("/notifications", corsMiddleware(authMiddleware(getNotificationsHandler)))
+	mux.HandleFunc("/notifications/unread-count", corsMiddleware(authMiddleware(getUnreadNotificationCountHandler)))
+	mux.HandleFunc("/notifications/read", corsMiddleware(authMiddleware(markNotificationsReadHandler)))
+	mux.HandleFunc("/notifications/read-all", corsMiddleware(authMiddleware(markAllNotificationsReadHandler)))
+	mux.HandleFunc("/notifications/preferences", corsMiddleware(notificationPreferencesRouter))
+
+	// Enquiry routes
+	mux.HandleFunc("/enquiries", corsMiddleware(enquiriesRouter))
+	mux.HandleFunc("/enquiries/messages", corsMiddleware(postEnquiryMessageHandler))
+	mux.HandleFunc("/enquiries/verify", corsMiddleware(verifyEnquiryHandler))
+	mux.HandleFunc("/enquiries/attachments", corsMiddleware(getEnquiryAttachmentHandler))
+	mux.HandleFunc("/enquiries/unread-count", corsMiddleware(authMiddleware(getEnquiryUnreadCountHandler)))
+	mux.HandleFunc("/enquiries/inbound", corsMiddleware(inboundEnquiryHandler))
+
+	// Business claim routes
+	mux.HandleFunc("/claims", corsMiddleware(claimsRouter))
+	mux.HandleFunc("/claims/verify", corsMiddleware(verifyClaimHandler))
+	mux.HandleFunc("/admin/claims", corsMiddleware(operatorOnly(getClaimsForReviewHandler)))
+	mux.HandleFunc("/admin/claims/document", corsMiddleware(operatorOnly(getClaimDocumentHandler)))
+	mux.HandleFunc("/admin/claims/review", corsMiddleware(operatorOnly(reviewClaimHandler)))
+	mux.HandleFunc("/admin/users/unlock", corsMiddleware(operatorOnly(adminUnlockAccountHandler)))
 
 	// Event routes
 	mux.HandleFunc("/business-events", corsMiddleware(businessEventsRouter))
 	mux.HandleFunc("/event/", corsMiddleware(getEventByIDHandler))
-	mux.HandleFunc("/my-events", corsMiddleware(eventOwnerOnly(getMyEventsHandler)))
+	mux.HandleFunc("/my-events", corsMiddleware(authMiddleware(getMyEventsHandler)))
+	mux.HandleFunc("/my-event-stats", corsMiddleware(authMiddleware(getMyEventStatsHandler)))
 
 	// Booking routes
 	mux.HandleFunc("/bookings", corsMiddleware(bookingsRouter))
@@ -602,6 +1364,10 @@ func NewRouter() http.Handler {
 	mux.HandleFunc("/images/add-url", corsMiddleware(authMiddleware(addImageURLHandler)))
 	mux.HandleFunc("/images/update", corsMiddleware(authMiddleware(updateImageHandler)))
 	mux.HandleFunc("/images/delete", corsMiddleware(authMiddleware(deleteImageHandler)))
+	mux.HandleFunc("/images/reorder", corsMiddleware(authMiddleware(reorderImagesHandler)))
+	mux.HandleFunc("/images/bulk", corsMiddleware(authMiddleware(bulkImagesRouter)))
+	mux.HandleFunc(tusBasePath, tusCorsMiddleware(corsMiddleware(authMiddleware(tusHandler))))
+	mux.HandleFunc("/entity-types", corsMiddleware(entityTypesHandler))
 
 	// Serve uploaded files
 	mux.Handle("/uploads/", http.StripPrefix("/uploads/", http.FileServer(http.Dir(uploadDir))))
@@ -621,7 +1387,7 @@ func NewRouter() http.Handler {
 		http.StripPrefix("/", http.FileServer(http.Dir("./web/"))).ServeHTTP(w, r)
 	})
 
-	return mux
+	return withRequestTimeout(requestLogger(traceRequests(instrumentHandler(mux))))
 }
 
 func businessesRouter(w http.ResponseWriter, r *http.Request) {
@@ -630,20 +1396,22 @@ func businessesRouter(w http.ResponseWriter, r *http.Request) {
 		// GET is public - no auth required
 		getBusinessesHandler(w, r)
 	case http.MethodPost:
-		// POST requires business owner auth
-		businessOwnerOnly(createBusinessHandler)(w, r)
+		// POST requires auth; the handler checks organisation roles
+		authMiddleware(createBusinessHandler)(w, r)
 	case http.MethodPut:
-		// PUT requires business owner auth
-		businessOwnerOnly(updateBusinessHandler)(w, r)
+		// PUT requires a role that can edit the business
+		authMiddleware(updateBusinessHandler)(w, r)
 	case http.MethodDelete:
-		// DELETE requires business owner auth
-		businessOwnerOnly(deleteBusinessHandler)(w, r)
+		// DELETE requires a role that can delete the business
+		authMiddleware(deleteBusinessHandler)(w, r)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -672,9 +1440,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	// Hash the password
 	hashedPassword, err := hashPassword(req.Password)
 	if err != nil {
-		log.Printf("Error hashing password: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error hashing password", "internal server error")
 		return
 	}
 
@@ -685,7 +1451,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Insert user
-	result, err := db.Exec("INSERT INTO users (name, email, password, type) VALUES (?, ?, ?, ?)",
+	result, err := db.ExecContext(ctx, "INSERT INTO users (name, email, password, type) VALUES (?, ?, ?, ?)",
 		req.Name, req.Email, hashedPassword, userType)
 
 	if err != nil {
@@ -694,9 +1460,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(map[string]string{"error": "email already exists"})
 			return
 		}
-		log.Printf("Error creating user: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create user"})
+		writeServerError(w, r, err, "Error creating user", "failed to create user")
 		return
 	}
 
@@ -704,48 +1468,48 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Insert business owner info if type is business_owner
 	if userType == "business_owner" {
-		_, err = db.Exec("INSERT INTO business_owners (id, company, phone) VALUES (?, ?, ?)",
+		_, err = db.ExecContext(ctx, "INSERT INTO business_owners (id, company, phone) VALUES (?, ?, ?)",
 			userID, req.Company, req.Phone)
 
 		if err != nil {
-			log.Printf("Error creating business owner: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "failed to create business owner profile"})
+			writeServerError(w, r, err, "Error creating business owner", "failed to create business owner profile")
 			return
 		}
 	}
 
 	// Insert event owner info if type is event_owner
 	if userType == "event_owner" {
-		_, err = db.Exec("INSERT INTO event_owners (id, organization, phone) VALUES (?, ?, ?)",
+		_, err = db.ExecContext(ctx, "INSERT INTO event_owners (id, organization, phone) VALUES (?, ?, ?)",
 			userID, req.Company, req.Phone)
 
 		if err != nil {
-			log.Printf("Error creating event owner: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "failed to create event owner profile"})
+			writeServerError(w, r, err, "Error creating event owner", "failed to create event owner profile")
 			return
 		}
 	}
 
 	// Get the created user for response
 	var user User
-	err = db.QueryRow("SELECT id, name, email, type, created_at FROM users WHERE id = ?", userID).
+	err = db.QueryRowContext(ctx, "SELECT id, name, email, type, created_at FROM users WHERE id = ?", userID).
 		Scan(&user.ID, &user.Name, &user.Email, &user.Type, &user.CreatedAt)
 
 	if err != nil {
-		log.Printf("Error fetching created user: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "user created but could not retrieve"})
+		writeServerError(w, r, err, "Error fetching created user", "user created but could not retrieve")
+		return
+	}
+
+	// New accounts are held to the two-factor policy like any login, so a
+	// type that requires it gets an enrolment challenge rather than a session.
+	// A new account can't have 2FA enabled yet.
+	if twoFactorRequired(user.Type) {
+		writeLoginChallenge(w, r, user, false)
 		return
 	}
 
 	// Generate JWT token and store in database
-	token, err := generateToken(user)
+	token, err := generateToken(ctx, user)
 	if err != nil {
-		log.Printf("Error generating token: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to generate token"})
+		writeServerError(w, r, err, "Error generating token", "failed to generate token")
 		return
 	}
 
@@ -759,6 +1523,8 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -780,47 +1546,81 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Addresses failing across many accounts are turned away up front
+	wait, err := ipLoginWait(ctx, clientIP(r))
+	if err != nil {
+		writeServerError(w, r, err, "Error checking login attempts", "internal server error")
+		return
+	}
+	if wait > 0 {
+		loginFailures.inc("throttled")
+		writeLoginWait(w, wait, http.StatusTooManyRequests, "too many failed logins, try again later")
+		return
+	}
+
 	// Get user from database
 	var user User
-	err := db.QueryRow("SELECT id, name, email, password, type, created_at FROM users WHERE email = ?", req.Email).
-		Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.Type, &user.CreatedAt)
+	var totpEnabled bool
+	err = db.QueryRowContext(ctx, "SELECT id, name, email, password, type, created_at, totp_enabled FROM users WHERE email = ?", req.Email).
+		Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.Type, &user.CreatedAt, &totpEnabled)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
+			// Unknown addresses wait and lock like accounts do
+			wait, locked, failures, err := unknownEmailLoginWait(ctx, req.Email)
+			if err != nil {
+				writeServerError(w, r, err, "Error checking account lock", "internal server error")
+				return
+			}
+			if refuseLoginWait(w, wait, locked) {
+				return
+			}
+			reason := "unknown_user"
+			if failures+1 >= accountLockThreshold {
+				reason = "unknown_user_locked"
+			}
+			loginFailures.inc("unknown_user")
+			if err := recordLoginAttempt(ctx, r, 0, req.Email, false, reason); err != nil {
+				slog.ErrorContext(ctx, "Error recording login attempt", "error", err)
+			}
 			w.WriteHeader(http.StatusUnauthorized)
 			json.NewEncoder(w).Encode(map[string]string{"error": "invalid credentials"})
 			return
 		}
-		log.Printf("Error fetching user: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error fetching user", "internal server error")
+		return
+	}
+
+	// Locked accounts and ones that failed just now wait before the
+	// password is even checked
+	wait, locked, err := accountLoginWait(ctx, user.ID)
+	if err != nil {
+		writeServerError(w, r, err, "Error checking account lock", "internal server error")
+		return
+	}
+	if refuseLoginWait(w, wait, locked) {
 		return
 	}
 
 	// Check password
 	if !checkPasswordHash(req.Password, user.Password) {
+		loginFailures.inc("bad_password")
+		if err := recordLoginFailure(ctx, r, user, "bad_password"); err != nil {
+			slog.ErrorContext(ctx, "Error recording login failure", "error", err)
+		}
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(map[string]string{"error": "invalid credentials"})
 		return
 	}
 
-	// Generate JWT token and store in database
-	token, err := generateToken(user)
-	if err != nil {
-		log.Printf("Error generating token: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to generate token"})
+	// With two-factor authentication, or a policy requiring it, the session
+	// waits for the second step
+	if totpEnabled || twoFactorRequired(user.Type) {
+		writeLoginChallenge(w, r, user, totpEnabled)
 		return
 	}
 
-	// Don't send password in response
-	user.Password = ""
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"user":  user,
-		"token": token,
-	})
+	completeLogin(w, r, user, nil)
 }
 
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
@@ -839,11 +1639,9 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
 	// Delete token from database
-	_, err := db.Exec("DELETE FROM sessions WHERE token = ?", tokenString)
+	_, err := db.ExecContext(r.Context(), "DELETE FROM sessions WHERE token = ?", tokenString)
 	if err != nil {
-		log.Printf("Error deleting session: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to logout"})
+		writeServerError(w, r, err, "Error deleting session", "failed to logout")
 		return
 	}
 
@@ -856,18 +1654,42 @@ func healthHandler(w http.ResponseWriter, _ *http.Request) {
 	w.Write([]byte("OK"))
 }
 
-func getBusinessesHandler(w http.ResponseWriter, _ *http.Request) {
-	rows, err := db.Query(`
+func getBusinessesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// ?near=lat,lng&radius_km= searches by distance instead
+	near, ok, err := parseNearQuery(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if ok {
+		getNearbyBusinessesHandler(w, r, near)
+		return
+	}
+
+	// ?category=<slug> includes subcategories
+	categoryWhere, args, err := categoryFilter(r, "business", "category_id")
+	if err != nil {
+		writeCategoryError(w, r, err)
+		return
+	}
+	where := ""
+	if categoryWhere != "" {
+		where = "WHERE " + categoryWhere
+	}
+
+	rows, err := db.QueryContext(ctx, `
 		SELECT id, name, category, description, phone, email, address,
 		  (SELECT image_url FROM images WHERE entity_type = 'business' AND entity_id = businesses.id ORDER BY is_primary DESC, display_order ASC, created_at ASC LIMIT 1) as image_url,
-		  rating, created_at, owner_id
+		  rating, created_at, IFNULL(owner_id, 0), organization_id, verified, category_id, latitude, longitude
 		FROM businesses
+		`+where+`
 		ORDER BY created_at DESC
-	`)
+	`, args...)
 	if err != nil {
-		log.Printf("Error querying businesses: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error querying businesses", "internal server error")
 		return
 	}
 	defer rows.Close()
@@ -876,9 +1698,9 @@ func getBusinessesHandler(w http.ResponseWriter, _ *http.Request) {
 	for rows.Next() {
 		var b Business
 		var imageURL sql.NullString
-		err := rows.Scan(&b.ID, &b.Name, &b.Category, &b.Description, &b.Phone, &b.Email, &b.Address, &imageURL, &b.Rating, &b.CreatedAt, &b.OwnerID)
+		err := rows.Scan(&b.ID, &b.Name, &b.Category, &b.Description, &b.Phone, &b.Email, &b.Address, &imageURL, &b.Rating, &b.CreatedAt, &b.OwnerID, &b.OrganizationID, &b.Verified, &b.CategoryID, &b.Latitude, &b.Longitude)
 		if err != nil {
-			log.Printf("Error scanning business: %v", err)
+			slog.ErrorContext(r.Context(), "Error scanning business", "error", err)
 			continue
 		}
 		if imageURL.Valid {
@@ -886,12 +1708,33 @@ func getBusinessesHandler(w http.ResponseWriter, _ *http.Request) {
 		}
 		businesses = append(businesses, b)
 	}
+	rows.Close()
+
+	// Add open_now/next_open_at and apply the ?open_now=true filter, which
+	// can't be answered without the hours
+	openNow := r.URL.Query().Get("open_now") == "true"
+	if err := applyOpeningHours(ctx, businesses, false); err != nil {
+		if openNow {
+			writeServerError(w, r, err, "Error loading opening hours", "failed to load opening hours")
+			return
+		}
+		slog.ErrorContext(r.Context(), "Error loading opening hours", "error", err)
+	}
+	if openNow {
+		businesses = filterOpenNow(businesses)
+	}
+
+	if err := applyBusinessFavourites(r, businesses); err != nil {
+		slog.ErrorContext(r.Context(), "Error loading favourites", "error", err)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(businesses)
 }
 
 func createBusinessHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -906,13 +1749,17 @@ func createBusinessHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Name        string  `json:"name"`
-		Category    string  `json:"category"`
-		Description string  `json:"description"`
-		Phone       string  `json:"phone"`
-		Email       string  `json:"email"`
-		Address     string  `json:"address"`
-		Rating      float64 `json:"rating"`
+		OrganizationID *int     `json:"organization_id"`
+		Name           string   `json:"name"`
+		Category       string   `json:"category"`
+		CategoryID     *int     `json:"category_id"`
+		Description    string   `json:"description"`
+		Phone          string   `json:"phone"`
+		Email          string   `json:"email"`
+		Address        string   `json:"address"`
+		Rating         float64  `json:"rating"`
+		Latitude       *float64 `json:"latitude"`
+		Longitude      *float64 `json:"longitude"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -920,34 +1767,70 @@ func createBusinessHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Name == "" || req.Category == "" || req.Description == "" {
+	if req.Name == "" || (req.Category == "" && req.CategoryID == nil) || req.Description == "" {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{"error": "name, category, and description are required"})
 		return
 	}
 
-	result, err := db.Exec("INSERT INTO businesses (name, category, description, phone, email, address, rating, owner_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-		req.Name, req.Category, req.Description, req.Phone, req.Email, req.Address, req.Rating, ownerID)
+	category, err := requestCategory(ctx, "business", req.CategoryID, req.Category)
+	if err != nil {
+		writeCategoryError(w, r, err)
+		return
+	}
+
+	// The business belongs to an organisation; owner_id records who created it
+	orgID, err := listingOrganization(ctx, ownerID, r.Header.Get("X-User-Type"), req.OrganizationID)
+	if err != nil {
+		writeAuthzError(w, r, err, "organization not found", "you need a business owner account or a manager role in the organization")
+		return
+	}
+	var createdBy *int
+	if r.Header.Get("X-User-Type") == "business_owner" {
+		createdBy = &ownerID
+	}
+
+	if (req.Latitude != nil || req.Longitude != nil) && !validCoordinates(req.Latitude, req.Longitude) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "latitude and longitude must be given together and in range"})
+		return
+	}
+
+	result, err := db.ExecContext(ctx, "INSERT INTO businesses (name, category, category_id, description, phone, email, address, rating, owner_id, organization_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		req.Name, category.Name, category.ID, req.Description, req.Phone, req.Email, req.Address, req.Rating, createdBy, orgID)
 
 	if err != nil {
-		log.Printf("Error creating business: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create business"})
+		writeServerError(w, r, err, "Error creating business", "failed to create business")
 		return
 	}
 
 	id, _ := result.LastInsertId()
 	business := Business{
-		ID:          int(id),
-		Name:        req.Name,
-		Category:    req.Category,
-		Description: req.Description,
-		Phone:       req.Phone,
-		Email:       req.Email,
-		Address:     req.Address,
-		Rating:      req.Rating,
-		CreatedAt:   time.Now(),
-		OwnerID:     ownerID,
+		ID:             int(id),
+		Name:           req.Name,
+		Category:       category.Name,
+		CategoryID:     &category.ID,
+		Description:    req.Description,
+		Phone:          req.Phone,
+		Email:          req.Email,
+		Address:        req.Address,
+		Rating:         req.Rating,
+		CreatedAt:      time.Now(),
+		OrganizationID: &orgID,
+	}
+	if createdBy != nil {
+		business.OwnerID = ownerID
+	}
+
+	// Use supplied coordinates, otherwise geocode the address
+	if req.Latitude != nil {
+		if err := setCoordinates(ctx, "businesses", business.ID, *req.Latitude, *req.Longitude); err != nil {
+			slog.ErrorContext(r.Context(), "Error storing business coordinates", "error", err)
+		} else {
+			business.Latitude, business.Longitude = req.Latitude, req.Longitude
+		}
+	} else {
+		geocodeAsync(ctx, "businesses", business.ID, business.Address)
 	}
 
 	logEvent("business_created", "Business "+business.Name+" added to directory", business)
@@ -958,20 +1841,25 @@ func createBusinessHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func updateBusinessHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodPut {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
 	var req struct {
-		ID          int     `json:"id"`
-		Name        string  `json:"name"`
-		Category    string  `json:"category"`
-		Description string  `json:"description"`
-		Phone       string  `json:"phone"`
-		Email       string  `json:"email"`
-		Address     string  `json:"address"`
-		Rating      float64 `json:"rating"`
+		ID          int      `json:"id"`
+		Name        string   `json:"name"`
+		Category    string   `json:"category"`
+		CategoryID  *int     `json:"category_id"`
+		Description string   `json:"description"`
+		Phone       string   `json:"phone"`
+		Email       string   `json:"email"`
+		Address     string   `json:"address"`
+		Rating      float64  `json:"rating"`
+		Latitude    *float64 `json:"latitude"`
+		Longitude   *float64 `json:"longitude"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -979,6 +1867,18 @@ func updateBusinessHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if (req.Latitude != nil || req.Longitude != nil) && !validCoordinates(req.Latitude, req.Longitude) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "latitude and longitude must be given together and in range"})
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err := authorizeEntity(ctx, "business", req.ID, userID, permEditListing); err != nil {
+		writeAuthzError(w, r, err, "business not found", "you can only update your organization's businesses")
+		return
+	}
+
 	// Build update query dynamically
 	setParts := []string{}
 	args := []interface{}{}
@@ -987,9 +1887,14 @@ func updateBusinessHandler(w http.ResponseWriter, r *http.Request) {
 		setParts = append(setParts, "name = ?")
 		args = append(args, req.Name)
 	}
-	if req.Category != "" {
-		setParts = append(setParts, "category = ?")
-		args = append(args, req.Category)
+	category, err := requestCategory(ctx, "business", req.CategoryID, req.Category)
+	if err != nil {
+		writeCategoryError(w, r, err)
+		return
+	}
+	if category != nil {
+		setParts = append(setParts, "category = ?", "category_id = ?")
+		args = append(args, category.Name, category.ID)
 	}
 	if req.Description != "" {
 		setParts = append(setParts, "description = ?")
@@ -1011,6 +1916,10 @@ func updateBusinessHandler(w http.ResponseWriter, r *http.Request) {
 		setParts = append(setParts, "rating = ?")
 		args = append(args, req.Rating)
 	}
+	if req.Latitude != nil {
+		setParts = append(setParts, "latitude = ?", "longitude = ?", "geo_point = POINT(?, ?)")
+		args = append(args, *req.Latitude, *req.Longitude, *req.Longitude, *req.Latitude)
+	}
 
 	if len(setParts) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
@@ -1025,26 +1934,27 @@ func updateBusinessHandler(w http.ResponseWriter, r *http.Request) {
 	query += " WHERE id = ?"
 	args = append(args, req.ID)
 
-	_, err := db.Exec(query, args...)
+	_, err = db.ExecContext(ctx, query, args...)
 	if err != nil {
-		log.Printf("Error updating business: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update business"})
+		writeServerError(w, r, err, "Error updating business", "failed to update business")
 		return
 	}
 
 	// Get updated business
 	var business Business
-	err = db.QueryRow("SELECT id, name, category, description, phone, email, address, rating, created_at, owner_id FROM businesses WHERE id = ?", req.ID).
-		Scan(&business.ID, &business.Name, &business.Category, &business.Description, &business.Phone, &business.Email, &business.Address, &business.Rating, &business.CreatedAt, &business.OwnerID)
+	err = db.QueryRowContext(ctx, "SELECT id, name, category, description, phone, email, address, rating, created_at, IFNULL(owner_id, 0), organization_id, verified, category_id, latitude, longitude FROM businesses WHERE id = ?", req.ID).
+		Scan(&business.ID, &business.Name, &business.Category, &business.Description, &business.Phone, &business.Email, &business.Address, &business.Rating, &business.CreatedAt, &business.OwnerID, &business.OrganizationID, &business.Verified, &business.CategoryID, &business.Latitude, &business.Longitude)
 
 	if err != nil {
-		log.Printf("Error fetching updated business: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch updated business"})
+		writeServerError(w, r, err, "Error fetching updated business", "failed to fetch updated business")
 		return
 	}
 
+	// A new address without explicit coordinates needs geocoding again
+	if req.Address != "" && req.Latitude == nil {
+		geocodeAsync(ctx, "businesses", business.ID, business.Address)
+	}
+
 	logEvent("business_updated", "Business "+business.Name+" updated", business)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1052,6 +1962,8 @@ func updateBusinessHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func deleteBusinessHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodDelete {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -1066,9 +1978,15 @@ func deleteBusinessHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err := authorizeEntity(ctx, "business", req.ID, userID, permDeleteListing); err != nil {
+		writeAuthzError(w, r, err, "business not found", "only organization owners can delete businesses")
+		return
+	}
+
 	// Get business before deletion for logging
 	var business Business
-	err := db.QueryRow("SELECT id, name FROM businesses WHERE id = ?", req.ID).
+	err := db.QueryRowContext(ctx, "SELECT id, name FROM businesses WHERE id = ?", req.ID).
 		Scan(&business.ID, &business.Name)
 
 	if err != nil {
@@ -1077,19 +1995,46 @@ func deleteBusinessHandler(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(map[string]string{"error": "business not found"})
 			return
 		}
-		log.Printf("Error fetching business for deletion: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error fetching business for deletion", "internal server error")
+		return
+	}
+
+	// Delete the business together with its images
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		writeServerError(w, r, err, "Error starting transaction", "failed to delete business")
+		return
+	}
+	defer tx.Rollback()
+
+	imagePaths, err := deleteEntityImages(ctx, tx, "business", req.ID)
+	if err == nil {
+		err = deleteEntityFavourites(ctx, tx, "business", req.ID)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM follows WHERE target_type = 'business' AND target_id = ?", req.ID)
+	}
+	if err == nil {
+		var attachmentPaths []string
+		attachmentPaths, err = deleteEnquiryAttachments(ctx, tx, req.ID)
+		imagePaths = append(imagePaths, attachmentPaths...)
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error deleting business images", "failed to delete business")
 		return
 	}
 
-	_, err = db.Exec("DELETE FROM businesses WHERE id = ?", req.ID)
+	_, err = tx.ExecContext(ctx, "DELETE FROM businesses WHERE id = ?", req.ID)
 	if err != nil {
-		log.Printf("Error deleting business: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to delete business"})
+		writeServerError(w, r, err, "Error deleting business", "failed to delete business")
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		writeServerError(w, r, err, "Error committing business deletion", "failed to delete business")
 		return
 	}
+	removeImageFiles(imagePaths)
 
 	logEvent("business_deleted", "Business "+business.Name+" removed from directory", business)
 
@@ -1097,6 +2042,8 @@ func deleteBusinessHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func getBusinessByIDHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -1124,13 +2071,13 @@ func getBusinessByIDHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var business Business
-	err = db.QueryRow(`
+	err = db.QueryRowContext(ctx, `
 		SELECT id, name, category, description, phone, email, address,
 		  (SELECT image_url FROM images WHERE entity_type = 'business' AND entity_id = businesses.id ORDER BY is_primary DESC, display_order ASC, created_at ASC LIMIT 1) as image_url,
-		  rating, created_at, owner_id
+		  rating, created_at, IFNULL(owner_id, 0), organization_id, verified, category_id, latitude, longitude
 		FROM businesses WHERE id = ?
 	`, id).
-		Scan(&business.ID, &business.Name, &business.Category, &business.Description, &business.Phone, &business.Email, &business.Address, &business.ImageURL, &business.Rating, &business.CreatedAt, &business.OwnerID)
+		Scan(&business.ID, &business.Name, &business.Category, &business.Description, &business.Phone, &business.Email, &business.Address, &business.ImageURL, &business.Rating, &business.CreatedAt, &business.OwnerID, &business.OrganizationID, &business.Verified, &business.CategoryID, &business.Latitude, &business.Longitude)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -1138,16 +2085,22 @@ func getBusinessByIDHandler(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(map[string]string{"error": "business not found"})
 			return
 		}
-		log.Printf("Error fetching business: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error fetching business", "internal server error")
 		return
 	}
 
+	// Add the opening hours schedule and whether the business is open now
+	withHours := []Business{business}
+	if err := applyOpeningHours(ctx, withHours, true); err != nil {
+		slog.ErrorContext(r.Context(), "Error loading opening hours", "error", err)
+	}
+	if err := applyBusinessFavourites(r, withHours); err != nil {
+		slog.ErrorContext(r.Context(), "Error loading favourites", "error", err)
+	}
+	business = withHours[0]
+
 	// Track business view (optional - don't fail if it errors)
-	userIP := r.RemoteAddr
-	userAgent := r.UserAgent()
-	_, _ = db.Exec("INSERT INTO business_views (business_id, user_ip, user_agent) VALUES (?, ?, ?)", id, userIP, userAgent)
+	recordView(r, businessViews, id)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(business)
@@ -1167,18 +2120,18 @@ func getMyBusinessesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := db.Query(`
+	// Businesses of every organisation the user belongs to
+	scope, args := organizationScope("organization_id", ownerID, permViewListing)
+	rows, err := db.QueryContext(r.Context(), `
 				SELECT id, name, category, description, phone, email, address,
 					(SELECT image_url FROM images WHERE entity_type = 'business' AND entity_id = businesses.id ORDER BY is_primary DESC, display_order ASC, created_at ASC LIMIT 1) as image_url,
-					rating, created_at, owner_id
+					rating, created_at, IFNULL(owner_id, 0), organization_id, verified, category_id, latitude, longitude
 				FROM businesses
-				WHERE owner_id = ?
+				WHERE `+scope+`
 				ORDER BY created_at DESC
-		`, ownerID)
+		`, args...)
 	if err != nil {
-		log.Printf("Error querying user businesses: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error querying user businesses", "internal server error")
 		return
 	}
 	defer rows.Close()
@@ -1187,17 +2140,21 @@ func getMyBusinessesHandler(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var b Business
 		var imageURL sql.NullString
-		err := rows.Scan(&b.ID, &b.Name, &b.Category, &b.Description, &b.Phone, &b.Email, &b.Address, &imageURL, &b.Rating, &b.CreatedAt, &b.OwnerID)
+		err := rows.Scan(&b.ID, &b.Name, &b.Category, &b.Description, &b.Phone, &b.Email, &b.Address, &imageURL, &b.Rating, &b.CreatedAt, &b.OwnerID, &b.OrganizationID, &b.Verified, &b.CategoryID, &b.Latitude, &b.Longitude)
 		if err == nil && imageURL.Valid {
 			b.ImageURL = imageURL.String
 		}
 		if err != nil {
-			log.Printf("Error scanning business: %v", err)
+			slog.ErrorContext(r.Context(), "Error scanning business", "error", err)
 			continue
 		}
 		businesses = append(businesses, b)
 	}
 
+	if err := applyBusinessFavourites(r, businesses); err != nil {
+		slog.ErrorContext(r.Context(), "Error loading favourites", "error", err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(businesses)
 }
@@ -1216,44 +2173,50 @@ func getMyBusinessStatsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	from, to, interval, err := statsRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Stats cover the businesses of every organisation the user belongs to
+	scope, scopeArgs := organizationScope("organization_id", ownerID, permViewListing)
+
 	// Get business count
 	var businessCount int
-	err = db.QueryRow("SELECT COUNT(*) FROM businesses WHERE owner_id = ?", ownerID).Scan(&businessCount)
+	err = db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM businesses WHERE "+scope, scopeArgs...).Scan(&businessCount)
 	if err != nil {
-		log.Printf("Error counting businesses: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error counting businesses", "internal server error")
 		return
 	}
 
-	// Get total views for all owner's businesses
+	// Get all-time views for all owner's businesses from the daily rollups
 	var totalViews int
-	err = db.QueryRow("SELECT COUNT(*) FROM business_views WHERE business_id IN (SELECT id FROM businesses WHERE owner_id = ?)", ownerID).Scan(&totalViews)
+	err = db.QueryRowContext(r.Context(), "SELECT IFNULL(SUM(views), 0) FROM business_view_buckets WHERE granularity = 'day' AND business_id IN (SELECT id FROM businesses WHERE "+scope+")", scopeArgs...).Scan(&totalViews)
 	if err != nil {
-		log.Printf("Error counting business views: %v", err)
+		slog.ErrorContext(r.Context(), "Error counting business views", "error", err)
 		totalViews = 0 // Don't fail request if views table is unavailable
 	}
 
 	// Get average rating
 	var avgRating sql.NullFloat64
-	err = db.QueryRow("SELECT AVG(rating) FROM businesses WHERE owner_id = ? AND rating > 0", ownerID).Scan(&avgRating)
+	err = db.QueryRowContext(r.Context(), "SELECT AVG(rating) FROM businesses WHERE "+scope+" AND rating > 0", scopeArgs...).Scan(&avgRating)
 	if err != nil {
-		log.Printf("Error calculating average rating: %v", err)
+		slog.ErrorContext(r.Context(), "Error calculating average rating", "error", err)
 	}
 
-	// Get views per business
-	rows, err := db.Query(`
-		SELECT b.id, b.name, COUNT(bv.id) as view_count
+	// Get all-time views per business
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT b.id, b.name, IFNULL(SUM(v.views), 0) as view_count
 		FROM businesses b
-		LEFT JOIN business_views bv ON b.id = bv.business_id
-		WHERE b.owner_id = ?
+		LEFT JOIN business_view_buckets v ON b.id = v.business_id AND v.granularity = 'day'
+		WHERE b.`+scope+`
 		GROUP BY b.id, b.name
 		ORDER BY view_count DESC
-	`, ownerID)
+	`, scopeArgs...)
 	if err != nil {
-		log.Printf("Error querying business views: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error querying business views", "internal server error")
 		return
 	}
 	defer rows.Close()
@@ -1266,7 +2229,7 @@ func getMyBusinessStatsHandler(w http.ResponseWriter, r *http.Request) {
 		var viewCount int
 		err := rows.Scan(&id, &name, &viewCount)
 		if err != nil {
-			log.Printf("Error scanning business view: %v", err)
+			slog.ErrorContext(r.Context(), "Error scanning business view", "error", err)
 			continue
 		}
 		b = map[string]interface{}{
@@ -1277,11 +2240,22 @@ func getMyBusinessStatsHandler(w http.ResponseWriter, r *http.Request) {
 		businessViews = append(businessViews, b)
 	}
 
+	// Time series for the requested range
+	series, err := businessStatsSeries(r.Context(), scope, scopeArgs, from, to, interval)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying view series", "internal server error")
+		return
+	}
+
 	resp := map[string]interface{}{
 		"business_count": businessCount,
 		"total_views":    totalViews,
 		"average_rating": avgRating.Float64,
 		"business_views": businessViews,
+		"from":           from,
+		"to":             to,
+		"interval":       interval,
+		"series":         series,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1289,9 +2263,7 @@ func getMyBusinessStatsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func statsHandler(w http.ResponseWriter, r *http.Request) {
-	requestMutex.Lock()
-	count := requestCount
-	requestMutex.Unlock()
+	count := int(httpRequests.total())
 
 	uptime := time.Since(startTime).Seconds()
 	resp := map[string]interface{}{
@@ -1315,6 +2287,19 @@ func logEvent(eventType, message string, data interface{}) {
 	if len(eventLog) > 100 {
 		eventLog = eventLog[1:]
 	}
+	listeners := eventListeners
+	eventMutex.Unlock()
+
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+// onEvent registers a listener called for every logged event. Listeners run
+// on the request goroutine, so they must not block.
+func onEvent(listener func(SystemEvent)) {
+	eventMutex.Lock()
+	eventListeners = append(eventListeners, listener)
 	eventMutex.Unlock()
 }
 
@@ -1336,25 +2321,37 @@ func businessEventsRouter(w http.ResponseWriter, r *http.Request) {
 		// GET is public - no auth required
 		getBusinessEventsHandler(w, r)
 	case http.MethodPost:
-		// POST requires event owner or business owner auth
-		eventOwnerOnly(createBusinessEventHandler)(w, r)
+		// POST requires auth; the handler checks organisation roles
+		authMiddleware(createBusinessEventHandler)(w, r)
 	case http.MethodPut:
-		// PUT requires event owner or business owner auth
-		eventOwnerOnly(updateBusinessEventHandler)(w, r)
+		// PUT requires a role that can edit the event
+		authMiddleware(updateBusinessEventHandler)(w, r)
 	case http.MethodDelete:
-		// DELETE requires event owner or business owner auth
-		eventOwnerOnly(deleteBusinessEventHandler)(w, r)
+		// DELETE requires a role that can delete the event
+		authMiddleware(deleteBusinessEventHandler)(w, r)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
 func getBusinessEventsHandler(w http.ResponseWriter, r *http.Request) {
+	// ?near=lat,lng&radius_km= searches by distance instead
+	near, ok, err := parseNearQuery(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if ok {
+		getNearbyEventsHandler(w, r, near)
+		return
+	}
+
 	// Get optional business_id filter
 	businessIDStr := r.URL.Query().Get("business_id")
 
-	var rows *sql.Rows
-	var err error
+	where := "event_date >= NOW()"
+	args := []interface{}{}
 
 	if businessIDStr != "" {
 		businessID, err := strconv.Atoi(businessIDStr)
@@ -1363,29 +2360,31 @@ func getBusinessEventsHandler(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(map[string]string{"error": "invalid business ID"})
 			return
 		}
-		rows, err = db.Query(`
-			SELECT id, owner_id, business_id, title, description, event_date, location, price, category,
-			  (SELECT image_url FROM images WHERE entity_type = 'event' AND entity_id = events.id ORDER BY is_primary DESC, display_order ASC, created_at ASC LIMIT 1) as image_url,
-			  created_at
-			FROM events
-			WHERE business_id = ? AND event_date >= NOW()
-			ORDER BY event_date ASC
-		`, businessID)
-	} else {
-		rows, err = db.Query(`
-			SELECT id, owner_id, business_id, title, description, event_date, location, price, category,
-			  (SELECT image_url FROM images WHERE entity_type = 'event' AND entity_id = events.id ORDER BY is_primary DESC, display_order ASC, created_at ASC LIMIT 1) as image_url,
-			  created_at
-			FROM events
-			WHERE event_date >= NOW()
-			ORDER BY event_date ASC
-		`)
+		where = "business_id = ? AND " + where
+		args = append(args, businessID)
+	}
+
+	// ?category=<slug> includes subcategories
+	categoryWhere, categoryArgs, err := categoryFilter(r, "event", "category_id")
+	if err != nil {
+		writeCategoryError(w, r, err)
+		return
+	}
+	if categoryWhere != "" {
+		where += " AND " + categoryWhere
+		args = append(args, categoryArgs...)
 	}
 
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, owner_id, organization_id, business_id, title, description, event_date, location, price, category,
+		  (SELECT image_url FROM images WHERE entity_type = 'event' AND entity_id = events.id ORDER BY is_primary DESC, display_order ASC, created_at ASC LIMIT 1) as image_url,
+		  created_at, category_id, latitude, longitude
+		FROM events
+		WHERE `+where+`
+		ORDER BY event_date ASC
+	`, args...)
 	if err != nil {
-		log.Printf("Error querying events: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error querying events", "internal server error")
 		return
 	}
 	defer rows.Close()
@@ -1395,9 +2394,9 @@ func getBusinessEventsHandler(w http.ResponseWriter, r *http.Request) {
 		var e BusinessEvent
 		var businessID sql.NullInt64
 		var imageURL sql.NullString
-		err := rows.Scan(&e.ID, &e.OwnerID, &businessID, &e.Title, &e.Description, &e.EventDate, &e.Location, &e.Price, &e.Category, &imageURL, &e.CreatedAt)
+		err := rows.Scan(&e.ID, &e.OwnerID, &e.OrganizationID, &businessID, &e.Title, &e.Description, &e.EventDate, &e.Location, &e.Price, &e.Category, &imageURL, &e.CreatedAt, &e.CategoryID, &e.Latitude, &e.Longitude)
 		if err != nil {
-			log.Printf("Error scanning event: %v", err)
+			slog.ErrorContext(r.Context(), "Error scanning event", "error", err)
 			continue
 		}
 		if businessID.Valid {
@@ -1410,11 +2409,17 @@ func getBusinessEventsHandler(w http.ResponseWriter, r *http.Request) {
 		events = append(events, e)
 	}
 
+	if err := applyEventFavourites(r, events); err != nil {
+		slog.ErrorContext(r.Context(), "Error loading favourites", "error", err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(events)
 }
 
 func createBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -1431,13 +2436,17 @@ func createBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
 	userType := r.Header.Get("X-User-Type")
 
 	var req struct {
-		BusinessID  *int    `json:"business_id"`
-		Title       string  `json:"title"`
-		Description string  `json:"description"`
-		EventDate   string  `json:"event_date"`
-		Location    string  `json:"location"`
-		Price       float64 `json:"price"`
-		Category    string  `json:"category"`
+		OrganizationID *int     `json:"organization_id"`
+		BusinessID     *int     `json:"business_id"`
+		Title          string   `json:"title"`
+		Description    string   `json:"description"`
+		EventDate      string   `json:"event_date"`
+		Location       string   `json:"location"`
+		Price          float64  `json:"price"`
+		Category       string   `json:"category"`
+		CategoryID     *int     `json:"category_id"`
+		Latitude       *float64 `json:"latitude"`
+		Longitude      *float64 `json:"longitude"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -1451,31 +2460,43 @@ func createBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// If business_id is provided, verify ownership (only for business owners)
-	if req.BusinessID != nil && *req.BusinessID > 0 {
-		if userType == "business_owner" {
-			var businessOwnerID int
-			err = db.QueryRow("SELECT owner_id FROM businesses WHERE id = ?", *req.BusinessID).Scan(&businessOwnerID)
-			if err != nil {
-				if err == sql.ErrNoRows {
-					w.WriteHeader(http.StatusNotFound)
-					json.NewEncoder(w).Encode(map[string]string{"error": "business not found"})
-					return
-				}
-				log.Printf("Error checking business ownership: %v", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
-				return
-			}
+	// Category is optional for events
+	var categoryName *string
+	var categoryID *int
+	category, err := requestCategory(ctx, "event", req.CategoryID, req.Category)
+	if err != nil {
+		writeCategoryError(w, r, err)
+		return
+	}
+	if category != nil {
+		categoryName, categoryID = &category.Name, &category.ID
+	}
 
-			if businessOwnerID != ownerID {
-				w.WriteHeader(http.StatusForbidden)
-				json.NewEncoder(w).Encode(map[string]string{"error": "you can only create events for your own businesses"})
-				return
-			}
-		} else {
-			// Event owners can't link to businesses they don't own
-			req.BusinessID = nil
+	if (req.Latitude != nil || req.Longitude != nil) && !validCoordinates(req.Latitude, req.Longitude) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "latitude and longitude must be given together and in range"})
+		return
+	}
+
+	// Events for a business belong to the business's organisation; others go
+	// to the requested or the user's personal organisation
+	var orgID int
+	if req.BusinessID != nil && *req.BusinessID > 0 {
+		if err := authorizeEntity(ctx, "business", *req.BusinessID, ownerID, permCreateListing); err != nil {
+			writeAuthzError(w, r, err, "business not found", "you can only create events for your organization's businesses")
+			return
+		}
+		err = db.QueryRowContext(ctx, "SELECT organization_id FROM businesses WHERE id = ?", *req.BusinessID).Scan(&orgID)
+		if err != nil {
+			writeServerError(w, r, err, "Error fetching business organization", "internal server error")
+			return
+		}
+	} else {
+		req.BusinessID = nil
+		orgID, err = listingOrganization(ctx, ownerID, userType, req.OrganizationID)
+		if err != nil {
+			writeAuthzError(w, r, err, "organization not found", "you need an event owner account or a manager role in the organization")
+			return
 		}
 	}
 
@@ -1487,30 +2508,43 @@ func createBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := db.Exec(`
-		INSERT INTO events (owner_id, business_id, title, description, event_date, location, price, category)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, ownerID, req.BusinessID, req.Title, req.Description, eventDate, req.Location, req.Price, req.Category)
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO events (owner_id, organization_id, business_id, title, description, event_date, location, price, category, category_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, ownerID, orgID, req.BusinessID, req.Title, req.Description, eventDate, req.Location, req.Price, categoryName, categoryID)
 
 	if err != nil {
-		log.Printf("Error creating event: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create event"})
+		writeServerError(w, r, err, "Error creating event", "failed to create event")
 		return
 	}
 
 	id, _ := result.LastInsertId()
 	event := BusinessEvent{
-		ID:          int(id),
-		OwnerID:     ownerID,
-		BusinessID:  req.BusinessID,
-		Title:       req.Title,
-		Description: req.Description,
-		EventDate:   eventDate,
-		Location:    req.Location,
-		Price:       req.Price,
-		Category:    req.Category,
-		CreatedAt:   time.Now(),
+		ID:             int(id),
+		OwnerID:        ownerID,
+		OrganizationID: &orgID,
+		BusinessID:     req.BusinessID,
+		Title:          req.Title,
+		Description:    req.Description,
+		EventDate:      eventDate,
+		Location:       req.Location,
+		Price:          req.Price,
+		CategoryID:     categoryID,
+		CreatedAt:      time.Now(),
+	}
+	if category != nil {
+		event.Category = category.Name
+	}
+
+	// Use supplied coordinates, otherwise geocode the location
+	if req.Latitude != nil {
+		if err := setCoordinates(ctx, "events", event.ID, *req.Latitude, *req.Longitude); err != nil {
+			slog.ErrorContext(r.Context(), "Error storing event coordinates", "error", err)
+		} else {
+			event.Latitude, event.Longitude = req.Latitude, req.Longitude
+		}
+	} else {
+		geocodeAsync(ctx, "events", event.ID, event.Location)
 	}
 
 	logEvent("event_created", "Event "+event.Title+" created", event)
@@ -1521,6 +2555,8 @@ func createBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func updateBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodPut {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -1535,13 +2571,16 @@ func updateBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		ID          int     `json:"id"`
-		Title       string  `json:"title"`
-		Description string  `json:"description"`
-		EventDate   string  `json:"event_date"`
-		Location    string  `json:"location"`
-		Price       float64 `json:"price"`
-		Category    string  `json:"category"`
+		ID          int      `json:"id"`
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		EventDate   string   `json:"event_date"`
+		Location    string   `json:"location"`
+		Price       float64  `json:"price"`
+		Category    string   `json:"category"`
+		CategoryID  *int     `json:"category_id"`
+		Latitude    *float64 `json:"latitude"`
+		Longitude   *float64 `json:"longitude"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -1549,25 +2588,15 @@ func updateBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify event belongs to owner
-	var eventOwnerID int
-	err = db.QueryRow("SELECT owner_id FROM events WHERE id = ?", req.ID).Scan(&eventOwnerID)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]string{"error": "event not found"})
-			return
-		}
-		log.Printf("Error checking event ownership: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+	if (req.Latitude != nil || req.Longitude != nil) && !validCoordinates(req.Latitude, req.Longitude) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "latitude and longitude must be given together and in range"})
 		return
 	}
 
-	if eventOwnerID != ownerID {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(map[string]string{"error": "you can only update your own events"})
+	// Verify the user's role in the event's organisation allows editing
+	if err := authorizeEntity(ctx, "event", req.ID, ownerID, permEditListing); err != nil {
+		writeAuthzError(w, r, err, "event not found", "you can only update your organization's events")
 		return
 	}
 
@@ -1601,9 +2630,18 @@ func updateBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
 		setParts = append(setParts, "price = ?")
 		args = append(args, req.Price)
 	}
-	if req.Category != "" {
-		setParts = append(setParts, "category = ?")
-		args = append(args, req.Category)
+	category, err := requestCategory(ctx, "event", req.CategoryID, req.Category)
+	if err != nil {
+		writeCategoryError(w, r, err)
+		return
+	}
+	if category != nil {
+		setParts = append(setParts, "category = ?", "category_id = ?")
+		args = append(args, category.Name, category.ID)
+	}
+	if req.Latitude != nil {
+		setParts = append(setParts, "latitude = ?", "longitude = ?", "geo_point = POINT(?, ?)")
+		args = append(args, *req.Latitude, *req.Longitude, *req.Longitude, *req.Latitude)
 	}
 
 	if len(setParts) == 0 {
@@ -1619,22 +2657,20 @@ func updateBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
 	query += " WHERE id = ?"
 	args = append(args, req.ID)
 
-	_, err = db.Exec(query, args...)
+	_, err = db.ExecContext(ctx, query, args...)
 	if err != nil {
-		log.Printf("Error updating event: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update event"})
+		writeServerError(w, r, err, "Error updating event", "failed to update event")
 		return
 	}
 
 	// Get updated event
 	var event BusinessEvent
 	var businessID sql.NullInt64
-	err = db.QueryRow(`
-		SELECT id, owner_id, business_id, title, description, event_date, location, price, category, created_at
+	err = db.QueryRowContext(ctx, `
+		SELECT id, owner_id, organization_id, business_id, title, description, event_date, location, price, category, created_at, category_id, latitude, longitude
 		FROM events
 		WHERE id = ?
-	`, req.ID).Scan(&event.ID, &event.OwnerID, &businessID, &event.Title, &event.Description, &event.EventDate, &event.Location, &event.Price, &event.Category, &event.CreatedAt)
+	`, req.ID).Scan(&event.ID, &event.OwnerID, &event.OrganizationID, &businessID, &event.Title, &event.Description, &event.EventDate, &event.Location, &event.Price, &event.Category, &event.CreatedAt, &event.CategoryID, &event.Latitude, &event.Longitude)
 
 	if businessID.Valid {
 		bid := int(businessID.Int64)
@@ -1642,12 +2678,15 @@ func updateBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err != nil {
-		log.Printf("Error fetching updated event: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to fetch updated event"})
+		writeServerError(w, r, err, "Error fetching updated event", "failed to fetch updated event")
 		return
 	}
 
+	// A new location without explicit coordinates needs geocoding again
+	if req.Location != "" && req.Latitude == nil {
+		geocodeAsync(ctx, "events", event.ID, event.Location)
+	}
+
 	logEvent("event_updated", "Event "+event.Title+" updated", event)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1655,6 +2694,8 @@ func updateBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func deleteBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodDelete {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -1679,7 +2720,7 @@ func deleteBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Get event before deletion for logging and verification
 	var event BusinessEvent
-	err = db.QueryRow("SELECT id, title, owner_id FROM events WHERE id = ?", req.ID).Scan(&event.ID, &event.Title, &event.OwnerID)
+	err = db.QueryRowContext(ctx, "SELECT id, title, owner_id FROM events WHERE id = ?", req.ID).Scan(&event.ID, &event.Title, &event.OwnerID)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -1687,26 +2728,44 @@ func deleteBusinessEventHandler(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(map[string]string{"error": "event not found"})
 			return
 		}
-		log.Printf("Error fetching event for deletion: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error fetching event for deletion", "internal server error")
+		return
+	}
+
+	if err := authorizeEntity(ctx, "event", req.ID, ownerID, permDeleteListing); err != nil {
+		writeAuthzError(w, r, err, "event not found", "only organization owners can delete events")
+		return
+	}
+
+	// Delete the event together with its images
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		writeServerError(w, r, err, "Error starting transaction", "failed to delete event")
 		return
 	}
+	defer tx.Rollback()
 
-	if event.OwnerID != ownerID {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(map[string]string{"error": "you can only delete your own events"})
+	imagePaths, err := deleteEntityImages(ctx, tx, "event", req.ID)
+	if err == nil {
+		err = deleteEntityFavourites(ctx, tx, "event", req.ID)
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error deleting event images", "failed to delete event")
 		return
 	}
 
-	_, err = db.Exec("DELETE FROM events WHERE id = ?", req.ID)
+	_, err = tx.ExecContext(ctx, "DELETE FROM events WHERE id = ?", req.ID)
 	if err != nil {
-		log.Printf("Error deleting event: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to delete event"})
+		writeServerError(w, r, err, "Error deleting event", "failed to delete event")
 		return
 	}
 
+	if err = tx.Commit(); err != nil {
+		writeServerError(w, r, err, "Error committing event deletion", "failed to delete event")
+		return
+	}
+	removeImageFiles(imagePaths)
+
 	logEvent("event_deleted", "Event "+event.Title+" deleted", event)
 
 	w.WriteHeader(http.StatusOK)
@@ -1735,11 +2794,11 @@ func getEventByIDHandler(w http.ResponseWriter, r *http.Request) {
 
 	var event BusinessEvent
 	var businessID sql.NullInt64
-	err = db.QueryRow(`
-		SELECT id, owner_id, business_id, title, description, event_date, location, price, category, created_at
+	err = db.QueryRowContext(r.Context(), `
+		SELECT id, owner_id, organization_id, business_id, title, description, event_date, location, price, category, created_at, category_id, latitude, longitude
 		FROM events
 		WHERE id = ?
-	`, id).Scan(&event.ID, &event.OwnerID, &businessID, &event.Title, &event.Description, &event.EventDate, &event.Location, &event.Price, &event.Category, &event.CreatedAt)
+	`, id).Scan(&event.ID, &event.OwnerID, &event.OrganizationID, &businessID, &event.Title, &event.Description, &event.EventDate, &event.Location, &event.Price, &event.Category, &event.CreatedAt, &event.CategoryID, &event.Latitude, &event.Longitude)
 
 	if businessID.Valid {
 		bid := int(businessID.Int64)
@@ -1752,12 +2811,19 @@ func getEventByIDHandler(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(map[string]string{"error": "event not found"})
 			return
 		}
-		log.Printf("Error fetching event: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error fetching event", "internal server error")
 		return
 	}
 
+	withFavourites := []BusinessEvent{event}
+	if err := applyEventFavourites(r, withFavourites); err != nil {
+		slog.ErrorContext(r.Context(), "Error loading favourites", "error", err)
+	}
+	event = withFavourites[0]
+
+	// Track event view for organiser stats
+	recordView(r, eventViews, id)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(event)
 }
@@ -1776,19 +2842,19 @@ func getMyEventsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := db.Query(`
-		SELECT id, owner_id, business_id, title, description, event_date, location, price, category,
+	// Events of every organisation the user belongs to
+	scope, args := organizationScope("organization_id", ownerID, permViewListing)
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, owner_id, organization_id, business_id, title, description, event_date, location, price, category,
 		  (SELECT image_url FROM images WHERE entity_type = 'event' AND entity_id = events.id ORDER BY is_primary DESC, display_order ASC, created_at ASC LIMIT 1) as image_url,
-		  created_at
+		  created_at, category_id, latitude, longitude
 		FROM events
-		WHERE owner_id = ?
+		WHERE `+scope+`
 		ORDER BY event_date ASC
-	`, ownerID)
+	`, args...)
 
 	if err != nil {
-		log.Printf("Error querying user events: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error querying user events", "internal server error")
 		return
 	}
 	defer rows.Close()
@@ -1798,9 +2864,9 @@ func getMyEventsHandler(w http.ResponseWriter, r *http.Request) {
 		var e BusinessEvent
 		var businessID sql.NullInt64
 		var imageURL sql.NullString
-		err := rows.Scan(&e.ID, &e.OwnerID, &businessID, &e.Title, &e.Description, &e.EventDate, &e.Location, &e.Price, &e.Category, &imageURL, &e.CreatedAt)
+		err := rows.Scan(&e.ID, &e.OwnerID, &e.OrganizationID, &businessID, &e.Title, &e.Description, &e.EventDate, &e.Location, &e.Price, &e.Category, &imageURL, &e.CreatedAt, &e.CategoryID, &e.Latitude, &e.Longitude)
 		if err != nil {
-			log.Printf("Error scanning event: %v", err)
+			slog.ErrorContext(r.Context(), "Error scanning event", "error", err)
 			continue
 		}
 		if businessID.Valid {
@@ -1813,6 +2879,10 @@ func getMyEventsHandler(w http.ResponseWriter, r *http.Request) {
 		events = append(events, e)
 	}
 
+	if err := applyEventFavourites(r, events); err != nil {
+		slog.ErrorContext(r.Context(), "Error loading favourites", "error", err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(events)
 }
@@ -1825,8 +2895,8 @@ func bookingsRouter(w http.ResponseWriter, r *http.Request) {
 		// GET requires auth to view bookings
 		authMiddleware(getBookingsHandler)(w, r)
 	case http.MethodPost:
-		// POST is public - anyone can book
-		createBookingHandler(w, r)
+		// POST is public - anyone can book, within the rate limit
+		rateLimited(bookingRateLimit, createBookingHandler)(w, r)
 	case http.MethodPut:
 		// PUT requires auth to update booking status
 		authMiddleware(updateBookingHandler)(w, r)
@@ -1839,6 +2909,8 @@ func bookingsRouter(w http.ResponseWriter, r *http.Request) {
 }
 
 func createBookingHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -1866,28 +2938,24 @@ func createBookingHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Verify event exists
 	var eventID int
-	err := db.QueryRow("SELECT id FROM events WHERE id = ?", req.EventID).Scan(&eventID)
+	err := db.QueryRowContext(ctx, "SELECT id FROM events WHERE id = ?", req.EventID).Scan(&eventID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
 			json.NewEncoder(w).Encode(map[string]string{"error": "event not found"})
 			return
 		}
-		log.Printf("Error checking event: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error checking event", "internal server error")
 		return
 	}
 
-	result, err := db.Exec(`
+	result, err := db.ExecContext(ctx, `
 		INSERT INTO bookings (event_id, name, email, phone, tickets, notes, status)
 		VALUES (?, ?, ?, ?, ?, ?, 'pending')
 	`, req.EventID, req.Name, req.Email, req.Phone, req.Tickets, req.Notes)
 
 	if err != nil {
-		log.Printf("Error creating booking: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create booking"})
+		writeServerError(w, r, err, "Error creating booking", "failed to create booking")
 		return
 	}
 
@@ -1928,19 +2996,18 @@ func getBookingsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get bookings for events owned by this user
-	rows, err := db.Query(`
+	// Get bookings for events of organisations where the user may see them
+	scope, args := organizationScope("e.organization_id", ownerID, permViewBookings)
+	rows, err := db.QueryContext(r.Context(), `
 		SELECT b.id, b.event_id, b.name, b.email, b.phone, b.tickets, b.notes, b.status, b.created_at
 		FROM bookings b
 		INNER JOIN events e ON b.event_id = e.id
-		WHERE e.owner_id = ?
+		WHERE `+scope+`
 		ORDER BY b.created_at DESC
-	`, ownerID)
+	`, args...)
 
 	if err != nil {
-		log.Printf("Error querying bookings: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error querying bookings", "internal server error")
 		return
 	}
 	defer rows.Close()
@@ -1950,7 +3017,7 @@ func getBookingsHandler(w http.ResponseWriter, r *http.Request) {
 		var b Booking
 		err := rows.Scan(&b.ID, &b.EventID, &b.Name, &b.Email, &b.Phone, &b.Tickets, &b.Notes, &b.Status, &b.CreatedAt)
 		if err != nil {
-			log.Printf("Error scanning booking: %v", err)
+			slog.ErrorContext(r.Context(), "Error scanning booking", "error", err)
 			continue
 		}
 		bookings = append(bookings, b)
@@ -1961,6 +3028,8 @@ func getBookingsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func updateBookingHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodPut {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -1984,14 +3053,16 @@ func updateBookingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify booking belongs to user's event
-	var eventOwnerID int
-	err = db.QueryRow(`
-		SELECT e.owner_id
-		FROM bookings b
-		INNER JOIN events e ON b.event_id = e.id
-		WHERE b.id = ?
-	`, req.ID).Scan(&eventOwnerID)
+	if req.Status != "pending" && req.Status != "confirmed" && req.Status != "cancelled" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "status must be pending, confirmed or cancelled"})
+		return
+	}
+
+	// Verify the user may manage bookings for the booking's event
+	var booking Booking
+	err = db.QueryRowContext(ctx, "SELECT id, event_id, name, email, phone, tickets, notes, status, created_at FROM bookings WHERE id = ?", req.ID).
+		Scan(&booking.ID, &booking.EventID, &booking.Name, &booking.Email, &booking.Phone, &booking.Tickets, &booking.Notes, &booking.Status, &booking.CreatedAt)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -1999,32 +3070,44 @@ func updateBookingHandler(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(map[string]string{"error": "booking not found"})
 			return
 		}
-		log.Printf("Error checking booking ownership: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error checking booking ownership", "internal server error")
 		return
 	}
 
-	if eventOwnerID != ownerID {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(map[string]string{"error": "you can only update bookings for your own events"})
+	if err := authorizeEntity(ctx, "event", booking.EventID, ownerID, permManageBookings); err != nil {
+		writeAuthzError(w, r, err, "booking not found", "you can only update bookings for your organization's events")
 		return
 	}
 
-	// Update booking status
-	_, err = db.Exec("UPDATE bookings SET status = ? WHERE id = ?", req.Status, req.ID)
+	// Update booking status, stamping confirmations and cancellations for stats
+	query := "UPDATE bookings SET status = ? WHERE id = ?"
+	if booking.Status != req.Status {
+		switch req.Status {
+		case "confirmed":
+			query = "UPDATE bookings SET status = ?, confirmed_at = CURRENT_TIMESTAMP WHERE id = ?"
+		case "cancelled":
+			query = "UPDATE bookings SET status = ?, cancelled_at = CURRENT_TIMESTAMP WHERE id = ?"
+		}
+	}
+	_, err = db.ExecContext(ctx, query, req.Status, req.ID)
 	if err != nil {
-		log.Printf("Error updating booking: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update booking"})
+		writeServerError(w, r, err, "Error updating booking", "failed to update booking")
 		return
 	}
 
+	if booking.Status != req.Status {
+		booking.Status = req.Status
+		logEvent("booking_updated", fmt.Sprintf("Booking %d for event %d %s", booking.ID, booking.EventID, booking.Status),
+			BookingEvent{BookingID: booking.ID, EventID: booking.EventID, Status: booking.Status})
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "booking updated successfully"})
 }
 
 func deleteBookingHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodDelete {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -2047,14 +3130,9 @@ func deleteBookingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify booking belongs to user's event
-	var eventOwnerID int
-	err = db.QueryRow(`
-		SELECT e.owner_id
-		FROM bookings b
-		INNER JOIN events e ON b.event_id = e.id
-		WHERE b.id = ?
-	`, req.ID).Scan(&eventOwnerID)
+	// Verify the user may manage bookings for the booking's event
+	var eventID int
+	err = db.QueryRowContext(ctx, "SELECT event_id FROM bookings WHERE id = ?", req.ID).Scan(&eventID)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -2062,23 +3140,18 @@ func deleteBookingHandler(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(map[string]string{"error": "booking not found"})
 			return
 		}
-		log.Printf("Error checking booking ownership: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error checking booking ownership", "internal server error")
 		return
 	}
 
-	if eventOwnerID != ownerID {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(map[string]string{"error": "you can only delete bookings for your own events"})
+	if err := authorizeEntity(ctx, "event", eventID, ownerID, permManageBookings); err != nil {
+		writeAuthzError(w, r, err, "booking not found", "you can only delete bookings for your organization's events")
 		return
 	}
 
-	_, err = db.Exec("DELETE FROM bookings WHERE id = ?", req.ID)
+	_, err = db.ExecContext(ctx, "DELETE FROM bookings WHERE id = ?", req.ID)
 	if err != nil {
-		log.Printf("Error deleting booking: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to delete booking"})
+		writeServerError(w, r, err, "Error deleting booking", "failed to delete booking")
 		return
 	}
 
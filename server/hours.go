@@ -0,0 +1,466 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // business timezones must resolve without system zoneinfo
+)
+
+// Opening hours are a weekly schedule of time ranges plus dated exceptions
+// that replace the schedule for a single day. Times are wall-clock times in
+// the business's timezone. A range whose closing time is not after its
+// opening time runs past midnight into the next day, and "00:00"-"24:00"
+// (or any range with equal opening and closing times) means open all day.
+
+const hoursLookahead = 14 // days searched for the next opening
+
+// HoursRange is one opening period in the weekly schedule
+type HoursRange struct {
+	Weekday int    `json:"weekday"` // 0 = Sunday ... 6 = Saturday
+	Opens   string `json:"opens"`   // "HH:MM"
+	Closes  string `json:"closes"`  // "HH:MM", "24:00" for midnight
+}
+
+// HoursException overrides the weekly schedule on one date. A closed
+// exception closes the business all day; otherwise the date's exceptions
+// together list its opening periods.
+type HoursException struct {
+	Date   string `json:"date"` // "YYYY-MM-DD"
+	Closed bool   `json:"closed"`
+	Opens  string `json:"opens,omitempty"`
+	Closes string `json:"closes,omitempty"`
+	Note   string `json:"note,omitempty"`
+}
+
+// OpeningHours is the full schedule of a business
+type OpeningHours struct {
+	Timezone   string           `json:"timezone"`
+	Weekly     []HoursRange     `json:"weekly"`
+	Exceptions []HoursException `json:"exceptions"`
+}
+
+// hoursStatus is what the schedule says about a moment in time
+type hoursStatus struct {
+	OpenNow    bool
+	ClosesAt   *time.Time
+	NextOpenAt *time.Time
+}
+
+// migrateHours adds the per-business timezone
+func migrateHours(ctx context.Context) error {
+	return addColumnIfMissing(ctx, "businesses", "timezone", "VARCHAR(64) NOT NULL DEFAULT 'UTC'")
+}
+
+// parseClock parses "HH:MM" into minutes after midnight, allowing "24:00"
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 || len(parts[0]) != 2 || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("invalid time %q, use HH:MM", s)
+	}
+	h, errH := strconv.Atoi(parts[0])
+	m, errM := strconv.Atoi(parts[1])
+	if errH != nil || errM != nil || h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("invalid time %q, use HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// dayInterval turns an opening period on a local date into absolute times,
+// carrying overnight periods into the next day
+func dayInterval(date time.Time, opens, closes int) (time.Time, time.Time) {
+	y, m, d := date.Date()
+	loc := date.Location()
+	start := time.Date(y, m, d, 0, opens, 0, 0, loc)
+	if closes <= opens {
+		closes += 24 * 60
+	}
+	return start, time.Date(y, m, d, 0, closes, 0, 0, loc)
+}
+
+// intervals returns the opening periods that start on the given local date
+func (h *OpeningHours) intervals(date time.Time) [][2]time.Time {
+	dateStr := date.Format("2006-01-02")
+
+	var ranges [][2]int
+	overridden := false
+	for _, ex := range h.Exceptions {
+		if ex.Date != dateStr {
+			continue
+		}
+		overridden = true
+		if ex.Closed {
+			return nil
+		}
+		opens, errO := parseClock(ex.Opens)
+		closes, errC := parseClock(ex.Closes)
+		if errO == nil && errC == nil {
+			ranges = append(ranges, [2]int{opens, closes})
+		}
+	}
+	if !overridden {
+		for _, wr := range h.Weekly {
+			if wr.Weekday != int(date.Weekday()) {
+				continue
+			}
+			opens, errO := parseClock(wr.Opens)
+			closes, errC := parseClock(wr.Closes)
+			if errO == nil && errC == nil {
+				ranges = append(ranges, [2]int{opens, closes})
+			}
+		}
+	}
+
+	result := make([][2]time.Time, 0, len(ranges))
+	for _, rg := range ranges {
+		start, end := dayInterval(date, rg[0], rg[1])
+		result = append(result, [2]time.Time{start, end})
+	}
+	return result
+}
+
+// status evaluates the schedule at t
+func (h *OpeningHours) status(t time.Time) hoursStatus {
+	loc, err := time.LoadLocation(h.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	t = t.In(loc)
+	y, m, d := t.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, loc)
+
+	var st hoursStatus
+	// Start from yesterday so overnight periods are taken into account
+	for i := -1; i <= hoursLookahead; i++ {
+		for _, iv := range h.intervals(today.AddDate(0, 0, i)) {
+			start, end := iv[0], iv[1]
+			if !t.Before(start) && t.Before(end) {
+				st.OpenNow = true
+				if st.ClosesAt == nil || end.After(*st.ClosesAt) {
+					closes := end
+					st.ClosesAt = &closes
+				}
+			} else if start.After(t) && (st.NextOpenAt == nil || start.Before(*st.NextOpenAt)) {
+				next := start
+				st.NextOpenAt = &next
+			}
+		}
+	}
+	if st.OpenNow {
+		st.NextOpenAt = nil
+	}
+	return st
+}
+
+// validate checks the schedule before it is stored
+func (h *OpeningHours) validate() error {
+	if h.Timezone == "" {
+		h.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(h.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", h.Timezone)
+	}
+	for _, wr := range h.Weekly {
+		if wr.Weekday < 0 || wr.Weekday > 6 {
+			return errors.New("weekday must be between 0 (Sunday) and 6 (Saturday)")
+		}
+		if _, err := parseClock(wr.Opens); err != nil {
+			return err
+		}
+		if _, err := parseClock(wr.Closes); err != nil {
+			return err
+		}
+	}
+	for _, ex := range h.Exceptions {
+		if _, err := time.Parse("2006-01-02", ex.Date); err != nil {
+			return fmt.Errorf("invalid date %q, use YYYY-MM-DD", ex.Date)
+		}
+		if ex.Closed {
+			continue
+		}
+		if _, err := parseClock(ex.Opens); err != nil {
+			return err
+		}
+		if _, err := parseClock(ex.Closes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadOpeningHours loads the schedules of several businesses in three
+// queries. Businesses without a stored schedule are left out of the result.
+// Exceptions older than yesterday no longer matter and are skipped.
+func loadOpeningHours(ctx context.Context, businessIDs []int) (map[int]*OpeningHours, error) {
+	result := make(map[int]*OpeningHours)
+	if len(businessIDs) == 0 {
+		return result, nil
+	}
+
+	placeholders := "?" + strings.Repeat(", ?", len(businessIDs)-1)
+	args := make([]interface{}, len(businessIDs))
+	for i, id := range businessIDs {
+		args[i] = id
+	}
+
+	timezones := make(map[int]string)
+	rows, err := db.QueryContext(ctx, "SELECT id, timezone FROM businesses WHERE id IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int
+		var tz string
+		if err := rows.Scan(&id, &tz); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		timezones[id] = tz
+	}
+	rows.Close()
+
+	get := func(id int) *OpeningHours {
+		h, ok := result[id]
+		if !ok {
+			h = &OpeningHours{Timezone: timezones[id], Weekly: []HoursRange{}, Exceptions: []HoursException{}}
+			result[id] = h
+		}
+		return h
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT business_id, weekday, opens_at, closes_at FROM business_hours
+		WHERE business_id IN (`+placeholders+`)
+		ORDER BY business_id, weekday, opens_at
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id, weekday, opens, closes int
+		if err := rows.Scan(&id, &weekday, &opens, &closes); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		h := get(id)
+		h.Weekly = append(h.Weekly, HoursRange{Weekday: weekday, Opens: formatClock(opens), Closes: formatClock(closes)})
+	}
+	rows.Close()
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT business_id, exception_date, closed, opens_at, closes_at, note FROM business_hour_exceptions
+		WHERE business_id IN (`+placeholders+`) AND exception_date >= CURDATE() - INTERVAL 1 DAY
+		ORDER BY business_id, exception_date, opens_at
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var date time.Time
+		var closed bool
+		var opens, closes sql.NullInt64
+		var note sql.NullString
+		if err := rows.Scan(&id, &date, &closed, &opens, &closes, &note); err != nil {
+			return nil, err
+		}
+		ex := HoursException{Date: date.Format("2006-01-02"), Closed: closed, Note: note.String}
+		if !closed && opens.Valid && closes.Valid {
+			ex.Opens = formatClock(int(opens.Int64))
+			ex.Closes = formatClock(int(closes.Int64))
+		}
+		h := get(id)
+		h.Exceptions = append(h.Exceptions, ex)
+	}
+	return result, rows.Err()
+}
+
+// applyOpeningHours fills in hours, open_now and next_open_at on businesses
+func applyOpeningHours(ctx context.Context, businesses []Business, withSchedule bool) error {
+	ids := make([]int, len(businesses))
+	for i, b := range businesses {
+		ids[i] = b.ID
+	}
+	schedules, err := loadOpeningHours(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range businesses {
+		h, ok := schedules[businesses[i].ID]
+		if !ok {
+			continue
+		}
+		st := h.status(now)
+		businesses[i].OpenNow = &st.OpenNow
+		businesses[i].ClosesAt = st.ClosesAt
+		businesses[i].NextOpenAt = st.NextOpenAt
+		if withSchedule {
+			businesses[i].Hours = h
+		}
+	}
+	return nil
+}
+
+// filterOpenNow keeps the businesses that are open right now. It expects
+// applyOpeningHours to have run; businesses without hours are dropped.
+func filterOpenNow(businesses []Business) []Business {
+	open := []Business{}
+	for _, b := range businesses {
+		if b.OpenNow != nil && *b.OpenNow {
+			open = append(open, b)
+		}
+	}
+	return open
+}
+
+// businessHoursRouter serves GET (public) and PUT (owner) on /business-hours
+func businessHoursRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getBusinessHoursHandler(w, r)
+	case http.MethodPut:
+		authMiddleware(updateBusinessHoursHandler)(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Get the opening hours of a business
+func getBusinessHoursHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	businessID, err := strconv.Atoi(r.URL.Query().Get("business_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid business ID"})
+		return
+	}
+
+	var tz string
+	err = db.QueryRowContext(ctx, "SELECT timezone FROM businesses WHERE id = ?", businessID).Scan(&tz)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "business not found"})
+			return
+		}
+		writeServerError(w, r, err, "Error fetching business timezone", "internal server error")
+		return
+	}
+
+	schedules, err := loadOpeningHours(ctx, []int{businessID})
+	if err != nil {
+		writeServerError(w, r, err, "Error loading opening hours", "internal server error")
+		return
+	}
+	hours, ok := schedules[businessID]
+	if !ok {
+		hours = &OpeningHours{Timezone: tz, Weekly: []HoursRange{}, Exceptions: []HoursException{}}
+	}
+
+	st := hours.status(time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"business_id":  businessID,
+		"hours":        hours,
+		"open_now":     st.OpenNow,
+		"closes_at":    st.ClosesAt,
+		"next_open_at": st.NextOpenAt,
+	})
+}
+
+// Replace the opening hours of a business
+func updateBusinessHoursHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid user ID"})
+		return
+	}
+
+	var req struct {
+		BusinessID int `json:"business_id"`
+		OpeningHours
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if err := req.OpeningHours.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := authorizeEntity(ctx, "business", req.BusinessID, userID, permEditListing); err != nil {
+		writeAuthzError(w, r, err, "business not found", "you can only update hours for your organization's businesses")
+		return
+	}
+
+	err = func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.ExecContext(ctx, "UPDATE businesses SET timezone = ? WHERE id = ?", req.Timezone, req.BusinessID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM business_hours WHERE business_id = ?", req.BusinessID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM business_hour_exceptions WHERE business_id = ?", req.BusinessID); err != nil {
+			return err
+		}
+		for _, wr := range req.Weekly {
+			opens, _ := parseClock(wr.Opens)
+			closes, _ := parseClock(wr.Closes)
+			_, err := tx.ExecContext(ctx, "INSERT INTO business_hours (business_id, weekday, opens_at, closes_at) VALUES (?, ?, ?, ?)",
+				req.BusinessID, wr.Weekday, opens, closes)
+			if err != nil {
+				return err
+			}
+		}
+		for _, ex := range req.Exceptions {
+			var opens, closes interface{}
+			if !ex.Closed {
+				o, _ := parseClock(ex.Opens)
+				c, _ := parseClock(ex.Closes)
+				opens, closes = o, c
+			}
+			_, err := tx.ExecContext(ctx, "INSERT INTO business_hour_exceptions (business_id, exception_date, closed, opens_at, closes_at, note) VALUES (?, ?, ?, ?, ?, ?)",
+				req.BusinessID, ex.Date, ex.Closed, opens, closes, ex.Note)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		writeServerError(w, r, err, "Error updating opening hours", "failed to update opening hours")
+		return
+	}
+
+	logEvent("business_hours_updated", fmt.Sprintf("Opening hours updated for business %d", req.BusinessID), req)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "opening hours updated successfully"})
+}
@@ -1,11 +1,13 @@
 package server
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -17,6 +19,10 @@ import (
 const (
 	maxUploadSize = 10 << 20 // 10 MB
 	uploadDir     = "./uploads"
+
+	// Images of private entity types are kept outside uploadDir and served
+	// by handlers that check who is asking
+	privateUploadDir = "./private-uploads"
 )
 
 type Image struct {
@@ -47,6 +53,12 @@ func InitImageStorage() error {
 	if err := os.MkdirAll(uploadDir, 0755); err != nil {
 		return fmt.Errorf("failed to create upload directory: %v", err)
 	}
+	if err := os.MkdirAll(tusDir, 0755); err != nil {
+		return fmt.Errorf("failed to create resumable upload directory: %v", err)
+	}
+	if err := os.MkdirAll(privateUploadDir, 0700); err != nil {
+		return fmt.Errorf("failed to create private upload directory: %v", err)
+	}
 	return nil
 }
 
@@ -73,7 +85,13 @@ func getImagesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := db.Query(`
+	if et, ok := entityTypes[entityType]; !ok || et.Private {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown entity_type"})
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
 		SELECT id, entity_type, entity_id, image_url, storage_path, caption, display_order, is_primary, uploaded_by, created_at
 		FROM images
 		WHERE entity_type = ? AND entity_id = ?
@@ -81,9 +99,7 @@ func getImagesHandler(w http.ResponseWriter, r *http.Request) {
 	`, entityType, entityID)
 
 	if err != nil {
-		log.Printf("Error querying images: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error querying images", "internal server error")
 		return
 	}
 	defer rows.Close()
@@ -96,7 +112,7 @@ func getImagesHandler(w http.ResponseWriter, r *http.Request) {
 
 		err := rows.Scan(&img.ID, &img.EntityType, &img.EntityID, &img.ImageURL, &storagePath, &caption, &img.DisplayOrder, &img.IsPrimary, &uploadedBy, &img.CreatedAt)
 		if err != nil {
-			log.Printf("Error scanning image: %v", err)
+			slog.ErrorContext(r.Context(), "Error scanning image", "error", err)
 			continue
 		}
 
@@ -118,8 +134,115 @@ func getImagesHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(images)
 }
 
+var (
+	errImageFile   = errors.New("failed to save file")
+	errImageRecord = errors.New("failed to save image record")
+)
+
+// imageUpload describes an image file being stored for an entity
+type imageUpload struct {
+	EntityType       string
+	EntityID         int
+	Caption          string
+	IsPrimary        bool
+	UploadedBy       *int
+	OriginalFilename string
+	ContentType      string
+}
+
+// storeImage writes an image to the upload directory and creates its images
+// and image_metadata records. Every upload path goes through here so stored
+// files and records are created the same way.
+func storeImage(ctx context.Context, src io.Reader, up imageUpload) (Image, error) {
+	// Generate unique filename
+	ext := filepath.Ext(up.OriginalFilename)
+	filename := fmt.Sprintf("%s_%d_%d%s", up.EntityType, up.EntityID, time.Now().UnixNano(), ext)
+	storagePath := filepath.Join(uploadDir, filename)
+	imageURL := fmt.Sprintf("/uploads/%s", filename)
+	perm := os.FileMode(0644)
+	if entityTypes[up.EntityType].Private {
+		// No public URL; the entity's own handlers serve the file
+		storagePath = filepath.Join(privateUploadDir, filename)
+		imageURL = ""
+		perm = 0600
+	}
+
+	// Create file
+	dst, err := os.OpenFile(storagePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return Image{}, fmt.Errorf("%w: %v", errImageFile, err)
+	}
+	defer dst.Close()
+
+	// Copy file content
+	fileSize, err := io.Copy(dst, src)
+	if err != nil {
+		os.Remove(storagePath)
+		return Image{}, fmt.Errorf("%w: %v", errImageFile, err)
+	}
+
+	image := Image{
+		EntityType:  up.EntityType,
+		EntityID:    up.EntityID,
+		ImageURL:    imageURL,
+		StoragePath: storagePath,
+		Caption:     up.Caption,
+		IsPrimary:   up.IsPrimary,
+		UploadedBy:  up.UploadedBy,
+		CreatedAt:   time.Now(),
+	}
+
+	// Insert image record and metadata
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		os.Remove(storagePath)
+		return Image{}, fmt.Errorf("%w: %v", errImageRecord, err)
+	}
+	defer tx.Rollback()
+
+	if err = insertImage(ctx, tx, &image); err != nil {
+		os.Remove(storagePath) // Clean up file
+		if errors.Is(err, errUnknownEntityType) || errors.Is(err, errEntityNotFound) {
+			return Image{}, err
+		}
+		return Image{}, fmt.Errorf("%w: %v", errImageRecord, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO image_metadata (image_id, file_size, mime_type, original_filename)
+		VALUES (?, ?, ?, ?)
+	`, image.ID, fileSize, up.ContentType, up.OriginalFilename)
+	if err != nil {
+		slog.Error("Error inserting image metadata", "error", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		os.Remove(storagePath)
+		return Image{}, fmt.Errorf("%w: %v", errImageRecord, err)
+	}
+
+	return image, nil
+}
+
+// writeStoreImageError writes the response for an error returned by storeImage
+func writeStoreImageError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errUnknownEntityType) || errors.Is(err, errEntityNotFound) {
+		writeEntityError(w, r, err)
+		return
+	}
+	slog.ErrorContext(r.Context(), "Error storing image", "error", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	if errors.Is(err, errImageFile) {
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to save file"})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"error": "failed to save image record"})
+}
+
 // Upload image for an entity
 func uploadImageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -152,6 +275,12 @@ func uploadImageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Verify the entity exists before storing anything for it
+	if err := checkEntity(ctx, entityType, entityID); err != nil {
+		writeEntityError(w, r, err)
+		return
+	}
+
 	isPrimary := isPrimaryStr == "true"
 
 	// Get user ID from auth
@@ -181,96 +310,32 @@ func uploadImageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate unique filename
-	ext := filepath.Ext(header.Filename)
-	filename := fmt.Sprintf("%s_%d_%d%s", entityType, entityID, time.Now().Unix(), ext)
-	filepath := filepath.Join(uploadDir, filename)
-
-	// Create file
-	dst, err := os.Create(filepath)
+	image, err := storeImage(ctx, file, imageUpload{
+		EntityType:       entityType,
+		EntityID:         entityID,
+		Caption:          caption,
+		IsPrimary:        isPrimary,
+		UploadedBy:       uploadedBy,
+		OriginalFilename: header.Filename,
+		ContentType:      contentType,
+	})
 	if err != nil {
-		log.Printf("Error creating file: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to save file"})
+		writeStoreImageError(w, r, err)
 		return
 	}
-	defer dst.Close()
 
-	// Copy file content
-	fileSize, err := io.Copy(dst, file)
-	if err != nil {
-		log.Printf("Error copying file: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to save file"})
-		return
-	}
-
-	// Generate URL for the uploaded file
-	imageURL := fmt.Sprintf("/uploads/%s", filename)
-
-	// If this is primary, unset other primary images
-	if isPrimary {
-		_, err = db.Exec("UPDATE images SET is_primary = FALSE WHERE entity_type = ? AND entity_id = ?", entityType, entityID)
-		if err != nil {
-			log.Printf("Error unsetting primary images: %v", err)
-		}
-	}
-
-	// Get next display order
-	var maxOrder sql.NullInt64
-	err = db.QueryRow("SELECT MAX(display_order) FROM images WHERE entity_type = ? AND entity_id = ?", entityType, entityID).Scan(&maxOrder)
-	displayOrder := 0
-	if maxOrder.Valid {
-		displayOrder = int(maxOrder.Int64) + 1
-	}
-
-	// Insert image record
-	result, err := db.Exec(`
-		INSERT INTO images (entity_type, entity_id, image_url, storage_path, caption, display_order, is_primary, uploaded_by)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-	`, entityType, entityID, imageURL, filepath, caption, displayOrder, isPrimary, uploadedBy)
-
-	if err != nil {
-		log.Printf("Error inserting image record: %v", err)
-		os.Remove(filepath) // Clean up file
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to save image record"})
-		return
-	}
-
-	imageID, _ := result.LastInsertId()
-
-	// Insert metadata
-	_, err = db.Exec(`
-		INSERT INTO image_metadata (image_id, file_size, mime_type, original_filename)
-		VALUES (?, ?, ?, ?)
-	`, imageID, fileSize, contentType, header.Filename)
-
-	if err != nil {
-		log.Printf("Error inserting image metadata: %v", err)
-	}
-
-	// Return created image
-	image := Image{
-		ID:           int(imageID),
-		EntityType:   entityType,
-		EntityID:     entityID,
-		ImageURL:     imageURL,
-		StoragePath:  filepath,
-		Caption:      caption,
-		DisplayOrder: displayOrder,
-		IsPrimary:    isPrimary,
-		UploadedBy:   uploadedBy,
-		CreatedAt:    time.Now(),
-	}
+	logEvent("image_uploaded", fmt.Sprintf("Image %d added to %s %d", image.ID, image.EntityType, image.EntityID), image)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(image)
 }
 
-// Add image by URL (for external images)
+// Add image by URL (for external images). With "mirror": true the image is
+// downloaded and stored like an upload instead of being hotlinked.
 func addImageURLHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -282,6 +347,7 @@ func addImageURLHandler(w http.ResponseWriter, r *http.Request) {
 		ImageURL   string `json:"image_url"`
 		Caption    string `json:"caption"`
 		IsPrimary  bool   `json:"is_primary"`
+		Mirror     bool   `json:"mirror"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -296,6 +362,20 @@ func addImageURLHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	imageURL, err := parseImageURL(req.ImageURL)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "image_url must be an http or https URL"})
+		return
+	}
+	req.ImageURL = imageURL.String()
+
+	// Verify the entity exists before storing anything for it
+	if err := checkEntity(ctx, req.EntityType, req.EntityID); err != nil {
+		writeEntityError(w, r, err)
+		return
+	}
+
 	// Get user ID from auth
 	userIDStr := r.Header.Get("X-User-ID")
 	var uploadedBy *int
@@ -306,48 +386,70 @@ func addImageURLHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// If this is primary, unset other primary images
-	if req.IsPrimary {
-		_, err := db.Exec("UPDATE images SET is_primary = FALSE WHERE entity_type = ? AND entity_id = ?", req.EntityType, req.EntityID)
+	if req.Mirror {
+		image, err := mirrorRemoteImage(r.Context(), imageURL, imageUpload{
+			EntityType: req.EntityType,
+			EntityID:   req.EntityID,
+			Caption:    req.Caption,
+			IsPrimary:  req.IsPrimary,
+			UploadedBy: uploadedBy,
+		})
 		if err != nil {
-			log.Printf("Error unsetting primary images: %v", err)
+			switch {
+			case errors.Is(err, errImageFile), errors.Is(err, errImageRecord):
+				writeStoreImageError(w, r, err)
+			case errors.Is(err, errRemoteTooLarge):
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			case errors.Is(err, errRemoteURL), errors.Is(err, errRemoteAddress),
+				errors.Is(err, errRemoteRedirects), errors.Is(err, errRemoteContentType):
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			default:
+				slog.ErrorContext(r.Context(), "Error fetching remote image", "url", req.ImageURL, "error", err)
+				w.WriteHeader(http.StatusBadGateway)
+				json.NewEncoder(w).Encode(map[string]string{"error": "could not fetch image"})
+			}
+			return
 		}
+
+		logEvent("image_uploaded", fmt.Sprintf("Image %d mirrored to %s %d", image.ID, image.EntityType, image.EntityID), image)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(image)
+		return
 	}
 
-	// Get next display order
-	var maxOrder sql.NullInt64
-	err := db.QueryRow("SELECT MAX(display_order) FROM images WHERE entity_type = ? AND entity_id = ?", req.EntityType, req.EntityID).Scan(&maxOrder)
-	displayOrder := 0
-	if maxOrder.Valid {
-		displayOrder = int(maxOrder.Int64) + 1
+	image := Image{
+		EntityType: req.EntityType,
+		EntityID:   req.EntityID,
+		ImageURL:   req.ImageURL,
+		Caption:    req.Caption,
+		IsPrimary:  req.IsPrimary,
+		UploadedBy: uploadedBy,
+		CreatedAt:  time.Now(),
 	}
 
 	// Insert image record
-	result, err := db.Exec(`
-		INSERT INTO images (entity_type, entity_id, image_url, caption, display_order, is_primary, uploaded_by)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, req.EntityType, req.EntityID, req.ImageURL, req.Caption, displayOrder, req.IsPrimary, uploadedBy)
-
+	tx, err := db.BeginTx(ctx, nil)
+	if err == nil {
+		defer tx.Rollback()
+		err = insertImage(ctx, tx, &image)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
-		log.Printf("Error inserting image record: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to save image record"})
+		if errors.Is(err, errUnknownEntityType) || errors.Is(err, errEntityNotFound) {
+			writeEntityError(w, r, err)
+			return
+		}
+		writeServerError(w, r, err, "Error inserting image record", "failed to save image record")
 		return
 	}
 
-	imageID, _ := result.LastInsertId()
-
-	image := Image{
-		ID:           int(imageID),
-		EntityType:   req.EntityType,
-		EntityID:     req.EntityID,
-		ImageURL:     req.ImageURL,
-		Caption:      req.Caption,
-		DisplayOrder: displayOrder,
-		IsPrimary:    req.IsPrimary,
-		UploadedBy:   uploadedBy,
-		CreatedAt:    time.Now(),
-	}
+	logEvent("image_uploaded", fmt.Sprintf("Image %d added to %s %d", image.ID, image.EntityType, image.EntityID), image)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -356,6 +458,8 @@ func addImageURLHandler(w http.ResponseWriter, r *http.Request) {
 
 // Update image
 func updateImageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodPut {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -374,41 +478,80 @@ func updateImageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		writeServerError(w, r, err, "Error starting transaction", "failed to update image")
+		return
+	}
+	defer tx.Rollback()
+
 	// Get image to check entity info
 	var entityType string
 	var entityID int
-	err := db.QueryRow("SELECT entity_type, entity_id FROM images WHERE id = ?", req.ID).Scan(&entityType, &entityID)
+	err = tx.QueryRowContext(ctx, "SELECT entity_type, entity_id FROM images WHERE id = ?", req.ID).Scan(&entityType, &entityID)
+	if err == nil && entityTypes[entityType].Private {
+		err = sql.ErrNoRows
+	}
 	if err != nil {
 		if err == sql.ErrNoRows {
 			w.WriteHeader(http.StatusNotFound)
 			json.NewEncoder(w).Encode(map[string]string{"error": "image not found"})
 			return
 		}
-		log.Printf("Error fetching image: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error fetching image", "internal server error")
 		return
 	}
 
-	// If setting as primary, unset other primary images
-	if req.IsPrimary {
-		_, err = db.Exec("UPDATE images SET is_primary = FALSE WHERE entity_type = ? AND entity_id = ? AND id != ?", entityType, entityID, req.ID)
-		if err != nil {
-			log.Printf("Error unsetting primary images: %v", err)
+	err = func() error {
+		if err := lockEntity(ctx, tx, entityType, entityID); err != nil {
+			return err
 		}
-	}
 
-	// Update image
-	_, err = db.Exec(`
-		UPDATE images 
-		SET caption = ?, display_order = ?, is_primary = ?
-		WHERE id = ?
-	`, req.Caption, req.DisplayOrder, req.IsPrimary, req.ID)
+		if _, err := tx.ExecContext(ctx, "UPDATE images SET caption = ? WHERE id = ?", req.Caption, req.ID); err != nil {
+			return err
+		}
 
+		// Move the image to its new position in the gallery
+		ids, primaryID, err := galleryImages(ctx, tx, entityType, entityID)
+		if err != nil {
+			return err
+		}
+		order := make([]int, 0, len(ids))
+		for _, id := range ids {
+			if id != req.ID {
+				order = append(order, id)
+			}
+		}
+		pos := req.DisplayOrder
+		if pos < 0 {
+			pos = 0
+		}
+		if pos > len(order) {
+			pos = len(order)
+		}
+		order = append(order[:pos], append([]int{req.ID}, order[pos:]...)...)
+
+		// Setting is_primary makes this the primary image; clearing it on the
+		// current primary hands the role to the first other image
+		if req.IsPrimary {
+			primaryID = req.ID
+		} else if primaryID == req.ID {
+			primaryID = 0
+			for _, id := range order {
+				if id != req.ID {
+					primaryID = id
+					break
+				}
+			}
+		}
+
+		if err := applyGallery(ctx, tx, entityType, entityID, order, primaryID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
 	if err != nil {
-		log.Printf("Error updating image: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to update image"})
+		writeGalleryError(w, r, err, "update image")
 		return
 	}
 
@@ -418,6 +561,8 @@ func updateImageHandler(w http.ResponseWriter, r *http.Request) {
 
 // Delete image
 func deleteImageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
 	if r.Method != http.MethodDelete {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -433,36 +578,30 @@ func deleteImageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get image info before deletion
-	var storagePath sql.NullString
-	err := db.QueryRow("SELECT storage_path FROM images WHERE id = ?", req.ID).Scan(&storagePath)
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			w.WriteHeader(http.StatusNotFound)
-			json.NewEncoder(w).Encode(map[string]string{"error": "image not found"})
-			return
-		}
-		log.Printf("Error fetching image: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "internal server error"})
+		writeServerError(w, r, err, "Error starting transaction", "failed to delete image")
 		return
 	}
+	defer tx.Rollback()
 
-	// Delete from database
-	_, err = db.Exec("DELETE FROM images WHERE id = ?", req.ID)
+	// Delete from database, promoting another image if this was the primary
+	paths, deleted, err := deleteImages(ctx, tx, []int{req.ID})
+	if err == nil && deleted == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "image not found"})
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
-		log.Printf("Error deleting image: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]string{"error": "failed to delete image"})
+		writeGalleryError(w, r, err, "delete image")
 		return
 	}
 
 	// Delete file if it exists locally
-	if storagePath.Valid && storagePath.String != "" {
-		if err := os.Remove(storagePath.String); err != nil {
-			log.Printf("Warning: Could not delete file %s: %v", storagePath.String, err)
-		}
-	}
+	removeImageFiles(paths)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "image deleted successfully"})
@@ -0,0 +1,391 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Every login attempt is recorded with the address and user agent it came
+// from. Consecutive failures on an account first slow it down, each attempt
+// after loginDelayThreshold having to wait twice as long as the last, then
+// lock it for accountLockDuration. The lock is lifted early through a link
+// emailed to the owner, or by an operator. Separately, an address failing
+// maxIPLoginFailures times within ipLoginWindow is refused for any account.
+// An email address with no account is slowed down and locked the same way,
+// counted from its failed attempts, so the answers don't reveal whether it
+// is registered.
+//
+// Users can see their login history and are notified when an account is
+// signed in to from a device, identified by its user agent, it hasn't been
+// used from before.
+
+const (
+	loginDelayThreshold   = 3
+	maxLoginDelay         = time.Minute
+	accountLockThreshold  = 10
+	accountLockDuration   = 15 * time.Minute
+	unlockTokenLifetime   = 24 * time.Hour
+	ipLoginWindow         = 15 * time.Minute
+	maxIPLoginFailures    = 30
+	loginHistoryPageSize  = 50
+	loginHistoryRetention = 90 * 24 * time.Hour
+)
+
+// LoginAttempt is one entry of a user's login history
+type LoginAttempt struct {
+	ID        int64     `json:"id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// migrateLockout adds the failure count and lock to users
+func migrateLockout(ctx context.Context) error {
+	columns := []struct{ name, definition string }{
+		{"failed_logins", "INT NOT NULL DEFAULT 0"},
+		{"last_failed_login_at", "TIMESTAMP NULL"},
+		{"locked_until", "TIMESTAMP NULL"},
+		{"unlock_token_hash", "CHAR(64) NULL"},
+		{"unlock_token_expires_at", "TIMESTAMP NULL"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfMissing(ctx, "users", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+	if err := addIndexIfMissing(ctx, "users", "idx_users_unlock_token_hash", "(unlock_token_hash)"); err != nil {
+		return err
+	}
+	return addIndexIfMissing(ctx, "login_attempts", "idx_login_attempts_email", "(email, id)")
+}
+
+// loginDelay is how long an account must wait after its nth consecutive
+// failure
+func loginDelay(failures int) time.Duration {
+	if failures < loginDelayThreshold {
+		return 0
+	}
+	shift := failures - loginDelayThreshold
+	if shift > 6 {
+		return maxLoginDelay
+	}
+	return min(time.Second<<shift, maxLoginDelay)
+}
+
+// ipLoginWait returns how long the address must wait before trying again,
+// or zero if it may try now
+func ipLoginWait(ctx context.Context, ip string) (time.Duration, error) {
+	since := time.Now().Add(-ipLoginWindow)
+	var count int
+	var oldest sql.NullTime
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*), MIN(created_at) FROM login_attempts WHERE ip = ? AND NOT success AND created_at > ?", ip, since).
+		Scan(&count, &oldest)
+	if err != nil || count < maxIPLoginFailures || !oldest.Valid {
+		return 0, err
+	}
+	return time.Until(oldest.Time.Add(ipLoginWindow)), nil
+}
+
+// accountLoginWait returns how long the account must wait before trying
+// again, and whether that is because it is locked
+func accountLoginWait(ctx context.Context, userID int) (time.Duration, bool, error) {
+	var failures int
+	var lastFailed, lockedUntil sql.NullTime
+	err := db.QueryRowContext(ctx, "SELECT failed_logins, last_failed_login_at, locked_until FROM users WHERE id = ?", userID).
+		Scan(&failures, &lastFailed, &lockedUntil)
+	if err != nil {
+		return 0, false, err
+	}
+	if lockedUntil.Valid && time.Until(lockedUntil.Time) > 0 {
+		return time.Until(lockedUntil.Time), true, nil
+	}
+	if lastFailed.Valid {
+		if wait := time.Until(lastFailed.Time.Add(loginDelay(failures))); wait > 0 {
+			return wait, false, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// unknownEmailLoginWait is accountLoginWait for an email address with no
+// account. The attempt that reached accountLockThreshold is recorded with
+// the reason unknown_user_locked, and the failures after it count towards
+// the delay and the next lock.
+func unknownEmailLoginWait(ctx context.Context, email string) (time.Duration, bool, int, error) {
+	var lockID sql.NullInt64
+	var lockedAt sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT id, created_at FROM login_attempts
+		WHERE email = ? AND user_id IS NULL AND reason = 'unknown_user_locked'
+		ORDER BY id DESC LIMIT 1
+	`, truncate(email, 255)).Scan(&lockID, &lockedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, false, 0, err
+	}
+	if lockedAt.Valid {
+		if wait := time.Until(lockedAt.Time.Add(accountLockDuration)); wait > 0 {
+			return wait, true, 0, nil
+		}
+	}
+
+	var failures int
+	var lastFailed sql.NullTime
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(*), MAX(created_at) FROM login_attempts
+		WHERE email = ? AND user_id IS NULL AND NOT success AND id > ?
+	`, truncate(email, 255), lockID.Int64).Scan(&failures, &lastFailed)
+	if err != nil {
+		return 0, false, 0, err
+	}
+	if lastFailed.Valid {
+		if wait := time.Until(lastFailed.Time.Add(loginDelay(failures))); wait > 0 {
+			return wait, false, failures, nil
+		}
+	}
+	return 0, false, failures, nil
+}
+
+// refuseLoginWait answers a login that has to wait for its account or
+// email address, and reports whether it did
+func refuseLoginWait(w http.ResponseWriter, wait time.Duration, locked bool) bool {
+	switch {
+	case locked:
+		loginFailures.inc("locked")
+		writeLoginWait(w, wait, http.StatusLocked, "account temporarily locked after too many failed logins, check your email to unlock it")
+	case wait > 0:
+		loginFailures.inc("throttled")
+		writeLoginWait(w, wait, http.StatusTooManyRequests, "too many failed logins, try again later")
+	default:
+		return false
+	}
+	return true
+}
+
+// recordLoginAttempt adds an attempt to the login history. userID is 0 for
+// an unknown email address.
+func recordLoginAttempt(ctx context.Context, r *http.Request, userID int, email string, success bool, reason string) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO login_attempts (user_id, email, ip, user_agent, device_hash, success, reason)
+		VALUES (NULLIF(?, 0), ?, ?, ?, ?, ?, NULLIF(?, ''))
+	`, userID, truncate(email, 255), clientIP(r), truncate(r.UserAgent(), 500), hashToken(r.UserAgent()), success, reason)
+	return err
+}
+
+// recordLoginFailure counts a wrong password or second factor against the
+// account, locking it and emailing an unlock link once it reaches
+// accountLockThreshold
+func recordLoginFailure(ctx context.Context, r *http.Request, user User, reason string) error {
+	if err := recordLoginAttempt(ctx, r, user.ID, user.Email, false, reason); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE users SET failed_logins = failed_logins + 1, last_failed_login_at = NOW() WHERE id = ?", user.ID); err != nil {
+		return err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	// Only the failure that reaches the threshold locks the account, and
+	// the count starts again for when the lock runs out
+	result, err := db.ExecContext(ctx, `
+		UPDATE users
+		SET failed_logins = 0, locked_until = ?, unlock_token_hash = ?, unlock_token_expires_at = ?
+		WHERE id = ? AND failed_logins >= ?
+	`, time.Now().Add(accountLockDuration), hashToken(token), time.Now().Add(unlockTokenLifetime), user.ID, accountLockThreshold)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	slog.WarnContext(ctx, "Account locked after failed logins", "locked_user_id", user.ID, "ip", clientIP(r))
+	sendMailAsync(user.Email, "Your account has been locked",
+		fmt.Sprintf("Someone tried to sign in to your account with a wrong password or code %d times, so it has been locked for %d minutes.\n\n",
+			accountLockThreshold, int(accountLockDuration.Minutes()))+
+			"If that was you, you can unlock it now by opening this link within 24 hours:\n\n"+
+			publicURL("/account/unlock?token="+token)+"\n\n"+
+			"If not, someone may be guessing your password. Unlocking is safe, but consider choosing a stronger one.\n")
+	return nil
+}
+
+// recordLoginSuccess clears the failure count and tells the user if the
+// login came from a new device
+func recordLoginSuccess(ctx context.Context, r *http.Request, user User) error {
+	var known, anyBefore bool
+	err := db.QueryRowContext(ctx, `
+		SELECT
+			EXISTS(SELECT 1 FROM login_attempts WHERE user_id = ? AND success AND device_hash = ?),
+			EXISTS(SELECT 1 FROM login_attempts WHERE user_id = ? AND success)
+	`, user.ID, hashToken(r.UserAgent()), user.ID).Scan(&known, &anyBefore)
+	if err != nil {
+		return err
+	}
+
+	if err := recordLoginAttempt(ctx, r, user.ID, user.Email, true, ""); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `
+		UPDATE users
+		SET failed_logins = 0, last_failed_login_at = NULL, locked_until = NULL, unlock_token_hash = NULL, unlock_token_expires_at = NULL
+		WHERE id = ? AND (failed_logins > 0 OR unlock_token_hash IS NOT NULL)
+	`, user.ID); err != nil {
+		return err
+	}
+
+	// The first login after signing up has nothing to compare with
+	if !known && anyBefore {
+		n := Notification{
+			Type:  "new_login",
+			Title: "New sign-in to your account",
+			Body: fmt.Sprintf("Your account was signed in to from a device it hasn't been used from before.\n\n"+
+				"Time: %s\nIP address: %s\nDevice: %s\n\n"+
+				"If this was you, there is nothing to do. If not, change your password now.",
+				time.Now().UTC().Format(time.RFC1123), clientIP(r), r.UserAgent()),
+		}
+		recipients := []recipient{{UserID: user.ID, Email: user.Email}}
+		go func() {
+			if err := notify(context.WithoutCancel(ctx), n, recipients); err != nil {
+				slog.Error("Error notifying new login", "error", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// truncate shortens s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// writeLoginWait refuses a login that has to wait
+func writeLoginWait(w http.ResponseWriter, wait time.Duration, status int, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// Get the current user's recent login attempts, newest first
+func getLoginHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, ip, IFNULL(user_agent, ''), success, IFNULL(reason, ''), created_at
+		FROM login_attempts
+		WHERE user_id = ?
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?
+	`, userID, loginHistoryPageSize)
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching login history", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	attempts := []LoginAttempt{}
+	for rows.Next() {
+		var a LoginAttempt
+		if err := rows.Scan(&a.ID, &a.IP, &a.UserAgent, &a.Success, &a.Reason, &a.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning login attempt", "error", err)
+			continue
+		}
+		attempts = append(attempts, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attempts)
+}
+
+// Unlock an account from the emailed link
+func unlockAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "token is required"})
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `
+		UPDATE users
+		SET failed_logins = 0, last_failed_login_at = NULL, locked_until = NULL, unlock_token_hash = NULL, unlock_token_expires_at = NULL
+		WHERE unlock_token_hash = ? AND unlock_token_expires_at > NOW()
+	`, hashToken(token))
+	if err != nil {
+		writeServerError(w, r, err, "Error unlocking account", "internal server error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired link"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "account unlocked, you can sign in again"})
+}
+
+// Unlock an account on the owner's behalf (operators only)
+func adminUnlockAccountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		UserID int `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "user_id is required"})
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), `
+		UPDATE users
+		SET failed_logins = 0, last_failed_login_at = NULL, locked_until = NULL, unlock_token_hash = NULL, unlock_token_expires_at = NULL
+		WHERE id = ?
+	`, req.UserID)
+	if err != nil {
+		writeServerError(w, r, err, "Error unlocking account", "internal server error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		var exists bool
+		if err := db.QueryRowContext(r.Context(), "SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", req.UserID).Scan(&exists); err != nil {
+			writeServerError(w, r, err, "Error unlocking account", "internal server error")
+			return
+		}
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "user not found"})
+			return
+		}
+	}
+
+	slog.InfoContext(r.Context(), "Account unlocked by operator", "unlocked_user_id", req.UserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "account unlocked"})
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Magic links sign a user in from an emailed link instead of a password.
+// Requesting one returns a device token that the client keeps; the link only
+// works together with it, so a link forwarded or intercepted on its way to
+// the inbox is no use on another device. Links are single use and expire
+// after 15 minutes.
+//
+// The emailed link opens the site page the request named, with the link
+// token in the URL fragment. That page posts it to /login/magic/verify along
+// with the device token.
+
+const magicLinkLifetime = 15 * time.Minute
+
+var (
+	errInvalidMagicLink = errString("invalid or expired link, request a new one")
+	errWrongDevice      = errString("open the link on the device you requested it from")
+)
+
+// Email a sign-in link. The response is the same whether or not the
+// address has an account.
+func requestMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Email    string `json:"email"`
+		Redirect string `json:"redirect"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "email is required"})
+		return
+	}
+
+	deviceToken, err := newToken()
+	if err != nil {
+		writeServerError(w, r, err, "Error creating device token", "internal server error")
+		return
+	}
+
+	var userID int
+	err = db.QueryRowContext(ctx, "SELECT id FROM users WHERE email = ?", strings.TrimSpace(req.Email)).Scan(&userID)
+	switch {
+	case err == sql.ErrNoRows:
+		if err := recordLoginAttempt(ctx, r, 0, req.Email, false, "unknown_user"); err != nil {
+			slog.ErrorContext(ctx, "Error recording login attempt", "error", err)
+		}
+	case err != nil:
+		writeServerError(w, r, err, "Error fetching user", "internal server error")
+		return
+	default:
+		token, err := newToken()
+		if err != nil {
+			writeServerError(w, r, err, "Error creating magic link", "internal server error")
+			return
+		}
+		if _, err := db.ExecContext(ctx, "DELETE FROM magic_links WHERE expires_at < NOW()"); err != nil {
+			writeServerError(w, r, err, "Error purging magic links", "internal server error")
+			return
+		}
+		_, err = db.ExecContext(ctx, "INSERT INTO magic_links (token_hash, user_id, device_hash, expires_at) VALUES (?, ?, ?, ?)",
+			hashToken(token), userID, hashToken(deviceToken), time.Now().Add(magicLinkLifetime))
+		if err != nil {
+			writeServerError(w, r, err, "Error storing magic link", "internal server error")
+			return
+		}
+
+		link := publicURL(safeRedirect(req.Redirect)) + "#" + url.Values{"magic_token": {token}}.Encode()
+		sendMailAsync(strings.TrimSpace(req.Email), "Your sign-in link",
+			"Open this link within 15 minutes to sign in:\n\n"+link+"\n\n"+
+				"It only works in the browser you requested it from, and only once.\n"+
+				"If you didn't ask to sign in, you can ignore this email.\n")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "if the address has an account, a sign-in link is on its way",
+		"device_token": deviceToken,
+		"expires_in":   int(magicLinkLifetime.Seconds()),
+	})
+}
+
+// Sign in with a magic link token and the device token it was requested with
+func verifyMagicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Token       string `json:"token"`
+		DeviceToken string `json:"device_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.DeviceToken == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "token and device_token are required"})
+		return
+	}
+
+	tokenHash := hashToken(req.Token)
+	var userID int
+	var deviceHash string
+	err := db.QueryRowContext(ctx, "SELECT user_id, device_hash FROM magic_links WHERE token_hash = ? AND used_at IS NULL AND expires_at > NOW()",
+		tokenHash).Scan(&userID, &deviceHash)
+	if err == sql.ErrNoRows {
+		loginFailures.inc("bad_magic_link")
+		writeMagicLinkError(w, r, errInvalidMagicLink)
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching magic link", "internal server error")
+		return
+	}
+
+	// A wrong device doesn't use the link up, so the right one still can
+	if subtle.ConstantTimeCompare([]byte(hashToken(req.DeviceToken)), []byte(deviceHash)) != 1 {
+		loginFailures.inc("wrong_device")
+		writeMagicLinkError(w, r, errWrongDevice)
+		return
+	}
+
+	result, err := db.ExecContext(ctx, "UPDATE magic_links SET used_at = NOW() WHERE token_hash = ? AND used_at IS NULL", tokenHash)
+	if err != nil {
+		writeServerError(w, r, err, "Error using magic link", "internal server error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeMagicLinkError(w, r, errInvalidMagicLink)
+		return
+	}
+
+	// Following a link sent to the address proves it belongs to the user
+	if _, err := db.ExecContext(ctx, "UPDATE users SET email_verified_at = NOW() WHERE id = ? AND email_verified_at IS NULL", userID); err != nil {
+		writeServerError(w, r, err, "Error marking email verified", "internal server error")
+		return
+	}
+
+	user, err := loadUser(ctx, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching user", "internal server error")
+		return
+	}
+	setRequestUser(r, strconv.Itoa(user.ID))
+
+	// The link stands in for the password, not for the second factor
+	completeFirstFactor(w, r, user)
+}
+
+func writeMagicLinkError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errInvalidMagicLink:
+		w.WriteHeader(http.StatusUnauthorized)
+	case errWrongDevice:
+		w.WriteHeader(http.StatusForbidden)
+	default:
+		writeServerError(w, r, err, "Error verifying magic link", "internal server error")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Message is a plain-text email. ReplyTo is optional.
+type Message struct {
+	To      string
+	ReplyTo string
+	Subject string
+	Body    string
+}
+
+// Mailer sends plain-text email
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// SMTPMailer sends mail through an SMTP relay
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// Send delivers one message
+func (m *SMTPMailer) Send(msg Message) error {
+	if strings.ContainsAny(msg.To+msg.ReplyTo+msg.Subject, "\r\n") {
+		return fmt.Errorf("invalid mail header")
+	}
+	headers := "From: " + m.From + "\r\n" +
+		"To: " + msg.To + "\r\n"
+	if msg.ReplyTo != "" {
+		headers += "Reply-To: " + msg.ReplyTo + "\r\n"
+	}
+	data := headers +
+		"Subject: " + msg.Subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + msg.Body
+
+	_, span := tracer.Start(context.Background(), "smtp send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.ServerAddress(m.Addr)))
+	defer span.End()
+	if err := smtp.SendMail(m.Addr, m.Auth, m.From, []string{msg.To}, []byte(data)); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+// LogMailer writes messages to the log instead of sending them, for
+// development without an SMTP relay
+type LogMailer struct{}
+
+// Send logs the message
+func (LogMailer) Send(msg Message) error {
+	if msg.ReplyTo != "" {
+		slog.Info("Mail not sent, SMTP is not configured", "to", msg.To, "reply_to", msg.ReplyTo, "subject", msg.Subject, "body", msg.Body)
+		return nil
+	}
+	slog.Info("Mail not sent, SMTP is not configured", "to", msg.To, "subject", msg.Subject, "body", msg.Body)
+	return nil
+}
+
+var mailer Mailer = LogMailer{}
+
+// initMailer configures SMTP delivery from SMTP_HOST, SMTP_PORT,
+// SMTP_USERNAME, SMTP_PASSWORD and MAIL_FROM. Without SMTP_HOST mail is
+// only logged.
+func initMailer() {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		slog.Info("SMTP_HOST not set, outgoing mail will be logged")
+		return
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "no-reply@" + host
+	}
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	mailer = &SMTPMailer{Addr: host + ":" + port, From: from, Auth: auth}
+}
+
+// sendMailAsync sends mail in the background so slow relays don't hold up
+// requests
+func sendMailAsync(to, subject, body string) {
+	sendMessageAsync(Message{To: to, Subject: subject, Body: body})
+}
+
+// sendMessageAsync is sendMailAsync for messages with extra headers
+func sendMessageAsync(msg Message) {
+	go func() {
+		if err := mailer.Send(msg); err != nil {
+			slog.Error("Error sending mail", "to", msg.To, "error", err)
+		}
+	}()
+}
+
+// publicURL builds an absolute link to the site from PUBLIC_URL
+func publicURL(path string) string {
+	base := os.Getenv("PUBLIC_URL")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	return strings.TrimRight(base, "/") + path
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are exposed in the Prometheus text format on /metrics, which is
+// served by NewAdminRouter on its own listener so it is never reachable
+// through the public API. Request metrics are labelled with the route
+// pattern rather than the raw path to keep label cardinality bounded.
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histogram
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	httpRequests = newCounterVec("http_requests_total",
+		"HTTP requests handled, by route, method and status.", "route", "method", "status")
+	httpDuration = newHistogramVec("http_request_duration_seconds",
+		"HTTP request latency in seconds, by route, method and status.", latencyBuckets, "route", "method", "status")
+	httpInFlight = newGauge("http_requests_in_flight",
+		"HTTP requests currently being served.")
+
+	bookingsCreated = newCounterVec("bookings_created_total",
+		"Bookings created.")
+	imageUploads = newCounterVec("image_uploads_total",
+		"Images added to galleries, uploaded or mirrored.")
+	loginFailures = newCounterVec("login_failures_total",
+		"Failed logins, by reason.", "reason")
+	rateLimitedRequests = newCounterVec("rate_limited_requests_total",
+		"Requests refused with 429, by rate limit rule.", "rule")
+
+	metricsRegistry = []collector{
+		httpRequests,
+		httpDuration,
+		httpInFlight,
+		bookingsCreated,
+		imageUploads,
+		loginFailures,
+		rateLimitedRequests,
+		newFuncMetric("process_start_time_seconds", "gauge", "Start time of the process since the Unix epoch in seconds.",
+			func() float64 { return float64(startTime.Unix()) }),
+		newFuncMetric("db_pool_max_open_connections", "gauge", "Maximum number of open database connections.",
+			func() float64 { return float64(dbStats().MaxOpenConnections) }),
+		newFuncMetric("db_pool_open_connections", "gauge", "Open database connections, in use and idle.",
+			func() float64 { return float64(dbStats().OpenConnections) }),
+		newFuncMetric("db_pool_in_use_connections", "gauge", "Database connections currently in use.",
+			func() float64 { return float64(dbStats().InUse) }),
+		newFuncMetric("db_pool_idle_connections", "gauge", "Idle database connections.",
+			func() float64 { return float64(dbStats().Idle) }),
+		newFuncMetric("db_pool_wait_count_total", "counter", "Connections waited for because the pool was exhausted.",
+			func() float64 { return float64(dbStats().WaitCount) }),
+		newFuncMetric("db_pool_wait_duration_seconds_total", "counter", "Total time spent waiting for a connection.",
+			func() float64 { return dbStats().WaitDuration.Seconds() }),
+		newFuncMetric("db_pool_max_idle_closed_total", "counter", "Connections closed because of the idle limit.",
+			func() float64 { return float64(dbStats().MaxIdleClosed) }),
+		newFuncMetric("db_pool_max_lifetime_closed_total", "counter", "Connections closed because of their maximum lifetime.",
+			func() float64 { return float64(dbStats().MaxLifetimeClosed) }),
+	}
+)
+
+func init() {
+	// Business counters follow the event log so every path that creates a
+	// booking or an image is counted
+	onEvent(func(e SystemEvent) {
+		switch e.Type {
+		case "booking_created":
+			bookingsCreated.inc()
+		case "image_uploaded":
+			imageUploads.inc()
+		}
+	})
+}
+
+// collector writes one metric family
+type collector interface {
+	write(w io.Writer)
+}
+
+// metricSeries is one labelled series of a counter or histogram
+type metricSeries struct {
+	labels []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+// metricVec holds the series of a metric family keyed by label values
+type metricVec struct {
+	name, help string
+	labels     []string
+
+	mutex  sync.Mutex
+	series map[string]*metricSeries
+}
+
+func (v *metricVec) get(values []string) *metricSeries {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", v.name, len(values), len(v.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &metricSeries{labels: values}
+		v.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series ordered by label values for stable output
+func (v *metricVec) sorted() []*metricSeries {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]*metricSeries, len(keys))
+	for i, k := range keys {
+		series[i] = v.series[k]
+	}
+	return series
+}
+
+type counterVec struct {
+	metricVec
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{metricVec{name: name, help: help, labels: labels, series: make(map[string]*metricSeries)}}
+	if len(labels) == 0 {
+		// Unlabelled counters are reported as zero before their first increment
+		c.get(nil)
+	}
+	return c
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) add(n float64, values ...string) {
+	c.mutex.Lock()
+	c.get(values).value += n
+	c.mutex.Unlock()
+}
+
+// total sums every series
+func (c *counterVec) total() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	total := 0.0
+	for _, s := range c.series {
+		total += s.value
+	}
+	return total
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	writeHeader(w, c.name, "counter", c.help)
+	for _, s := range c.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labels), formatValue(s.value))
+	}
+}
+
+type histogramVec struct {
+	metricVec
+	buckets []float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{metricVec{name: name, help: help, labels: labels, series: make(map[string]*metricSeries)}, buckets}
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	s := h.get(values)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets))
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	writeHeader(w, h.name, "histogram", h.help)
+	names := append(append([]string{}, h.labels...), "le")
+	for _, s := range h.sorted() {
+		values := append(append([]string{}, s.labels...), "")
+		for i, upper := range h.buckets {
+			values[len(values)-1] = formatValue(upper)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, values), s.counts[i])
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+type gauge struct {
+	name, help string
+
+	mutex sync.Mutex
+	value float64
+}
+
+func newGauge(name, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+func (g *gauge) add(n float64) {
+	g.mutex.Lock()
+	g.value += n
+	g.mutex.Unlock()
+}
+
+func (g *gauge) write(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	writeHeader(w, g.name, "gauge", g.help)
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value))
+}
+
+// funcMetric is a single unlabelled value read at scrape time
+type funcMetric struct {
+	name, typ, help string
+	fn              func() float64
+}
+
+func newFuncMetric(name, typ, help string, fn func() float64) *funcMetric {
+	return &funcMetric{name: name, typ: typ, help: help, fn: fn}
+}
+
+func (m *funcMetric) write(w io.Writer) {
+	writeHeader(w, m.name, m.typ, m.help)
+	fmt.Fprintf(w, "%s %s\n", m.name, formatValue(m.fn()))
+}
+
+// dbStats reads the pool stats, tolerating a database that isn't open yet
+func dbStats() sql.DBStats {
+	if db == nil {
+		return sql.DBStats{}
+	}
+	return db.Stats()
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// statusRecorder captures the status code and body size written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrumentHandler records request counts, latency and in-flight requests.
+// It wraps the whole mux, which sets r.Pattern to the matched route.
+func instrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpInFlight.add(1)
+		defer httpInFlight.add(-1)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labels := []string{route, r.Method, strconv.Itoa(status)}
+		httpRequests.inc(labels...)
+		httpDuration.observe(time.Since(start).Seconds(), labels...)
+	})
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range metricsRegistry {
+		c.write(w)
+	}
+}
+
+// NewAdminRouter serves operational endpoints that must not be exposed
+// publicly. It is meant for a separate listener bound to a private address.
+func NewAdminRouter() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/log-level", logLevelHandler)
+	mux.HandleFunc("/traces", tracesHandler)
+	mux.HandleFunc("/health", healthHandler)
+	return mux
+}
@@ -0,0 +1,68 @@
+package server
+
+import "context"
+
+// Schema helpers for evolving tables that were created by earlier versions of
+// createTables. CREATE TABLE IF NOT EXISTS leaves existing tables untouched,
+// so new columns, indexes and constraints are added through these checks.
+
+// columnExists reports whether table has a column with the given name
+func columnExists(ctx context.Context, table, column string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?
+	`, table, column).Scan(&count)
+	return count > 0, err
+}
+
+// constraintExists reports whether table has a constraint with the given name
+func constraintExists(ctx context.Context, table, name string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM information_schema.table_constraints
+		WHERE table_schema = DATABASE() AND table_name = ? AND constraint_name = ?
+	`, table, name).Scan(&count)
+	return count > 0, err
+}
+
+// indexExists reports whether table has an index with the given name
+func indexExists(ctx context.Context, table, name string) (bool, error) {
+	var count int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?
+	`, table, name).Scan(&count)
+	return count > 0, err
+}
+
+// addColumnIfMissing runs ALTER TABLE ... ADD COLUMN when the column is absent
+func addColumnIfMissing(ctx context.Context, table, column, definition string) error {
+	exists, err := columnExists(ctx, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN "+column+" "+definition)
+	return err
+}
+
+// addConstraintIfMissing runs ALTER TABLE ... ADD CONSTRAINT when the constraint is absent
+func addConstraintIfMissing(ctx context.Context, table, name, definition string) error {
+	exists, err := constraintExists(ctx, table, name)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "ALTER TABLE "+table+" ADD CONSTRAINT "+name+" "+definition)
+	return err
+}
+
+// addIndexIfMissing runs ALTER TABLE ... ADD INDEX when the index is absent.
+// definition is everything after the index name, e.g. "(col_a, col_b)".
+func addIndexIfMissing(ctx context.Context, table, name, definition string) error {
+	exists, err := indexExists(ctx, table, name)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "ALTER TABLE "+table+" ADD INDEX "+name+" "+definition)
+	return err
+}
@@ -0,0 +1,546 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notifications are created from logged booking and listing events. Each
+// recipient's channel preferences decide whether a notification is stored
+// for the in-app notification centre, emailed, or both. Guests without an
+// account (bookings only need an email address) are emailed.
+
+const (
+	notificationQueueSize   = 1000
+	notificationPageSize    = 20
+	maxNotificationPageSize = 100
+)
+
+// Channel defaults for each notification type, used until a user saves a
+// preference
+var notificationTypes = map[string]NotificationPreference{
+	"booking_received": {Type: "booking_received", InApp: true, Email: true},
+	"booking_status":   {Type: "booking_status", InApp: true, Email: true},
+	"event_updated":    {Type: "event_updated", InApp: true, Email: true},
+	"claim_reviewed":   {Type: "claim_reviewed", InApp: true, Email: true},
+	"enquiry_received": {Type: "enquiry_received", InApp: true, Email: true},
+	"enquiry_reply":    {Type: "enquiry_reply", InApp: true, Email: true},
+	"new_login":        {Type: "new_login", InApp: true, Email: true},
+}
+
+var notificationQueue = make(chan SystemEvent, notificationQueueSize)
+
+type Notification struct {
+	ID         int64      `json:"id"`
+	Type       string     `json:"type"`
+	Title      string     `json:"title"`
+	Body       string     `json:"body"`
+	EntityType string     `json:"entity_type,omitempty"`
+	EntityID   int        `json:"entity_id,omitempty"`
+	ReadAt     *time.Time `json:"read_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+
+	// Reply-To for the email copy, e.g. an enquiry relay address
+	ReplyTo string `json:"-"`
+}
+
+type NotificationPreference struct {
+	Type  string `json:"type"`
+	InApp bool   `json:"in_app"`
+	Email bool   `json:"email"`
+}
+
+// recipient is a user, or a guest with only an email address when UserID is 0
+type recipient struct {
+	UserID int
+	Email  string
+}
+
+// startNotifier subscribes to logged events and delivers notifications in
+// the background
+func startNotifier(ctx context.Context) {
+	onEvent(func(e SystemEvent) {
+		switch e.Type {
+		case "booking_created", "booking_updated", "event_updated", "claim_approved", "claim_rejected":
+		default:
+			return
+		}
+		select {
+		case notificationQueue <- e:
+		default:
+			slog.Info("Notification queue full, dropping notification", "event", e.Type)
+		}
+	})
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e := <-notificationQueue:
+				if err := notifyEvent(ctx, e); err != nil {
+					slog.Error("Error sending notifications", "event", e.Type, "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// notifyEvent works out who to tell about a logged event and what to say
+func notifyEvent(ctx context.Context, e SystemEvent) error {
+	switch data := e.Data.(type) {
+	case Booking:
+		var title string
+		if err := db.QueryRowContext(ctx, "SELECT title FROM events WHERE id = ?", data.EventID).Scan(&title); err != nil {
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return err
+		}
+
+		recipients, err := listingMembers(ctx, "event", data.EventID, permViewBookings)
+		if err != nil {
+			return err
+		}
+		n := Notification{
+			Type:       "booking_received",
+			Title:      "New booking for " + title,
+			Body:       fmt.Sprintf("%s booked %d ticket(s) for %s.", data.Name, data.Tickets, title),
+			EntityType: "event",
+			EntityID:   data.EventID,
+		}
+		return notify(ctx, n, recipients)
+
+	case BookingEvent:
+		if data.Status != "confirmed" && data.Status != "cancelled" {
+			return nil
+		}
+		var title, email string
+		var tickets int
+		err := db.QueryRowContext(ctx, `
+			SELECT e.title, b.email, b.tickets FROM bookings b
+			JOIN events e ON e.id = b.event_id
+			WHERE b.id = ?
+		`, data.BookingID).Scan(&title, &email, &tickets)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		recipients, err := resolveRecipients(ctx, []string{email})
+		if err != nil {
+			return err
+		}
+		n := Notification{
+			Type:       "booking_status",
+			Title:      "Your booking for " + title + " was " + data.Status,
+			Body:       fmt.Sprintf("Your booking of %d ticket(s) for %s is now %s.", tickets, title, data.Status),
+			EntityType: "event",
+			EntityID:   data.EventID,
+		}
+		return notify(ctx, n, recipients)
+
+	case BusinessEvent:
+		recipients, err := eventAttendees(ctx, data.ID)
+		if err != nil {
+			return err
+		}
+		n := Notification{
+			Type:       "event_updated",
+			Title:      data.Title + " has been updated",
+			Body:       fmt.Sprintf("%s on %s at %s has been updated by the organiser.", data.Title, data.EventDate.Format("Mon 2 Jan 2006 15:04"), data.Location),
+			EntityType: "event",
+			EntityID:   data.ID,
+		}
+		return notify(ctx, n, recipients)
+
+	case ClaimEvent:
+		claims, err := queryClaims(ctx, "WHERE c.id = ?", data.ClaimID)
+		if err != nil || len(claims) == 0 {
+			return err
+		}
+		claim := claims[0]
+
+		status := strings.TrimPrefix(e.Type, "claim_")
+		body := "Your claim on " + claim.BusinessName + " was " + status + "."
+		if claim.ReviewNote != "" {
+			body += "\n\nNote from the reviewer: " + claim.ReviewNote
+		}
+		n := Notification{
+			Type:       "claim_reviewed",
+			Title:      "Your claim on " + claim.BusinessName + " was " + status,
+			Body:       body,
+			EntityType: "business",
+			EntityID:   claim.BusinessID,
+		}
+		return notify(ctx, n, []recipient{{UserID: claim.ClaimantID, Email: claim.ClaimantEmail}})
+	}
+	return nil
+}
+
+// listingMembers returns the members of the organisation owning a business
+// or event who have perm
+func listingMembers(ctx context.Context, entityType string, entityID int, perm Permission) ([]recipient, error) {
+	roles := rolesWith(perm)
+	args := []interface{}{entityID}
+	for _, role := range roles {
+		args = append(args, role)
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, u.email
+		FROM `+entityTypes[entityType].Table+` l
+		INNER JOIN organization_members m ON m.organization_id = l.organization_id
+		INNER JOIN users u ON u.id = m.user_id
+		WHERE l.id = ? AND m.role IN (?`+strings.Repeat(", ?", len(roles)-1)+`)
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []recipient
+	for rows.Next() {
+		var rc recipient
+		if err := rows.Scan(&rc.UserID, &rc.Email); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, rc)
+	}
+	return recipients, rows.Err()
+}
+
+// eventAttendees returns everyone holding an active booking for an event
+func eventAttendees(ctx context.Context, eventID int) ([]recipient, error) {
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT email FROM bookings WHERE event_id = ? AND status != 'cancelled'", eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return resolveRecipients(ctx, emails)
+}
+
+// resolveRecipients matches email addresses to user accounts. Addresses
+// without an account are returned as guests.
+func resolveRecipients(ctx context.Context, emails []string) ([]recipient, error) {
+	if len(emails) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(emails))
+	for i, email := range emails {
+		args[i] = email
+	}
+	rows, err := db.QueryContext(ctx, "SELECT id, email FROM users WHERE email IN (?"+strings.Repeat(", ?", len(emails)-1)+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[string]int)
+	for rows.Next() {
+		var id int
+		var email string
+		if err := rows.Scan(&id, &email); err != nil {
+			return nil, err
+		}
+		users[strings.ToLower(email)] = id
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	recipients := make([]recipient, len(emails))
+	for i, email := range emails {
+		recipients[i] = recipient{UserID: users[strings.ToLower(email)], Email: email}
+	}
+	return recipients, nil
+}
+
+// notify delivers a notification to each recipient on the channels they
+// have enabled for its type
+func notify(ctx context.Context, n Notification, recipients []recipient) error {
+	for _, rc := range recipients {
+		pref := notificationTypes[n.Type]
+		if rc.UserID != 0 {
+			var err error
+			if pref, err = notificationPreference(ctx, rc.UserID, n.Type); err != nil {
+				return err
+			}
+			if pref.InApp {
+				_, err = db.ExecContext(ctx, `
+					INSERT INTO notifications (user_id, type, title, body, entity_type, entity_id)
+					VALUES (?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, 0))
+				`, rc.UserID, n.Type, n.Title, n.Body, n.EntityType, n.EntityID)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if pref.Email && rc.Email != "" {
+			sendMessageAsync(Message{To: rc.Email, ReplyTo: n.ReplyTo, Subject: n.Title, Body: n.Body + "\n"})
+		}
+	}
+	return nil
+}
+
+// notificationPreference returns the user's channels for a notification type
+func notificationPreference(ctx context.Context, userID int, notificationType string) (NotificationPreference, error) {
+	pref := notificationTypes[notificationType]
+	err := db.QueryRowContext(ctx, "SELECT in_app, email FROM notification_preferences WHERE user_id = ? AND type = ?", userID, notificationType).
+		Scan(&pref.InApp, &pref.Email)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return pref, err
+}
+
+// Get the current user's notifications, newest first. ?unread=true limits
+// the list to unread ones; pass the returned next_before as ?before= for the
+// next page.
+func getNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	limit := notificationPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxNotificationPageSize {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "limit must be between 1 and 100"})
+			return
+		}
+		limit = n
+	}
+
+	query := `
+		SELECT id, type, title, body, IFNULL(entity_type, ''), IFNULL(entity_id, 0), read_at, created_at
+		FROM notifications
+		WHERE user_id = ?`
+	args := []interface{}{userID}
+	if r.URL.Query().Get("unread") == "true" {
+		query += " AND read_at IS NULL"
+	}
+	if v := r.URL.Query().Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid before cursor"})
+			return
+		}
+		query += " AND id < ?"
+		args = append(args, before)
+	}
+	// Fetch one extra row to know whether there is another page
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.QueryContext(r.Context(), query, args...)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying notifications", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		if err := rows.Scan(&n.ID, &n.Type, &n.Title, &n.Body, &n.EntityType, &n.EntityID, &n.ReadAt, &n.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning notification", "error", err)
+			continue
+		}
+		notifications = append(notifications, n)
+	}
+
+	resp := map[string]interface{}{"items": notifications}
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+		resp["items"] = notifications
+		resp["next_before"] = notifications[len(notifications)-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Get the number of unread notifications, for badge counts
+func getUnreadNotificationCountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var count int
+	err := db.QueryRowContext(r.Context(), "SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID).Scan(&count)
+	if err != nil {
+		writeServerError(w, r, err, "Error counting notifications", "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"unread": count})
+}
+
+// Mark notifications as read
+func markNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		IDs []int64 `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.IDs) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "ids are required"})
+		return
+	}
+	if len(req.IDs) > maxNotificationPageSize {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "at most 100 ids per request"})
+		return
+	}
+
+	args := []interface{}{userID}
+	for _, id := range req.IDs {
+		args = append(args, id)
+	}
+	result, err := db.ExecContext(r.Context(), "UPDATE notifications SET read_at = NOW() WHERE user_id = ? AND read_at IS NULL AND id IN (?"+
+		strings.Repeat(", ?", len(req.IDs)-1)+")", args...)
+	if err != nil {
+		writeServerError(w, r, err, "Error marking notifications read", "failed to update notifications")
+		return
+	}
+
+	updated, _ := result.RowsAffected()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"updated": updated})
+}
+
+// Mark all of the current user's notifications as read
+func markAllNotificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	result, err := db.ExecContext(r.Context(), "UPDATE notifications SET read_at = NOW() WHERE user_id = ? AND read_at IS NULL", userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error marking notifications read", "failed to update notifications")
+		return
+	}
+
+	updated, _ := result.RowsAffected()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"updated": updated})
+}
+
+func notificationPreferencesRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		authMiddleware(getNotificationPreferencesHandler)(w, r)
+	case http.MethodPut:
+		authMiddleware(updateNotificationPreferencesHandler)(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Get the current user's channels for every notification type
+func getNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	prefs := make(map[string]NotificationPreference, len(notificationTypes))
+	for t, pref := range notificationTypes {
+		prefs[t] = pref
+	}
+
+	rows, err := db.QueryContext(r.Context(), "SELECT type, in_app, email FROM notification_preferences WHERE user_id = ?", userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying notification preferences", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p NotificationPreference
+		if err := rows.Scan(&p.Type, &p.InApp, &p.Email); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning notification preference", "error", err)
+			continue
+		}
+		if _, ok := prefs[p.Type]; ok {
+			prefs[p.Type] = p
+		}
+	}
+
+	list := make([]NotificationPreference, 0, len(prefs))
+	for _, p := range prefs {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Type < list[j].Type })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Save channels for one or more notification types
+func updateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var prefs []NotificationPreference
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil || len(prefs) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "a list of preferences is required"})
+		return
+	}
+	for _, p := range prefs {
+		if _, ok := notificationTypes[p.Type]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "unknown notification type: " + p.Type})
+			return
+		}
+	}
+
+	for _, p := range prefs {
+		_, err := db.ExecContext(r.Context(), `
+			INSERT INTO notification_preferences (user_id, type, in_app, email) VALUES (?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE in_app = VALUES(in_app), email = VALUES(email)
+		`, userID, p.Type, p.InApp, p.Email)
+		if err != nil {
+			writeServerError(w, r, err, "Error saving notification preference", "failed to save preferences")
+			return
+		}
+	}
+
+	getNotificationPreferencesHandler(w, r)
+}
@@ -0,0 +1,808 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// "Sign in with ..." goes through a generic OpenID Connect client using the
+// authorization code flow with PKCE. Providers are listed in OIDC_PROVIDERS,
+// e.g. "google,mock", each configured with OIDC_<NAME>_ISSUER,
+// OIDC_<NAME>_CLIENT_ID, OIDC_<NAME>_CLIENT_SECRET and optionally
+// OIDC_<NAME>_SCOPES. Endpoints and signing keys come from the issuer's
+// discovery document.
+//
+// The browser is sent to /auth/oidc/<name>/start and comes back to
+// /auth/oidc/<name>/callback, which must be registered with the provider as
+// PUBLIC_URL + that path. After a successful login the browser is sent on to
+// the page it started from with the session token in the URL fragment, or a
+// challenge token if the account uses two-factor authentication. The state
+// is also kept, hashed, in a cookie on the browser that started, so a
+// callback URL made on one browser can't be finished on another.
+//
+// A provider identity is matched by its subject first. A new identity is
+// linked to the account with the same email only if both the provider and
+// this site have verified that email; an account whose email is unverified
+// could have been registered by someone else, so its owner has to sign in
+// with the password and link from there. Otherwise a new account is created.
+// Signed-in users can also link further providers explicitly.
+
+const (
+	oidcStateTTL       = 10 * time.Minute
+	oidcJWKSRefresh    = time.Minute
+	oidcDiscoveryTTL   = time.Hour
+	maxOIDCResponse    = 1 << 20
+	defaultOIDCScopes  = "openid email profile"
+	oidcIDTokenLeeway  = time.Minute
+	oidcProviderPrefix = "/auth/oidc/"
+	oidcStateCookie    = "oidc_state"
+)
+
+var (
+	errUnverifiedEmail  = errString("the provider did not confirm your email address")
+	errLinkWithPassword = errString("an account with this email already exists, sign in with your password and link this provider from your account settings")
+)
+
+// OIDCProvider is one configured identity provider
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       string
+
+	mutex      sync.Mutex
+	discovery  *oidcDiscovery
+	fetchedAt  time.Time
+	keys       map[string]interface{}
+	keysLoaded time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcClaims are the ID token claims used to find or create the account
+type oidcClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string      `json:"nonce"`
+	AuthorizedBy  string      `json:"azp"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+	Name          string      `json:"name"`
+}
+
+// UserIdentity is a provider account linked to a user
+type UserIdentity struct {
+	ID          int        `json:"id"`
+	Provider    string     `json:"provider"`
+	Email       string     `json:"email,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+}
+
+var (
+	oidcProviders = map[string]*OIDCProvider{}
+	oidcClient    = &http.Client{Timeout: 10 * time.Second, Transport: newTracingTransport(nil)}
+)
+
+// initOIDC reads the providers from the environment
+func initOIDC() {
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		env := "OIDC_" + strings.ToUpper(name) + "_"
+		p := &OIDCProvider{
+			Name:         name,
+			Issuer:       strings.TrimRight(os.Getenv(env+"ISSUER"), "/"),
+			ClientID:     os.Getenv(env + "CLIENT_ID"),
+			ClientSecret: os.Getenv(env + "CLIENT_SECRET"),
+			Scopes:       os.Getenv(env + "SCOPES"),
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			slog.Warn("OIDC provider is missing its issuer or client ID, skipping", "provider", name)
+			continue
+		}
+		if p.Scopes == "" {
+			p.Scopes = defaultOIDCScopes
+		}
+		oidcProviders[name] = p
+		slog.Info("OIDC provider configured", "provider", name, "issuer", p.Issuer)
+	}
+}
+
+// migrateOIDC marks accounts that have no password of their own, and
+// records when an account's email was proven to belong to its owner
+func migrateOIDC(ctx context.Context) error {
+	if err := addColumnIfMissing(ctx, "users", "has_password", "BOOLEAN NOT NULL DEFAULT TRUE"); err != nil {
+		return err
+	}
+	return addColumnIfMissing(ctx, "users", "email_verified_at", "DATETIME NULL")
+}
+
+// redirectURI is where the provider sends the browser back to
+func (p *OIDCProvider) redirectURI() string {
+	return publicURL(oidcProviderPrefix + p.Name + "/callback")
+}
+
+// getJSON fetches a JSON document from the provider
+func getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponse)).Decode(v)
+}
+
+// metadata returns the discovery document, fetched at most once an hour
+func (p *OIDCProvider) metadata(ctx context.Context) (*oidcDiscovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.discovery != nil && time.Since(p.fetchedAt) < oidcDiscoveryTTL {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", d.Issuer, p.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document for %s is missing endpoints", p.Issuer)
+	}
+	p.discovery, p.fetchedAt = &d, time.Now()
+	return p.discovery, nil
+}
+
+// signingKey finds the provider key an ID token was signed with. The key
+// set is fetched again for an unknown key ID, as providers rotate keys, but
+// at most once a minute.
+func (p *OIDCProvider) signingKey(ctx context.Context, kid string) (interface{}, error) {
+	p.mutex.Lock()
+	key, ok := p.keys[kid]
+	stale := time.Since(p.keysLoaded) > oidcJWKSRefresh
+	p.mutex.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !stale {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	d, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+
+	p.mutex.Lock()
+	p.keys, p.keysLoaded = keys, time.Now()
+	p.mutex.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// jsonWebKey is an RSA or EC public key from a JWKS document
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// authorizationURL builds the URL the browser is sent to
+func (p *OIDCProvider) authorizationURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	d, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.redirectURI())
+	v.Set("scope", p.Scopes)
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// exchange trades the authorization code for tokens and returns the
+// validated ID token claims
+func (p *OIDCProvider) exchange(ctx context.Context, code, verifier, nonce string) (*oidcClaims, error) {
+	d, err := p.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURI())
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.ClientID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponse)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token response: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("token request failed: %s %s %s", resp.Status, tokens.Error, tokens.ErrorDescription)
+	}
+	return p.verifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+// verifyIDToken checks the ID token's signature, issuer, audience, expiry
+// and nonce
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, raw, nonce string) (*oidcClaims, error) {
+	claims := &oidcClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.signingKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384"}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(oidcIDTokenLeeway),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedBy != p.ClientID {
+		return nil, fmt.Errorf("ID token was issued to %q", claims.AuthorizedBy)
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return nil, fmt.Errorf("ID token nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// emailVerified reads email_verified, which some providers send as a string
+func (c *oidcClaims) emailVerified() bool {
+	switch v := c.EmailVerified.(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// oidcUser finds the account for a provider identity, linking or creating
+// it as needed. linkUserID is the signed-in user asking to link, or 0.
+func oidcUser(ctx context.Context, provider string, claims *oidcClaims, linkUserID int) (User, error) {
+	email := strings.ToLower(strings.TrimSpace(claims.Email))
+
+	var userID int
+	err := db.QueryRowContext(ctx, "SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?", provider, claims.Subject).Scan(&userID)
+	switch {
+	case err == nil:
+		if linkUserID != 0 && linkUserID != userID {
+			return User{}, errString("this account is already linked to another user")
+		}
+	case err != sql.ErrNoRows:
+		return User{}, err
+	case linkUserID != 0:
+		userID = linkUserID
+	default:
+		if email == "" || !claims.emailVerified() {
+			return User{}, errUnverifiedEmail
+		}
+		var verified bool
+		err = db.QueryRowContext(ctx, "SELECT id, email_verified_at IS NOT NULL FROM users WHERE email = ?", email).Scan(&userID, &verified)
+		if err == sql.ErrNoRows {
+			userID, err = createOIDCUser(ctx, email, claims.Name)
+		} else if err == nil && !verified {
+			return User{}, errLinkWithPassword
+		}
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO user_identities (user_id, provider, subject, email, last_login_at)
+		VALUES (?, ?, ?, NULLIF(?, ''), NOW())
+		ON DUPLICATE KEY UPDATE email = VALUES(email), last_login_at = NOW()
+	`, userID, provider, claims.Subject, email)
+	if err != nil {
+		return User{}, err
+	}
+	return loadUser(ctx, userID)
+}
+
+// createOIDCUser creates an account without a password of its own. The
+// stored hash is of a random password nobody knows. The provider has
+// verified the email, so the account starts verified.
+func createOIDCUser(ctx context.Context, email, name string) (int, error) {
+	if name == "" {
+		name, _, _ = strings.Cut(email, "@")
+	}
+	secret, err := newToken()
+	if err != nil {
+		return 0, err
+	}
+	hash, err := hashPassword(secret)
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.ExecContext(ctx, "INSERT INTO users (name, email, password, type, has_password, email_verified_at) VALUES (?, ?, ?, 'user', FALSE, NOW())",
+		truncate(name, 255), email, hash)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err == nil {
+		slog.InfoContext(ctx, "Account created from OIDC login", "new_user_id", id)
+	}
+	return int(id), err
+}
+
+// safeRedirect keeps the post-login redirect on this site
+func safeRedirect(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/"
+	}
+	return path
+}
+
+// oidcRouter dispatches /auth/oidc/<name>/<action>
+func oidcRouter(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, oidcProviderPrefix)
+	if rest == "providers" {
+		listOIDCProvidersHandler(w, r)
+		return
+	}
+
+	name, action, _ := strings.Cut(rest, "/")
+	p, ok := oidcProviders[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unknown provider"})
+		return
+	}
+
+	switch action {
+	case "start":
+		startOIDCHandler(w, r, p)
+	case "link":
+		authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			linkOIDCHandler(w, r, p)
+		})(w, r)
+	case "callback":
+		oidcCallbackHandler(w, r, p)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "not found"})
+	}
+}
+
+// List the providers users can sign in with
+func listOIDCProvidersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	names := make([]string, 0, len(oidcProviders))
+	for name := range oidcProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	providers := make([]map[string]string, len(names))
+	for i, name := range names {
+		providers[i] = map[string]string{
+			"name":      name,
+			"login_url": oidcProviderPrefix + name + "/start",
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(providers)
+}
+
+// beginOIDC stores a new login state, binds it to the browser with a
+// cookie and returns the provider URL to visit
+func beginOIDC(ctx context.Context, w http.ResponseWriter, p *OIDCProvider, redirect string, linkUserID int) (string, error) {
+	state, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	verifier, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := db.ExecContext(ctx, "DELETE FROM oidc_states WHERE expires_at < NOW()"); err != nil {
+		return "", err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO oidc_states (state_hash, provider, nonce, code_verifier, redirect, link_user_id, expires_at)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, 0), ?)
+	`, hashToken(state), p.Name, nonce, verifier, truncate(safeRedirect(redirect), 500), linkUserID, time.Now().Add(oidcStateTTL))
+	if err != nil {
+		return "", err
+	}
+	authURL, err := p.authorizationURL(ctx, state, nonce, verifier)
+	if err != nil {
+		return "", err
+	}
+	setOIDCStateCookie(w, hashToken(state), int(oidcStateTTL.Seconds()))
+	return authURL, nil
+}
+
+// setOIDCStateCookie sets the state cookie, or clears it when maxAge is
+// negative. Lax lets it through on the provider's top-level redirect back.
+func setOIDCStateCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     oidcProviderPrefix,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Send the browser to the provider. ?redirect= is the page to return to.
+func startOIDCHandler(w http.ResponseWriter, r *http.Request, p *OIDCProvider) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	authURL, err := beginOIDC(r.Context(), w, p, r.URL.Query().Get("redirect"), 0)
+	if err != nil {
+		writeServerError(w, r, err, "Error starting OIDC login", "could not reach the sign-in provider")
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// Link another provider to the signed-in account. Returns the provider URL
+// for the client to send the browser to; the call must come from the site's
+// own pages so the browser keeps the state cookie.
+func linkOIDCHandler(w http.ResponseWriter, r *http.Request, p *OIDCProvider) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	authURL, err := beginOIDC(r.Context(), w, p, r.URL.Query().Get("redirect"), userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error starting OIDC link", "could not reach the sign-in provider")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"authorization_url": authURL})
+}
+
+// Finish a login or link coming back from the provider
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request, p *OIDCProvider) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	stateHash := hashToken(q.Get("state"))
+
+	// Only the browser that started the sign-in may finish it
+	cookie, err := r.Cookie(oidcStateCookie)
+	setOIDCStateCookie(w, "", -1)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(stateHash)) != 1 {
+		oidcRedirect(w, r, "/", url.Values{"error": {"sign-in expired, please try again"}})
+		return
+	}
+
+	// The state is single use
+	var nonce, verifier, redirect string
+	var linkUserID sql.NullInt64
+	err = db.QueryRowContext(ctx, `
+		SELECT nonce, code_verifier, redirect, link_user_id FROM oidc_states
+		WHERE state_hash = ? AND provider = ? AND expires_at > NOW()
+	`, stateHash, p.Name).Scan(&nonce, &verifier, &redirect, &linkUserID)
+	if err == sql.ErrNoRows {
+		oidcRedirect(w, r, "/", url.Values{"error": {"sign-in expired, please try again"}})
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching OIDC state", "internal server error")
+		return
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM oidc_states WHERE state_hash = ?", stateHash); err != nil {
+		writeServerError(w, r, err, "Error deleting OIDC state", "internal server error")
+		return
+	}
+
+	if e := q.Get("error"); e != "" {
+		oidcRedirect(w, r, redirect, url.Values{"error": {"sign-in was cancelled or refused"}})
+		return
+	}
+
+	claims, err := p.exchange(ctx, q.Get("code"), verifier, nonce)
+	if err != nil {
+		slog.WarnContext(ctx, "OIDC code exchange failed", "provider", p.Name, "error", err)
+		oidcRedirect(w, r, redirect, url.Values{"error": {"sign-in failed, please try again"}})
+		return
+	}
+
+	user, err := oidcUser(ctx, p.Name, claims, int(linkUserID.Int64))
+	if err != nil {
+		if msg, ok := err.(errString); ok {
+			oidcRedirect(w, r, redirect, url.Values{"error": {string(msg)}})
+			return
+		}
+		writeServerError(w, r, err, "Error resolving OIDC account", "internal server error")
+		return
+	}
+	setRequestUser(r, strconv.Itoa(user.ID))
+
+	if linkUserID.Valid {
+		oidcRedirect(w, r, redirect, url.Values{"linked": {p.Name}})
+		return
+	}
+
+	// The provider stands in for the password, not for the second factor
+	var totpEnabled bool
+	if err := db.QueryRowContext(ctx, "SELECT totp_enabled FROM users WHERE id = ?", user.ID).Scan(&totpEnabled); err != nil {
+		writeServerError(w, r, err, "Error fetching two-factor status", "internal server error")
+		return
+	}
+	if totpEnabled || twoFactorRequired(user.Type) {
+		purpose := challengeVerify
+		if !totpEnabled {
+			purpose = challengeEnroll
+		}
+		token, err := newLoginChallenge(ctx, user.ID, purpose)
+		if err != nil {
+			writeServerError(w, r, err, "Error creating login challenge", "internal server error")
+			return
+		}
+		flag := "two_factor_required"
+		if !totpEnabled {
+			flag = "two_factor_setup_required"
+		}
+		oidcRedirect(w, r, redirect, url.Values{"challenge_token": {token}, flag: {"true"}})
+		return
+	}
+
+	if err := recordLoginSuccess(ctx, r, user); err != nil {
+		slog.ErrorContext(ctx, "Error recording login", "error", err)
+	}
+	token, err := generateToken(ctx, user)
+	if err != nil {
+		writeServerError(w, r, err, "Error generating token", "failed to generate token")
+		return
+	}
+	oidcRedirect(w, r, redirect, url.Values{"token": {token}})
+}
+
+// oidcRedirect sends the browser back to the site with the outcome in the
+// URL fragment, which browsers don't send on to servers or in Referer
+func oidcRedirect(w http.ResponseWriter, r *http.Request, path string, values url.Values) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, safeRedirect(path)+"#"+values.Encode(), http.StatusFound)
+}
+
+// List the providers linked to the current user, or unlink one with
+// DELETE ?id=
+func identitiesRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getIdentitiesHandler(w, r)
+	case http.MethodDelete:
+		deleteIdentityHandler(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func getIdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, provider, IFNULL(email, ''), created_at, last_login_at
+		FROM user_identities WHERE user_id = ? ORDER BY created_at
+	`, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching identities", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	identities := []UserIdentity{}
+	for rows.Next() {
+		var i UserIdentity
+		if err := rows.Scan(&i.ID, &i.Provider, &i.Email, &i.CreatedAt, &i.LastLoginAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning identity", "error", err)
+			continue
+		}
+		identities = append(identities, i)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(identities)
+}
+
+func deleteIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid identity ID"})
+		return
+	}
+
+	// Accounts without a password must keep a way to sign in
+	var hasPassword bool
+	var others int
+	err = db.QueryRowContext(ctx, `
+		SELECT u.has_password,
+			(SELECT COUNT(*) FROM user_identities WHERE user_id = u.id AND id != ?) +
+			(SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = u.id)
+		FROM users u WHERE u.id = ?
+	`, id, userID).Scan(&hasPassword, &others)
+	if err != nil {
+		writeServerError(w, r, err, "Error checking identities", "internal server error")
+		return
+	}
+	if !hasPassword && others == 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "this is the only way to sign in to your account"})
+		return
+	}
+
+	result, err := db.ExecContext(ctx, "DELETE FROM user_identities WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error deleting identity", "internal server error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "identity not found"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
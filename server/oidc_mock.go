@@ -0,0 +1,242 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// MockOIDCProvider is a minimal OpenID Connect provider for trying social
+// login locally, run by cmd/mock-oidc. Its login page lets anyone sign in as
+// any email address, so it must never be reachable in production.
+type MockOIDCProvider struct {
+	Issuer string
+
+	key   *rsa.PrivateKey
+	kid   string
+	mutex sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+// mockAuthorization is an issued code waiting to be exchanged
+type mockAuthorization struct {
+	clientID      string
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	email         string
+	verified      bool
+	expires       time.Time
+}
+
+// NewMockOIDCProvider creates a provider for the given issuer URL with a
+// fresh signing key
+func NewMockOIDCProvider(issuer string) (*MockOIDCProvider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return nil, err
+	}
+	return &MockOIDCProvider{
+		Issuer: strings.TrimRight(issuer, "/"),
+		key:    key,
+		kid:    hex.EncodeToString(kid),
+		codes:  make(map[string]mockAuthorization),
+	}, nil
+}
+
+// ServeHTTP serves discovery, the login page, the token endpoint and the
+// key set
+func (m *MockOIDCProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		m.discovery(w, r)
+	case "/authorize":
+		m.authorize(w, r)
+	case "/token":
+		m.token(w, r)
+	case "/jwks":
+		m.jwks(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *MockOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                m.Issuer,
+		"authorization_endpoint":                m.Issuer + "/authorize",
+		"token_endpoint":                        m.Issuer + "/token",
+		"jwks_uri":                              m.Issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+	})
+}
+
+var mockLoginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html><head><title>Mock OIDC provider</title></head>
+<body>
+<h1>Mock OIDC provider</h1>
+<p>Signing in to {{.client_id}}</p>
+<form method="post" action="/authorize?{{.query}}">
+<label>Email <input name="email" type="email" required autofocus></label>
+<label><input name="email_verified" type="checkbox" value="true" checked> Email verified</label>
+<button type="submit">Sign in</button>
+<button type="submit" name="deny" value="true">Deny</button>
+</form>
+</body></html>`))
+
+// authorize shows the login form on GET and issues a code on POST
+func (m *MockOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() || q.Get("client_id") == "" {
+		http.Error(w, "invalid client_id or redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		mockLoginPage.Execute(w, map[string]string{"client_id": q.Get("client_id"), "query": r.URL.RawQuery})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	back := url.Values{}
+	back.Set("state", q.Get("state"))
+	switch {
+	case r.FormValue("deny") != "":
+		back.Set("error", "access_denied")
+	case q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "":
+		back.Set("error", "invalid_request")
+	default:
+		code, err := newToken()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m.mutex.Lock()
+		m.codes[code] = mockAuthorization{
+			clientID:      q.Get("client_id"),
+			redirectURI:   redirectURI.String(),
+			nonce:         q.Get("nonce"),
+			codeChallenge: q.Get("code_challenge"),
+			email:         strings.ToLower(strings.TrimSpace(r.FormValue("email"))),
+			verified:      r.FormValue("email_verified") == "true",
+			expires:       time.Now().Add(time.Minute),
+		}
+		m.mutex.Unlock()
+		back.Set("code", code)
+	}
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token exchanges a code for a signed ID token after checking the PKCE
+// verifier. The subject is derived from the email so the same address is
+// always the same user.
+func (m *MockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokenError := func(code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	code := r.PostFormValue("code")
+	m.mutex.Lock()
+	auth, ok := m.codes[code]
+	delete(m.codes, code)
+	m.mutex.Unlock()
+
+	clientID := r.PostFormValue("client_id")
+	if id, _, basic := r.BasicAuth(); basic {
+		clientID, _ = url.QueryUnescape(id)
+	}
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	switch {
+	case r.PostFormValue("grant_type") != "authorization_code":
+		tokenError("unsupported_grant_type")
+		return
+	case !ok || time.Now().After(auth.expires):
+		tokenError("invalid_grant")
+		return
+	case clientID != auth.clientID || r.PostFormValue("redirect_uri") != auth.redirectURI:
+		tokenError("invalid_grant")
+		return
+	case base64.RawURLEncoding.EncodeToString(verifier[:]) != auth.codeChallenge:
+		tokenError("invalid_grant")
+		return
+	}
+
+	subject := sha256.Sum256([]byte(auth.email))
+	now := time.Now()
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":            m.Issuer,
+		"sub":            hex.EncodeToString(subject[:16]),
+		"aud":            auth.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          auth.nonce,
+		"email":          auth.email,
+		"email_verified": auth.verified,
+		"name":           strings.SplitN(auth.email, "@", 2)[0],
+	})
+	idToken.Header["kid"] = m.kid
+	signed, err := idToken.SignedString(m.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	access, _ := newToken()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     signed,
+	})
+}
+
+func (m *MockOIDCProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := m.key.PublicKey
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": m.kid,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
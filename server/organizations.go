@@ -0,0 +1,852 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Businesses and events belong to an organisation. Members hold one role per
+// organisation and handlers check role permissions rather than comparing
+// owner_id, which is kept only as a record of who created a listing.
+
+const invitationLifetime = 7 * 24 * time.Hour
+
+type Permission string
+
+const (
+	permViewListing     Permission = "listing.view"
+	permCreateListing   Permission = "listing.create"
+	permEditListing     Permission = "listing.edit"
+	permDeleteListing   Permission = "listing.delete"
+	permViewBookings    Permission = "bookings.view"
+	permManageBookings  Permission = "bookings.manage"
+	permManageMembers   Permission = "members.manage"
+	permManageEnquiries Permission = "enquiries.manage"
+)
+
+var organizationRoles = []string{"owner", "manager", "staff", "viewer"}
+
+var rolePermissions = map[string][]Permission{
+	"owner":   {permViewListing, permCreateListing, permEditListing, permDeleteListing, permViewBookings, permManageBookings, permManageMembers, permManageEnquiries},
+	"manager": {permViewListing, permCreateListing, permEditListing, permViewBookings, permManageBookings, permManageEnquiries},
+	"staff":   {permViewListing, permViewBookings, permManageBookings, permManageEnquiries},
+	"viewer":  {permViewListing, permViewBookings},
+}
+
+var errForbidden = errors.New("forbidden")
+
+type Organization struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OrganizationMember struct {
+	UserID    int       `json:"user_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OrganizationInvitation struct {
+	ID             int       `json:"id"`
+	OrganizationID int       `json:"organization_id"`
+	Email          string    `json:"email"`
+	Role           string    `json:"role"`
+	InvitedBy      int       `json:"invited_by"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// can reports whether a role grants a permission
+func can(role string, perm Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// rolesWith lists the roles granting a permission
+func rolesWith(perm Permission) []string {
+	var roles []string
+	for _, role := range organizationRoles {
+		if can(role, perm) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// organizationScope builds a condition limiting column (an organization_id)
+// to organisations where the user has perm
+func organizationScope(column string, userID int, perm Permission) (string, []interface{}) {
+	roles := rolesWith(perm)
+	args := []interface{}{userID}
+	for _, role := range roles {
+		args = append(args, role)
+	}
+	return column + " IN (SELECT organization_id FROM organization_members WHERE user_id = ? AND role IN (?" +
+		strings.Repeat(", ?", len(roles)-1) + "))", args
+}
+
+// organizationRole returns the user's role in an organisation, or "" if they
+// are not a member
+func organizationRole(ctx context.Context, q dbtx, orgID, userID int) (string, error) {
+	var role string
+	err := q.QueryRowContext(ctx, "SELECT role FROM organization_members WHERE organization_id = ? AND user_id = ?", orgID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// authorizeOrganization checks that the user has perm in an organisation
+func authorizeOrganization(ctx context.Context, orgID, userID int, perm Permission) error {
+	role, err := organizationRole(ctx, db, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if !can(role, perm) {
+		return errForbidden
+	}
+	return nil
+}
+
+// authorizeEntity checks that the user has perm in the organisation owning a
+// business or event
+func authorizeEntity(ctx context.Context, entityType string, entityID, userID int, perm Permission) error {
+	et, ok := entityTypes[entityType]
+	if !ok || (entityType != "business" && entityType != "event") {
+		return errUnknownEntityType
+	}
+
+	var orgID sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT organization_id FROM "+et.Table+" WHERE id = ?", entityID).Scan(&orgID)
+	if err == sql.ErrNoRows {
+		return errEntityNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !orgID.Valid {
+		return errForbidden
+	}
+	return authorizeOrganization(ctx, int(orgID.Int64), userID, perm)
+}
+
+// writeAuthzError reports a failed authorization check
+func writeAuthzError(w http.ResponseWriter, r *http.Request, err error, notFound, forbidden string) {
+	switch err {
+	case errEntityNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": notFound})
+	case errForbidden:
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": forbidden})
+	default:
+		writeServerError(w, r, err, "Error checking permissions", "internal server error")
+	}
+}
+
+// personalOrganization returns the first organisation the user owns,
+// creating one named after their company, organisation or name if needed.
+// The created organisation is keyed by personal_owner_id, so concurrent
+// first listings from the same user end up in the same one.
+func personalOrganization(ctx context.Context, q dbtx, userID int) (int, error) {
+	var orgID int
+	err := q.QueryRowContext(ctx, "SELECT organization_id FROM organization_members WHERE user_id = ? AND role = 'owner' ORDER BY organization_id LIMIT 1", userID).Scan(&orgID)
+	if err != sql.ErrNoRows {
+		return orgID, err
+	}
+
+	var name string
+	err = q.QueryRowContext(ctx, `
+		SELECT COALESCE(NULLIF(bo.company, ''), NULLIF(eo.organization, ''), u.name)
+		FROM users u
+		LEFT JOIN business_owners bo ON bo.id = u.id
+		LEFT JOIN event_owners eo ON eo.id = u.id
+		WHERE u.id = ?
+	`, userID).Scan(&name)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := q.ExecContext(ctx, `
+		INSERT INTO organizations (name, created_by, personal_owner_id) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)
+	`, name, userID, userID)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := result.LastInsertId()
+	_, err = q.ExecContext(ctx, "INSERT IGNORE INTO organization_members (organization_id, user_id, role) VALUES (?, ?, 'owner')", id, userID)
+	return int(id), err
+}
+
+// createOrganization inserts an organisation with the user as its owner
+func createOrganization(ctx context.Context, q dbtx, name string, ownerID int) (int, error) {
+	result, err := q.ExecContext(ctx, "INSERT INTO organizations (name, created_by) VALUES (?, ?)", name, ownerID)
+	if err != nil {
+		return 0, err
+	}
+	id, _ := result.LastInsertId()
+	_, err = q.ExecContext(ctx, "INSERT INTO organization_members (organization_id, user_id, role) VALUES (?, ?, 'owner')", id, ownerID)
+	return int(id), err
+}
+
+// listingOrganization picks the organisation a new business or event goes
+// to: the requested one if the user may create listings there, otherwise
+// the user's personal organisation, which only business and event owner
+// accounts get
+func listingOrganization(ctx context.Context, userID int, userType string, requested *int) (int, error) {
+	if requested != nil {
+		if err := authorizeOrganization(ctx, *requested, userID, permCreateListing); err != nil {
+			return 0, err
+		}
+		return *requested, nil
+	}
+	if userType != "business_owner" && userType != "event_owner" {
+		return 0, errForbidden
+	}
+	return personalOrganization(ctx, db, userID)
+}
+
+// migrateOrganizations adds organization_id to businesses and events and
+// gives every existing owner a personal organisation holding their listings
+func migrateOrganizations(ctx context.Context) error {
+	// At most one personal organisation per user
+	if err := addColumnIfMissing(ctx, "organizations", "personal_owner_id", "INT NULL"); err != nil {
+		return err
+	}
+	if err := addConstraintIfMissing(ctx, "organizations", "uq_organizations_personal_owner", "UNIQUE (personal_owner_id)"); err != nil {
+		return err
+	}
+	if err := addConstraintIfMissing(ctx, "organizations", "fk_organizations_personal_owner",
+		"FOREIGN KEY (personal_owner_id) REFERENCES users(id) ON DELETE SET NULL"); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"businesses", "events"} {
+		if err := addColumnIfMissing(ctx, table, "organization_id", "INT NULL"); err != nil {
+			return err
+		}
+		if err := addConstraintIfMissing(ctx, table, "fk_"+table+"_organization",
+			"FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE SET NULL"); err != nil {
+			return err
+		}
+		if err := addIndexIfMissing(ctx, table, "idx_"+table+"_organization_id", "(organization_id)"); err != nil {
+			return err
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT owner_id FROM businesses WHERE organization_id IS NULL AND owner_id IS NOT NULL
+		UNION
+		SELECT owner_id FROM events WHERE organization_id IS NULL
+	`)
+	if err != nil {
+		return err
+	}
+	var owners []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		owners = append(owners, id)
+	}
+	rows.Close()
+
+	for _, ownerID := range owners {
+		orgID, err := personalOrganization(ctx, db, ownerID)
+		if err != nil {
+			return err
+		}
+		if _, err = db.ExecContext(ctx, "UPDATE businesses SET organization_id = ? WHERE owner_id = ? AND organization_id IS NULL", orgID, ownerID); err != nil {
+			return err
+		}
+		if _, err = db.ExecContext(ctx, "UPDATE events SET organization_id = ? WHERE owner_id = ? AND organization_id IS NULL", orgID, ownerID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func organizationsRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		authMiddleware(getMyOrganizationsHandler)(w, r)
+	case http.MethodPost:
+		authMiddleware(createOrganizationHandler)(w, r)
+	case http.MethodPut:
+		authMiddleware(updateOrganizationHandler)(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Get the organisations the current user belongs to
+func getMyOrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT o.id, o.name, m.role, o.created_at
+		FROM organizations o
+		INNER JOIN organization_members m ON m.organization_id = o.id
+		WHERE m.user_id = ?
+		ORDER BY o.name ASC
+	`, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying organizations", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	orgs := []Organization{}
+	for rows.Next() {
+		var o Organization
+		if err := rows.Scan(&o.ID, &o.Name, &o.Role, &o.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning organization", "error", err)
+			continue
+		}
+		orgs = append(orgs, o)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orgs)
+}
+
+// Create an organisation owned by the current user
+func createOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "name is required"})
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		writeServerError(w, r, err, "Error starting transaction", "failed to create organization")
+		return
+	}
+	defer tx.Rollback()
+
+	id, err := createOrganization(r.Context(), tx, strings.TrimSpace(req.Name), userID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error creating organization", "failed to create organization")
+		return
+	}
+
+	org := Organization{ID: id, Name: strings.TrimSpace(req.Name), Role: "owner", CreatedAt: time.Now()}
+	logEvent("organization_created", "Organization "+org.Name+" created", org)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(org)
+}
+
+// Rename an organisation
+func updateOrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "id and name are required"})
+		return
+	}
+
+	if err := authorizeOrganization(r.Context(), req.ID, userID, permManageMembers); err != nil {
+		writeAuthzError(w, r, err, "organization not found", "only organization owners can rename it")
+		return
+	}
+
+	if _, err := db.ExecContext(r.Context(), "UPDATE organizations SET name = ? WHERE id = ?", strings.TrimSpace(req.Name), req.ID); err != nil {
+		writeServerError(w, r, err, "Error updating organization", "failed to update organization")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "organization updated successfully"})
+}
+
+func organizationMembersRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		authMiddleware(getOrganizationMembersHandler)(w, r)
+	case http.MethodPut:
+		authMiddleware(updateOrganizationMemberHandler)(w, r)
+	case http.MethodDelete:
+		authMiddleware(removeOrganizationMemberHandler)(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Get the members of an organisation (any member may look)
+func getOrganizationMembersHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	orgID, err := strconv.Atoi(r.URL.Query().Get("organization_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid organization ID"})
+		return
+	}
+
+	if err := authorizeOrganization(r.Context(), orgID, userID, permViewListing); err != nil {
+		writeAuthzError(w, r, err, "organization not found", "you are not a member of this organization")
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT u.id, u.name, u.email, m.role, m.created_at
+		FROM organization_members m
+		INNER JOIN users u ON u.id = m.user_id
+		WHERE m.organization_id = ?
+		ORDER BY FIELD(m.role, 'owner', 'manager', 'staff', 'viewer'), u.name
+	`, orgID)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying organization members", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	members := []OrganizationMember{}
+	for rows.Next() {
+		var m OrganizationMember
+		if err := rows.Scan(&m.UserID, &m.Name, &m.Email, &m.Role, &m.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning organization member", "error", err)
+			continue
+		}
+		members = append(members, m)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(members)
+}
+
+// changeMember updates or removes a membership in a transaction, refusing to
+// leave an organisation without an owner
+func changeMember(ctx context.Context, orgID, memberID int, newRole string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the membership rows so two owners can't demote each other at once
+	rows, err := tx.QueryContext(ctx, "SELECT user_id, role FROM organization_members WHERE organization_id = ? FOR UPDATE", orgID)
+	if err != nil {
+		return err
+	}
+	owners, current := 0, ""
+	for rows.Next() {
+		var uid int
+		var role string
+		if err := rows.Scan(&uid, &role); err != nil {
+			rows.Close()
+			return err
+		}
+		if role == "owner" {
+			owners++
+		}
+		if uid == memberID {
+			current = role
+		}
+	}
+	rows.Close()
+
+	if current == "" {
+		return errEntityNotFound
+	}
+	if current == "owner" && newRole != "owner" && owners == 1 {
+		return errLastOwner
+	}
+
+	if newRole == "" {
+		_, err = tx.ExecContext(ctx, "DELETE FROM organization_members WHERE organization_id = ? AND user_id = ?", orgID, memberID)
+	} else {
+		_, err = tx.ExecContext(ctx, "UPDATE organization_members SET role = ? WHERE organization_id = ? AND user_id = ?", newRole, orgID, memberID)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+var errLastOwner = errors.New("an organization needs at least one owner")
+
+func writeMemberError(w http.ResponseWriter, r *http.Request, err error, action string) {
+	switch err {
+	case errEntityNotFound:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "member not found"})
+	case errLastOwner:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	default:
+		writeServerError(w, r, err, "Error changing membership", "failed to "+action)
+	}
+}
+
+// Change a member's role
+func updateOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		OrganizationID int    `json:"organization_id"`
+		UserID         int    `json:"user_id"`
+		Role           string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validRole(req.Role) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "organization_id, user_id and a valid role are required"})
+		return
+	}
+
+	if err := authorizeOrganization(r.Context(), req.OrganizationID, userID, permManageMembers); err != nil {
+		writeAuthzError(w, r, err, "organization not found", "only organization owners can change roles")
+		return
+	}
+
+	if err := changeMember(r.Context(), req.OrganizationID, req.UserID, req.Role); err != nil {
+		writeMemberError(w, r, err, "update member")
+		return
+	}
+
+	logEvent("member_updated", "Organization member role changed to "+req.Role, req)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "member updated successfully"})
+}
+
+// Remove a member. Members may also remove themselves to leave.
+func removeOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		OrganizationID int `json:"organization_id"`
+		UserID         int `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	if req.UserID != userID {
+		if err := authorizeOrganization(r.Context(), req.OrganizationID, userID, permManageMembers); err != nil {
+			writeAuthzError(w, r, err, "organization not found", "only organization owners can remove members")
+			return
+		}
+	}
+
+	if err := changeMember(r.Context(), req.OrganizationID, req.UserID, ""); err != nil {
+		writeMemberError(w, r, err, "remove member")
+		return
+	}
+
+	logEvent("member_removed", "Organization member removed", req)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "member removed successfully"})
+}
+
+func organizationInvitationsRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		authMiddleware(getOrganizationInvitationsHandler)(w, r)
+	case http.MethodPost:
+		authMiddleware(createOrganizationInvitationHandler)(w, r)
+	case http.MethodDelete:
+		authMiddleware(revokeOrganizationInvitationHandler)(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Get the pending invitations of an organisation
+func getOrganizationInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	orgID, err := strconv.Atoi(r.URL.Query().Get("organization_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid organization ID"})
+		return
+	}
+
+	if err := authorizeOrganization(r.Context(), orgID, userID, permManageMembers); err != nil {
+		writeAuthzError(w, r, err, "organization not found", "only organization owners can see invitations")
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, organization_id, email, role, invited_by, expires_at, created_at
+		FROM organization_invitations
+		WHERE organization_id = ? AND accepted_at IS NULL AND expires_at > NOW()
+		ORDER BY created_at DESC
+	`, orgID)
+	if err != nil {
+		writeServerError(w, r, err, "Error querying invitations", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	invitations := []OrganizationInvitation{}
+	for rows.Next() {
+		var inv OrganizationInvitation
+		if err := rows.Scan(&inv.ID, &inv.OrganizationID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.ExpiresAt, &inv.CreatedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning invitation", "error", err)
+			continue
+		}
+		invitations = append(invitations, inv)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invitations)
+}
+
+// Invite someone by email to join an organisation with a role
+func createOrganizationInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		OrganizationID int    `json:"organization_id"`
+		Email          string `json:"email"`
+		Role           string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if !strings.Contains(req.Email, "@") || !validRole(req.Role) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "a valid email and role are required"})
+		return
+	}
+
+	if err := authorizeOrganization(ctx, req.OrganizationID, userID, permManageMembers); err != nil {
+		writeAuthzError(w, r, err, "organization not found", "only organization owners can invite members")
+		return
+	}
+
+	var orgName string
+	if err := db.QueryRowContext(ctx, "SELECT name FROM organizations WHERE id = ?", req.OrganizationID).Scan(&orgName); err != nil {
+		writeServerError(w, r, err, "Error fetching organization", "internal server error")
+		return
+	}
+
+	var members int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM organization_members m INNER JOIN users u ON u.id = m.user_id
+		WHERE m.organization_id = ? AND LOWER(u.email) = LOWER(?)
+	`, req.OrganizationID, req.Email).Scan(&members)
+	if err != nil {
+		writeServerError(w, r, err, "Error checking membership", "internal server error")
+		return
+	}
+	if members > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "this person is already a member"})
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		writeServerError(w, r, err, "Error generating invitation token", "internal server error")
+		return
+	}
+
+	inv := OrganizationInvitation{
+		OrganizationID: req.OrganizationID,
+		Email:          req.Email,
+		Role:           req.Role,
+		InvitedBy:      userID,
+		ExpiresAt:      time.Now().Add(invitationLifetime),
+		CreatedAt:      time.Now(),
+	}
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO organization_invitations (organization_id, email, role, token_hash, invited_by, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, inv.OrganizationID, inv.Email, inv.Role, hashToken(token), userID, inv.ExpiresAt)
+	if err != nil {
+		writeServerError(w, r, err, "Error creating invitation", "failed to create invitation")
+		return
+	}
+	id, _ := result.LastInsertId()
+	inv.ID = int(id)
+
+	sendMailAsync(inv.Email, "You're invited to join "+orgName,
+		"You have been invited to join "+orgName+" as "+inv.Role+".\n\n"+
+			"Sign in or create an account with this email address, then open this link within 7 days:\n\n"+
+			publicURL("/organizations/invitations/accept?token="+token)+"\n")
+
+	// The invitee's address stays out of the public event stream
+	logEvent("member_invited", "Invitation to "+orgName+" sent", map[string]interface{}{"invitation_id": inv.ID, "organization_id": inv.OrganizationID, "role": inv.Role})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(inv)
+}
+
+// Revoke a pending invitation
+func revokeOrganizationInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+
+	var orgID int
+	err := db.QueryRowContext(ctx, "SELECT organization_id FROM organization_invitations WHERE id = ? AND accepted_at IS NULL", req.ID).Scan(&orgID)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invitation not found"})
+		return
+	}
+	if err == nil {
+		err = authorizeOrganization(ctx, orgID, userID, permManageMembers)
+	}
+	if err != nil {
+		writeAuthzError(w, r, err, "invitation not found", "only organization owners can revoke invitations")
+		return
+	}
+
+	if _, err := db.ExecContext(ctx, "DELETE FROM organization_invitations WHERE id = ?", req.ID); err != nil {
+		writeServerError(w, r, err, "Error revoking invitation", "failed to revoke invitation")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "invitation revoked successfully"})
+}
+
+// Accept an invitation. The signed-in account's email must match the
+// invited address.
+func acceptOrganizationInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.Token == "" {
+		req.Token = r.URL.Query().Get("token")
+	}
+	if req.Token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "token is required"})
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		writeServerError(w, r, err, "Error starting transaction", "internal server error")
+		return
+	}
+	defer tx.Rollback()
+
+	var invID, orgID int
+	var email, role string
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, organization_id, email, role FROM organization_invitations
+		WHERE token_hash = ? AND accepted_at IS NULL AND expires_at > NOW()
+		FOR UPDATE
+	`, hashToken(req.Token)).Scan(&invID, &orgID, &email, &role)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid or expired invitation"})
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching invitation", "internal server error")
+		return
+	}
+
+	var userEmail string
+	if err := tx.QueryRowContext(ctx, "SELECT email FROM users WHERE id = ?", userID).Scan(&userEmail); err != nil {
+		writeServerError(w, r, err, "Error fetching user", "internal server error")
+		return
+	}
+	if !strings.EqualFold(userEmail, email) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "this invitation was sent to a different email address"})
+		return
+	}
+
+	existing, err := organizationRole(ctx, tx, orgID, userID)
+	if err == nil && existing == "" {
+		_, err = tx.ExecContext(ctx, "INSERT INTO organization_members (organization_id, user_id, role) VALUES (?, ?, ?)", orgID, userID, role)
+	}
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "UPDATE organization_invitations SET accepted_at = NOW() WHERE id = ?", invID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error accepting invitation", "failed to accept invitation")
+		return
+	}
+	if existing != "" {
+		role = existing
+	}
+
+	logEvent("member_joined", "Invitation accepted", map[string]interface{}{"organization_id": orgID, "user_id": userID, "role": role})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"organization_id": orgID, "role": role})
+}
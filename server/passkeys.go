@@ -0,0 +1,364 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Passkeys are WebAuthn credentials a user signs in with instead of a
+// password. A signed-in user registers one with /passkeys/register/begin and
+// /passkeys/register/finish; anyone can then sign in with /login/passkey/begin
+// and /login/passkey/finish. Passkeys are discoverable, so the login doesn't
+// ask for an email address first: the authenticator offers the passkeys it
+// holds for the site and the credential says whose it is.
+//
+// Each assertion carries the authenticator's signature counter. A counter
+// that doesn't go up means the passkey may have been copied, and the login
+// is refused. Passkeys synced between devices always report 0, which is
+// allowed.
+
+// Passkey is a registered WebAuthn credential
+type Passkey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Transports []string   `json:"transports"`
+	BackedUp   bool       `json:"backed_up"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+var (
+	errUnknownPasskey = errString("passkey not recognised")
+	errPasskeyCloned  = errString("this passkey can no longer be used, sign in another way and register it again")
+)
+
+// Start registering a passkey for the current user
+func beginPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	user, err := loadUser(ctx, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching user", "internal server error")
+		return
+	}
+
+	// Authenticators refuse to register a second passkey for the same user
+	opts := creationOptions{
+		PubKeyCredParams: []credentialParameter{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:            int(webauthnTimeout.Milliseconds()),
+		ExcludeCredentials: []credentialDescriptor{},
+		Attestation:        "none",
+	}
+	rows, err := db.QueryContext(ctx, "SELECT credential_id, transports FROM webauthn_credentials WHERE user_id = ?", userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching passkeys", "internal server error")
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var credentialID []byte
+		var transports string
+		if err := rows.Scan(&credentialID, &transports); err != nil {
+			slog.ErrorContext(ctx, "Error scanning passkey", "error", err)
+			continue
+		}
+		opts.ExcludeCredentials = append(opts.ExcludeCredentials, credentialDescriptor{
+			Type:       "public-key",
+			ID:         credentialID,
+			Transports: splitTransports(transports),
+		})
+	}
+
+	opts.Challenge, err = newCeremony(ctx, ceremonyRegister, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error starting passkey registration", "internal server error")
+		return
+	}
+	opts.RP.ID = webauthnRPID()
+	opts.RP.Name = webauthnRPName
+	opts.User.ID = webauthnUserHandle(user.ID)
+	opts.User.Name = user.Email
+	opts.User.DisplayName = user.Name
+	opts.AuthenticatorSelection.ResidentKey = "required"
+	opts.AuthenticatorSelection.RequireResidentKey = true
+	opts.AuthenticatorSelection.UserVerification = "preferred"
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": opts})
+}
+
+// Store the passkey the authenticator created
+func finishPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+		publicKeyCredential
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Type != "public-key" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid credential"})
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	ceremonyUser, err := useCeremony(ctx, ceremonyRegister, req.Response.ClientDataJSON)
+	if err != nil {
+		writePasskeyError(w, r, err)
+		return
+	}
+	if ceremonyUser != userID {
+		writePasskeyError(w, r, errInvalidCeremony)
+		return
+	}
+	ad, err := verifyRegistration(&req.publicKeyCredential)
+	if err != nil {
+		writePasskeyError(w, r, err)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	result, err := db.ExecContext(ctx, `
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key, sign_count, name, transports, backed_up)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, userID, ad.CredentialID, ad.PublicKey, ad.SignCount, truncate(name, 100),
+		strings.Join(req.Response.Transports, ","), ad.Flags&flagBackupState != 0)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate entry") {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "this passkey is already registered"})
+			return
+		}
+		writeServerError(w, r, err, "Error storing passkey", "internal server error")
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	slog.InfoContext(ctx, "Passkey registered", "passkey_id", id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Passkey{
+		ID:         int(id),
+		Name:       truncate(name, 100),
+		Transports: req.Response.Transports,
+		BackedUp:   ad.Flags&flagBackupState != 0,
+		CreatedAt:  time.Now(),
+	})
+}
+
+// List the current user's passkeys, or remove one with DELETE ?id=
+func passkeysRouter(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getPasskeysHandler(w, r)
+	case http.MethodDelete:
+		deletePasskeyHandler(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func getPasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	rows, err := db.QueryContext(r.Context(), `
+		SELECT id, name, transports, backed_up, created_at, last_used_at
+		FROM webauthn_credentials WHERE user_id = ? ORDER BY created_at
+	`, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching passkeys", "internal server error")
+		return
+	}
+	defer rows.Close()
+
+	passkeys := []Passkey{}
+	for rows.Next() {
+		var p Passkey
+		var transports string
+		if err := rows.Scan(&p.ID, &p.Name, &transports, &p.BackedUp, &p.CreatedAt, &p.LastUsedAt); err != nil {
+			slog.ErrorContext(r.Context(), "Error scanning passkey", "error", err)
+			continue
+		}
+		p.Transports = splitTransports(transports)
+		passkeys = append(passkeys, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(passkeys)
+}
+
+func deletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid passkey ID"})
+		return
+	}
+
+	result, err := db.ExecContext(r.Context(), "DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error deleting passkey", "internal server error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "passkey not found"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Start a passkey login
+func beginPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	challenge, err := newCeremony(r.Context(), ceremonyLogin, 0)
+	if err != nil {
+		writeServerError(w, r, err, "Error starting passkey login", "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"publicKey": requestOptions{
+		Challenge:        challenge,
+		Timeout:          int(webauthnTimeout.Milliseconds()),
+		RPID:             webauthnRPID(),
+		AllowCredentials: []credentialDescriptor{},
+		UserVerification: "preferred",
+	}})
+}
+
+// Sign in with a passkey assertion
+func finishPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var cred publicKeyCredential
+	if err := json.NewDecoder(r.Body).Decode(&cred); err != nil || cred.Type != "public-key" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid credential"})
+		return
+	}
+
+	if _, err := useCeremony(ctx, ceremonyLogin, cred.Response.ClientDataJSON); err != nil {
+		writePasskeyError(w, r, err)
+		return
+	}
+	ad, err := parseAuthenticatorData(cred.Response.AuthenticatorData)
+	if err != nil {
+		writePasskeyError(w, r, err)
+		return
+	}
+
+	var id, userID int
+	var publicKey []byte
+	var signCount uint32
+	err = db.QueryRowContext(ctx, "SELECT id, user_id, public_key, sign_count FROM webauthn_credentials WHERE credential_id = ?",
+		[]byte(cred.RawID)).Scan(&id, &userID, &publicKey, &signCount)
+	if err == sql.ErrNoRows {
+		loginFailures.inc("unknown_passkey")
+		writePasskeyError(w, r, errUnknownPasskey)
+		return
+	}
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching passkey", "internal server error")
+		return
+	}
+	if len(cred.Response.UserHandle) > 0 && !bytes.Equal(cred.Response.UserHandle, webauthnUserHandle(userID)) {
+		loginFailures.inc("unknown_passkey")
+		writePasskeyError(w, r, errUnknownPasskey)
+		return
+	}
+
+	if err := verifyAssertion(publicKey, cred.Response.AuthenticatorData, cred.Response.ClientDataJSON, cred.Response.Signature); err != nil {
+		loginFailures.inc("bad_passkey")
+		writePasskeyError(w, r, err)
+		return
+	}
+	if (ad.SignCount != 0 || signCount != 0) && ad.SignCount <= signCount {
+		loginFailures.inc("passkey_cloned")
+		slog.WarnContext(ctx, "Passkey signature counter went backwards", "passkey_id", id, "stored", signCount, "received", ad.SignCount)
+		writePasskeyError(w, r, errPasskeyCloned)
+		return
+	}
+
+	// A conditional update keeps two logins racing with the same counter
+	// from both succeeding
+	result, err := db.ExecContext(ctx, "UPDATE webauthn_credentials SET sign_count = ?, backed_up = ?, last_used_at = NOW() WHERE id = ? AND sign_count = ?",
+		ad.SignCount, ad.Flags&flagBackupState != 0, id, signCount)
+	if err != nil {
+		writeServerError(w, r, err, "Error updating passkey", "internal server error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 && ad.SignCount != 0 {
+		writePasskeyError(w, r, errPasskeyCloned)
+		return
+	}
+
+	user, err := loadUser(ctx, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching user", "internal server error")
+		return
+	}
+	setRequestUser(r, strconv.Itoa(user.ID))
+
+	// A passkey unlocked with a PIN or biometric is two factors already
+	if ad.Flags&flagUserVerified != 0 {
+		completeLogin(w, r, user, nil)
+		return
+	}
+	completeFirstFactor(w, r, user)
+}
+
+func splitTransports(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+func writePasskeyError(w http.ResponseWriter, r *http.Request, err error) {
+	msg, ok := err.(errString)
+	if !ok {
+		writeServerError(w, r, err, "Error verifying passkey", "internal server error")
+		return
+	}
+	if msg == errInvalidCeremony || msg == errUnknownPasskey || msg == errPasskeyCloned {
+		w.WriteHeader(http.StatusUnauthorized)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"error": string(msg)})
+}
@@ -0,0 +1,322 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Business and event views never store a full client address or user agent.
+// Each view keeps the address truncated to its network prefix and a visitor
+// hash salted with a random value that is replaced every UTC day and deleted
+// soon after, so visitors can be counted within a day but not followed across
+// days or traced back. Requests sending DNT: 1 or Sec-GPC: 1 are counted with no
+// identifier at all. Raw rows are deleted after VIEW_RETENTION_DAYS once
+// they have been rolled up.
+
+const (
+	defaultViewRetentionDays = 30
+	retentionInterval        = time.Hour
+	retentionBatchSize       = 10000
+
+	// Enquiry throttles only look back an hour, so addresses kept for them
+	// are cleared after a day
+	enquiryIPRetention = 24 * time.Hour
+)
+
+var (
+	trustedProxiesOnce sync.Once
+	trustedProxies     []*net.IPNet
+
+	saltMutex sync.Mutex
+	saltDay   string
+	saltValue []byte
+)
+
+// loadTrustedProxies parses TRUSTED_PROXIES, a comma-separated list of IPs
+// or CIDR ranges of reverse proxies allowed to set X-Forwarded-For
+func loadTrustedProxies() {
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			slog.Warn("Ignoring invalid TRUSTED_PROXIES entry", "entry", entry)
+			continue
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	trustedProxiesOnce.Do(loadTrustedProxies)
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// believed when the connection comes from a trusted proxy, and is read from
+// the right, skipping further trusted proxies, so clients can't spoof it by
+// sending their own header.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// anonymizeIP truncates an address to its /24 (IPv4) or /48 (IPv6) network
+func anonymizeIP(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// trackingOptOut reports whether the browser asked not to be tracked
+func trackingOptOut(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+// viewSalt returns the salt for the current UTC day, creating it on first
+// use. Salts live in the database so every instance hashes alike.
+func viewSalt(ctx context.Context) ([]byte, error) {
+	day := time.Now().UTC().Format("2006-01-02")
+
+	saltMutex.Lock()
+	defer saltMutex.Unlock()
+	if day == saltDay {
+		return saltValue, nil
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, "INSERT IGNORE INTO view_salts (day, salt) VALUES (?, ?)", day, salt); err != nil {
+		return nil, err
+	}
+	// Another instance may have created the day's salt first
+	if err := db.QueryRowContext(ctx, "SELECT salt FROM view_salts WHERE day = ?", day).Scan(&salt); err != nil {
+		return nil, err
+	}
+
+	saltDay, saltValue = day, salt
+	return salt, nil
+}
+
+// visitorHash identifies a visitor for the current day only
+func visitorHash(salt []byte, ip, userAgent string) string {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(ip + "|" + userAgent))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordView stores an anonymised view of a business or event. Failures are
+// logged and never fail the request.
+func recordView(r *http.Request, src viewSource, entityID int) {
+	ctx := r.Context()
+
+	userAgent := r.UserAgent()
+	bot := isBot(userAgent)
+
+	var prefix, hash interface{}
+	if !trackingOptOut(r) {
+		ip := clientIP(r)
+		salt, err := viewSalt(ctx)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error loading view salt", "error", err)
+		} else {
+			prefix = anonymizeIP(ip)
+			hash = visitorHash(salt, ip, userAgent)
+		}
+	}
+
+	_, err := db.ExecContext(ctx, "INSERT INTO "+src.Table+" ("+src.Column+", user_ip, visitor_hash, is_bot) VALUES (?, ?, ?, ?)",
+		entityID, prefix, hash, bot)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error recording view", "table", src.Table, "error", err)
+	}
+}
+
+// migrateViewPrivacy adds the anonymised columns and rewrites views stored
+// with full addresses and user agents
+func migrateViewPrivacy(ctx context.Context) error {
+	if err := addColumnIfMissing(ctx, "business_views", "visitor_hash", "CHAR(64) NULL"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(ctx, "business_views", "is_bot", "BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+		return err
+	}
+
+	// Legacy rows are hashed with a salt that is never stored
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	migrated := 0
+	for {
+		rows, err := db.QueryContext(ctx, "SELECT id, IFNULL(user_ip, ''), user_agent FROM business_views WHERE user_agent IS NOT NULL LIMIT 1000")
+		if err != nil {
+			return err
+		}
+		type legacyView struct {
+			id            int64
+			ip, userAgent string
+		}
+		var views []legacyView
+		for rows.Next() {
+			var v legacyView
+			if err := rows.Scan(&v.id, &v.ip, &v.userAgent); err != nil {
+				rows.Close()
+				return err
+			}
+			views = append(views, v)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(views) == 0 {
+			break
+		}
+
+		for _, v := range views {
+			// Old rows stored RemoteAddr, port included
+			ip := v.ip
+			if host, _, err := net.SplitHostPort(ip); err == nil {
+				ip = host
+			}
+			_, err := db.ExecContext(ctx, "UPDATE business_views SET user_ip = NULLIF(?, ''), visitor_hash = ?, is_bot = ?, user_agent = NULL WHERE id = ?",
+				anonymizeIP(ip), visitorHash(salt, ip, v.userAgent), isBot(v.userAgent), v.id)
+			if err != nil {
+				return err
+			}
+		}
+		migrated += len(views)
+	}
+	if migrated > 0 {
+		slog.Info("Anonymised stored business views", "count", migrated)
+	}
+	return nil
+}
+
+// viewRetention reads VIEW_RETENTION_DAYS
+func viewRetention() time.Duration {
+	days := defaultViewRetentionDays
+	if v := os.Getenv("VIEW_RETENTION_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			days = n
+		} else {
+			slog.Warn("Invalid VIEW_RETENTION_DAYS, using default", "value", v, "days", days)
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// startRetentionPurge periodically deletes personal data past its retention
+func startRetentionPurge(ctx context.Context) {
+	retention := viewRetention()
+	go func() {
+		ticker := time.NewTicker(retentionInterval)
+		defer ticker.Stop()
+		for {
+			if err := purgeExpiredViews(ctx, retention); err != nil {
+				slog.Error("Error purging views", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// purgeExpiredViews deletes raw views older than the retention period that
+// have already been rolled up, old view salts, enquiry client addresses and
+// old login history
+func purgeExpiredViews(ctx context.Context, retention time.Duration) error {
+	cutoff := time.Now().Add(-retention)
+	for _, src := range viewSources {
+		var watermark int64
+		if err := db.QueryRowContext(ctx, "SELECT value FROM analytics_state WHERE name = ?", src.Table).Scan(&watermark); err != nil {
+			return err
+		}
+
+		total := int64(0)
+		for {
+			result, err := db.ExecContext(ctx, "DELETE FROM "+src.Table+" WHERE viewed_at < ? AND id <= ? LIMIT ?", cutoff, watermark, retentionBatchSize)
+			if err != nil {
+				return err
+			}
+			n, _ := result.RowsAffected()
+			total += n
+			if n < retentionBatchSize {
+				break
+			}
+		}
+		if total > 0 {
+			slog.Info("Purged expired views", "count", total, "table", src.Table, "cutoff", cutoff.Format("2006-01-02"))
+		}
+	}
+
+	// Once a salt is gone its day's hashes can't be recomputed
+	today := time.Now().UTC().Format("2006-01-02")
+	if _, err := db.ExecContext(ctx, "DELETE FROM view_salts WHERE day < ?", today); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE enquiry_threads SET client_ip = NULL WHERE client_ip IS NOT NULL AND created_at < ?",
+		time.Now().Add(-enquiryIPRetention)); err != nil {
+		return err
+	}
+
+	_, err := db.ExecContext(ctx, "DELETE FROM login_attempts WHERE created_at < ?", time.Now().Add(-loginHistoryRetention))
+	return err
+}
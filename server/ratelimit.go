@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Abuse-prone routes are throttled with token buckets. Each rule refills
+// Burst tokens over Period and every request takes one; a request finding
+// the bucket empty gets 429 with Retry-After. Responses carry the
+// RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and RateLimit-Policy
+// headers either way.
+//
+// Buckets live in memory by default, which is per replica. With
+// RATE_LIMIT_STORE=mysql they are kept in the database so every replica
+// enforces the same limits. A rule can be changed with RATE_LIMIT_<NAME>,
+// e.g. RATE_LIMIT_LOGIN=20/1m, or turned off with "off", and what it counts
+// by with RATE_LIMIT_<NAME>_KEY: ip, user or api_key.
+
+// RateLimit allows Burst requests at once, refilled evenly over Period
+type RateLimit struct {
+	Burst  int
+	Period time.Duration
+}
+
+// RateLimitResult is the state of a bucket after a request
+type RateLimitResult struct {
+	Allowed   bool
+	Remaining int
+	// RetryAfter is how long until a token is available again
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// RateLimitStore keeps token buckets. Take must be atomic per key, across
+// every replica sharing the store.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// rate is the refill rate in tokens per second
+func (l RateLimit) rate() float64 {
+	return float64(l.Burst) / l.Period.Seconds()
+}
+
+// take refills a bucket last left with tokens at updated and takes a token
+// if there is one. It returns the result and the tokens left.
+func (l RateLimit) take(tokens float64, updated, now time.Time) (RateLimitResult, float64) {
+	if elapsed := now.Sub(updated).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(l.Burst), tokens+elapsed*l.rate())
+	}
+	var res RateLimitResult
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - tokens) / l.rate() * float64(time.Second))
+	}
+	res.Remaining = int(tokens)
+	res.Reset = time.Duration((float64(l.Burst) - tokens) / l.rate() * float64(time.Second))
+	return res, tokens
+}
+
+// MemoryRateLimitStore keeps buckets in the process
+type MemoryRateLimitStore struct {
+	mutex     sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time
+}
+
+// NewMemoryRateLimitStore creates an empty in-memory store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*memoryBucket)}
+}
+
+// Take takes a token from the bucket at key
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Buckets that have refilled completely are the same as no bucket
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, b := range s.buckets {
+			if now.After(b.full) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	res, tokens := limit.take(b.tokens, b.updated, now)
+	b.tokens, b.updated, b.full = tokens, now, now.Add(res.Reset)
+	return res, nil
+}
+
+// SQLRateLimitStore keeps buckets in the rate_limit_buckets table, locking
+// the row for the duration of each Take
+type SQLRateLimitStore struct {
+	DB *sql.DB
+}
+
+// Take takes a token from the bucket at key
+func (s *SQLRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (res RateLimitResult, err error) {
+	// The row is created full first, so the locking read below never has to
+	// lock a gap
+	if _, err = s.DB.ExecContext(ctx, "INSERT IGNORE INTO rate_limit_buckets (bucket_key, tokens, updated_at, full_at) VALUES (?, ?, ?, ?)",
+		key, limit.Burst, now, now); err != nil {
+		return res, err
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	var tokens float64
+	var updated time.Time
+	if err = tx.QueryRowContext(ctx, "SELECT tokens, updated_at FROM rate_limit_buckets WHERE bucket_key = ? FOR UPDATE", key).Scan(&tokens, &updated); err != nil {
+		return res, err
+	}
+	res, tokens = limit.take(tokens, updated, now)
+	if _, err = tx.ExecContext(ctx, "UPDATE rate_limit_buckets SET tokens = ?, updated_at = ?, full_at = ? WHERE bucket_key = ?",
+		tokens, now, now.Add(res.Reset), key); err != nil {
+		return res, err
+	}
+	return res, tx.Commit()
+}
+
+var rateLimitStore RateLimitStore = NewMemoryRateLimitStore()
+
+// initRateLimitStore picks the bucket store from RATE_LIMIT_STORE
+func initRateLimitStore(ctx context.Context) {
+	switch v := os.Getenv("RATE_LIMIT_STORE"); v {
+	case "", "memory":
+	case "mysql":
+		rateLimitStore = &SQLRateLimitStore{DB: db}
+		startRateLimitPurge(ctx)
+	default:
+		slog.Warn("Unknown RATE_LIMIT_STORE, keeping buckets in memory", "value", v)
+	}
+}
+
+// startRateLimitPurge deletes buckets that have refilled completely
+func startRateLimitPurge(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if _, err := db.ExecContext(ctx, "DELETE FROM rate_limit_buckets WHERE full_at < ?", time.Now()); err != nil {
+				slog.Error("Error purging rate limit buckets", "error", err)
+			}
+		}
+	}()
+}
+
+// rateLimitKey picks the bucket a request counts against
+type rateLimitKey func(r *http.Request) string
+
+// keyByIP counts requests per client address
+func keyByIP(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// keyByUser counts requests per signed-in user, and per address for anyone
+// else. The bearer token is checked, so the user can't be made up.
+func keyByUser(r *http.Request) string {
+	if claims, err := authenticateToken(r); err == nil {
+		return fmt.Sprintf("user:%.0f", claims["user_id"])
+	}
+	return keyByIP(r)
+}
+
+// keyByAPIKey counts requests per X-API-Key, and per user otherwise. Keys
+// are taken as presented, so it only suits routes where a gateway in front
+// has already checked them.
+func keyByAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return "key:" + hashToken(key)
+	}
+	return keyByUser(r)
+}
+
+var rateLimitKeys = map[string]rateLimitKey{
+	"ip":      keyByIP,
+	"user":    keyByUser,
+	"api_key": keyByAPIKey,
+}
+
+// rateLimitRule throttles one route
+type rateLimitRule struct {
+	name  string
+	key   rateLimitKey
+	limit RateLimit
+	off   bool
+}
+
+// newRateLimitRule creates a rule with the given defaults, which
+// RATE_LIMIT_<NAME> and RATE_LIMIT_<NAME>_KEY override
+func newRateLimitRule(name string, key rateLimitKey, burst int, period time.Duration) *rateLimitRule {
+	rule := &rateLimitRule{name: name, key: key, limit: RateLimit{Burst: burst, Period: period}}
+	env := "RATE_LIMIT_" + strings.ToUpper(name)
+	if v := os.Getenv(env + "_KEY"); v != "" {
+		if key, ok := rateLimitKeys[v]; ok {
+			rule.key = key
+		} else {
+			slog.Warn("Invalid "+env+"_KEY, using default", "value", v)
+		}
+	}
+	v := os.Getenv(env)
+	if v == "" {
+		return rule
+	}
+	if v == "off" {
+		rule.off = true
+		return rule
+	}
+	n, p, _ := strings.Cut(v, "/")
+	burst, err1 := strconv.Atoi(n)
+	period, err2 := time.ParseDuration(p)
+	if err1 != nil || err2 != nil || burst < 1 || period <= 0 {
+		slog.Warn("Invalid "+env+", using default", "value", v)
+		return rule
+	}
+	rule.limit = RateLimit{Burst: burst, Period: period}
+	return rule
+}
+
+var (
+	loginRateLimit    = newRateLimitRule("login", keyByIP, 10, time.Minute)
+	registerRateLimit = newRateLimitRule("register", keyByIP, 5, time.Hour)
+	bookingRateLimit  = newRateLimitRule("bookings", keyByIP, 20, time.Hour)
+	// Each request sends an email
+	magicLinkRateLimit = newRateLimitRule("magic_link", keyByIP, 5, 15*time.Minute)
+)
+
+// rateLimited wraps a handler with a rate limit rule. If the store fails the
+// request is let through rather than locking everyone out.
+func rateLimited(rule *rateLimitRule, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rule.off {
+			next(w, r)
+			return
+		}
+
+		res, err := rateLimitStore.Take(r.Context(), rule.name+":"+rule.key(r), rule.limit, time.Now())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error checking rate limit", "rule", rule.name, "error", err)
+			next(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(rule.limit.Burst))
+		h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+		h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.limit.Burst, ceilSeconds(rule.limit.Period)))
+		if !res.Allowed {
+			rateLimitedRequests.inc(rule.name)
+			h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(map[string]string{"error": "too many requests, try again later"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
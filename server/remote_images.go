@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	remoteFetchTimeout   = 15 * time.Second
+	remoteMaxRedirects   = 3
+	remoteMaxContentSize = maxUploadSize
+)
+
+var (
+	// Schemes accepted for image URLs, both hotlinked and mirrored
+	allowedImageURLSchemes = map[string]bool{"http": true, "https": true}
+
+	// Image formats accepted when mirroring, keyed by sniffed content type
+	remoteImageTypes = map[string]string{
+		"image/jpeg": ".jpg",
+		"image/png":  ".png",
+		"image/gif":  ".gif",
+		"image/webp": ".webp",
+	}
+
+	// Special-purpose ranges not covered by the netip.Addr helpers
+	blockedPrefixes = []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/8"),
+		netip.MustParsePrefix("100.64.0.0/10"),
+		netip.MustParsePrefix("192.0.0.0/24"),
+		netip.MustParsePrefix("192.0.2.0/24"),
+		netip.MustParsePrefix("198.18.0.0/15"),
+		netip.MustParsePrefix("198.51.100.0/24"),
+		netip.MustParsePrefix("203.0.113.0/24"),
+		netip.MustParsePrefix("240.0.0.0/4"),
+		netip.MustParsePrefix("64:ff9b::/96"),
+		netip.MustParsePrefix("64:ff9b:1::/48"),
+		netip.MustParsePrefix("2001:db8::/32"),
+		netip.MustParsePrefix("2002::/16"),
+	}
+
+	errRemoteURL         = errors.New("image URL is not allowed")
+	errRemoteAddress     = errors.New("image host resolves to a disallowed address")
+	errRemoteRedirects   = errors.New("too many redirects")
+	errRemoteStatus      = errors.New("remote server returned an error")
+	errRemoteTooLarge    = errors.New("remote image is too large")
+	errRemoteContentType = errors.New("remote file is not a supported image")
+)
+
+// remoteImageClient fetches remote images. Every connection it makes is
+// checked against the resolved IP address, so a hostname cannot be used to
+// reach loopback or private networks, including through redirects or DNS
+// rebinding between lookup and connect.
+var remoteImageClient = &http.Client{
+	Timeout: remoteFetchTimeout,
+	Transport: newTracingTransport(&http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: checkDialAddress,
+		}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}),
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) > remoteMaxRedirects {
+			return errRemoteRedirects
+		}
+		return validateImageURL(req.URL)
+	},
+}
+
+// remoteImage is an image downloaded by fetchRemoteImage
+type remoteImage struct {
+	Data        []byte
+	ContentType string
+	Filename    string
+}
+
+// parseImageURL parses rawURL and checks it with validateImageURL
+func parseImageURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return nil, errRemoteURL
+	}
+	if err := validateImageURL(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// validateImageURL accepts absolute URLs with an allowed scheme, a host and
+// no embedded credentials
+func validateImageURL(u *url.URL) error {
+	if !allowedImageURLSchemes[strings.ToLower(u.Scheme)] || u.Hostname() == "" || u.User != nil {
+		return errRemoteURL
+	}
+	return nil
+}
+
+// isPublicAddress reports whether ip is a globally routable unicast address
+func isPublicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDialAddress is a net.Dialer Control hook run after DNS resolution,
+// immediately before each connection is made
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	if network != "tcp4" && network != "tcp6" {
+		return errRemoteAddress
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errRemoteAddress
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !isPublicAddress(ip) {
+		return errRemoteAddress
+	}
+	return nil
+}
+
+// fetchRemoteImage downloads an image, enforcing the size cap and checking
+// the content by sniffing it rather than trusting the Content-Type header
+func fetchRemoteImage(ctx context.Context, u *url.URL) (*remoteImage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errRemoteURL
+	}
+	req.Header.Set("Accept", "image/*")
+	req.Header.Set("User-Agent", "business-directory-image-fetcher/1.0")
+
+	resp, err := remoteImageClient.Do(req)
+	if err != nil {
+		for _, known := range []error{errRemoteURL, errRemoteAddress, errRemoteRedirects} {
+			if errors.Is(err, known) {
+				return nil, known
+			}
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", errRemoteStatus, resp.Status)
+	}
+	if resp.ContentLength > remoteMaxContentSize {
+		return nil, errRemoteTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, remoteMaxContentSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > remoteMaxContentSize {
+		return nil, errRemoteTooLarge
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, ok := remoteImageTypes[contentType]
+	if !ok {
+		return nil, errRemoteContentType
+	}
+
+	// Name the file after the final URL, with an extension matching its content
+	name := strings.TrimSuffix(path.Base(resp.Request.URL.Path), path.Ext(resp.Request.URL.Path))
+	if name == "" || name == "." || name == "/" {
+		name = "remote"
+	}
+
+	return &remoteImage{
+		Data:        data,
+		ContentType: contentType,
+		Filename:    name + ext,
+	}, nil
+}
+
+// mirrorRemoteImage downloads an image and stores it like a regular upload
+func mirrorRemoteImage(ctx context.Context, u *url.URL, up imageUpload) (Image, error) {
+	remote, err := fetchRemoteImage(ctx, u)
+	if err != nil {
+		return Image{}, err
+	}
+	up.OriginalFilename = remote.Filename
+	up.ContentType = remote.ContentType
+	return storeImage(ctx, bytes.NewReader(remote.Data), up)
+}
@@ -0,0 +1,433 @@
+package server
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Requests are traced with OpenTelemetry: a server span per inbound request,
+// continuing any W3C traceparent the caller sent, with client spans for SQL
+// statements, outbound HTTP calls and mail. SQL spans hang off the request
+// span when the statement is run with the request's context.
+//
+// OTEL_TRACES_EXPORTER picks where spans go: "otlp" (configured through the
+// standard OTEL_EXPORTER_OTLP_* variables), "console" to print them to
+// stdout, "memory" to keep them for /traces on the admin listener, or "none".
+// It defaults to otlp when OTEL_EXPORTER_OTLP_ENDPOINT is set.
+
+var tracer = otel.Tracer("example.com/starterkit/server")
+
+// memoryExporter holds spans when OTEL_TRACES_EXPORTER=memory
+var memoryExporter *tracetest.InMemoryExporter
+
+// InitTracing installs the tracer provider and the W3C propagators
+func InitTracing() error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	name := os.Getenv("OTEL_TRACES_EXPORTER")
+	if name == "" {
+		name = "none"
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+			name = "otlp"
+		}
+	}
+
+	var processor sdktrace.SpanProcessor
+	switch name {
+	case "none":
+		return nil
+	case "otlp":
+		exporter, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			return err
+		}
+		processor = sdktrace.NewBatchSpanProcessor(exporter)
+	case "console", "stdout":
+		exporter, err := stdouttrace.New()
+		if err != nil {
+			return err
+		}
+		processor = sdktrace.NewSimpleSpanProcessor(exporter)
+	case "memory":
+		memoryExporter = tracetest.NewInMemoryExporter()
+		processor = sdktrace.NewSimpleSpanProcessor(memoryExporter)
+	default:
+		return fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", name)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName())))
+	if err != nil {
+		return err
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(res),
+	))
+	slog.Info("Tracing enabled", "exporter", name)
+	return nil
+}
+
+func serviceName() string {
+	if name := os.Getenv("OTEL_SERVICE_NAME"); name != "" {
+		return name
+	}
+	return "business-directory"
+}
+
+// traceRequests starts a server span for each request, named after the
+// route the mux matched once the request has been served
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.UserAgentOriginal(r.UserAgent()),
+			))
+		defer span.End()
+
+		if info := requestInfoFrom(ctx); info != nil {
+			info.TraceID = span.SpanContext().TraceID().String()
+		}
+
+		inner := r.WithContext(ctx)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, inner)
+		// Hand the matched route back to the outer middleware
+		r.Pattern = inner.Pattern
+
+		if r.Pattern != "" {
+			span.SetName(r.Method + " " + r.Pattern)
+			span.SetAttributes(semconv.HTTPRoute(r.Pattern))
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// tracingTransport records a client span for each outbound request and
+// propagates the trace to the remote service
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func newTracingTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return tracingTransport{base}
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The query string is left out, as it can carry user input such as
+	// addresses being geocoded
+	ctx, span := tracer.Start(req.Context(), req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLFull(req.URL.Scheme+"://"+req.URL.Host+req.URL.Path),
+			semconv.ServerAddress(req.URL.Hostname()),
+		))
+	defer span.End()
+
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
+
+var (
+	sqlStringLiteral = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.|"")*"`)
+	sqlNumberLiteral = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+)
+
+// sanitizeQuery replaces literals with placeholders and collapses whitespace,
+// so values written into a statement never reach the trace backend
+func sanitizeQuery(query string) string {
+	query = sqlStringLiteral.ReplaceAllString(query, "?")
+	query = sqlNumberLiteral.ReplaceAllString(query, "?")
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// recordQuery adds a span for a statement that has already run, started at
+// start. Statements outside a traced request start their own trace.
+func recordQuery(ctx context.Context, start time.Time, query string, result driver.Result, err error) {
+	query = sanitizeQuery(query)
+	operation, _, _ := strings.Cut(query, " ")
+	operation = strings.ToUpper(operation)
+
+	_, span := tracer.Start(ctx, operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			semconv.DBSystemNameMySQL,
+			semconv.DBOperationName(operation),
+			semconv.DBQueryText(query),
+		))
+	if result != nil {
+		if n, err := result.RowsAffected(); err == nil {
+			span.SetAttributes(attribute.Int64("db.response.rows_affected", n))
+		}
+	}
+	if err != nil && !errors.Is(err, driver.ErrSkip) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedConnector wraps a driver connector so every statement is traced
+type tracedConnector struct {
+	driver.Connector
+}
+
+func (c tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{conn}, nil
+}
+
+// tracedConn passes everything through to the driver's connection, tracing
+// statements run directly on it and giving each its own deadline. When the
+// driver asks for a prepared statement instead (driver.ErrSkip), the span is
+// left to tracedStmt.
+type tracedConn struct {
+	driver.Conn
+}
+
+func (c *tracedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmtCtx, cancel := statementContext(ctx)
+		stmt, err = pc.PrepareContext(stmtCtx, query)
+		err = statementError(stmtCtx, err)
+		cancel()
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tracedStmt{stmt, query}, nil
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bt, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return bt.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	stmtCtx, cancel := statementContext(ctx)
+	defer cancel()
+	result, err := execer.ExecContext(stmtCtx, query, args)
+	err = statementError(stmtCtx, err)
+	if err != driver.ErrSkip {
+		recordQuery(ctx, start, query, result, err)
+	}
+	return result, err
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	stmtCtx, cancel := statementContext(ctx)
+	rows, err := queryer.QueryContext(stmtCtx, query, args)
+	err = statementError(stmtCtx, err)
+	if err != driver.ErrSkip {
+		recordQuery(ctx, start, query, nil, err)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &timedRows{rows, stmtCtx, cancel}, nil
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *tracedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type tracedStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s *tracedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var result driver.Result
+	var err error
+	if se, ok := s.Stmt.(driver.StmtExecContext); ok {
+		stmtCtx, cancel := statementContext(ctx)
+		result, err = se.ExecContext(stmtCtx, args)
+		err = statementError(stmtCtx, err)
+		cancel()
+	} else {
+		result, err = s.Stmt.Exec(namedValues(args))
+	}
+	recordQuery(ctx, start, s.query, result, err)
+	return result, err
+}
+
+func (s *tracedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	if sq, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		stmtCtx, cancel := statementContext(ctx)
+		rows, err := sq.QueryContext(stmtCtx, args)
+		err = statementError(stmtCtx, err)
+		recordQuery(ctx, start, s.query, nil, err)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		return &timedRows{rows, stmtCtx, cancel}, nil
+	}
+	rows, err := s.Stmt.Query(namedValues(args))
+	recordQuery(ctx, start, s.query, nil, err)
+	return rows, err
+}
+
+func (s *tracedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+// tracesHandler lists or clears the spans kept by the memory exporter
+func tracesHandler(w http.ResponseWriter, r *http.Request) {
+	if memoryExporter == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "set OTEL_TRACES_EXPORTER=memory to keep traces"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		type spanJSON struct {
+			TraceID    string                 `json:"trace_id"`
+			SpanID     string                 `json:"span_id"`
+			ParentID   string                 `json:"parent_span_id,omitempty"`
+			Name       string                 `json:"name"`
+			Kind       string                 `json:"kind"`
+			Start      time.Time              `json:"start"`
+			DurationMS float64                `json:"duration_ms"`
+			Status     string                 `json:"status"`
+			Attributes map[string]interface{} `json:"attributes"`
+		}
+		spans := []spanJSON{}
+		for _, s := range memoryExporter.GetSpans() {
+			span := spanJSON{
+				TraceID:    s.SpanContext.TraceID().String(),
+				SpanID:     s.SpanContext.SpanID().String(),
+				Name:       s.Name,
+				Kind:       s.SpanKind.String(),
+				Start:      s.StartTime,
+				DurationMS: float64(s.EndTime.Sub(s.StartTime).Microseconds()) / 1000,
+				Status:     s.Status.Code.String(),
+				Attributes: make(map[string]interface{}, len(s.Attributes)),
+			}
+			if s.Parent.IsValid() {
+				span.ParentID = s.Parent.SpanID().String()
+			}
+			for _, kv := range s.Attributes {
+				span.Attributes[string(kv.Key)] = kv.Value.AsInterface()
+			}
+			spans = append(spans, span)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(spans)
+	case http.MethodDelete:
+		memoryExporter.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
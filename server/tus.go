@@ -0,0 +1,555 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads following the tus 1.0.0 protocol (https://tus.io) with the
+// creation, expiration and termination extensions. A client creates an upload
+// with POST, sends the bytes with one or more PATCH requests and can ask for
+// the current offset with HEAD after a dropped connection. Once every byte
+// has arrived the file goes through storeImage like a regular upload.
+
+const (
+	tusVersion        = "1.0.0"
+	tusExtensions     = "creation,expiration,termination"
+	tusMaxSize        = 200 << 20 // 200 MB
+	tusUploadLifetime = 24 * time.Hour
+	tusCleanupPeriod  = 15 * time.Minute
+	tusBasePath       = "/images/tus/"
+)
+
+var (
+	// Partial uploads are kept outside uploadDir so they aren't served
+	tusDir = "./uploads-partial"
+
+	// tusLocks serialises PATCH requests for the same upload
+	tusLocks   = make(map[string]*sync.Mutex)
+	tusLocksMu sync.Mutex
+)
+
+// tusUpload is a row of the tus_uploads table
+type tusUpload struct {
+	ID         string
+	UserID     int
+	EntityType string
+	EntityID   int
+	Caption    string
+	IsPrimary  bool
+	Filename   string
+	Length     int64
+	Offset     int64
+	ImageID    *int
+	ExpiresAt  time.Time
+}
+
+func (u *tusUpload) path() string {
+	return filepath.Join(tusDir, u.ID)
+}
+
+// tusCorsMiddleware answers tus discovery and CORS preflight requests and
+// exposes the tus response headers to browsers
+func tusCorsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, Upload-Expires, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size")
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "POST, HEAD, PATCH, DELETE, GET, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+			w.Header().Set("Tus-Version", tusVersion)
+			w.Header().Set("Tus-Extension", tusExtensions)
+			w.Header().Set("Tus-Max-Size", strconv.Itoa(tusMaxSize))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// tusHandler routes requests under /images/tus/
+func tusHandler(w http.ResponseWriter, r *http.Request) {
+	// GET is a convenience for clients to look up the resulting image and is
+	// not part of the protocol, so it doesn't require Tus-Resumable
+	if r.Method != http.MethodGet && r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, tusBasePath)
+	if id == "" {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		createTusUploadHandler(w, r)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid user ID"})
+		return
+	}
+
+	upload, err := getTusUpload(r.Context(), id, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Error fetching upload", "upload_id", id, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		headTusUploadHandler(w, upload)
+	case http.MethodPatch:
+		patchTusUploadHandler(w, r, upload)
+	case http.MethodDelete:
+		deleteTusUploadHandler(w, r, upload)
+	case http.MethodGet:
+		getTusUploadHandler(w, upload)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// createTusUploadHandler handles POST: it validates the target entity from
+// Upload-Metadata and reserves an empty upload
+func createTusUploadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := strconv.Atoi(r.Header.Get("X-User-ID"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid user ID"})
+		return
+	}
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Upload-Defer-Length is not supported"})
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "valid Upload-Length is required"})
+		return
+	}
+	if length > tusMaxSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(map[string]string{"error": "upload too large"})
+		return
+	}
+
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid Upload-Metadata"})
+		return
+	}
+
+	entityID, err := strconv.Atoi(meta["entity_id"])
+	if meta["entity_type"] == "" || err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "entity_type and entity_id metadata are required"})
+		return
+	}
+
+	// Verify the entity exists before accepting any bytes for it
+	if err := checkEntity(ctx, meta["entity_type"], entityID); err != nil {
+		writeEntityError(w, r, err)
+		return
+	}
+
+	upload := tusUpload{
+		ID:         newTusID(),
+		UserID:     userID,
+		EntityType: meta["entity_type"],
+		EntityID:   entityID,
+		Caption:    meta["caption"],
+		IsPrimary:  meta["is_primary"] == "true",
+		Filename:   filepath.Base(meta["filename"]),
+		Length:     length,
+		ExpiresAt:  time.Now().Add(tusUploadLifetime),
+	}
+
+	f, err := os.Create(upload.path())
+	if err != nil {
+		writeServerError(w, r, err, "Error creating upload file", "failed to create upload")
+		return
+	}
+	f.Close()
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO tus_uploads (id, user_id, entity_type, entity_id, caption, is_primary, filename, upload_length, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, upload.ID, upload.UserID, upload.EntityType, upload.EntityID, upload.Caption, upload.IsPrimary, upload.Filename, upload.Length, upload.ExpiresAt)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error creating upload record", "error", err)
+		os.Remove(upload.path())
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "failed to create upload"})
+		return
+	}
+
+	w.Header().Set("Location", tusBasePath+upload.ID)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// headTusUploadHandler reports how many bytes the server has received
+func headTusUploadHandler(w http.ResponseWriter, upload *tusUpload) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.ImageID == nil {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// patchTusUploadHandler appends a chunk at Upload-Offset. Whatever arrives
+// before the connection drops is kept and the offset persisted, so the client
+// can resume from there.
+func patchTusUploadHandler(w http.ResponseWriter, r *http.Request, upload *tusUpload) {
+	ctx := r.Context()
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	lock := tusLock(upload.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Re-read under the lock in case another PATCH just finished
+	id := upload.ID
+	upload, err = getTusUpload(ctx, id, upload.UserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Error fetching upload", "upload_id", id, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if upload.ImageID != nil || offset != upload.Offset {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	f, err := os.OpenFile(upload.path(), os.O_WRONLY, 0644)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error opening upload file", "upload_id", upload.ID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Drop anything past the last persisted offset, e.g. from a crash
+	// between writing the file and updating the database
+	if err = f.Truncate(upload.Offset); err == nil {
+		_, err = f.Seek(upload.Offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		slog.ErrorContext(r.Context(), "Error preparing upload file", "upload_id", upload.ID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	written, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Length-upload.Offset))
+	if err = f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	// The offset is saved even when the client has gone away mid-PATCH, as
+	// the bytes it sent are on disk and it resumes from here
+	newOffset := upload.Offset + written
+	expiresAt := time.Now().Add(tusUploadLifetime)
+	saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), queryTimeout)
+	_, err = db.ExecContext(saveCtx, "UPDATE tus_uploads SET upload_offset = ?, expires_at = ? WHERE id = ?", newOffset, expiresAt, upload.ID)
+	cancel()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error saving upload offset", "upload_id", upload.ID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	upload.Offset = newOffset
+	upload.ExpiresAt = expiresAt
+
+	if copyErr != nil {
+		// The client went away or the write failed; it resumes with HEAD
+		slog.InfoContext(r.Context(), "Upload interrupted", "upload_id", upload.ID, "offset", newOffset, "error", copyErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if upload.Offset == upload.Length {
+		if err := finishTusUpload(ctx, upload); err != nil {
+			switch {
+			case errors.Is(err, errUnknownEntityType), errors.Is(err, errEntityNotFound), errors.Is(err, errTusNotImage):
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			default:
+				writeStoreImageError(w, r, err)
+			}
+			return
+		}
+		w.Header().Set("Location", tusBasePath+upload.ID)
+	} else {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteTusUploadHandler terminates an upload and discards its data
+func deleteTusUploadHandler(w http.ResponseWriter, r *http.Request, upload *tusUpload) {
+	lock := tusLock(upload.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if _, err := db.ExecContext(r.Context(), "DELETE FROM tus_uploads WHERE id = ?", upload.ID); err != nil {
+		slog.ErrorContext(r.Context(), "Error deleting upload", "upload_id", upload.ID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	removeImageFiles([]string{upload.path()})
+	releaseTusLock(upload.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getTusUploadHandler returns the upload progress and, once finished, the
+// created image
+func getTusUploadHandler(w http.ResponseWriter, upload *tusUpload) {
+	resp := map[string]interface{}{
+		"id":            upload.ID,
+		"upload_offset": upload.Offset,
+		"upload_length": upload.Length,
+		"completed":     upload.ImageID != nil,
+	}
+	if upload.ImageID != nil {
+		resp["image_id"] = *upload.ImageID
+	} else {
+		resp["expires_at"] = upload.ExpiresAt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+var errTusNotImage = errors.New("uploaded file is not an image")
+
+// finishTusUpload turns a completed upload into an image record
+func finishTusUpload(ctx context.Context, upload *tusUpload) error {
+	// The entity may have been deleted while the upload was in progress
+	if err := checkEntity(ctx, upload.EntityType, upload.EntityID); err != nil {
+		return err
+	}
+
+	f, err := os.Open(upload.path())
+	if err != nil {
+		return fmt.Errorf("%w: %v", errImageFile, err)
+	}
+	defer f.Close()
+
+	// Validate file type from the content rather than client metadata
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	contentType := http.DetectContentType(head[:n])
+	if !strings.HasPrefix(contentType, "image/") {
+		return errTusNotImage
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("%w: %v", errImageFile, err)
+	}
+
+	uploadedBy := upload.UserID
+	image, err := storeImage(ctx, f, imageUpload{
+		EntityType:       upload.EntityType,
+		EntityID:         upload.EntityID,
+		Caption:          upload.Caption,
+		IsPrimary:        upload.IsPrimary,
+		UploadedBy:       &uploadedBy,
+		OriginalFilename: upload.Filename,
+		ContentType:      contentType,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE tus_uploads SET image_id = ? WHERE id = ?", image.ID, upload.ID)
+	if err != nil {
+		slog.Error("Error marking upload complete", "upload_id", upload.ID, "error", err)
+	}
+	upload.ImageID = &image.ID
+
+	f.Close()
+	removeImageFiles([]string{upload.path()})
+
+	logEvent("image_uploaded", fmt.Sprintf("Resumable upload %s stored as image %d", upload.ID, image.ID), image)
+	return nil
+}
+
+// getTusUpload loads an upload owned by userID
+func getTusUpload(ctx context.Context, id string, userID int) (*tusUpload, error) {
+	var u tusUpload
+	var caption, filename sql.NullString
+	var imageID sql.NullInt64
+	err := db.QueryRowContext(ctx, `
+		SELECT id, user_id, entity_type, entity_id, caption, is_primary, filename, upload_length, upload_offset, image_id, expires_at
+		FROM tus_uploads
+		WHERE id = ? AND user_id = ?
+	`, id, userID).Scan(&u.ID, &u.UserID, &u.EntityType, &u.EntityID, &caption, &u.IsPrimary, &filename, &u.Length, &u.Offset, &imageID, &u.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	u.Caption = caption.String
+	u.Filename = filename.String
+	if imageID.Valid {
+		iid := int(imageID.Int64)
+		u.ImageID = &iid
+	}
+	return &u, nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs
+// of a key and an optional base64 encoded value
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return meta, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		switch len(parts) {
+		case 1:
+			meta[parts[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			meta[parts[0]] = string(value)
+		default:
+			return nil, fmt.Errorf("malformed metadata pair %q", pair)
+		}
+	}
+	return meta, nil
+}
+
+// newTusID generates a random upload ID
+func newTusID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func tusLock(id string) *sync.Mutex {
+	tusLocksMu.Lock()
+	defer tusLocksMu.Unlock()
+	lock, ok := tusLocks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		tusLocks[id] = lock
+	}
+	return lock
+}
+
+func releaseTusLock(id string) {
+	tusLocksMu.Lock()
+	delete(tusLocks, id)
+	tusLocksMu.Unlock()
+}
+
+// startTusCleanup periodically removes expired unfinished uploads and the
+// records of finished ones
+func startTusCleanup(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(tusCleanupPeriod)
+		defer ticker.Stop()
+		for {
+			expireTusUploads(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func expireTusUploads(ctx context.Context) {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM tus_uploads WHERE expires_at < NOW()")
+	if err != nil {
+		slog.Error("Error querying expired uploads", "error", err)
+		return
+	}
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		lock := tusLock(id)
+		lock.Lock()
+		_, err := db.ExecContext(ctx, "DELETE FROM tus_uploads WHERE id = ? AND expires_at < NOW()", id)
+		if err != nil {
+			slog.Error("Error expiring upload", "upload_id", id, "error", err)
+		} else {
+			removeImageFiles([]string{filepath.Join(tusDir, id)})
+		}
+		lock.Unlock()
+		releaseTusLock(id)
+	}
+
+	if len(ids) > 0 {
+		slog.Info("Expired resumable uploads", "count", len(ids))
+	}
+}
@@ -0,0 +1,734 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Two-factor authentication uses time-based one-time passwords (RFC 6238:
+// HMAC-SHA1, 30 second steps, 6 digits) from an authenticator app, with
+// single-use recovery codes as a fallback. Each code is accepted once, and
+// one step either side of the current one to allow for clock drift.
+//
+// When a user with 2FA enabled logs in, the password step returns a
+// short-lived challenge token instead of a session; the session is issued by
+// /login/2fa once a code has been checked. TWO_FACTOR_POLICY=owners (or
+// "all") makes 2FA mandatory: an owner without it gets a challenge that only
+// allows enrolling through /2fa/setup and /2fa/enable, which then completes
+// the login.
+
+const (
+	totpIssuer           = "Business Directory"
+	totpPeriod           = 30
+	totpDigits           = 6
+	totpSkew             = 1
+	recoveryCodeCount    = 10
+	loginChallengeTTL    = 5 * time.Minute
+	maxChallengeAttempts = 5
+	challengeVerify      = "verify"
+	challengeEnroll      = "enroll"
+)
+
+var (
+	errInvalidChallenge = errString("invalid or expired login challenge, log in again")
+	errNotSignedIn      = errString("unauthorized")
+)
+
+// loginChallenge is a login waiting for its second factor
+type loginChallenge struct {
+	TokenHash string
+	UserID    int
+	Purpose   string
+}
+
+// migrateTwoFactor adds the TOTP secret to users
+func migrateTwoFactor(ctx context.Context) error {
+	columns := []struct{ name, definition string }{
+		{"totp_secret", "VARCHAR(64) NULL"},
+		{"totp_enabled", "BOOLEAN NOT NULL DEFAULT FALSE"},
+		{"totp_last_step", "BIGINT NULL"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfMissing(ctx, "users", c.name, c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// twoFactorRequired reports whether TWO_FACTOR_POLICY makes users of this
+// type enrol
+func twoFactorRequired(userType string) bool {
+	switch os.Getenv("TWO_FACTOR_POLICY") {
+	case "all":
+		return true
+	case "owners":
+		return userType == "business_owner" || userType == "event_owner"
+	}
+	return false
+}
+
+// newTOTPSecret generates a 160-bit secret, base32 encoded as authenticator
+// apps expect
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b), nil
+}
+
+// totpCode computes the code for a time step
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// matchTOTP returns the time step a code is valid for
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth URI an authenticator app enrols from
+func totpURI(secret, email string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", strconv.Itoa(totpDigits))
+	v.Set("period", strconv.Itoa(totpPeriod))
+	// Some authenticator apps show a + in the issuer literally
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + strings.ReplaceAll(v.Encode(), "+", "%20")
+}
+
+// useTOTP checks a code against the user's secret, enabled or still being
+// set up, and records its step so the same code can't be used twice
+func useTOTP(ctx context.Context, userID int, code string) (bool, error) {
+	var secret sql.NullString
+	if err := db.QueryRowContext(ctx, "SELECT totp_secret FROM users WHERE id = ?", userID).Scan(&secret); err != nil {
+		return false, err
+	}
+	if !secret.Valid {
+		return false, nil
+	}
+	step, ok := matchTOTP(secret.String, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return false, nil
+	}
+	result, err := db.ExecContext(ctx, "UPDATE users SET totp_last_step = ? WHERE id = ? AND (totp_last_step IS NULL OR totp_last_step < ?)",
+		step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the new
+// ones, which are only ever shown this once
+func newRecoveryCodes(ctx context.Context, userID int) ([]string, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO user_recovery_codes (user_id, code_hash) VALUES (?, ?)",
+			userID, hashToken(normalizeRecoveryCode(code))); err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// useRecoveryCode spends one of the user's recovery codes
+func useRecoveryCode(ctx context.Context, userID int, code string) (bool, error) {
+	result, err := db.ExecContext(ctx, "UPDATE user_recovery_codes SET used_at = NOW() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// checkSecondFactor accepts either a current code or an unused recovery code
+func checkSecondFactor(ctx context.Context, userID int, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return useRecoveryCode(ctx, userID, recoveryCode)
+	}
+	if code == "" {
+		return false, nil
+	}
+	return useTOTP(ctx, userID, code)
+}
+
+func remainingRecoveryCodes(ctx context.Context, userID int) (int, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM user_recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&n)
+	return n, err
+}
+
+// newLoginChallenge starts the second step of a login
+func newLoginChallenge(ctx context.Context, userID int, purpose string) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM login_challenges WHERE expires_at < NOW()"); err != nil {
+		return "", err
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO login_challenges (token_hash, user_id, purpose, expires_at) VALUES (?, ?, ?, ?)",
+		hashToken(token), userID, purpose, time.Now().Add(loginChallengeTTL))
+	return token, err
+}
+
+// loadLoginChallenge finds a live challenge for the purpose
+func loadLoginChallenge(ctx context.Context, token, purpose string) (*loginChallenge, error) {
+	if token == "" {
+		return nil, errInvalidChallenge
+	}
+	c := &loginChallenge{TokenHash: hashToken(token), Purpose: purpose}
+	err := db.QueryRowContext(ctx, "SELECT user_id FROM login_challenges WHERE token_hash = ? AND purpose = ? AND expires_at > NOW() AND attempts < ?",
+		c.TokenHash, purpose, maxChallengeAttempts).Scan(&c.UserID)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadUser fetches the public fields of a user
+func loadUser(ctx context.Context, userID int) (User, error) {
+	var user User
+	err := db.QueryRowContext(ctx, "SELECT id, name, email, type, created_at FROM users WHERE id = ?", userID).
+		Scan(&user.ID, &user.Name, &user.Email, &user.Type, &user.CreatedAt)
+	return user, err
+}
+
+// writeLoginChallenge answers the password step of a login that needs a
+// second factor, or enrolment in one
+func writeLoginChallenge(w http.ResponseWriter, r *http.Request, user User, enrolled bool) {
+	purpose := challengeVerify
+	if !enrolled {
+		purpose = challengeEnroll
+	}
+	token, err := newLoginChallenge(r.Context(), user.ID, purpose)
+	if err != nil {
+		writeServerError(w, r, err, "Error creating login challenge", "internal server error")
+		return
+	}
+
+	resp := map[string]interface{}{
+		"challenge_token": token,
+		"expires_in":      int(loginChallengeTTL.Seconds()),
+	}
+	if enrolled {
+		resp["two_factor_required"] = true
+	} else {
+		resp["two_factor_setup_required"] = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// completeFirstFactor finishes a login whose first step has been checked,
+// asking for the second factor when the account has or needs one
+func completeFirstFactor(w http.ResponseWriter, r *http.Request, user User) {
+	var totpEnabled bool
+	if err := db.QueryRowContext(r.Context(), "SELECT totp_enabled FROM users WHERE id = ?", user.ID).Scan(&totpEnabled); err != nil {
+		writeServerError(w, r, err, "Error fetching two-factor status", "internal server error")
+		return
+	}
+	if totpEnabled || twoFactorRequired(user.Type) {
+		writeLoginChallenge(w, r, user, totpEnabled)
+		return
+	}
+	completeLogin(w, r, user, nil)
+}
+
+// completeLogin records a successful login and issues the session
+func completeLogin(w http.ResponseWriter, r *http.Request, user User, extra map[string]interface{}) {
+	ctx := r.Context()
+
+	if err := recordLoginSuccess(ctx, r, user); err != nil {
+		slog.ErrorContext(ctx, "Error recording login", "error", err)
+	}
+
+	// Generate JWT token and store in database
+	token, err := generateToken(ctx, user)
+	if err != nil {
+		writeServerError(w, r, err, "Error generating token", "failed to generate token")
+		return
+	}
+
+	// Don't send password in response
+	user.Password = ""
+
+	resp := map[string]interface{}{
+		"user":  user,
+		"token": token,
+	}
+	for k, v := range extra {
+		resp[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Complete a login with a TOTP code or a recovery code
+func verifyLoginChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+		return
+	}
+	if req.Code == "" && req.RecoveryCode == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "code or recovery_code is required"})
+		return
+	}
+
+	challenge, err := loadLoginChallenge(ctx, req.ChallengeToken, challengeVerify)
+	if err != nil {
+		writeTwoFactorError(w, r, err)
+		return
+	}
+	user, err := loadUser(ctx, challenge.UserID)
+	if err != nil {
+		writeServerError(w, r, err, "Error fetching user", "internal server error")
+		return
+	}
+
+	// The account may have been locked since the password step
+	wait, locked, err := accountLoginWait(ctx, user.ID)
+	if err != nil {
+		writeServerError(w, r, err, "Error checking account lock", "internal server error")
+		return
+	}
+	if locked {
+		loginFailures.inc("locked")
+		writeLoginWait(w, wait, http.StatusLocked, "account temporarily locked after too many failed logins, check your email to unlock it")
+		return
+	}
+
+	ok, err := checkSecondFactor(ctx, user.ID, req.Code, req.RecoveryCode)
+	if err != nil {
+		writeServerError(w, r, err, "Error checking second factor", "internal server error")
+		return
+	}
+	if !ok {
+		loginFailures.inc("bad_second_factor")
+		if _, err := db.ExecContext(ctx, "UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = ?", challenge.TokenHash); err != nil {
+			slog.ErrorContext(ctx, "Error counting challenge attempt", "error", err)
+		}
+		if err := recordLoginFailure(ctx, r, user, "bad_second_factor"); err != nil {
+			slog.ErrorContext(ctx, "Error recording login failure", "error", err)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid code"})
+		return
+	}
+
+	if _, err := db.ExecContext(ctx, "DELETE FROM login_challenges WHERE token_hash = ?", challenge.TokenHash); err != nil {
+		writeServerError(w, r, err, "Error deleting login challenge", "internal server error")
+		return
+	}
+
+	var extra map[string]interface{}
+	if req.RecoveryCode != "" {
+		remaining, err := remainingRecoveryCodes(ctx, user.ID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error counting recovery codes", "error", err)
+		}
+		extra = map[string]interface{}{"recovery_codes_remaining": remaining}
+	}
+	completeLogin(w, r, user, extra)
+}
+
+// twoFactorUser identifies who is enrolling: a signed-in user, or one part
+// way through a login that requires enrolment. challenge is nil for a
+// signed-in user.
+func twoFactorUser(r *http.Request, challengeToken string) (User, *loginChallenge, error) {
+	ctx := r.Context()
+
+	if claims, err := authenticateToken(r); err == nil {
+		userID := int(claims["user_id"].(float64))
+		setRequestUser(r, strconv.Itoa(userID))
+		user, err := loadUser(ctx, userID)
+		return user, nil, err
+	}
+	if challengeToken == "" {
+		return User{}, nil, errNotSignedIn
+	}
+	challenge, err := loadLoginChallenge(ctx, challengeToken, challengeEnroll)
+	if err != nil {
+		return User{}, nil, err
+	}
+	setRequestUser(r, strconv.Itoa(challenge.UserID))
+	user, err := loadUser(ctx, challenge.UserID)
+	return user, challenge, err
+}
+
+// writeTwoFactorError writes the response for errors from the 2FA helpers
+func writeTwoFactorError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case errNotSignedIn, errInvalidChallenge:
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+	default:
+		writeServerError(w, r, err, "Error handling two-factor authentication", "internal server error")
+	}
+}
+
+// Get the current user's 2FA status
+func getTwoFactorStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var enabled bool
+	if err := db.QueryRowContext(r.Context(), "SELECT totp_enabled FROM users WHERE id = ?", userID).Scan(&enabled); err != nil {
+		writeServerError(w, r, err, "Error fetching two-factor status", "internal server error")
+		return
+	}
+	remaining, err := remainingRecoveryCodes(r.Context(), userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error counting recovery codes", "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":                  enabled,
+		"required":                 twoFactorRequired(r.Header.Get("X-User-Type")),
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// Start enrolling in 2FA. Returns the secret as text, as an otpauth URI and
+// as a QR code of that URI; the secret takes effect once /2fa/enable has
+// confirmed a code from it.
+func setupTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ChallengeToken string `json:"challenge_token"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid request"})
+			return
+		}
+	}
+
+	user, _, err := twoFactorUser(r, req.ChallengeToken)
+	if err != nil {
+		writeTwoFactorError(w, r, err)
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		writeServerError(w, r, err, "Error generating TOTP secret", "internal server error")
+		return
+	}
+	result, err := db.ExecContext(ctx, "UPDATE users SET totp_secret = ?, totp_last_step = NULL WHERE id = ? AND NOT totp_enabled", secret, user.ID)
+	if err != nil {
+		writeServerError(w, r, err, "Error saving TOTP secret", "internal server error")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	uri := totpURI(secret, user.Email)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		writeServerError(w, r, err, "Error generating QR code", "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": uri,
+		"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// Finish enrolling with a code from the new secret. Returns the recovery
+// codes, and a session when enrolment was part of a login.
+func enableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "code is required"})
+		return
+	}
+
+	user, challenge, err := twoFactorUser(r, req.ChallengeToken)
+	if err != nil {
+		writeTwoFactorError(w, r, err)
+		return
+	}
+
+	var enabled bool
+	if err := db.QueryRowContext(ctx, "SELECT totp_enabled FROM users WHERE id = ?", user.ID).Scan(&enabled); err != nil {
+		writeServerError(w, r, err, "Error fetching two-factor status", "internal server error")
+		return
+	}
+	if enabled {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	ok, err := useTOTP(ctx, user.ID, req.Code)
+	if err != nil {
+		writeServerError(w, r, err, "Error checking TOTP code", "internal server error")
+		return
+	}
+	if !ok {
+		if challenge != nil {
+			if _, err := db.ExecContext(ctx, "UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = ?", challenge.TokenHash); err != nil {
+				slog.ErrorContext(ctx, "Error counting challenge attempt", "error", err)
+			}
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid code, check the authenticator app's clock and try again"})
+		return
+	}
+
+	codes, err := newRecoveryCodes(ctx, user.ID)
+	if err != nil {
+		writeServerError(w, r, err, "Error creating recovery codes", "internal server error")
+		return
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE users SET totp_enabled = TRUE WHERE id = ?", user.ID); err != nil {
+		writeServerError(w, r, err, "Error enabling two-factor authentication", "internal server error")
+		return
+	}
+	slog.InfoContext(ctx, "Two-factor authentication enabled")
+
+	if challenge == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+		return
+	}
+
+	if _, err := db.ExecContext(ctx, "DELETE FROM login_challenges WHERE token_hash = ?", challenge.TokenHash); err != nil {
+		writeServerError(w, r, err, "Error deleting login challenge", "internal server error")
+		return
+	}
+	completeLogin(w, r, user, map[string]interface{}{"recovery_codes": codes})
+}
+
+// Turn 2FA off, confirmed with the password and a code
+func disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "password and code are required"})
+		return
+	}
+
+	if twoFactorRequired(r.Header.Get("X-User-Type")) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "two-factor authentication is required for your account"})
+		return
+	}
+
+	var hash string
+	var enabled bool
+	if err := db.QueryRowContext(ctx, "SELECT password, totp_enabled FROM users WHERE id = ?", userID).Scan(&hash, &enabled); err != nil {
+		writeServerError(w, r, err, "Error fetching user", "internal server error")
+		return
+	}
+	if !enabled {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "two-factor authentication is not enabled"})
+		return
+	}
+	if !checkPasswordHash(req.Password, hash) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid password"})
+		return
+	}
+	ok, err := checkSecondFactor(ctx, userID, req.Code, req.RecoveryCode)
+	if err != nil {
+		writeServerError(w, r, err, "Error checking second factor", "internal server error")
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid code"})
+		return
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = NULL WHERE id = ?", userID); err != nil {
+		writeServerError(w, r, err, "Error disabling two-factor authentication", "internal server error")
+		return
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM user_recovery_codes WHERE user_id = ?", userID); err != nil {
+		writeServerError(w, r, err, "Error deleting recovery codes", "internal server error")
+		return
+	}
+	slog.InfoContext(ctx, "Two-factor authentication disabled")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "two-factor authentication disabled"})
+}
+
+// Replace the recovery codes, confirmed with a current code
+func regenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _ := strconv.Atoi(r.Header.Get("X-User-ID"))
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "code is required"})
+		return
+	}
+
+	var enabled bool
+	if err := db.QueryRowContext(ctx, "SELECT totp_enabled FROM users WHERE id = ?", userID).Scan(&enabled); err != nil {
+		writeServerError(w, r, err, "Error fetching two-factor status", "internal server error")
+		return
+	}
+	if !enabled {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "two-factor authentication is not enabled"})
+		return
+	}
+	ok, err := useTOTP(ctx, userID, req.Code)
+	if err != nil {
+		writeServerError(w, r, err, "Error checking TOTP code", "internal server error")
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid code"})
+		return
+	}
+
+	codes, err := newRecoveryCodes(ctx, userID)
+	if err != nil {
+		writeServerError(w, r, err, "Error creating recovery codes", "internal server error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
@@ -0,0 +1,393 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// The relying party side of WebAuthn, enough for passkeys: "none"
+// attestation, and ES256, RS256 and EdDSA credential keys. Options and
+// responses use the JSON form browsers produce with
+// PublicKeyCredential.parseCreationOptionsFromJSON and toJSON(), with binary
+// fields as unpadded base64url.
+//
+// The relying party ID defaults to the host of PUBLIC_URL and the accepted
+// origins to PUBLIC_URL itself; WEBAUTHN_RP_ID and WEBAUTHN_ORIGINS (comma
+// separated) override them when the site is served from elsewhere.
+
+const (
+	webauthnTimeout  = 5 * time.Minute
+	webauthnRPName   = "Business Directory"
+	ceremonyRegister = "register"
+	ceremonyLogin    = "login"
+
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagBackupState  = 0x10
+	flagAttestedData = 0x40
+)
+
+var errInvalidCeremony = errString("passkey request expired or was already used, try again")
+
+// b64url is binary data sent as unpadded base64url
+type b64url []byte
+
+func (b b64url) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *b64url) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+type credentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         b64url   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// creationOptions are the options for navigator.credentials.create
+type creationOptions struct {
+	Challenge b64url `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          b64url `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey        string `json:"residentKey"`
+		RequireResidentKey bool   `json:"requireResidentKey"`
+		UserVerification   string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// requestOptions are the options for navigator.credentials.get
+type requestOptions struct {
+	Challenge        b64url                 `json:"challenge"`
+	Timeout          int                    `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// publicKeyCredential is the authenticator's answer to either ceremony
+type publicKeyCredential struct {
+	ID       string `json:"id"`
+	RawID    b64url `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON b64url `json:"clientDataJSON"`
+		// Registration
+		AttestationObject b64url   `json:"attestationObject,omitempty"`
+		Transports        []string `json:"transports,omitempty"`
+		// Authentication
+		AuthenticatorData b64url `json:"authenticatorData,omitempty"`
+		Signature         b64url `json:"signature,omitempty"`
+		UserHandle        b64url `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type attestationObject struct {
+	Fmt      string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+// authenticatorData is the parsed authData of either ceremony
+type authenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// webauthnRPID is the domain passkeys are scoped to
+func webauthnRPID() string {
+	if id := os.Getenv("WEBAUTHN_RP_ID"); id != "" {
+		return id
+	}
+	if u, err := url.Parse(publicURL("")); err == nil {
+		return u.Hostname()
+	}
+	return "localhost"
+}
+
+// webauthnOrigin reports whether a ceremony ran on one of the site's pages
+func webauthnOrigin(origin string) bool {
+	origins := os.Getenv("WEBAUTHN_ORIGINS")
+	if origins == "" {
+		origins = publicURL("")
+	}
+	for _, o := range strings.Split(origins, ",") {
+		if strings.TrimRight(strings.TrimSpace(o), "/") == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// newCeremony stores a fresh challenge. userID is 0 for a login, where the
+// user is only known from the credential.
+func newCeremony(ctx context.Context, purpose string, userID int) (b64url, error) {
+	challenge := make(b64url, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM webauthn_challenges WHERE expires_at < NOW()"); err != nil {
+		return nil, err
+	}
+	_, err := db.ExecContext(ctx, "INSERT INTO webauthn_challenges (challenge_hash, purpose, user_id, expires_at) VALUES (?, ?, NULLIF(?, 0), ?)",
+		hashToken(base64.RawURLEncoding.EncodeToString(challenge)), purpose, userID, time.Now().Add(webauthnTimeout))
+	return challenge, err
+}
+
+// useCeremony checks the client data of a response and uses up the
+// challenge it answers. It returns the user the ceremony was started for, or
+// 0 for a login.
+func useCeremony(ctx context.Context, purpose string, raw []byte) (int, error) {
+	var cd collectedClientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return 0, errString("invalid client data")
+	}
+	wantType := "webauthn.get"
+	if purpose == ceremonyRegister {
+		wantType = "webauthn.create"
+	}
+	if cd.Type != wantType {
+		return 0, errString("client data is for the wrong ceremony")
+	}
+	if !webauthnOrigin(cd.Origin) || cd.CrossOrigin {
+		return 0, errString("passkey was used on another site")
+	}
+
+	challengeHash := hashToken(strings.TrimRight(cd.Challenge, "="))
+	var userID sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT user_id FROM webauthn_challenges WHERE challenge_hash = ? AND purpose = ? AND expires_at > NOW()",
+		challengeHash, purpose).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidCeremony
+	}
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.ExecContext(ctx, "DELETE FROM webauthn_challenges WHERE challenge_hash = ?", challengeHash)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, errInvalidCeremony
+	}
+	return int(userID.Int64), nil
+}
+
+// parseAuthenticatorData splits authData and checks it is for this site
+// with the user present
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errString("authenticator data is too short")
+	}
+	ad := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(webauthnRPID()))
+	if !bytes.Equal(ad.RPIDHash, rpIDHash[:]) {
+		return nil, errString("passkey is for another site")
+	}
+	if ad.Flags&flagUserPresent == 0 {
+		return nil, errString("user presence was not confirmed")
+	}
+
+	if ad.Flags&flagAttestedData != 0 {
+		rest := data[37:]
+		if len(rest) < 18 {
+			return nil, errString("attested credential data is too short")
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n == 0 || n > 1023 || len(rest) < n {
+			return nil, errString("invalid credential ID")
+		}
+		ad.CredentialID, rest = rest[:n], rest[n:]
+
+		// The key is followed by extensions, if any
+		var key cbor.RawMessage
+		if _, err := cbor.UnmarshalFirst(rest, &key); err != nil {
+			return nil, errString("invalid credential public key")
+		}
+		ad.PublicKey = key
+	}
+	return ad, nil
+}
+
+// coseKey is a credential public key in COSE_Key form
+type coseKey struct {
+	Kty int    `cbor:"1,keyasint"`
+	Alg int    `cbor:"3,keyasint"`
+	Crv int    `cbor:"-1,keyasint,omitempty"`
+	X   []byte `cbor:"-2,keyasint,omitempty"`
+	Y   []byte `cbor:"-3,keyasint,omitempty"`
+}
+
+// rsaCOSEKey reuses the labels -1 and -2 for the modulus and exponent
+type rsaCOSEKey struct {
+	N []byte `cbor:"-1,keyasint"`
+	E []byte `cbor:"-2,keyasint"`
+}
+
+// parseCOSEKey decodes a stored credential key
+func parseCOSEKey(raw []byte) (int, crypto.PublicKey, error) {
+	var k struct {
+		Kty int `cbor:"1,keyasint"`
+		Alg int `cbor:"3,keyasint"`
+	}
+	if err := cbor.Unmarshal(raw, &k); err != nil {
+		return 0, nil, err
+	}
+
+	switch {
+	case k.Kty == 2 && k.Alg == coseAlgES256:
+		var ec coseKey
+		if err := cbor.Unmarshal(raw, &ec); err != nil {
+			return 0, nil, err
+		}
+		if ec.Crv != 1 || len(ec.X) != 32 || len(ec.Y) != 32 {
+			return 0, nil, fmt.Errorf("ES256 key is not on P-256")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(ec.X), Y: new(big.Int).SetBytes(ec.Y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return 0, nil, fmt.Errorf("ES256 key is not on P-256")
+		}
+		return k.Alg, pub, nil
+	case k.Kty == 3 && k.Alg == coseAlgRS256:
+		var rk rsaCOSEKey
+		if err := cbor.Unmarshal(raw, &rk); err != nil {
+			return 0, nil, err
+		}
+		e := new(big.Int).SetBytes(rk.E)
+		if len(rk.N) < 256 || !e.IsInt64() || e.Int64() < 3 {
+			return 0, nil, fmt.Errorf("RS256 key is too weak")
+		}
+		return k.Alg, &rsa.PublicKey{N: new(big.Int).SetBytes(rk.N), E: int(e.Int64())}, nil
+	case k.Kty == 1 && k.Alg == coseAlgEdDSA:
+		var okp coseKey
+		if err := cbor.Unmarshal(raw, &okp); err != nil {
+			return 0, nil, err
+		}
+		if okp.Crv != 6 || len(okp.X) != ed25519.PublicKeySize {
+			return 0, nil, fmt.Errorf("EdDSA key is not Ed25519")
+		}
+		return k.Alg, ed25519.PublicKey(okp.X), nil
+	}
+	return 0, nil, fmt.Errorf("unsupported key type %d with algorithm %d", k.Kty, k.Alg)
+}
+
+// verifyAssertion checks an authentication signature, which covers the
+// authenticator data and the hash of the client data
+func verifyAssertion(rawKey, authData, clientDataJSON, signature []byte) error {
+	alg, pub, err := parseCOSEKey(rawKey)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+	digest := sha256.Sum256(signed)
+
+	ok := false
+	switch alg {
+	case coseAlgES256:
+		ok = ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], signature)
+	case coseAlgRS256:
+		ok = rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	case coseAlgEdDSA:
+		ok = ed25519.Verify(pub.(ed25519.PublicKey), signed, signature)
+	}
+	if !ok {
+		return errString("invalid passkey signature")
+	}
+	return nil
+}
+
+// verifyRegistration checks a new credential and returns its authenticator
+// data, including the credential ID and key to store
+func verifyRegistration(cred *publicKeyCredential) (*authenticatorData, error) {
+	var att attestationObject
+	if err := cbor.Unmarshal(cred.Response.AttestationObject, &att); err != nil {
+		return nil, errString("invalid attestation object")
+	}
+	// Attestation isn't requested, so whatever statement came with the
+	// credential isn't checked
+	ad, err := parseAuthenticatorData(att.AuthData)
+	if err != nil {
+		return nil, err
+	}
+	if ad.CredentialID == nil {
+		return nil, errString("no credential in attestation")
+	}
+	if !bytes.Equal(ad.CredentialID, cred.RawID) {
+		return nil, errString("credential ID does not match")
+	}
+	if _, _, err := parseCOSEKey(ad.PublicKey); err != nil {
+		return nil, errString("unsupported passkey type")
+	}
+	return ad, nil
+}
+
+// webauthnUserHandle is the user ID authenticators store with a passkey
+func webauthnUserHandle(userID int) b64url {
+	return b64url(fmt.Sprint(userID))
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// SoftwareAuthenticator is a WebAuthn authenticator kept in memory, for
+// trying passkeys without a browser, run by cmd/soft-authenticator. It
+// answers the options from the begin endpoints with what a browser would
+// post to the finish endpoints. Its keys are ES256, its passkeys are
+// discoverable, and it always reports the user as present and verified.
+//
+// The state, including private keys, marshals to JSON so it can be saved
+// between runs. It is for development only.
+type SoftwareAuthenticator struct {
+	Credentials []*SoftwareCredential `json:"credentials"`
+}
+
+// SoftwareCredential is one passkey held by a SoftwareAuthenticator
+type SoftwareCredential struct {
+	ID         []byte `json:"id"`
+	RPID       string `json:"rp_id"`
+	UserHandle []byte `json:"user_handle"`
+	UserName   string `json:"user_name"`
+	PrivateKey []byte `json:"private_key"`
+	SignCount  uint32 `json:"sign_count"`
+}
+
+var errNoSoftwareCredential = errors.New("no passkey for this site")
+
+// Create answers creation options from /passkeys/register/begin as a page
+// on origin would. The result is the body for /passkeys/register/finish.
+func (a *SoftwareAuthenticator) Create(options []byte, origin string) ([]byte, error) {
+	var req struct {
+		PublicKey creationOptions `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &req); err != nil {
+		return nil, err
+	}
+	opts := req.PublicKey
+
+	supported := false
+	for _, p := range opts.PubKeyCredParams {
+		supported = supported || (p.Type == "public-key" && p.Alg == coseAlgES256)
+	}
+	if !supported {
+		return nil, errors.New("ES256 is not among the accepted algorithms")
+	}
+	for _, d := range opts.ExcludeCredentials {
+		if a.credential(opts.RP.ID, d.ID) != nil {
+			return nil, errors.New("a passkey for this user is already registered")
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	cred := &SoftwareCredential{
+		ID:         id,
+		RPID:       opts.RP.ID,
+		UserHandle: opts.User.ID,
+		UserName:   opts.User.Name,
+		PrivateKey: der,
+	}
+
+	pub, err := cbor.Marshal(coseKey{
+		Kty: 2,
+		Alg: coseAlgES256,
+		Crv: 1,
+		X:   key.X.FillBytes(make([]byte, 32)),
+		Y:   key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	authData := cred.authenticatorData(flagUserPresent | flagUserVerified | flagAttestedData)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(id)))
+	authData = append(authData, id...)
+	authData = append(authData, pub...)
+
+	attestation, err := cbor.Marshal(attestationObject{
+		Fmt:      "none",
+		AttStmt:  cbor.RawMessage{0xa0}, // empty map
+		AuthData: authData,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var resp publicKeyCredential
+	resp.ID = base64.RawURLEncoding.EncodeToString(id)
+	resp.RawID = id
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON, err = softwareClientData("webauthn.create", opts.Challenge, origin)
+	if err != nil {
+		return nil, err
+	}
+	resp.Response.AttestationObject = attestation
+	resp.Response.Transports = []string{"internal"}
+
+	a.Credentials = append(a.Credentials, cred)
+	return json.Marshal(resp)
+}
+
+// Get answers request options from /login/passkey/begin as a page on
+// origin would, using the newest passkey for the site that the options
+// allow. The result is the body for /login/passkey/finish.
+func (a *SoftwareAuthenticator) Get(options []byte, origin string) ([]byte, error) {
+	var req struct {
+		PublicKey requestOptions `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &req); err != nil {
+		return nil, err
+	}
+	opts := req.PublicKey
+
+	var cred *SoftwareCredential
+	if len(opts.AllowCredentials) == 0 {
+		for i := len(a.Credentials) - 1; i >= 0 && cred == nil; i-- {
+			if a.Credentials[i].RPID == opts.RPID {
+				cred = a.Credentials[i]
+			}
+		}
+	}
+	for _, d := range opts.AllowCredentials {
+		if cred == nil {
+			cred = a.credential(opts.RPID, d.ID)
+		}
+	}
+	if cred == nil {
+		return nil, errNoSoftwareCredential
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(cred.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("stored key is %T, not ECDSA", parsed)
+	}
+
+	clientData, err := softwareClientData("webauthn.get", opts.Challenge, origin)
+	if err != nil {
+		return nil, err
+	}
+	cred.SignCount++
+	authData := cred.authenticatorData(flagUserPresent | flagUserVerified)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var resp publicKeyCredential
+	resp.ID = base64.RawURLEncoding.EncodeToString(cred.ID)
+	resp.RawID = cred.ID
+	resp.Type = "public-key"
+	resp.Response.ClientDataJSON = clientData
+	resp.Response.AuthenticatorData = authData
+	resp.Response.Signature = signature
+	resp.Response.UserHandle = cred.UserHandle
+	return json.Marshal(resp)
+}
+
+func (a *SoftwareAuthenticator) credential(rpID string, id []byte) *SoftwareCredential {
+	for _, c := range a.Credentials {
+		if c.RPID == rpID && string(c.ID) == string(id) {
+			return c
+		}
+	}
+	return nil
+}
+
+// authenticatorData is the fixed part of authData: the RP ID hash, flags
+// and signature counter
+func (c *SoftwareCredential) authenticatorData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(c.RPID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, c.SignCount)
+}
+
+func softwareClientData(typ string, challenge []byte, origin string) ([]byte, error) {
+	return json.Marshal(collectedClientData{
+		Type:      typ,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    origin,
+	})
+}
@@ -95,7 +95,8 @@ async function handleLogin(e) {
       throw new Error(errorData.error || 'Login failed');
     }
 
-    const data = await response.json();
+    // Accounts with two-factor authentication need a code as well
+    const data = await completeTwoFactor(API_BASE, await response.json());
     const userType = data.user.type;
 
     // Store auth token and user data
@@ -181,7 +182,8 @@ async function handleRegister(e) {
       throw new Error(errorData.error || 'Registration failed');
     }
 
-    const data = await response.json();
+    // Account types that require two-factor authentication set it up now
+    const data = await completeTwoFactor(API_BASE, await response.json());
 
     // Store auth token and user data
     sessionStorage.setItem('authToken', data.token);
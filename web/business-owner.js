@@ -134,6 +134,8 @@ function handleLogin(e) {
     }
     return res.json();
   })
+  // Accounts with two-factor authentication need a code as well
+  .then(data => completeTwoFactor(base, data))
   .then(data => {
     currentUser = data.user;
     authToken = data.token;
@@ -172,6 +174,8 @@ function handleRegister(e) {
     }
     return res.json();
   })
+  // Account types that require two-factor authentication set it up now
+  .then(data => completeTwoFactor(base, data))
   .then(data => {
     currentUser = data.user;
     authToken = data.token;
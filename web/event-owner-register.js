@@ -35,7 +35,8 @@ document.getElementById('register-form').addEventListener('submit', async (e) =>
       throw new Error(error.error || 'Registration failed');
     }
 
-    const data = await response.json();
+    // Account types that require two-factor authentication set it up now
+    const data = await completeTwoFactor(API_BASE, await response.json());
     
     // Store auth token
     localStorage.setItem('authToken', data.token);
@@ -0,0 +1,192 @@
+// Second sign-in step. When an account uses two-factor authentication, or
+// its type requires it and it isn't set up yet, /login and /register answer
+// with a challenge token instead of a session. completeTwoFactor asks for a
+// code, setting up an authenticator app first if needed, and resolves with
+// the same { user, token } a plain login returns.
+
+function needsTwoFactor(data) {
+  return Boolean(data && (data.two_factor_required || data.two_factor_setup_required));
+}
+
+async function completeTwoFactor(apiBase, data) {
+  if (!needsTwoFactor(data)) {
+    return data;
+  }
+
+  const challengeToken = data.challenge_token;
+  let setup = null;
+  if (data.two_factor_setup_required) {
+    setup = await twoFactorPost(apiBase, '/2fa/setup', { challenge_token: challengeToken });
+  }
+
+  const session = await twoFactorDialog(setup, async (code) => {
+    if (setup) {
+      return twoFactorPost(apiBase, '/2fa/enable', { challenge_token: challengeToken, code });
+    }
+    // Six digits is an authenticator code, anything else a recovery code
+    const body = /^\d{6}$/.test(code)
+      ? { challenge_token: challengeToken, code }
+      : { challenge_token: challengeToken, recovery_code: code };
+    return twoFactorPost(apiBase, '/login/2fa', body);
+  });
+
+  if (session.recovery_codes) {
+    await showRecoveryCodes(session.recovery_codes);
+  }
+  return session;
+}
+
+async function twoFactorPost(apiBase, path, body) {
+  const response = await fetch(`${apiBase}${path}`, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify(body)
+  });
+  const data = await response.json().catch(() => ({}));
+  if (!response.ok) {
+    throw new Error(data.error || 'Two-factor authentication failed');
+  }
+  return data;
+}
+
+// twoFactorDialog asks for codes until submit resolves, or rejects if the
+// user cancels
+function twoFactorDialog(setup, submit) {
+  return new Promise((resolve, reject) => {
+    const { overlay, box } = twoFactorOverlay();
+
+    const title = document.createElement('h2');
+    title.textContent = setup ? 'Set up two-factor authentication' : 'Two-factor authentication';
+    box.appendChild(title);
+
+    const intro = document.createElement('p');
+    if (setup) {
+      intro.textContent = 'Your account needs a second sign-in step. Scan this code with an authenticator app, or enter the key by hand, then type the 6-digit code it shows.';
+    } else {
+      intro.textContent = 'Enter the 6-digit code from your authenticator app, or one of your recovery codes.';
+    }
+    box.appendChild(intro);
+
+    if (setup) {
+      const qr = document.createElement('img');
+      qr.src = setup.qr_code;
+      qr.alt = 'QR code for your authenticator app';
+      qr.style.cssText = 'display: block; margin: 0 auto 12px; width: 200px; height: 200px;';
+      box.appendChild(qr);
+
+      const secret = document.createElement('code');
+      secret.textContent = setup.secret;
+      secret.style.cssText = 'display: block; text-align: center; margin-bottom: 12px; word-break: break-all;';
+      box.appendChild(secret);
+    }
+
+    const form = document.createElement('form');
+    const input = document.createElement('input');
+    input.type = 'text';
+    input.autocomplete = 'one-time-code';
+    input.placeholder = setup ? '6-digit code' : 'Code or recovery code';
+    input.required = true;
+    input.style.cssText = 'width: 100%; box-sizing: border-box; margin-bottom: 8px;';
+    form.appendChild(input);
+
+    const error = document.createElement('p');
+    error.style.cssText = 'color: #721c24; min-height: 1em; margin: 0 0 8px;';
+    form.appendChild(error);
+
+    const verify = document.createElement('button');
+    verify.type = 'submit';
+    verify.textContent = 'Verify';
+    form.appendChild(verify);
+
+    const cancel = document.createElement('button');
+    cancel.type = 'button';
+    cancel.textContent = 'Cancel';
+    cancel.style.marginLeft = '8px';
+    form.appendChild(cancel);
+    box.appendChild(form);
+
+    form.addEventListener('submit', async (e) => {
+      e.preventDefault();
+      const code = input.value.replace(/\s+/g, '');
+      if (!code) {
+        return;
+      }
+      verify.disabled = true;
+      error.textContent = '';
+      try {
+        const session = await submit(code);
+        overlay.remove();
+        resolve(session);
+      } catch (err) {
+        error.textContent = err.message;
+        input.select();
+      } finally {
+        verify.disabled = false;
+      }
+    });
+    cancel.addEventListener('click', () => {
+      overlay.remove();
+      reject(new Error('Sign-in cancelled'));
+    });
+
+    input.focus();
+  });
+}
+
+// showRecoveryCodes shows the codes handed out when two-factor
+// authentication is turned on, until the user says they have saved them
+function showRecoveryCodes(codes) {
+  return new Promise((resolve) => {
+    const { overlay, box } = twoFactorOverlay();
+
+    const title = document.createElement('h2');
+    title.textContent = 'Save your recovery codes';
+    box.appendChild(title);
+
+    const intro = document.createElement('p');
+    intro.textContent = 'Each code signs you in once if you lose your authenticator app. They won\'t be shown again.';
+    box.appendChild(intro);
+
+    const list = document.createElement('pre');
+    list.textContent = codes.join('\n');
+    list.style.cssText = 'background: #f4f4f4; padding: 12px; border-radius: 8px;';
+    box.appendChild(list);
+
+    const done = document.createElement('button');
+    done.type = 'button';
+    done.textContent = 'I have saved these codes';
+    done.addEventListener('click', () => {
+      overlay.remove();
+      resolve();
+    });
+    box.appendChild(done);
+    done.focus();
+  });
+}
+
+function twoFactorOverlay() {
+  const overlay = document.createElement('div');
+  overlay.style.cssText = `
+    position: fixed;
+    inset: 0;
+    background: rgba(0, 0, 0, 0.5);
+    display: flex;
+    align-items: center;
+    justify-content: center;
+    z-index: 10001;
+  `;
+  const box = document.createElement('div');
+  box.setAttribute('role', 'dialog');
+  box.setAttribute('aria-modal', 'true');
+  box.style.cssText = `
+    background: white;
+    padding: 24px;
+    border-radius: 12px;
+    width: 90%;
+    max-width: 400px;
+    box-shadow: 0 10px 30px rgba(0, 0, 0, 0.2);
+  `;
+  overlay.appendChild(box);
+  document.body.appendChild(overlay);
+  return { overlay, box };
+}